@@ -0,0 +1,271 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/tailscale/go-cache-plugin/lib/gobuild"
+	"github.com/tailscale/go-cache-plugin/lib/s3util"
+)
+
+var benchFlags struct {
+	Count int   `flag:"n,default=100,Number of objects to write and read"`
+	Size  int64 `flag:"size,default=65536,Size of each object in bytes"`
+}
+
+// runBench measures the latency of cache operations through the build cache,
+// using synthetic objects.
+func runBench(env *command.Env) error {
+	if benchFlags.Count <= 0 {
+		return env.Usagef("the object count must be positive")
+	} else if benchFlags.Size < 0 {
+		return env.Usagef("the object size must not be negative")
+	}
+	client, err := initS3Client(env)
+	if err != nil {
+		return err
+	}
+
+	// Stage the benchmark in scratch directories, on the same filesystem as
+	// the cache directory if one is specified, so that the results reflect the
+	// disk the cache will use.
+	if flags.CacheDir != "" {
+		if err := os.MkdirAll(flags.CacheDir, dirMode()); err != nil {
+			return fmt.Errorf("create cache directory: %w", err)
+		}
+	}
+	root, err := os.MkdirTemp(flags.CacheDir, "gocache-bench-")
+	if err != nil {
+		return fmt.Errorf("create scratch directory: %w", err)
+	}
+	defer os.RemoveAll(root)
+
+	// Keep benchmark objects separate from real cache entries, and from those
+	// of other runs, so they can be removed when the run is complete.
+	prefix := path.Join(flags.KeyPrefix, "bench", filepath.Base(root))
+	if client != nil {
+		defer func() {
+			n, err := benchCleanup(context.WithoutCancel(env.Context()), client, prefix)
+			if err != nil {
+				fmt.Fprintf(env, "Warning: removing benchmark objects from s3://%s/%s: %v\n", client.Bucket, prefix, err)
+			} else {
+				vprintf("removed %d benchmark objects from s3://%s/%s", n, client.Bucket, prefix)
+			}
+		}()
+	}
+	newCache := func(name string) (*gobuild.S3Cache, error) {
+		dir, err := cachedir.New(filepath.Join(root, name))
+		if err != nil {
+			return nil, fmt.Errorf("create local cache: %w", err)
+		}
+		return &gobuild.S3Cache{
+			Local:             dir,
+			S3Client:          client,
+			KeyPrefix:         prefix,
+			UploadConcurrency: flags.S3Concurrency,
+			UploadTimeout:     flags.UploadTimeout,
+		}, nil
+	}
+	ctx := env.Context()
+	objs := benchObjects(benchFlags.Count, benchFlags.Size)
+	fmt.Fprintf(env, "Benchmarking %d objects of %d bytes", len(objs), benchFlags.Size)
+	if client == nil {
+		fmt.Fprint(env, " (local only)")
+	} else {
+		fmt.Fprintf(env, " (s3://%s/%s)", client.Bucket, prefix)
+	}
+	fmt.Fprintln(env)
+
+	// Phase 1: Write the objects, and wait for them to be uploaded.
+	writer, err := newCache("put")
+	if err != nil {
+		return err
+	}
+	var put, upload benchStats
+	var umu sync.Mutex
+	started := make(map[string]time.Time)
+	writer.OnPut = func(obj gocache.Object, uploaded bool, err error) {
+		umu.Lock()
+		defer umu.Unlock()
+		if err != nil {
+			upload.errors++
+		} else if uploaded {
+			upload.add(time.Since(started[obj.ActionID]), obj.Size)
+		}
+	}
+	put.start = time.Now()
+	for _, obj := range objs {
+		umu.Lock()
+		started[obj.actionID] = time.Now()
+		umu.Unlock()
+		start := time.Now()
+		_, err := writer.Put(ctx, gocache.Object{
+			ActionID: obj.actionID,
+			OutputID: obj.outputID,
+			Size:     int64(len(obj.data)),
+			Body:     bytes.NewReader(obj.data),
+		})
+		if err != nil {
+			put.errors++
+			vprintf("put %s: %v", obj.actionID, err)
+			continue
+		}
+		put.add(time.Since(start), int64(len(obj.data)))
+	}
+	put.stop()
+	upload.start = put.start
+	if err := writer.Close(ctx); err != nil {
+		return fmt.Errorf("close cache: %w", err)
+	}
+	upload.stop()
+
+	// Phase 2: Read the objects back from the local cache.
+	get, err := benchGet(ctx, writer, objs, gobuild.GetLocalHit)
+	if err != nil {
+		return err
+	}
+	results := []benchResult{{"put", &put}, {"get-local", get}}
+
+	// Phase 3: Read the objects back from S3 into an empty local cache.
+	if client != nil {
+		reader, err := newCache("get")
+		if err != nil {
+			return err
+		}
+		get, err := benchGet(ctx, reader, objs, gobuild.GetFaultHit)
+		if err != nil {
+			return err
+		}
+		results = append(results, benchResult{"get-fault", get}, benchResult{"upload", &upload})
+	}
+
+	tw := tabwriter.NewWriter(env, 4, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\tok\terrors\tp50\tp90\tp99\tMB/s\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%v\t%v\t%v\t%.2f\t\n", r.name, len(r.stats.times), r.stats.errors,
+			r.stats.percentile(50), r.stats.percentile(90), r.stats.percentile(99), r.stats.throughput())
+	}
+	return tw.Flush()
+}
+
+// benchGet reads each of objs from cache, and reports the latency of requests
+// with the expected result.
+func benchGet(ctx context.Context, cache *gobuild.S3Cache, objs []benchObject, want gobuild.GetResult) (*benchStats, error) {
+	var stats benchStats
+	cache.OnGet = func(actionID string, result gobuild.GetResult) {
+		if result != want {
+			stats.errors++
+			vprintf("get %s: got %v, want %v", actionID, result, want)
+		}
+	}
+	stats.start = time.Now()
+	for _, obj := range objs {
+		start := time.Now()
+		outputID, diskPath, err := cache.Get(ctx, obj.actionID)
+		if err != nil {
+			stats.errors++
+			vprintf("get %s: %v", obj.actionID, err)
+			continue
+		} else if outputID != obj.outputID || diskPath == "" {
+			continue // already counted by OnGet
+		}
+		stats.add(time.Since(start), int64(len(obj.data)))
+	}
+	stats.stop()
+	return &stats, cache.Close(ctx)
+}
+
+// benchCleanup removes the objects written to S3 under prefix by a benchmark
+// run, and reports how many were removed.
+func benchCleanup(ctx context.Context, client *s3util.Client, prefix string) (int, error) {
+	var n int
+	err := client.List(ctx, prefix+"/", func(key string) error {
+		if err := client.Delete(ctx, key); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// A benchObject is a synthetic cache entry.
+type benchObject struct {
+	actionID, outputID string
+	data               []byte
+}
+
+// benchObjects returns n objects with random contents of the given size.
+func benchObjects(n int, size int64) []benchObject {
+	out := make([]benchObject, n)
+	for i := range out {
+		var id [sha256.Size]byte
+		rand.Read(id[:])
+		data := make([]byte, size)
+		rand.Read(data)
+		out[i] = benchObject{
+			actionID: fmt.Sprintf("%x", id),
+			outputID: fmt.Sprintf("%x", sha256.Sum256(data)),
+			data:     data,
+		}
+	}
+	return out
+}
+
+type benchResult struct {
+	name  string
+	stats *benchStats
+}
+
+// benchStats records the latencies of a sequence of operations.
+type benchStats struct {
+	times   []time.Duration // latencies of successful operations
+	bytes   int64           // total bytes transferred by successful operations
+	errors  int             // number of failed operations
+	start   time.Time       // when the operations began
+	elapsed time.Duration   // total wall time for the operations
+}
+
+func (b *benchStats) add(d time.Duration, nbytes int64) {
+	b.times = append(b.times, d)
+	b.bytes += nbytes
+}
+
+func (b *benchStats) stop() { b.elapsed = time.Since(b.start) }
+
+// percentile returns the pth percentile latency, or 0 if there were no
+// successful operations.
+func (b *benchStats) percentile(p float64) time.Duration {
+	if len(b.times) == 0 {
+		return 0
+	}
+	ts := slices.Clone(b.times)
+	slices.Sort(ts)
+	i := int(math.Ceil(p/100*float64(len(ts)))) - 1
+	return ts[max(i, 0)].Round(time.Microsecond)
+}
+
+// throughput returns the effective throughput in megabytes per second.
+func (b *benchStats) throughput() float64 {
+	if b.elapsed <= 0 {
+		return 0
+	}
+	return float64(b.bytes) / 1e6 / b.elapsed.Seconds()
+}
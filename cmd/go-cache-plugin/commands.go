@@ -4,36 +4,69 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/creachadair/command"
 	"github.com/creachadair/gocache"
 	"github.com/creachadair/taskgroup"
+	"tailscale.com/tsweb"
 )
 
 var flags struct {
 	CacheDir      string        `flag:"cache-dir,default=$GOCACHE_DIR,Local cache directory (required)"`
-	S3Bucket      string        `flag:"bucket,default=$GOCACHE_S3_BUCKET,S3 bucket name (required)"`
+	S3Bucket      string        `flag:"bucket,default=$GOCACHE_S3_BUCKET,S3 bucket name or s3://bucket/prefix URI (required)"`
+	AWSCredsFile  string        `flag:"aws-credentials-file,default=$GOCACHE_AWS_CREDS,AWS shared credentials file (optional)"`
+	AWSProfile    string        `flag:"aws-profile,default=$GOCACHE_AWS_PROFILE,AWS profile name (optional)"`
+	LocalOnly     bool          `flag:"local-only,default=$GOCACHE_LOCAL_ONLY,Use only the local cache directory, without S3"`
 	S3Region      string        `flag:"region,default=$GOCACHE_S3_REGION,S3 region"`
+	S3PathStyle   bool          `flag:"s3-path-style,default=$GOCACHE_S3_PATH_STYLE,Use path-style addressing for S3 requests"`
+	RequestPayer  bool          `flag:"requester-pays,default=$GOCACHE_REQUESTER_PAYS,Accept charges for a requester-pays S3 bucket"`
+	StorageClass  string        `flag:"s3-storage-class,default=$GOCACHE_STORAGE_CLASS,S3 storage class for uploaded objects (optional)"`
+	ACL           string        `flag:"s3-acl,default=$GOCACHE_S3_ACL,S3 canned ACL for uploaded objects (optional)"`
 	KeyPrefix     string        `flag:"prefix,default=$GOCACHE_KEY_PREFIX,S3 key prefix (optional)"`
+	KeyPartition  int           `flag:"partition-bytes,default=$GOCACHE_PARTITION,Number of ID bytes used to partition S3 keys (default 1)"`
 	MinUploadSize int64         `flag:"min-upload-size,default=$GOCACHE_MIN_SIZE,Minimum object size to upload to S3 (in bytes)"`
+	MaxUploadSize int64         `flag:"max-upload-size,default=$GOCACHE_MAX_SIZE,Maximum object size to upload to S3 (in bytes)"`
+	MaxLocalSize  int64         `flag:"max-local-size,default=$GOCACHE_MAX_LOCAL_SIZE,Maximum object size to keep in the local cache (in bytes)"`
+	MemEntries    int           `flag:"mem-entries,default=$GOCACHE_MEM_ENTRIES,Number of recent local hits to cache in memory (default 0, disabled)"`
 	Concurrency   int           `flag:"c,default=$GOCACHE_CONCURRENCY,Maximum number of concurrent requests"`
 	S3Concurrency int           `flag:"u,default=$GOCACHE_S3_CONCURRENCY,Maximum concurrency for upload to S3"`
+	PartSize      int64         `flag:"part-size,default=$GOCACHE_PART_SIZE,Part size for multipart uploads to S3 (in bytes, default 16MiB)"`
+	PartConc      int           `flag:"part-concurrency,default=$GOCACHE_PART_CONC,Maximum concurrent parts per multipart upload to S3"`
+	UploadTimeout time.Duration `flag:"upload-timeout,default=$GOCACHE_UPLOAD_TIMEOUT,Timeout for each upload to S3, per part of a multipart upload (default 1m)"`
+	UploadRate    float64       `flag:"upload-rate,default=$GOCACHE_UPLOAD_RATE,Maximum average uploads to S3 started per second (default unlimited)"`
 	PrintMetrics  bool          `flag:"metrics,default=$GOCACHE_METRICS,Print summary metrics to stderr at exit"`
 	Expiration    time.Duration `flag:"expiry,default=$GOCACHE_EXPIRY,Cache expiration period (optional)"`
+	RefreshOnHit  bool          `flag:"refresh-on-hit,default=$GOCACHE_REFRESH_ON_HIT,Refresh S3 copies of stale actions on cache hits"`
+	AccessTime    bool          `flag:"access-time,default=$GOCACHE_ACCESS_TIME,Record creation and access times in S3 action records"`
+	Combined      bool          `flag:"combined-objects,default=$GOCACHE_COMBINED,Store small objects in S3 together with their action records"`
+	DropUploaded  bool          `flag:"drop-uploaded,default=$GOCACHE_DROP_UPLOADED,Remove local copies of uploaded objects at exit"`
+	AuditMode     bool          `flag:"audit,default=$GOCACHE_AUDIT,Compare local cache hits with S3 and log differences (expensive)"`
+	VerifyStrong  bool          `flag:"verify-strong,default=$GOCACHE_VERIFY_STRONG,Record and verify SHA-256 digests of objects in S3"`
+	ShadowMode    bool          `flag:"shadow,default=$GOCACHE_SHADOW,Check writes against S3 without uploading, and log differences"`
+	Provenance    string        `flag:"provenance,default=$GOCACHE_PROVENANCE,S3 metadata identifying this writer (comma-separated key=value)"`
+	Dangling      string        `flag:"dangling-actions,default=$GOCACHE_DANGLING,Handling of S3 actions with missing objects (error, miss, or delete)"`
+	DirMode       fileMode      `flag:"dir-mode,default=$GOCACHE_DIR_MODE,Permission mode for local cache directories (octal)"`
+	FileMode      fileMode      `flag:"file-mode,default=$GOCACHE_FILE_MODE,Permission mode for local cache files (octal)"`
 	Verbose       bool          `flag:"v,default=$GOCACHE_VERBOSE,Enable verbose logging"`
 	DebugLog      int           `flag:"debug,default=$GOCACHE_DEBUG,Enable detailed per-request debug logging (noisy)"`
+	LogFormat     string        `flag:"log-format,default=$GOCACHE_LOG_FORMAT,Format of build cache debug logs (text or json)"`
 }
 
 const (
@@ -45,7 +78,7 @@ const (
 // runDirect runs a cache communicating on stdin/stdout, for use as a direct
 // GOCACHEPROG plugin.
 func runDirect(env *command.Env) error {
-	s, _, err := initCacheServer(env)
+	s, _, _, err := initCacheServer(env)
 	if err != nil {
 		return err
 	}
@@ -59,24 +92,49 @@ func runDirect(env *command.Env) error {
 }
 
 var serveFlags struct {
-	Plugin   int    `flag:"plugin,default=$GOCACHE_PLUGIN,Plugin service port (required)"`
-	HTTP     string `flag:"http,default=$GOCACHE_HTTP,HTTP service address ([host]:port)"`
-	ModProxy bool   `flag:"modproxy,default=$GOCACHE_MODPROXY,Enable a Go module proxy (requires --http)"`
-	RevProxy string `flag:"revproxy,default=$GOCACHE_REVPROXY,Reverse proxy these hosts (comma-separated; requires --http)"`
-	SumDB    string `flag:"sumdb,default=$GOCACHE_SUMDB,SumDB servers to proxy for (comma-separated)"`
+	Plugin       int           `flag:"plugin,default=$GOCACHE_PLUGIN,Plugin service port (required)"`
+	PluginAddr   string        `flag:"plugin-addr,default=$GOCACHE_PLUGIN_ADDR,Plugin service bind address (default 127.0.0.1)"`
+	PluginCert   string        `flag:"plugin-cert,default=$GOCACHE_PLUGIN_CERT,TLS certificate file for the plugin port (PEM)"`
+	PluginKey    string        `flag:"plugin-key,default=$GOCACHE_PLUGIN_KEY,TLS private key file for the plugin port (PEM)"`
+	PluginCA     string        `flag:"plugin-ca,default=$GOCACHE_PLUGIN_CA,Require plugin clients to present a certificate signed by these CAs (PEM)"`
+	PluginSecret string        `flag:"plugin-secret,default=$GOCACHE_PLUGIN_SECRET,Require plugin clients to authenticate with this shared secret"`
+	HTTP         string        `flag:"http,default=$GOCACHE_HTTP,HTTP service address ([host]:port)"`
+	SharePort    bool          `flag:"share-port,default=$GOCACHE_SHARE_PORT,Serve HTTP on the plugin port (instead of --http)"`
+	ModProxy     bool          `flag:"modproxy,default=$GOCACHE_MODPROXY,Enable a Go module proxy (requires --http)"`
+	ModPath      string        `flag:"modproxy-path,default=$GOCACHE_MODPROXY_PATH,URL path prefix for the module proxy (default /mod)"`
+	RevProxy     string        `flag:"revproxy,default=$GOCACHE_REVPROXY,Reverse proxy these hosts (comma-separated; requires --http)"`
+	ModMirror    string        `flag:"modproxy-mirror,default=$GOCACHE_MOD_MIRROR,Read-only module download cache directories to serve from (comma-separated)"`
+	ModPrivate   string        `flag:"modproxy-private,default=$GOCACHE_MOD_PRIVATE,Private module path patterns not to proxy or cache (comma-separated)"`
+	ModFailOpen  bool          `flag:"modproxy-fail-open,default=$GOCACHE_MOD_FAIL_OPEN,Treat S3 read errors in the module proxy as misses"`
+	ModCacheDir  string        `flag:"module-cache-dir,default=$GOCACHE_MOD_DIR,Local module proxy cache directory (default <cache-dir>/module)"`
+	RevCacheDir  string        `flag:"revproxy-cache-dir,default=$GOCACHE_REVPROXY_DIR,Local reverse proxy cache directory (default <cache-dir>/revproxy)"`
+	NoInstallCA  bool          `flag:"revproxy-no-install-ca,Do not install the reverse proxy CA certificate in the system store"`
+	NoHTTP2      bool          `flag:"revproxy-no-http2,Use only HTTP/1.1 for reverse proxy requests to targets"`
+	RevProxyCA   string        `flag:"revproxy-ca,default=$GOCACHE_REVPROXY_CA,Verify reverse proxy targets with these CA certificates (PEM)"`
+	RevProxyPin  string        `flag:"revproxy-pin,default=$GOCACHE_REVPROXY_PIN,Trust reverse proxy targets presenting these SHA-256 certificate fingerprints (comma-separated)"`
+	StatsD       string        `flag:"statsd,default=$GOCACHE_STATSD,Export metrics to this StatsD server (host:port, UDP)"`
+	StatsEvery   time.Duration `flag:"statsd-interval,default=$GOCACHE_STATSD_EVERY,Interval between StatsD metric reports (default 10s)"`
+	SumDB        string        `flag:"sumdb,default=$GOCACHE_SUMDB,SumDB servers to proxy for (comma-separated)"`
+	FetchEnv     envList       `flag:"mod-fetch-env,Add KEY=VALUE to the module proxy fetch environment (repeatable)"`
 }
 
 func noopClose(context.Context) error { return nil }
 
+// httpEnabled reports whether the server exports an HTTP service, either at
+// the --http address or on the plugin port (--share-port).
+func httpEnabled() bool { return serveFlags.HTTP != "" || serveFlags.SharePort }
+
 // runServe runs a cache communicating over a local TCP socket.
 func runServe(env *command.Env) error {
 	if serveFlags.Plugin <= 0 {
 		return env.Usagef("you must provide a --plugin port")
+	} else if serveFlags.SharePort && serveFlags.HTTP != "" {
+		return env.Usagef("you may not set both --http and --share-port")
 	}
 
 	// Initialize the cache server. Unlike a direct server, only close down and
 	// wait for cache cleanup when the whole process exits.
-	s, s3c, err := initCacheServer(env)
+	s, cache, s3c, err := initCacheServer(env)
 	if err != nil {
 		return err
 	}
@@ -84,11 +142,37 @@ func runServe(env *command.Env) error {
 	s.Close = noopClose
 
 	// Listen for connections from the Go toolchain on the specified socket.
-	lst, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", serveFlags.Plugin))
+	tlsConfig, err := pluginServerTLS()
+	if err != nil {
+		return env.Usagef("%v", err)
+	}
+	host := cmp.Or(serveFlags.PluginAddr, "127.0.0.1")
+	if !isLoopbackHost(host) && tlsConfig == nil {
+		if serveFlags.SharePort {
+			// A shared secret authenticates plugin clients only, not HTTP.
+			return env.Usagef("--plugin-addr %q is not a loopback address; "+
+				"set --plugin-cert and --plugin-key to share the port", host)
+		} else if serveFlags.PluginSecret == "" {
+			return env.Usagef("--plugin-addr %q is not a loopback address; "+
+				"set --plugin-cert and --plugin-key, or --plugin-secret, to serve it", host)
+		}
+	}
+	lst, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(serveFlags.Plugin)))
 	if err != nil {
 		return fmt.Errorf("listen: %w", err)
 	}
-	log.Printf("plugin listening at %q", lst.Addr())
+	if tlsConfig != nil {
+		if serveFlags.SharePort {
+			tlsConfig = sharedTLSConfig(tlsConfig)
+		}
+		lst = tls.NewListener(lst, tlsConfig)
+	}
+	var httpLst net.Listener
+	if serveFlags.SharePort {
+		lst, httpLst = splitListener(lst)
+	}
+	log.Printf("plugin listening at %q (TLS: %v, secret: %v, shared: %v)",
+		lst.Addr(), tlsConfig != nil, serveFlags.PluginSecret != "", serveFlags.SharePort)
 
 	ctx, cancel := signal.NotifyContext(env.Context(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
@@ -100,8 +184,15 @@ func runServe(env *command.Env) error {
 		lst.Close()
 	})
 
+	// Debug handlers are served from the HTTP endpoint, if one is enabled.
+	mux := http.NewServeMux()
+	dbg := tsweb.Debugger(mux)
+	expvar.Publish("build_info", expvar.Func(func() any { return buildInfo() }))
+	dbg.HandleSilent("reset-metrics", resetMetrics(cache))
+	dbg.HandleSilent("flush", flushUploads(cache))
+
 	// If a module proxy is enabled, start it.
-	modProxy, modCleanup, err := initModProxy(env.SetContext(ctx), s3c)
+	modProxy, modCleanup, err := initModProxy(env.SetContext(ctx), s3c, dbg)
 	if err != nil {
 		lst.Close()
 		return fmt.Errorf("module proxy: %w", err)
@@ -109,21 +200,32 @@ func runServe(env *command.Env) error {
 	defer modCleanup()
 
 	// If a reverse proxy is enabled, start it.
-	revProxy, err := initRevProxy(env.SetContext(ctx), s3c, &g)
+	revProxy, err := initRevProxy(env.SetContext(ctx), s3c, mux, dbg, &g)
 	if err != nil {
 		lst.Close()
 		return fmt.Errorf("reverse proxy: %w", err)
 	}
 
+	// If a StatsD server is set, push metrics to it periodically.
+	if serveFlags.StatsD != "" {
+		interval := cmp.Or(max(serveFlags.StatsEvery, 0), 10*time.Second)
+		g.Run(func() { runStatsd(ctx, serveFlags.StatsD, interval) })
+	}
+
 	// If an HTTP server is enabled, start it up with debug routes
 	// and whatever other services were requested.
-	if serveFlags.HTTP != "" {
+	if httpEnabled() {
 		srv := &http.Server{
 			Addr:    serveFlags.HTTP,
-			Handler: makeHandler(modProxy, revProxy),
+			Handler: makeHandler(mux, modProxy, revProxy),
+		}
+		if httpLst != nil {
+			g.Go(func() error { return srv.Serve(httpLst) })
+			vprintf("HTTP server sharing plugin port at %q", httpLst.Addr())
+		} else {
+			g.Go(srv.ListenAndServe)
+			vprintf("HTTP server listening at %q", serveFlags.HTTP)
 		}
-		g.Go(srv.ListenAndServe)
-		vprintf("HTTP server listening at %q", serveFlags.HTTP)
 		g.Run(func() {
 			<-ctx.Done()
 			vprintf("stopping HTTP service")
@@ -145,6 +247,10 @@ func runServe(env *command.Env) error {
 				log.Printf("client connection closed")
 				conn.Close()
 			}()
+			if err := authenticateClient(conn, serveFlags.PluginSecret); err != nil {
+				log.Printf("reject client %q: %v", conn.RemoteAddr(), err)
+				return nil
+			}
 			return s.Run(ctx, conn, conn)
 		})
 	}
@@ -159,22 +265,54 @@ func runServe(env *command.Env) error {
 	return nil
 }
 
+var connectFlags struct {
+	TLS        bool   `flag:"tls,Use TLS to connect to the server"`
+	CA         string `flag:"ca,CA certificates to verify the server (PEM; implies --tls)"`
+	Cert       string `flag:"cert,Client certificate file for mutual TLS (PEM; implies --tls)"`
+	Key        string `flag:"key,Client private key file for mutual TLS (PEM)"`
+	ServerName string `flag:"server-name,Server name to verify (default is the host)"`
+	Secret     string `flag:"secret,default=$GOCACHE_PLUGIN_SECRET,Shared secret to authenticate to the server"`
+	SharePort  bool   `flag:"share-port,default=$GOCACHE_SHARE_PORT,Identify as a plugin client to a server with --share-port"`
+}
+
 // runConnect implements a direct cache proxy by connecting to a remote server.
 func runConnect(env *command.Env, plugin string) error {
-	port, err := strconv.Atoi(plugin)
+	addr, err := pluginAddr(plugin)
 	if err != nil {
-		return fmt.Errorf("invalid plugin port: %w", err)
+		return env.Usagef("invalid plugin address: %v", err)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	tlsConfig, err := pluginClientTLS(cmp.Or(host, "localhost"))
+	if err != nil {
+		return env.Usagef("%v", err)
 	}
 
-	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	var conn net.Conn
+	if tlsConfig != nil {
+		conn, err = tls.Dial("tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
 	if err != nil {
 		return fmt.Errorf("dial: %w", err)
 	}
+	if connectFlags.SharePort && tlsConfig == nil {
+		// Over TLS, the client identifies itself by its application protocol.
+		if _, err := io.WriteString(conn, pluginPreamble); err != nil {
+			conn.Close()
+			return fmt.Errorf("send preamble: %w", err)
+		}
+	}
+	if err := authenticateServer(conn, connectFlags.Secret); err != nil {
+		conn.Close()
+		return err
+	}
 	start := time.Now()
 	vprintf("connected to %q", conn.RemoteAddr())
 
 	out := taskgroup.Go(func() error {
-		defer conn.(*net.TCPConn).CloseWrite() // let the server finish
+		// Let the server finish.
+		defer conn.(interface{ CloseWrite() error }).CloseWrite()
 		return copy(conn, os.Stdin)
 	})
 	if rerr := copy(os.Stdout, conn); rerr != nil {
@@ -186,6 +324,50 @@ func runConnect(env *command.Env, plugin string) error {
 	return nil
 }
 
+// pluginAddr returns the network address for a plugin specification, which
+// is either a port number on the local host, or a "host:port" address.
+func pluginAddr(s string) (string, error) {
+	if port, err := strconv.Atoi(s); err == nil {
+		return fmt.Sprintf(":%d", port), nil
+	}
+	if _, port, err := net.SplitHostPort(s); err != nil {
+		return "", err
+	} else if _, err := strconv.Atoi(port); err != nil {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return s, nil
+}
+
+// fileMode is a [flag.Value] for file permission modes given in octal.
+type fileMode fs.FileMode
+
+func (m *fileMode) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid file mode %q: %w", s, err)
+	} else if v&^uint64(fs.ModePerm) != 0 {
+		return fmt.Errorf("invalid file mode %q: only permission bits are allowed", s)
+	}
+	*m = fileMode(v)
+	return nil
+}
+
+func (m fileMode) String() string { return fmt.Sprintf("%#o", fs.FileMode(m)) }
+
+// envList is a [flag.Value] for environment settings of the form KEY=VALUE.
+// Each use of the flag adds another setting.
+type envList []string
+
+func (e *envList) Set(s string) error {
+	if key, _, ok := strings.Cut(s, "="); !ok || key == "" {
+		return fmt.Errorf("invalid setting %q: want KEY=VALUE", s)
+	}
+	*e = append(*e, s)
+	return nil
+}
+
+func (e envList) String() string { return strings.Join(e, " ") }
+
 // copy emulates the base case of io.Copy, but does not attempt to use the
 // io.ReaderFrom or io.WriterTo implementations.
 //
@@ -0,0 +1,63 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"io/fs"
+	"slices"
+	"testing"
+)
+
+func TestFileMode(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  fs.FileMode
+		ok    bool
+	}{
+		{"0755", 0755, true},
+		{"644", 0644, true},
+		{"0", 0, true},
+		{"0777", 0777, true},
+		{"", 0, false},
+		{"0789", 0, false},
+		{"rwxr-xr-x", 0, false},
+		{"1777", 0, false}, // sticky bit is not a permission
+		{"04755", 0, false},
+	} {
+		var m fileMode
+		err := m.Set(tc.input)
+		if tc.ok {
+			if err != nil {
+				t.Errorf("Set(%q): unexpected error: %v", tc.input, err)
+			} else if fs.FileMode(m) != tc.want {
+				t.Errorf("Set(%q): got %v, want %v", tc.input, fs.FileMode(m), tc.want)
+			}
+		} else if err == nil {
+			t.Errorf("Set(%q): got %v, want error", tc.input, fs.FileMode(m))
+		}
+	}
+	if got, want := fileMode(0750).String(), "0750"; got != want {
+		t.Errorf("String: got %q, want %q", got, want)
+	}
+}
+
+func TestEnvList(t *testing.T) {
+	var e envList
+	for _, s := range []string{"A=1", "B=", "A=2=3"} {
+		if err := e.Set(s); err != nil {
+			t.Errorf("Set(%q): unexpected error: %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "A", "=1"} {
+		if err := e.Set(s); err == nil {
+			t.Errorf("Set(%q): got nil, want error", s)
+		}
+	}
+	if want := (envList{"A=1", "B=", "A=2=3"}); !slices.Equal(e, want) {
+		t.Errorf("Settings: got %q, want %q", e, want)
+	}
+	if got, want := e.String(), "A=1 B= A=2=3"; got != want {
+		t.Errorf("String: got %q, want %q", got, want)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"log"
 	"os"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/creachadair/command"
 	"github.com/creachadair/flax"
 	"github.com/tailscale/go-cache-plugin/lib/s3util"
@@ -33,7 +34,8 @@ Note that this requires a Go toolchain built with GOEXPERIMENT=cacheprog.
 You must provide --cache-dir, --bucket, and --region, or the corresponding
 environment variables (see "help environment").  Entries in the cache are
 stored in the specified S3 bucket, and staged in a local directory specified by
-the --cache-dir flag or GOCACHE_DIR environment.`,
+the --cache-dir flag or GOCACHE_DIR environment. With --local-only, S3 is not
+used, and entries are stored only in the local directory.`,
 
 		SetFlags: command.Flags(flax.MustBind, &flags),
 		Run:      command.Adapt(runDirect),
@@ -51,28 +53,117 @@ interface to this one.
 By default, only the build cache is exported via the --plugin port.
 
 If --http is set, the server also exports an HTTP server at that address.
-By default, this exports only /debug endpoints, including metrics.
+By default, this exports only /debug endpoints, including metrics, and a
+/version endpoint that reports the build version of the server as JSON (this
+is also published in the metrics as "build_info"). To reset the build cache
+metrics, send a POST request to /debug/reset-metrics. The counters are reset
+one at a time, so a reset while requests are in flight may leave totals that
+do not agree with each other; reset between builds for consistent numbers. To
+wait for pending uploads to S3 to complete, for example at the end of a build
+job, send a POST request to /debug/flush; it reports an error if any of those
+uploads failed.
 When --http is enabled, the following options are available:
 
-- When --modcache is true, the server also exports a caching module proxy at
-  http://<host>:<port>/mod/.
+- When --modproxy is true, the server also exports a caching module proxy at
+  http://<host>:<port>/mod/ (or the path set by --modproxy-path).
 
 - When --revproxy is set, the server also hosts a caching reverse proxy for the
   specified hosts at http://<host>:<port>. The reverse proxy handles both HTTP
-  and HTTPS requests, and caches immutable successful responses.`,
+  and HTTPS requests, and caches immutable successful responses.
+
+Instead of --http, you may set --share-port to serve HTTP on the --plugin port,
+so that only one port is exposed. The options above apply as if --http were
+set. If TLS is enabled for the plugin port, it also applies to HTTP, and each
+connection is routed by the application protocol negotiated during the TLS
+handshake. Otherwise, each connection is routed by its first bytes: HTTP
+requests go to the HTTP server, and plugin clients must identify themselves
+with "connect --share-port". Without TLS, --share-port is only permitted on a
+loopback --plugin-addr, since the shared secret does not protect HTTP.
+
+By default, the plugin port listens only on the loopback address 127.0.0.1.
+To accept connections from other hosts, set --plugin-addr to the host address
+to bind, for example 0.0.0.0 for all interfaces.
+
+The plugin port does not use encryption or authentication by default. To serve
+the plugin port over TLS, set --plugin-cert and --plugin-key. To also require
+clients to present certificates signed by a particular CA, set --plugin-ca.
+To require clients to prove knowledge of a shared secret, set --plugin-secret.
+Clients that do not satisfy these requirements are disconnected. The server
+refuses to bind a --plugin-addr other than a loopback address unless TLS or a
+shared secret is configured.
+
+To push metrics to a StatsD server, set --statsd to its host:port. The server
+then sends the build cache, module proxy, and reverse proxy metrics over UDP
+as gauges named "gocache.<group>.<metric>", every --statsd-interval (default
+10s). This does not require --http.`,
 
 				SetFlags: command.Flags(flax.MustBind, &serveFlags),
 				Run:      command.Adapt(runServe),
 			},
 			{
 				Name:  "connect",
-				Usage: "<port>",
+				Usage: "[options] <port>|<host>:<port>",
 				Help: `Connect to a remote cache server.
 
 This mode bridges stdin/stdout to a cache server (see the "serve" command)
-listening on the specified port.`,
+listening on the specified port. By default it connects to the local host.
 
-				Run: command.Adapt(runConnect),
+If the server requires TLS, set --tls, and --ca if the server certificate is
+not signed by a CA trusted by the system. If the server requires clients to
+present certificates, set --cert and --key. If the server requires a shared
+secret, set --secret or the GOCACHE_PLUGIN_SECRET environment variable. If the
+server shares its plugin port with HTTP (serve --share-port) without TLS, set
+--share-port so that the server recognizes the connection.`,
+
+				SetFlags: command.Flags(flax.MustBind, &connectFlags),
+				Run:      command.Adapt(runConnect),
+			},
+			{
+				Name:  "bench",
+				Usage: "[-n count] [-size bytes]",
+				Help: `Measure the latency of the build cache.
+
+This command writes synthetic objects through the build cache, using the same
+cache directory and S3 settings as a direct plugin, and then reads them back.
+It reports the latency percentiles and effective throughput for each phase:
+
+- put:       write an object to the local cache (uploads happen in background)
+- get-local: read an object that is present in the local cache
+- get-fault: read an object from S3 into an empty local cache
+- upload:    time from put until the object and action are stored in S3
+
+Objects are staged in a temporary directory inside --cache-dir (or the system
+temporary directory), which is removed when the benchmark completes. Objects
+written to S3 are stored under a per-run subdirectory of "bench/" in the key
+prefix, and are deleted when the benchmark completes. The --min-upload-size, --max-upload-size, and
+--max-local-size settings are ignored. With --local-only, only the put and
+get-local phases are run.`,
+
+				SetFlags: command.Flags(flax.MustBind, &benchFlags),
+				Run:      command.Adapt(runBench),
+			},
+			{
+				Name:  "migrate",
+				Usage: "--from-prefix p --to-prefix q [options]",
+				Help: `Copy build cache entries in S3 to a new key prefix or layout.
+
+Changing --prefix or --partition-bytes makes the existing entries in S3
+unreachable. This command lists the action and output keys under the old
+layout and copies each to its key in the new layout, using server-side copies,
+so that the cache remains warm after the change.
+
+The old and new prefixes default to --prefix, and the old and new partition
+bytes default to --partition-bytes, so only the settings that change need to be
+given. Prefixes are relative to the bucket, including any prefix in an s3://
+bucket URI. Keys under the old prefix that do not match the old layout are
+skipped, and keys already present in the new layout are overwritten.
+
+With --delete, each original key is removed after it is copied. With
+--dry-run, the keys that would be copied are printed, and nothing is changed.
+Progress and a summary are reported to stderr.`,
+
+				SetFlags: command.Flags(flax.MustBind, &migrateFlags),
+				Run:      command.Adapt(runMigrate),
 			},
 			command.HelpCommand(helpTopics),
 			command.VersionCommand(),
@@ -83,12 +174,12 @@ listening on the specified port.`,
 
 // getBucketRegion reports the specified region for the given bucket.
 // if the --region flag was set, that value is returned without error.
-// Otherwise, it queries the GetBucketLocation API.
-func getBucketRegion(ctx context.Context, bucket string) (string, error) {
+// Otherwise, it queries the GetBucketLocation API using the given config.
+func getBucketRegion(ctx context.Context, cfg aws.Config, bucket string) (string, error) {
 	if flags.S3Region != "" {
 		return flags.S3Region, nil
 	}
-	return s3util.BucketRegion(ctx, bucket)
+	return s3util.BucketRegionConfig(ctx, cfg, bucket, s3Options)
 }
 
 // vprintf acts as log.Printf if the --verbose flag is set; otherwise it
@@ -22,6 +22,11 @@ get credentials from the instance metadata service; otherwise you will need to
 plumb AWS environment variables (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY) or
 set up a configuration file.
 
+By default, the local cache directory is readable by all users, but writable
+only by the user running the plugin. To share a cache directory among multiple
+users in the same group, set --dir-mode and --file-mode to group-writable modes,
+for example --dir-mode=0775 --file-mode=0664.
+
 See also: "help environment".
 Related:  "direct-mode", "serve-mode", "module-proxy", "reverse-proxy".`,
 	},
@@ -32,29 +37,185 @@ Related:  "direct-mode", "serve-mode", "module-proxy", "reverse-proxy".`,
 To make it easier to configure this tool for multiple workflows, most of the
 settings can be set via environment variables as well as flags.
 
-   --------------------------------------------------------------------
-   Flag (global)      Variable               Format      Default
-   --------------------------------------------------------------------
-    --cache-dir       GOCACHE_DIR            path        (required)
-    --bucket          GOCACHE_S3_BUCKET      string      (required)
-    --region          GOCACHE_S3_REGION      string      based on bucket
-    --prefix          GOCACHE_KEY_PREFIX     string      ""
-    --min-upload-size GOCACHE_MIN_SIZE       int64       0
-    --metrics         GOCACHE_METRICS        bool        false
-    --expiry          GOCACHE_EXPIRY         duration    0
-    -c                GOCACHE_CONCURRENCY    int         runtime.NumCPU
-    -u                GOCACHE_S3_CONCURRENCY duration    runtime.NumCPU
-    -v                GOCACHE_VERBOSE        bool        false
-    --debug           GOCACHE_DEBUG          int         0 (see "help debug")
-
-   --------------------------------------------------------------------
-   Flag (serve)       Variable               Format      Default
-   --------------------------------------------------------------------
-    --plugin          GOCACHE_PLUGIN         port        (required)
-    --http            GOCACHE_HTTP           [host]:port ""
-    --modproxy        GOCACHE_MODPROXY       bool        false
-    --revproxy        GOCACHE_REVPROXY       host,...    ""
-    --sumdb           GOCACHE_SUMDB          host,...    ""
+   -------------------------------------------------------------------------
+   Flag (global)           Variable               Format      Default
+   -------------------------------------------------------------------------
+    --cache-dir            GOCACHE_DIR            path        (required)
+    --bucket               GOCACHE_S3_BUCKET      string/URI  (required)
+    --region               GOCACHE_S3_REGION      string      based on bucket
+    --s3-path-style        GOCACHE_S3_PATH_STYLE  bool        false
+    --aws-credentials-file GOCACHE_AWS_CREDS      path        SDK default
+    --aws-profile          GOCACHE_AWS_PROFILE    string      SDK default
+    --local-only           GOCACHE_LOCAL_ONLY     bool        false
+    --requester-pays       GOCACHE_REQUESTER_PAYS bool        false
+    --prefix               GOCACHE_KEY_PREFIX     string      ""
+    --s3-storage-class     GOCACHE_STORAGE_CLASS  string      bucket default
+    --s3-acl               GOCACHE_S3_ACL         string      none
+    --partition-bytes      GOCACHE_PARTITION      int         1
+    --min-upload-size      GOCACHE_MIN_SIZE       int64       0
+    --max-upload-size      GOCACHE_MAX_SIZE       int64       0 (no limit)
+    --max-local-size       GOCACHE_MAX_LOCAL_SIZE int64       0 (no limit)
+    --mem-entries          GOCACHE_MEM_ENTRIES    int         0 (disabled)
+    --metrics              GOCACHE_METRICS        bool        false
+    --expiry               GOCACHE_EXPIRY         duration    0
+    --refresh-on-hit       GOCACHE_REFRESH_ON_HIT bool        false
+    --access-time          GOCACHE_ACCESS_TIME    bool        false
+    --combined-objects     GOCACHE_COMBINED       bool        false
+    --drop-uploaded        GOCACHE_DROP_UPLOADED  bool        false
+    --audit                GOCACHE_AUDIT          bool        false
+    --shadow               GOCACHE_SHADOW         bool        false
+    --verify-strong        GOCACHE_VERIFY_STRONG  bool        false
+    --dangling-actions     GOCACHE_DANGLING       string      error
+    --provenance           GOCACHE_PROVENANCE     key=val,... ""
+    --dir-mode             GOCACHE_DIR_MODE       octal       0755
+    --file-mode            GOCACHE_FILE_MODE      octal       0644
+    -c                     GOCACHE_CONCURRENCY    int         runtime.NumCPU
+    -u                     GOCACHE_S3_CONCURRENCY duration    runtime.NumCPU
+    --part-size            GOCACHE_PART_SIZE      int64       16MiB
+    --part-concurrency     GOCACHE_PART_CONC      int         runtime.NumCPU
+    --upload-timeout       GOCACHE_UPLOAD_TIMEOUT duration    1m
+    --upload-rate          GOCACHE_UPLOAD_RATE    float       0 (unlimited)
+    -v                     GOCACHE_VERBOSE        bool        false
+    --debug                GOCACHE_DEBUG          int         0 (see "help debug")
+    --log-format           GOCACHE_LOG_FORMAT     string      text
+
+   -------------------------------------------------------------------------
+   Flag (serve)            Variable               Format      Default
+   -------------------------------------------------------------------------
+    --plugin               GOCACHE_PLUGIN         port        (required)
+    --plugin-addr          GOCACHE_PLUGIN_ADDR    host        127.0.0.1
+    --plugin-cert          GOCACHE_PLUGIN_CERT    path        ""
+    --plugin-key           GOCACHE_PLUGIN_KEY     path        ""
+    --plugin-ca            GOCACHE_PLUGIN_CA      path        ""
+    --plugin-secret        GOCACHE_PLUGIN_SECRET  string      ""
+    --http                 GOCACHE_HTTP           [host]:port ""
+    --share-port           GOCACHE_SHARE_PORT     bool        false
+    --modproxy             GOCACHE_MODPROXY       bool        false
+    --modproxy-path        GOCACHE_MODPROXY_PATH  path        /mod
+    --modproxy-mirror      GOCACHE_MOD_MIRROR     path,...    ""
+    --modproxy-private     GOCACHE_MOD_PRIVATE    glob,...    ""
+    --modproxy-fail-open   GOCACHE_MOD_FAIL_OPEN  bool        false
+    --module-cache-dir     GOCACHE_MOD_DIR        path        <cache-dir>/module
+    --revproxy             GOCACHE_REVPROXY       host,...    ""
+    --revproxy-ca          GOCACHE_REVPROXY_CA    path        ""
+    --revproxy-pin         GOCACHE_REVPROXY_PIN   hex,...     ""
+    --revproxy-cache-dir   GOCACHE_REVPROXY_DIR   path        <cache-dir>/revproxy
+    --sumdb                GOCACHE_SUMDB          host,...    ""
+    --statsd               GOCACHE_STATSD         host:port   ""
+    --statsd-interval      GOCACHE_STATSD_EVERY   duration    10s
+
+   -------------------------------------------------------------------------
+   Flag (connect)          Variable               Format      Default
+   -------------------------------------------------------------------------
+    --secret               GOCACHE_PLUGIN_SECRET  string      ""
+
+The bucket may be given either as a plain bucket name, or as an S3 URI of the
+form "s3://bucket/prefix". In the latter case, the path is used as a key prefix,
+and any --prefix is appended to it.
+
+The --prefix may refer to environment variables as $VAR or ${VAR}, which are
+expanded when the program starts. For example, --prefix='ci/${BRANCH}' gives
+each branch its own cache. It is an error if a variable is not set, or if the
+expanded prefix contains characters other than letters, digits, and the
+punctuation "!-_.*'()", separated by slashes. Note that earlier versions did
+not check the prefix, so a prefix that was accepted before, for example one
+containing spaces, "+", "@", or an empty or "." path component, is now an
+error. Such a cache must be given a new prefix, and its entries written again.
+
+AWS credentials are found in the usual places for the AWS SDK, such as the
+AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables, or the shared
+credentials file ~/.aws/credentials. To read credentials from a file in another
+location, such as a mounted secret, set --aws-credentials-file to its path.
+To use a named profile other than "default", set --aws-profile.
+
+To record the source of each entry written to S3 for auditing, set
+--provenance to a list of key=value pairs, for example:
+
+   --provenance="build-id=${BUILD_ID},host=$(hostname)"
+
+These are stored as S3 user metadata (x-amz-meta-<key>) on each object and
+action record the cache writes. With --debug=1, the provenance of each action
+faulted in from S3 is logged.
+
+By default, S3 requests use virtual-hosted addressing, in which the bucket name
+is part of the host name. Set --s3-path-style to put the bucket name in the URL
+path instead. This is required for bucket names containing dots when using
+HTTPS, since such names do not match the wildcard TLS certificate for S3, and
+for some S3-compatible stores such as MinIO and Ceph.
+
+Set --s3-storage-class to write objects to S3 with a specific storage class,
+for example INTELLIGENT_TIERING or ONEZONE_IA, instead of the default for the
+bucket. Since most cache entries are rarely read after a day or two, a cheaper
+storage class can substantially reduce the cost of a large shared cache.
+
+Set --s3-acl to write objects with a canned ACL, for example
+bucket-owner-full-control. This is needed when the bucket is owned by another
+AWS account, and shared by a bucket policy, so that the bucket owner can read
+the objects written by the plugin.
+
+Build cache keys in S3 are partitioned by a prefix of each ID, by default its
+first byte (256 partitions). For very large caches, set --partition-bytes to
+use a longer prefix, up to 4 bytes; for example, 2 gives 65536 partitions.
+Entries written with one setting are not found with another, so all clients
+sharing a bucket and prefix must agree. To change the setting for an existing
+cache, also change the --prefix so that old and new entries do not mix, or
+use the migrate command. At startup, the server checks an existing action key
+and refuses to start if its partition depth differs from --partition-bytes.
+
+With --refresh-on-hit, actions found in the cache that were last written to S3
+more than a day ago are rewritten in the background, along with their outputs.
+This keeps entries in use from being removed by a bucket lifecycle rule based
+on the last-modified time of objects.
+
+With --access-time, action records in S3 carry both the time each object was
+created and the time its action was last accessed, and --refresh-on-hit updates
+the access time while keeping the creation time. Older versions of the plugin
+cannot read these records, so upgrade all clients sharing a bucket and prefix
+before enabling it.
+
+With --combined-objects, objects up to 64KiB are stored in S3 together with
+their action records, so that writing or faulting in a small object takes one
+S3 request rather than two. Entries stored separately remain readable, but
+older versions of the plugin cannot read combined records, so upgrade all
+clients sharing a bucket and prefix before enabling it.
+
+With --drop-uploaded, objects that were successfully written to S3 are removed
+from the local cache directory when the plugin exits. Later builds fault them
+in from S3 as needed, so the local directory holds only the objects that have
+not been uploaded. This saves disk space on shared machines, at the cost of
+more S3 reads.
+
+Several plugin processes may share one cache directory, for example when
+concurrent go commands each run the plugin directly. Each process holds a
+shared lock on "gobuild.lock" in the cache directory, and the removals done at
+exit for --drop-uploaded, --max-local-size, and --expiry happen only in the
+last process to exit, so that one process does not remove files another has
+reported to its toolchain. Files that an earlier process would have removed
+are listed in "gobuild.lock.remove", and removed by the last process. A
+process waits up to 30 seconds for the lock while another process is exiting.
+Advisory locks are used only on Unix systems.
+
+With --audit, each hit in the local cache is also compared in the background
+with the copy in S3, and differences in the output ID or size are logged. This
+reads every object found locally from S3, so use it only for debugging.
+
+With --shadow, the plugin does not upload to S3. Instead, each object that
+would have been uploaded is checked against S3, and actions or objects that
+are missing or differ are counted and logged. Use this to check that a new
+configuration agrees with an existing bucket before letting it write. To avoid
+all writes, do not also set --refresh-on-hit or --dangling-actions=delete.
+
+With --verify-strong, the plugin records a SHA-256 digest of each object it
+writes to S3, and checks objects faulted in from S3 against the recorded
+digest. An object that does not match is logged and treated as a miss, so the
+toolchain rebuilds and replaces it. Entries written without a digest, such as
+those written before --verify-strong was set, are also treated as misses, and
+are rewritten with a digest when the toolchain rebuilds them. This guards
+against a bucket whose contents were altered.
+
+With --mem-entries=N, the plugin keeps the N most recent local hits for small
+objects in memory, so repeated lookups of the same action do not read the
+local cache directory. The objects themselves are still read from disk.
 
 See also: "help configure".`,
 	},
@@ -72,7 +233,13 @@ Alternatively:
   export GOCACHEPROG=go-cache-plugin
   go build ...
 
-In this mode, you must specify the --cache-dir and --bucket settings.`,
+In this mode, you must specify the --cache-dir and --bucket settings.
+
+For development machines and offline builds, the --local-only flag disables
+the use of S3 entirely. In this mode, only --cache-dir is required, and the
+plugin does not need a bucket, region, or credentials:
+
+  export GOCACHEPROG="go-cache-plugin --local-only --cache-dir=/tmp/gocache"`,
 	},
 	{
 		Name: "serve-mode",
@@ -113,6 +280,62 @@ The proxy path for a given sumdb (e.g., sum.golang.org) has this format:
 
    export GOSUMDB="sum.golang.org http://localhost:5970/mod/sumdb/sum.golang.org"
 
+To serve the module proxy under a different path, set --modproxy-path.
+For example, with --modproxy-path=/goproxy:
+
+   export GOPROXY=http://localhost:5970/goproxy
+   export GOSUMDB="sum.golang.org http://localhost:5970/goproxy/sumdb/sum.golang.org"
+
+To serve modules from existing module download caches, set --modproxy-mirror
+to a comma-separated list of directories, for example:
+
+   --modproxy-mirror=$(go env GOMODCACHE)/cache/download
+
+Module files not in the local cache are copied from the first mirror that has
+them, before consulting S3 or fetching them from upstream.
+
+The module proxy keeps its local cache in the "module" subdirectory of
+--cache-dir. To place it elsewhere, for example on cheaper storage than the
+build cache, set --module-cache-dir. Likewise, --revproxy-cache-dir sets the
+location of the local reverse proxy cache, which defaults to the "revproxy"
+subdirectory of --cache-dir.
+
+The proxy fetches modules from proxy.golang.org. To add settings to the
+environment used for fetching, use --mod-fetch-env, which may be repeated:
+
+   go-cache-plugin serve ... --modproxy \
+      --mod-fetch-env=GOPROXY=https://goproxy.example.com \
+      --mod-fetch-env=GONOSUMDB=example.com/private
+
+The proxy never fetches modules directly from their origin, so settings that
+enable direct fetches (a GOPROXY including "direct", or GONOPROXY/GOPRIVATE)
+are rejected.
+
+To keep private modules out of the cache and the upstream proxy, set
+--modproxy-private to a comma-separated list of module path patterns, in the
+same syntax as GOPRIVATE. The proxy answers requests for matching modules with
+"not found", without consulting the cache, S3, or upstream. Include "direct"
+in GOPROXY so that the toolchain falls back to fetching them itself:
+
+   export GOPROXY=http://localhost:5970/mod,direct
+   export GOPRIVATE=example.com/private
+
+By default, an error reading a module file from S3 (other than a timeout) fails
+the request. With --modproxy-fail-open, such errors are treated as misses, and
+the file is fetched from upstream instead, so builds can continue while S3 is
+unavailable.
+
+To fault module files in from S3 before a build starts, POST a go.sum or
+go.mod file to the debug path /debug/modproxy-prefetch of the --http address:
+
+   curl --data-binary @go.sum http://localhost:5970/debug/modproxy-prefetch
+
+The body may also list cache file names one per line, for example
+"golang.org/x/mod/@v/v0.21.0.zip". Files not found in S3 are skipped, and are
+fetched from upstream when the build requests them. Like the other debug
+handlers, this path accepts requests only from loopback and Tailscale
+addresses.
+
 See also: https://proxy.golang.org/`,
 	},
 	{
@@ -133,7 +356,67 @@ When this is enabled, you can configure this address as an HTTP proxy:
 The proxy supports both HTTP and HTTPS backends. For HTTPS proxy targets, the
 server generates its own TLS certificate, and tries to install a custom signing
 cert so that other tools will validate it. The ability to do this varies by
-system and configuration, however.`,
+system and configuration, however.
+
+To skip installing the signing cert, for example on a system where the system
+store is read-only, set --revproxy-no-install-ca. The server then writes the
+signing cert to revproxy-ca.crt in the --cache-dir directory, and logs its
+location. Configure clients to trust that file, for example:
+
+   SSL_CERT_FILE=/tmp/gocache/revproxy-ca.crt curl https://api.example.com/foo
+
+The server also serves the current signing cert in PEM format at the path
+/_cache/ca.crt of the --http address, so clients can fetch it directly:
+
+   curl -o /tmp/revproxy-ca.crt http://localhost:5970/_cache/ca.crt
+
+The signing cert is regenerated each time the server starts.
+
+Responses are cached under a digest of the request method and complete URL,
+including its scheme and host. Earlier versions of the proxy keyed responses
+by the request URL alone, so when upgrading from one of those versions, the
+existing entries in the --revproxy-cache-dir and in S3 are no longer found,
+and responses are fetched again from the targets. The old entries are never
+read, and may be removed.
+
+The proxy uses HTTP/2 for requests to targets that support it over TLS. To
+restrict these requests to HTTP/1.1, for targets that misbehave with HTTP/2,
+set --revproxy-no-http2.
+
+Targets are verified using the system certificate pool. To proxy internal
+targets whose certificates are issued by a private CA, set --revproxy-ca to a
+file of PEM-encoded CA certificates to use instead. To trust specific target
+certificates, set --revproxy-pin to a comma-separated list of their SHA-256
+fingerprints, in hex:
+
+   openssl x509 -in server.crt -noout -fingerprint -sha256
+
+A target must then present a certificate matching one of the pins. Without
+--revproxy-ca, pins alone suffice, so self-signed certificates may be pinned;
+in that case, only the target's own (leaf) certificate is compared. With
+--revproxy-ca, a pin may also match a CA certificate in the verified chain.
+
+To pre-populate the cache before builds start, POST a list of URLs to the debug
+path /debug/revproxy-warm of the --http address, one per line or as a JSON
+array:
+
+   curl --data-binary @urls.txt http://localhost:5970/debug/revproxy-warm
+
+Each URL is fetched through the proxy and cached under the usual rules, and the
+server replies with a JSON array reporting the result for each URL.
+
+To change the target hosts without restarting the server, POST the new list of
+hosts, in the same format as --revproxy, to the debug path
+/debug/revproxy-reload:
+
+   curl --data 'api.example.com,www.example.com' http://localhost:5970/debug/revproxy-reload
+
+Like the other debug handlers, the warm and reload paths accept requests only
+from loopback and Tailscale addresses.
+
+The new list replaces the old one, and a server certificate is issued for the
+new hosts. Requests in progress are not interrupted, and cached responses are
+kept. The change lasts until the server exits.`,
 	},
 	{
 		Name: "debug",
@@ -146,6 +429,17 @@ cache plugin. The value of the flag is a bit mask of:
    2:  Go module proxy and sum database
    4:  HTTP reverse proxy
 
-The default is 0 (no debug logging).`,
+The default is 0 (no debug logging).
+
+By default, build cache requests are logged as terse text lines. To log them
+as structured records instead, set --log-format=json. Each Get and Put request,
+and each background upload to S3, is then written to stderr as a line of JSON:
+
+   {"time":"...","op":"get","action":"<id>","output":"<id>","result":"hit",
+    "bytes":1024,"elapsed_ms":0.12}
+
+The "op" is "get", "put", or "upload". For "get", the "result" is "hit",
+"fault", "miss", or "error"; otherwise it is "ok" or "error". An "error" field
+gives the error, if any.`,
 	},
 }
@@ -0,0 +1,141 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"path"
+	"sync/atomic"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/taskgroup"
+	"github.com/tailscale/go-cache-plugin/lib/gobuild"
+)
+
+var migrateFlags struct {
+	FromPrefix    string `flag:"from-prefix,S3 key prefix to migrate from (default --prefix)"`
+	ToPrefix      string `flag:"to-prefix,S3 key prefix to migrate to (default --prefix)"`
+	FromPartition int    `flag:"from-partition,Partition bytes of the existing layout (default --partition-bytes)"`
+	ToPartition   int    `flag:"to-partition,Partition bytes of the new layout (default --partition-bytes)"`
+	Delete        bool   `flag:"delete,Delete each original key after it is copied"`
+	DryRun        bool   `flag:"dry-run,Print the keys that would be copied without changing anything"`
+	Concurrency   int    `flag:"concurrency,default=16,Maximum number of concurrent copies"`
+}
+
+// migrateProgress is the number of keys between progress reports.
+const migrateProgress = 1000
+
+// runMigrate copies the build cache entries in S3 from one key prefix and
+// partition layout to another, using server-side copies.
+func runMigrate(env *command.Env) error {
+	if flags.LocalOnly {
+		return env.Usagef("migrate requires S3 and cannot be used with --local-only")
+	} else if migrateFlags.Concurrency <= 0 {
+		return env.Usagef("the concurrency must be positive")
+	}
+	for _, p := range []int{migrateFlags.FromPartition, migrateFlags.ToPartition} {
+		if p < 0 || p > 4 {
+			return env.Usagef("invalid partition bytes %d (want 0 to 4)", p)
+		}
+	}
+	_, bucketPrefix, err := parseBucket(flags.S3Bucket)
+	if err != nil {
+		return env.Usagef("invalid --bucket: %v", err)
+	}
+	client, err := initS3Client(env)
+	if err != nil {
+		return err
+	}
+	from, err := migratePrefix(bucketPrefix, migrateFlags.FromPrefix)
+	if err != nil {
+		return env.Usagef("invalid --from-prefix: %v", err)
+	}
+	to, err := migratePrefix(bucketPrefix, migrateFlags.ToPrefix)
+	if err != nil {
+		return env.Usagef("invalid --to-prefix: %v", err)
+	}
+
+	// Use caches configured with the old and new layouts to compute keys.
+	src := &gobuild.S3Cache{
+		KeyPrefix:      from,
+		PartitionBytes: migratePartition(migrateFlags.FromPartition),
+	}
+	dst := &gobuild.S3Cache{
+		KeyPrefix:      to,
+		PartitionBytes: migratePartition(migrateFlags.ToPartition),
+	}
+	if src.KeyPrefix == dst.KeyPrefix && src.PartitionBytes == dst.PartitionBytes {
+		return env.Usagef("the old and new layouts are the same")
+	}
+	fmt.Fprintf(env, "Migrating s3://%s/%s (partition %d) to s3://%s/%s (partition %d)",
+		client.Bucket, src.KeyPrefix, src.PartitionBytes, client.Bucket, dst.KeyPrefix, dst.PartitionBytes)
+	if migrateFlags.DryRun {
+		fmt.Fprint(env, " (dry run)")
+	}
+	fmt.Fprintln(env)
+
+	ctx := env.Context()
+	var nList, nCopy, nDelete, nSkip, nFail atomic.Int64
+	g, start := taskgroup.New(nil).Limit(migrateFlags.Concurrency)
+	for _, kind := range []string{"action", "output"} {
+		err := client.List(ctx, path.Join(src.KeyPrefix, kind)+"/", func(key string) error {
+			if n := nList.Add(1); n%migrateProgress == 0 {
+				fmt.Fprintf(env, "... %d keys listed, %d copied, %d failed\n", n, nCopy.Load(), nFail.Load())
+			}
+			id := path.Base(key)
+			newKey := path.Join(dst.KeyPrefix, dst.DefaultKey(kind, id))
+			if key != path.Join(src.KeyPrefix, src.DefaultKey(kind, id)) || key == newKey {
+				nSkip.Add(1) // not part of the old layout, or already in place
+				return nil
+			}
+			if migrateFlags.DryRun {
+				fmt.Printf("%s -> %s\n", key, newKey)
+				return nil
+			}
+			start(func() error {
+				if err := client.Copy(ctx, key, newKey); err != nil {
+					nFail.Add(1)
+					return fmt.Errorf("copy %q: %w", key, err)
+				}
+				nCopy.Add(1)
+				if migrateFlags.Delete {
+					if err := client.Delete(ctx, key); err != nil {
+						nFail.Add(1)
+						return fmt.Errorf("delete %q: %w", key, err)
+					}
+					nDelete.Add(1)
+				}
+				return nil
+			})
+			return nil
+		})
+		if err != nil {
+			g.Wait()
+			return fmt.Errorf("list %s keys: %w", kind, err)
+		}
+	}
+	werr := g.Wait()
+	fmt.Fprintf(env, "Listed %d keys: %d copied, %d deleted, %d skipped, %d failed\n",
+		nList.Load(), nCopy.Load(), nDelete.Load(), nSkip.Load(), nFail.Load())
+	return werr
+}
+
+// migratePrefix returns the complete S3 key prefix for a --from-prefix or
+// --to-prefix flag value s, within the prefix of the bucket URI. If s is
+// empty, the key prefix from the global flags is used.
+func migratePrefix(bucketPrefix, s string) (string, error) {
+	if s == "" {
+		return flags.KeyPrefix, nil
+	}
+	p, err := expandPrefix(s)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(bucketPrefix, p), nil
+}
+
+// migratePartition returns the partition bytes for a --from-partition or
+// --to-partition flag value p, defaulting to --partition-bytes.
+func migratePartition(p int) int { return max(cmp.Or(p, flags.KeyPartition), 1) }
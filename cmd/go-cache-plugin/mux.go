@@ -0,0 +1,170 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// When --share-port is set, the plugin and HTTP services share the plugin
+// listener. If TLS is enabled, the listener terminates TLS before connections
+// are classified, so HTTP on the shared port is protected by the same TLS
+// configuration as the plugin. Each new connection is classified as soon as
+// the client identifies itself:
+//
+//   - A TLS client that negotiates the pluginALPN protocol, or no protocol at
+//     all, is a plugin client. A TLS client that negotiates HTTP is delivered
+//     to the HTTP server.
+//   - A plain client whose first byte is an upper-case ASCII letter begins an
+//     HTTP request line ("GET /..."). A plain client that begins with
+//     pluginPreamble is a plugin client (see "connect --share-port").
+//
+// Anything else is closed. The server does not wait for a client to remain
+// silent, since in the cache protocol (and the shared-secret handshake) the
+// server speaks first; plain plugin clients must send the preamble instead.
+// A client that does not identify itself within handshakeTimeout is closed.
+
+// pluginALPN is the TLS application protocol negotiated by plugin clients.
+const pluginALPN = "go-cache-plugin"
+
+// pluginPreamble is sent by a plain plugin client before the plugin protocol
+// begins, to identify itself on a shared port. It begins with a byte that
+// cannot begin an HTTP request.
+const pluginPreamble = "\x00go-cache-plugin\n"
+
+// sharedTLSConfig returns a copy of cfg that negotiates the application
+// protocol of each connection, for use on a shared port.
+func sharedTLSConfig(cfg *tls.Config) *tls.Config {
+	out := cfg.Clone()
+	out.NextProtos = []string{"http/1.1", pluginALPN}
+	return out
+}
+
+// splitListener returns two listeners that share the connections accepted by
+// lst. Connections that begin with an HTTP request are delivered to web, and
+// plugin connections to plugin. Closing either listener closes lst.
+func splitListener(lst net.Listener) (plugin, web net.Listener) {
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() error {
+		var err error
+		once.Do(func() { close(done); err = lst.Close() })
+		return err
+	}
+	p := &subListener{lst: lst, conns: make(chan net.Conn), done: done, stop: stop}
+	w := &subListener{lst: lst, conns: make(chan net.Conn), done: done, stop: stop}
+	go func() {
+		defer stop()
+		for {
+			conn, err := lst.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					vprintf("shared port: accept failed: %v", err)
+				}
+				return
+			}
+			go func() {
+				sc, isHTTP, err := sniffConn(conn)
+				if err != nil {
+					vprintf("shared port: reject %q: %v", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+				dst := p
+				if isHTTP {
+					dst = w
+				}
+				select {
+				case dst.conns <- sc:
+				case <-done:
+					conn.Close()
+				}
+			}()
+		}
+	}()
+	return p, w
+}
+
+// sniffConn waits for the client on conn to identify itself, and reports
+// whether it carries HTTP. It returns a connection to deliver in place of
+// conn: for a TLS connection, conn itself, so that the HTTP server sees the
+// TLS state; otherwise, a connection that replays the bytes read ahead, with
+// any plugin preamble removed.
+func sniffConn(conn net.Conn) (net.Conn, bool, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return nil, false, fmt.Errorf("TLS handshake: %w", err)
+		}
+		proto := tc.ConnectionState().NegotiatedProtocol
+		return tc, proto != "" && proto != pluginALPN, nil
+	}
+
+	br := bufio.NewReader(conn)
+	buf, err := br.Peek(1)
+	if err != nil {
+		return nil, false, err
+	}
+	sc := &peekConn{Conn: conn, r: br}
+	if buf[0] >= 'A' && buf[0] <= 'Z' {
+		return sc, true, nil
+	} else if buf[0] != pluginPreamble[0] {
+		return nil, false, errors.New("unrecognized protocol")
+	}
+	buf, err = br.Peek(len(pluginPreamble))
+	if err != nil {
+		return nil, false, err
+	} else if string(buf) != pluginPreamble {
+		return nil, false, errors.New("unrecognized protocol")
+	}
+	br.Discard(len(buf))
+	return sc, false, nil
+}
+
+// peekConn is a [net.Conn] whose reads are served from r, which buffers the
+// underlying connection.
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekConn) Read(data []byte) (int, error) { return c.r.Read(data) }
+
+// CloseWrite supports half-closing the connection, if the underlying
+// connection does.
+func (c *peekConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// subListener is a [net.Listener] that delivers connections classified by
+// splitListener.
+type subListener struct {
+	lst   net.Listener
+	conns chan net.Conn
+	done  <-chan struct{}
+	stop  func() error
+}
+
+func (s *subListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *subListener) Close() error   { return s.stop() }
+func (s *subListener) Addr() net.Addr { return s.lst.Addr() }
@@ -0,0 +1,186 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSniffConn(t *testing.T) {
+	for _, tc := range []struct {
+		name, input string
+		isHTTP      bool
+		want        string // the data read from the result
+		ok          bool
+	}{
+		{"HTTP", "GET / HTTP/1.1\r\n", true, "GET / HTTP/1.1\r\n", true},
+		{"Plugin", pluginPreamble + "payload", false, "payload", true},
+		{"PluginOnly", pluginPreamble, false, "", true},
+		{"Unknown", "\x16\x03\x01 not a plugin", false, "", false},
+		{"ShortPreamble", pluginPreamble[:4], false, "", false},
+		{"Empty", "", false, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, cli := net.Pipe()
+			defer srv.Close()
+			go func() {
+				io.WriteString(cli, tc.input)
+				cli.Close()
+			}()
+
+			sc, isHTTP, err := sniffConn(srv)
+			if !tc.ok {
+				if err == nil {
+					t.Errorf("sniffConn: got HTTP=%v, want error", isHTTP)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("sniffConn: unexpected error: %v", err)
+			}
+			if isHTTP != tc.isHTTP {
+				t.Errorf("sniffConn: got HTTP=%v, want %v", isHTTP, tc.isHTTP)
+			}
+			got, err := io.ReadAll(sc)
+			if err != nil {
+				t.Fatalf("Read: unexpected error: %v", err)
+			} else if string(got) != tc.want {
+				t.Errorf("Read: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// acceptLine accepts a connection from lst and returns the first line read
+// from it, along with the connection.
+func acceptLine(t *testing.T, lst net.Listener) (net.Conn, string) {
+	t.Helper()
+	conn, err := lst.Accept()
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	line, err := readLine(conn)
+	if err != nil {
+		t.Fatalf("Read: unexpected error: %v", err)
+	}
+	return conn, line
+}
+
+func TestSplitListener(t *testing.T) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, web := splitListener(lst)
+	defer plugin.Close()
+
+	dial := func(data string) net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", lst.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		io.WriteString(conn, data)
+		return conn
+	}
+
+	// An unrecognized client is closed without being delivered.
+	bad := dial("\x01 what is this\n")
+	bad.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bad.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Read (unrecognized): got %v, want %v", err, io.EOF)
+	}
+
+	dial("GET / HTTP/1.1\r\n")
+	if _, line := acceptLine(t, web); line != "GET / HTTP/1.1\r" {
+		t.Errorf("Web: got %q, want the request line", line)
+	}
+	dial(pluginPreamble + "hello\n")
+	if _, line := acceptLine(t, plugin); line != "hello" {
+		t.Errorf("Plugin: got %q, want hello", line)
+	}
+
+	// Closing one listener closes both.
+	if err := plugin.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	if _, err := web.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after close: got %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestSplitListenerTLS(t *testing.T) {
+	cert := testCert(t)
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := sharedTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	plugin, web := splitListener(tls.NewListener(raw, cfg))
+	defer plugin.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	for _, tc := range []struct {
+		protos []string
+		dst    net.Listener
+	}{
+		{[]string{"http/1.1"}, web},
+		{[]string{pluginALPN}, plugin},
+		{nil, plugin}, // clients that predate protocol negotiation
+	} {
+		conn, err := tls.Dial("tcp", raw.Addr().String(), &tls.Config{
+			RootCAs:    pool,
+			ServerName: "localhost",
+			NextProtos: tc.protos,
+		})
+		if err != nil {
+			t.Fatalf("Dial %q: %v", tc.protos, err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "hello\n")
+
+		got, line := acceptLine(t, tc.dst)
+		if line != "hello" {
+			t.Errorf("Dial %q: got %q, want hello", tc.protos, line)
+		}
+		if _, ok := got.(*tls.Conn); !ok {
+			t.Errorf("Dial %q: got %T, want *tls.Conn", tc.protos, got)
+		}
+	}
+}
+
+// testCert returns a self-signed certificate for localhost.
+func testCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
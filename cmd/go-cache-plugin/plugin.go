@@ -0,0 +1,212 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// The plugin port optionally supports TLS and a shared-secret handshake, so
+// that a cache server can be shared by workers over a network.
+//
+// When a shared secret is configured, the server begins each connection by
+// sending a line with a random challenge, encoded as hex:
+//
+//	<challenge>\n
+//
+// The client replies with a line containing the HMAC-SHA256 of the challenge,
+// keyed by the secret, encoded as hex. If the reply is correct, the server
+// responds "OK\n" and the cache protocol begins. Otherwise, the server closes
+// the connection. The secret itself is never sent over the connection.
+
+// handshakeTimeout bounds the time allowed for a client to authenticate.
+const handshakeTimeout = 10 * time.Second
+
+// isLoopbackHost reports whether host, a host name or IP address, refers
+// only to the local machine.
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
+
+// pluginServerTLS returns a TLS configuration for the plugin listener, or nil
+// if TLS is not enabled for the plugin port.
+func pluginServerTLS() (*tls.Config, error) {
+	if serveFlags.PluginCert == "" && serveFlags.PluginKey == "" {
+		if serveFlags.PluginCA != "" {
+			return nil, errors.New("--plugin-ca requires --plugin-cert and --plugin-key")
+		}
+		return nil, nil
+	} else if serveFlags.PluginCert == "" || serveFlags.PluginKey == "" {
+		return nil, errors.New("--plugin-cert and --plugin-key must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(serveFlags.PluginCert, serveFlags.PluginKey)
+	if err != nil {
+		return nil, fmt.Errorf("load plugin certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if serveFlags.PluginCA != "" {
+		pool, err := loadCertPool(serveFlags.PluginCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// pluginClientTLS returns a TLS configuration for connecting to the plugin
+// port of a server at host, or nil if TLS is not enabled.
+func pluginClientTLS(host string) (*tls.Config, error) {
+	if !connectFlags.TLS && connectFlags.CA == "" && connectFlags.Cert == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{pluginALPN},
+	}
+	if connectFlags.ServerName != "" {
+		cfg.ServerName = connectFlags.ServerName
+	}
+	if connectFlags.CA != "" {
+		pool, err := loadCertPool(connectFlags.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if connectFlags.Cert != "" || connectFlags.Key != "" {
+		if connectFlags.Cert == "" || connectFlags.Key == "" {
+			return nil, errors.New("--cert and --key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(connectFlags.Cert, connectFlags.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// loadCertPool reads a pool of PEM-encoded CA certificates from path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA certificates: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no valid CA certificates in %q", path)
+	}
+	return pool, nil
+}
+
+// authenticateClient performs the server side of the shared-secret handshake
+// on conn. If secret is empty, it succeeds without reading or writing.
+// For a TLS connection, it also completes the TLS handshake, so that failures
+// are reported before the cache protocol begins.
+func authenticateClient(conn net.Conn, secret string) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake: %w", err)
+		}
+	}
+	if secret == "" {
+		return nil
+	}
+
+	var challenge [32]byte
+	rand.Read(challenge[:])
+	if _, err := fmt.Fprintf(conn, "%x\n", challenge); err != nil {
+		return fmt.Errorf("send challenge: %w", err)
+	}
+	reply, err := readLine(conn)
+	if err != nil {
+		return fmt.Errorf("read reply: %w", err)
+	}
+	got, err := hex.DecodeString(reply)
+	if err != nil || !hmac.Equal(got, authMAC(secret, challenge[:])) {
+		return errors.New("client failed authentication")
+	}
+	_, err = io.WriteString(conn, "OK\n")
+	return err
+}
+
+// authenticateServer performs the client side of the shared-secret handshake
+// on conn. If secret is empty, it succeeds without reading or writing.
+func authenticateServer(conn net.Conn, secret string) error {
+	if secret == "" {
+		return nil
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	line, err := readLine(conn)
+	if err != nil {
+		return fmt.Errorf("read challenge: %w", err)
+	}
+	challenge, err := hex.DecodeString(line)
+	if err != nil {
+		return fmt.Errorf("invalid challenge: %w", err)
+	}
+	if _, err := fmt.Fprintf(conn, "%x\n", authMAC(secret, challenge)); err != nil {
+		return fmt.Errorf("send reply: %w", err)
+	}
+	if ok, err := readLine(conn); err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
+	} else if ok != "OK" {
+		return fmt.Errorf("authentication failed: unexpected reply %q", ok)
+	}
+	return nil
+}
+
+// authMAC returns the HMAC-SHA256 of challenge keyed by secret.
+func authMAC(secret string, challenge []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// readLine reads a short newline-terminated line from r, and returns it
+// without the newline. It reads one byte at a time, so that it does not
+// consume any data after the line.
+func readLine(r io.Reader) (string, error) {
+	const maxLine = 256
+	var sb strings.Builder
+	var buf [1]byte
+	for sb.Len() < maxLine {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return "", err
+		}
+		if buf[0] == '\n' {
+			return sb.String(), nil
+		}
+		sb.WriteByte(buf[0])
+	}
+	return "", errors.New("line too long")
+}
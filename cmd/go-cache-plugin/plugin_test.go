@@ -0,0 +1,129 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// handshake runs the shared-secret handshake between a server using secret
+// srvSecret and a client using cliSecret over a pipe. After a successful
+// handshake, the client sends a message to check that the connection is
+// still usable. It returns the errors from each side.
+func handshake(t *testing.T, srvSecret, cliSecret string) (srvErr, cliErr error) {
+	t.Helper()
+	srv, cli := net.Pipe()
+	defer cli.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		defer srv.Close()
+		if err := authenticateClient(srv, srvSecret); err != nil {
+			done <- err
+			return
+		}
+		msg, err := readLine(srv)
+		if err == nil && msg != "hello" {
+			t.Errorf("Server: got message %q, want hello", msg)
+		}
+		done <- err
+	}()
+	cliErr = authenticateServer(cli, cliSecret)
+	if cliErr == nil {
+		io.WriteString(cli, "hello\n")
+	}
+	return <-done, cliErr
+}
+
+func TestHandshake(t *testing.T) {
+	t.Run("NoSecret", func(t *testing.T) {
+		if srvErr, cliErr := handshake(t, "", ""); srvErr != nil || cliErr != nil {
+			t.Errorf("Handshake: got (%v, %v), want success", srvErr, cliErr)
+		}
+	})
+	t.Run("Match", func(t *testing.T) {
+		if srvErr, cliErr := handshake(t, "sekrit", "sekrit"); srvErr != nil || cliErr != nil {
+			t.Errorf("Handshake: got (%v, %v), want success", srvErr, cliErr)
+		}
+	})
+	t.Run("Mismatch", func(t *testing.T) {
+		srvErr, cliErr := handshake(t, "sekrit", "guess")
+		if srvErr == nil {
+			t.Error("Server: got nil error, want authentication failure")
+		}
+		if cliErr == nil {
+			t.Error("Client: got nil error, want authentication failure")
+		}
+	})
+	t.Run("ServerWithoutSecret", func(t *testing.T) {
+		// The client expects a challenge, but the server sends none.
+		srv, cli := net.Pipe()
+		go func() {
+			authenticateClient(srv, "")
+			srv.Close()
+		}()
+		defer cli.Close()
+		if err := authenticateServer(cli, "sekrit"); err == nil {
+			t.Error("Client: got nil error, want failure")
+		}
+	})
+}
+
+func TestAuthMAC(t *testing.T) {
+	challenge := []byte("challenge")
+	a := authMAC("one", challenge)
+	if b := authMAC("one", challenge); string(a) != string(b) {
+		t.Error("MAC is not deterministic")
+	}
+	if b := authMAC("two", challenge); string(a) == string(b) {
+		t.Error("MACs for different secrets are equal")
+	}
+	if b := authMAC("one", []byte("other")); string(a) == string(b) {
+		t.Error("MACs for different challenges are equal")
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	r := strings.NewReader("first\nsecond\nrest")
+	for _, want := range []string{"first", "second"} {
+		if got, err := readLine(r); err != nil || got != want {
+			t.Errorf("readLine: got (%q, %v), want %q", got, err, want)
+		}
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+		t.Errorf("Remaining input: got %q, want rest", rest)
+	}
+	if got, err := readLine(strings.NewReader("unterminated")); err == nil {
+		t.Errorf("readLine unterminated: got %q, want error", got)
+	}
+	if got, err := readLine(strings.NewReader(strings.Repeat("x", 1000) + "\n")); err == nil {
+		t.Errorf("readLine long: got %q, want error", got)
+	}
+}
+
+func TestIsLoopbackHost(t *testing.T) {
+	for _, tc := range []struct {
+		host string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"localhost", true},
+		{"LocalHost", true},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"", false},
+		{"10.0.0.1", false},
+		{"example.com", false},
+		{"localhost.example.com", false},
+	} {
+		if got := isLoopbackHost(tc.host); got != tc.want {
+			t.Errorf("isLoopbackHost(%q): got %v, want %v", tc.host, got, tc.want)
+		}
+	}
+}
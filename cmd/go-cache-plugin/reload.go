@@ -0,0 +1,174 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/creachadair/mhttp/proxyconn"
+	"github.com/creachadair/taskgroup"
+	"github.com/creachadair/tlsutil"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+)
+
+// revProxyFront is the [http.Handler] that receives reverse proxy requests
+// from the main HTTP endpoint. It delegates to a [proxyconn.Bridge] for the
+// current set of target hosts, and allows the targets to be replaced while
+// the server is running (see setHosts).
+//
+// The targets of a Bridge cannot be changed once it is in use, so each change
+// of targets starts a new bridge, serving connections to the same inner TLS
+// server, and retires the old one. Connections already accepted by the old
+// bridge continue until they complete.
+type revProxyFront struct {
+	proxy   *revproxy.Server
+	psrv    *http.Server // the inner TLS server
+	ca      tlsutil.Certificate
+	g       *taskgroup.Group
+	metrics *expvar.Map // bridge metrics, updated when the bridge changes
+	active  expvar.Int  // connections to the inner TLS server currently open
+
+	mu     sync.Mutex // serializes calls to setHosts
+	hosts  []string   // the current target hosts
+	bridge atomic.Pointer[proxyconn.Bridge]
+	cert   atomic.Pointer[tls.Certificate]
+}
+
+// ServeHTTP implements the [http.Handler] interface by delegating to the
+// current bridge.
+func (f *revProxyFront) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.bridge.Load().ServeHTTP(w, r)
+}
+
+// connState tracks the number of open connections to the inner TLS server,
+// for use as its ConnState hook. Each such connection was accepted from a
+// CONNECT request by some bridge, and outlives a change of bridge.
+func (f *revProxyFront) connState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		f.active.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		f.active.Add(-1)
+	}
+}
+
+// getCertificate returns the current server certificate, for use as the
+// GetCertificate hook of the inner TLS server.
+func (f *revProxyFront) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return f.cert.Load(), nil
+}
+
+// setHosts replaces the target hosts of the reverse proxy. It issues a server
+// certificate for the new hosts, updates the targets of the proxy, and starts
+// a new bridge for them, in that order, so that a connection accepted for a
+// new host is never refused by a later step. The old bridge, if any, is closed.
+// It returns the previous target hosts.
+func (f *revProxyFront) setHosts(hosts []string) ([]string, error) {
+	cert, err := newServerCert(f.ca, hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cert.Store(&cert)
+	f.proxy.SetTargets(hosts)
+	old := f.hosts
+	f.hosts = hosts
+
+	nb := &proxyconn.Bridge{
+		Addrs:   hosts,
+		Handler: f.proxy, // forward HTTP requests unencrypted to the proxy
+		Logf:    vprintf,
+
+		// Forward connections not matching Addrs directly to their targets.
+		ForwardConnect: true,
+	}
+	f.g.Go(func() error {
+		err := f.psrv.ServeTLS(nb, "", "")
+		if errors.Is(err, net.ErrClosed) {
+			return nil // the bridge was replaced
+		}
+		return err
+	})
+	nb.Metrics().Do(func(kv expvar.KeyValue) { f.metrics.Set(kv.Key, kv.Value) })
+	f.metrics.Set("proxy_conn_active", &f.active)
+	if ob := f.bridge.Swap(nb); ob != nil {
+		ob.Close()
+	}
+	return old, nil
+}
+
+// reloadSlug is the debug handler path (under /debug/) at which the HTTP
+// server accepts requests to replace the target hosts of the reverse proxy,
+// when it is enabled.
+const reloadSlug = "revproxy-reload"
+
+// reloadRevProxy returns an HTTP handler that replaces the target hosts of
+// the reverse proxy in response to a POST request. The request body lists the
+// new hosts, in the same format as the --revproxy flag, and the reply reports
+// the hosts added and removed.
+func reloadRevProxy(f *revProxyFront) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWarmRequest))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hosts := parseRevProxyHosts(string(data))
+		if len(hosts) == 0 {
+			http.Error(w, "no reverse proxy targets specified", http.StatusBadRequest)
+			return
+		}
+		old, err := f.setHosts(hosts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var added, removed []string
+		for _, h := range hosts {
+			if !slices.Contains(old, h) {
+				added = append(added, h)
+			}
+		}
+		for _, h := range old {
+			if !slices.Contains(hosts, h) {
+				removed = append(removed, h)
+			}
+		}
+		vprintf("reloaded reverse proxy targets: %s", strings.Join(hosts, ", "))
+		fmt.Fprintf(w, "targets: %s\nadded: %s\nremoved: %s\n",
+			strings.Join(hosts, ","), strings.Join(added, ","), strings.Join(removed, ","))
+	}
+}
+
+// parseRevProxyHosts parses a list of reverse proxy target hosts separated by
+// commas or whitespace, as given to the --revproxy flag. Duplicate and empty
+// entries are discarded.
+func parseRevProxyHosts(s string) []string {
+	var hosts []string
+	for _, h := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}) {
+		if !slices.Contains(hosts, h) {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
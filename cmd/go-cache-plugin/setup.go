@@ -4,26 +4,35 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
+	"io/fs"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/creachadair/atomicfile"
 	"github.com/creachadair/command"
 	"github.com/creachadair/gocache"
 	"github.com/creachadair/gocache/cachedir"
-	"github.com/creachadair/mhttp/proxyconn"
 	"github.com/creachadair/taskgroup"
 	"github.com/creachadair/tlsutil"
 	"github.com/goproxy/goproxy"
@@ -34,75 +43,305 @@ import (
 	"tailscale.com/tsweb"
 )
 
-func initCacheServer(env *command.Env) (*gocache.Server, *s3util.Client, error) {
-	switch {
-	case flags.CacheDir == "":
-		return nil, nil, env.Usagef("you must provide a --cache-dir")
-	case flags.S3Bucket == "":
-		return nil, nil, env.Usagef("you must provide an S3 --bucket name")
+func initCacheServer(env *command.Env) (*gocache.Server, *gobuild.S3Cache, *s3util.Client, error) {
+	if flags.CacheDir == "" {
+		return nil, nil, nil, env.Usagef("you must provide a --cache-dir")
+	}
+	switch flags.LogFormat {
+	case "", "text", "json":
+	default:
+		return nil, nil, nil, env.Usagef("invalid --log-format %q (want text or json)", flags.LogFormat)
+	}
+	if flags.KeyPartition < 0 || flags.KeyPartition > 4 {
+		return nil, nil, nil, env.Usagef("invalid --partition-bytes %d (want 0 to 4)", flags.KeyPartition)
 	}
-	region, err := getBucketRegion(env.Context(), flags.S3Bucket)
+	dangling := gobuild.DanglingError
+	if flags.Dangling != "" {
+		p, err := gobuild.ParseDanglingActionPolicy(flags.Dangling)
+		if err != nil {
+			return nil, nil, nil, env.Usagef("invalid --dangling-actions %q (want error, miss, or delete)", flags.Dangling)
+		}
+		dangling = p
+	}
+	provenance, err := parseProvenance(flags.Provenance)
 	if err != nil {
-		return nil, nil, env.Usagef("you must provide an S3 --region name")
+		return nil, nil, nil, env.Usagef("invalid --provenance: %v", err)
 	}
-
-	dir, err := cachedir.New(flags.CacheDir)
+	client, err := initS3Client(env)
 	if err != nil {
-		return nil, nil, fmt.Errorf("create local cache: %w", err)
+		return nil, nil, nil, err
+	}
+	if client != nil {
+		// Check that the bucket is usable before we start, so that an error in
+		// the configuration is reported clearly rather than during a build.
+		cctx, cancel := context.WithTimeout(env.Context(), 30*time.Second)
+		err := client.CheckAccess(cctx)
+		cancel()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("S3 preflight: %w", err)
+		}
 	}
 
-	cfg, err := config.LoadDefaultConfig(env.Context(), config.WithRegion(region))
+	dir, err := cachedir.New(flags.CacheDir)
 	if err != nil {
-		return nil, nil, fmt.Errorf("load AWS config: %w", err)
+		return nil, nil, nil, fmt.Errorf("create local cache: %w", err)
 	}
-
-	vprintf("local cache directory: %s", flags.CacheDir)
-	vprintf("S3 cache bucket %q (%s)", flags.S3Bucket, region)
-	client := &s3util.Client{
-		Client: s3.NewFromConfig(cfg),
-		Bucket: flags.S3Bucket,
+	if flags.DirMode != 0 {
+		if err := os.Chmod(flags.CacheDir, fs.FileMode(flags.DirMode)); err != nil {
+			return nil, nil, nil, fmt.Errorf("set local cache mode: %w", err)
+		}
 	}
+	vprintf("local cache directory: %s", flags.CacheDir)
+
 	cache := &gobuild.S3Cache{
-		Local:             dir,
-		S3Client:          client,
-		KeyPrefix:         flags.KeyPrefix,
-		MinUploadSize:     flags.MinUploadSize,
-		UploadConcurrency: flags.S3Concurrency,
+		Local:               dir,
+		S3Client:            client,
+		KeyPrefix:           flags.KeyPrefix,
+		PartitionBytes:      flags.KeyPartition,
+		MinUploadSize:       flags.MinUploadSize,
+		MaxUploadSize:       flags.MaxUploadSize,
+		MaxLocalObjectBytes: flags.MaxLocalSize,
+		MemoryCacheEntries:  flags.MemEntries,
+		UploadConcurrency:   flags.S3Concurrency,
+		UploadTimeout:       flags.UploadTimeout,
+		UploadRate:          flags.UploadRate,
+		RefreshOnHit:        flags.RefreshOnHit,
+		RecordAccessTime:    flags.AccessTime,
+		CombinedObjects:     flags.Combined,
+		DropUploaded:        flags.DropUploaded,
+		AuditMode:           flags.AuditMode,
+		ShadowMode:          flags.ShadowMode,
+		VerifyStrong:        flags.VerifyStrong,
+		DanglingActions:     dangling,
+		Provenance:          provenance,
+		DirMode:             fs.FileMode(flags.DirMode),
+		FileMode:            fs.FileMode(flags.FileMode),
+	}
+	if client != nil {
+		// Entries stored with a different partition depth would never be
+		// found, so refuse to start rather than silently missing all of them.
+		cctx, cancel := context.WithTimeout(env.Context(), 30*time.Second)
+		err := cache.CheckPartition(cctx)
+		cancel()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("S3 preflight: %w (see the migrate command)", err)
+		}
 	}
 	cache.SetMetrics(env.Context(), expvar.NewMap("gocache_host"))
 
-	close := cache.Close
-	if flags.Expiration > 0 {
-		dirClose := dir.Cleanup(flags.Expiration)
-		close = func(ctx context.Context) error {
-			return errors.Join(cache.Close(ctx), dirClose(ctx))
+	// In JSON format, the cache logs structured records in place of the text
+	// request logs from the server.
+	logRequests := flags.DebugLog&debugBuildCache != 0
+	if logRequests && flags.LogFormat == "json" {
+		cache.RequestLog = os.Stderr
+		logRequests = false
+	}
+
+	if flags.DebugLog&debugBuildCache != 0 {
+		cache.OnProvenance = func(actionID string, meta map[string]string) {
+			vprintf("action %s provenance: %v", actionID, meta)
 		}
 	}
+
+	// Several plugin processes may share the cache directory, so cleanup is
+	// deferred to whichever of them is the last to close.
+	cache.LockFile = filepath.Join(flags.CacheDir, "gobuild.lock")
+	if flags.Expiration > 0 {
+		cache.Cleanup = dir.Cleanup(flags.Expiration)
+	}
 	s := &gocache.Server{
 		Get:         cache.Get,
 		Put:         cache.Put,
-		Close:       close,
+		Close:       cache.Close,
 		SetMetrics:  cache.SetMetrics,
 		MaxRequests: flags.Concurrency,
 		Logf:        vprintf,
-		LogRequests: flags.DebugLog&debugBuildCache != 0,
+		LogRequests: logRequests,
 	}
 	expvar.Publish("gocache_server", s.Metrics().Get("server"))
-	return s, client, nil
+	return s, cache, client, nil
+}
+
+// initS3Client constructs an S3 client for the bucket specified by the flags.
+// If --local-only is set, it returns nil without error.
+func initS3Client(env *command.Env) (*s3util.Client, error) {
+	if flags.LocalOnly {
+		vprintf("local-only mode, S3 is disabled")
+		return nil, nil
+	} else if flags.S3Bucket == "" {
+		return nil, env.Usagef("you must provide an S3 --bucket name")
+	}
+	bucket, prefix, err := parseBucket(flags.S3Bucket)
+	if err != nil {
+		return nil, env.Usagef("invalid --bucket: %v", err)
+	}
+	keyPrefix, err := expandPrefix(flags.KeyPrefix)
+	if err != nil {
+		return nil, env.Usagef("invalid --prefix: %v", err)
+	}
+	flags.S3Bucket = bucket
+	flags.KeyPrefix = path.Join(prefix, keyPrefix)
+	storageClass := types.StorageClass(strings.ToUpper(flags.StorageClass))
+	if storageClass != "" && !slices.Contains(storageClass.Values(), storageClass) {
+		return nil, env.Usagef("invalid --s3-storage-class %q", flags.StorageClass)
+	}
+	acl := types.ObjectCannedACL(strings.ToLower(flags.ACL))
+	if acl != "" && !slices.Contains(acl.Values(), acl) {
+		return nil, env.Usagef("invalid --s3-acl %q", flags.ACL)
+	}
+	if flags.AWSCredsFile != "" {
+		if _, err := os.Stat(flags.AWSCredsFile); err != nil {
+			return nil, env.Usagef("invalid --aws-credentials-file: %v", err)
+		}
+	}
+
+	cfg, err := config.LoadDefaultConfig(env.Context(), awsConfigOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	region, err := getBucketRegion(env.Context(), cfg, flags.S3Bucket)
+	if err != nil {
+		return nil, env.Usagef("you must provide an S3 --region name")
+	}
+	cfg.Region = region
+	vprintf("S3 cache bucket %q (%s)", flags.S3Bucket, region)
+	return &s3util.Client{
+		Client:       s3.NewFromConfig(cfg, s3Options),
+		Bucket:       flags.S3Bucket,
+		RequestPayer: flags.RequestPayer,
+		StorageClass: storageClass,
+		ACL:          acl,
+
+		MultipartPartSize:    flags.PartSize,
+		MultipartConcurrency: flags.PartConc,
+	}, nil
+}
+
+// parseProvenance parses a comma-separated list of key=value pairs for the
+// --provenance flag. Keys and values must be printable ASCII, and keys must not
+// contain spaces or separators, since they are sent as HTTP header names.
+func parseProvenance(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	out := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid setting %q: want key=value", kv)
+		}
+		for _, c := range key {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return nil, fmt.Errorf("invalid key %q", key)
+			}
+		}
+		for _, c := range val {
+			if c < ' ' || c > '~' {
+				return nil, fmt.Errorf("invalid value for %q", key)
+			}
+		}
+		out[strings.ToLower(key)] = val
+	}
+	return out, nil
+}
+
+// awsConfigOptions returns the options for loading the AWS config, as
+// specified by the flags.
+func awsConfigOptions() []func(*config.LoadOptions) error {
+	var opts []func(*config.LoadOptions) error
+	if flags.AWSCredsFile != "" {
+		opts = append(opts, config.WithSharedCredentialsFiles([]string{flags.AWSCredsFile}))
+	}
+	if flags.AWSProfile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(flags.AWSProfile))
+	}
+	return opts
+}
+
+// s3Options applies the S3 client options specified by the flags.
+func s3Options(o *s3.Options) {
+	o.UsePathStyle = flags.S3PathStyle
+}
+
+// expandPrefix expands references to environment variables of the form $VAR
+// or ${VAR} in the key prefix s, and checks that the result is safe to use as
+// part of an S3 key. It reports an error if a referenced variable is not set.
+//
+// The check is stricter than the handling of --prefix before variables were
+// supported, which used the flag verbatim: prefixes with characters outside
+// the safe set, or with empty, ".", or ".." components, are now rejected.
+func expandPrefix(s string) (string, error) {
+	var missing []string
+	out := os.Expand(s, func(name string) string {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) != 0 {
+		return "", fmt.Errorf("undefined variables in %q: %s", s, strings.Join(missing, ", "))
+	}
+	if out == "" {
+		return "", nil
+	}
+	for _, part := range strings.Split(strings.Trim(out, "/"), "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("prefix %q has an invalid path component %q", out, part)
+		}
+		if i := strings.IndexFunc(part, func(r rune) bool { return !isSafeKeyRune(r) }); i >= 0 {
+			return "", fmt.Errorf("prefix %q contains unsafe character %q", out, part[i:i+1])
+		}
+	}
+	return out, nil
+}
+
+// isSafeKeyRune reports whether r is one of the characters that S3 documents
+// as safe for use in object keys.
+func isSafeKeyRune(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		strings.ContainsRune("!-_.*'()", r)
+}
+
+// parseBucket parses a bucket specification, which is either a plain bucket
+// name or an S3 URI of the form "s3://bucket[/prefix...]". It returns the
+// bucket name and the key prefix, if any.
+func parseBucket(s string) (bucket, prefix string, _ error) {
+	if !strings.Contains(s, "://") {
+		if strings.Contains(s, "/") {
+			return "", "", fmt.Errorf("bucket name %q may not contain %q", s, "/")
+		}
+		return s, "", nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	} else if u.Scheme != "s3" {
+		return "", "", fmt.Errorf("unsupported URI scheme %q (want s3)", u.Scheme)
+	} else if u.Host == "" {
+		return "", "", fmt.Errorf("missing bucket name in %q", s)
+	} else if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", "", fmt.Errorf("invalid S3 URI %q", s)
+	}
+	return u.Host, strings.Trim(u.Path, "/"), nil
 }
 
 // initModProxy initializes a Go module proxy if one is enabled. If not, it
 // returns a nil handler without error. The caller must defer a call to the
 // cleanup function unless an error is reported.
-func initModProxy(env *command.Env, s3c *s3util.Client) (_ http.Handler, cleanup func(), _ error) {
+func initModProxy(env *command.Env, s3c *s3util.Client, dbg *tsweb.DebugHandler) (_ http.Handler, cleanup func(), _ error) {
 	if !serveFlags.ModProxy {
 		return nil, noop, nil // OK, proxy is disabled
-	} else if serveFlags.HTTP == "" {
-		return nil, nil, env.Usagef("you must set --http to enable --modproxy")
+	} else if !httpEnabled() {
+		return nil, nil, env.Usagef("you must set --http or --share-port to enable --modproxy")
+	}
+	modPath := modProxyPath()
+	if modPath == "" || modPath == "/debug" || strings.HasPrefix(modPath, "/debug/") {
+		return nil, nil, env.Usagef("invalid --modproxy-path %q", serveFlags.ModPath)
 	}
 
-	modCachePath := filepath.Join(flags.CacheDir, "module")
-	if err := os.MkdirAll(modCachePath, 0755); err != nil {
+	modCachePath := modCacheDir()
+	if err := os.MkdirAll(modCachePath, dirMode()); err != nil {
 		return nil, nil, fmt.Errorf("create module cache: %w", err)
 	}
 	cacher := &modproxy.S3Cacher{
@@ -110,9 +349,24 @@ func initModProxy(env *command.Env, s3c *s3util.Client) (_ http.Handler, cleanup
 		S3Client:    s3c,
 		KeyPrefix:   path.Join(flags.KeyPrefix, "module"),
 		MaxTasks:    flags.S3Concurrency,
+		DirMode:     fs.FileMode(flags.DirMode),
+		FileMode:    fs.FileMode(flags.FileMode),
+		FailOpen:    serveFlags.ModFailOpen,
 		Logf:        vprintf,
 		LogRequests: flags.DebugLog&debugModProxy != 0,
 	}
+	fetchEnv, err := modFetchEnv(serveFlags.FetchEnv)
+	if err != nil {
+		return nil, nil, env.Usagef("invalid --mod-fetch-env: %v", err)
+	}
+	if serveFlags.ModMirror != "" {
+		cacher.MirrorDirs = strings.Split(serveFlags.ModMirror, ",")
+		vprintf("module proxy mirrors: %s", strings.Join(cacher.MirrorDirs, ", "))
+	}
+	if serveFlags.ModPrivate != "" {
+		cacher.PrivatePatterns = strings.Split(serveFlags.ModPrivate, ",")
+		vprintf("module proxy private modules: %s", strings.Join(cacher.PrivatePatterns, ", "))
+	}
 	cleanup = func() { vprintf("close cacher (err=%v)", cacher.Close()) }
 	proxy := &goproxy.Goproxy{
 		Fetcher: &goproxy.GoFetcher{
@@ -121,7 +375,7 @@ func initModProxy(env *command.Env, s3c *s3util.Client) (_ http.Handler, cleanup
 			// bypass via GONOPROXY, GOPRIVATE, etc., we will only attempt to
 			// proxy for the specific server(s) listed in Env.
 			GoBin: "/bin/false",
-			Env:   []string{"GOPROXY=https://proxy.golang.org"},
+			Env:   fetchEnv,
 		},
 		Cacher:        cacher,
 		ProxiedSumDBs: []string{"sum.golang.org"}, // default, see below
@@ -132,7 +386,39 @@ func initModProxy(env *command.Env, s3c *s3util.Client) (_ http.Handler, cleanup
 		vprintf("enabling sum DB proxy for %s", strings.Join(proxy.ProxiedSumDBs, ", "))
 	}
 	expvar.Publish("modcache", cacher.Metrics())
-	return http.StripPrefix("/mod", proxy), cleanup, nil
+	dbg.HandleSilent(modPrefetchSlug, prefetchModProxy(cacher))
+	vprintf("module proxy serving at %s/", modPath)
+	return http.StripPrefix(modPath, cacher.PrivateFilter(proxy)), cleanup, nil
+}
+
+// modFetchEnv returns the environment for the module proxy fetcher, consisting
+// of the default settings followed by the extra settings from --mod-fetch-env.
+// Later settings override earlier ones for the same variable.
+//
+// It reports an error for any setting that would cause the fetcher to bypass
+// the proxy and shell out to the go tool for a direct fetch.
+func modFetchEnv(extra []string) ([]string, error) {
+	env := []string{"GOPROXY=https://proxy.golang.org"}
+	for _, kv := range extra {
+		key, value, _ := strings.Cut(kv, "=")
+		switch key {
+		case "GOPROXY":
+			if value == "" {
+				return nil, errors.New("GOPROXY must not be empty")
+			}
+			for _, elt := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '|' }) {
+				if elt == "direct" {
+					return nil, fmt.Errorf("GOPROXY %q includes direct fetches", value)
+				}
+			}
+		case "GONOPROXY", "GOPRIVATE":
+			if value != "" {
+				return nil, fmt.Errorf("%s is not supported, it enables direct fetches", key)
+			}
+		}
+		env = append(env, kv)
+	}
+	return env, nil
 }
 
 // initRevProxy initializes a reverse proxy if one is enabled.  If not, it
@@ -167,75 +453,114 @@ func initModProxy(env *command.Env, s3c *s3util.Client) (_ http.Handler, cleanup
 // To the main HTTP listener, the bridge is an [http.Handler] that serves
 // requests routed to it. To the inner server, the bridge is a [net.Listener],
 // a source of client connections (with TLS terminated).
-func initRevProxy(env *command.Env, s3c *s3util.Client, g *taskgroup.Group) (http.Handler, error) {
+func initRevProxy(env *command.Env, s3c *s3util.Client, mux *http.ServeMux, dbg *tsweb.DebugHandler, g *taskgroup.Group) (http.Handler, error) {
 	if serveFlags.RevProxy == "" {
 		return nil, nil // OK, proxy is disabled
-	} else if serveFlags.HTTP == "" {
-		return nil, env.Usagef("you must set --http to enable --revproxy")
+	} else if !httpEnabled() {
+		return nil, env.Usagef("you must set --http or --share-port to enable --revproxy")
 	}
 
-	revCachePath := filepath.Join(flags.CacheDir, "revproxy")
-	if err := os.MkdirAll(revCachePath, 0755); err != nil {
+	revCachePath := revProxyCacheDir()
+	if err := os.MkdirAll(revCachePath, dirMode()); err != nil {
 		return nil, fmt.Errorf("create revproxy cache: %w", err)
 	}
-	hosts := strings.Split(serveFlags.RevProxy, ",")
+	hosts := parseRevProxyHosts(serveFlags.RevProxy)
+	if len(hosts) == 0 {
+		return nil, env.Usagef("no reverse proxy targets specified")
+	}
 
-	// Issue a server certificate so we can proxy HTTPS requests.
-	cert, err := initServerCert(env, hosts)
+	// Create a signing certificate, from which we issue server certificates so
+	// we can proxy HTTPS requests.
+	ca, err := initSigningCert(env)
 	if err != nil {
 		return nil, err
 	}
+	mux.Handle("GET "+caCertPath, serveCACert(ca))
 
 	proxy := &revproxy.Server{
 		Targets:     hosts,
 		Local:       revCachePath,
 		S3Client:    s3c,
 		KeyPrefix:   path.Join(flags.KeyPrefix, "revproxy"),
+		DirMode:     fs.FileMode(flags.DirMode),
+		FileMode:    fs.FileMode(flags.FileMode),
 		Logf:        vprintf,
 		LogRequests: flags.DebugLog&debugRevProxy != 0,
-	}
-	bridge := &proxyconn.Bridge{
-		Addrs:   hosts,
-		Handler: proxy, // forward HTTP requests unencrypted to the proxy
-		Logf:    vprintf,
 
-		// Forward connections not matching Addrs directly to their targets.
-		ForwardConnect: true,
+		DisableUpstreamHTTP2: serveFlags.NoHTTP2,
+	}
+	if serveFlags.RevProxyCA != "" {
+		pool, err := loadCertPool(serveFlags.RevProxyCA)
+		if err != nil {
+			return nil, err
+		}
+		proxy.UpstreamRootCAs = pool
+	}
+	if serveFlags.RevProxyPin != "" {
+		for _, s := range strings.Split(serveFlags.RevProxyPin, ",") {
+			pin, err := revproxy.ParseCertPin(s)
+			if err != nil {
+				return nil, env.Usagef("invalid --revproxy-pin: %v", err)
+			}
+			proxy.UpstreamCertPins = append(proxy.UpstreamCertPins, pin)
+		}
+		vprintf("reverse proxy pinned %d upstream certificates", len(proxy.UpstreamCertPins))
 	}
-	expvar.Publish("proxyconn", bridge.Metrics())
 
 	// Run the proxy on its own separate server with TLS support.  This server
 	// does not listen on a real network; it receives connections forwarded by
 	// the bridge internally from successful CONNECT requests.
-	psrv := &http.Server{
-		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	front := &revProxyFront{
+		proxy:   proxy,
+		ca:      ca,
+		g:       g,
+		metrics: new(expvar.Map),
+	}
+	front.psrv = &http.Server{
+		TLSConfig: &tls.Config{GetCertificate: front.getCertificate},
 
 		// Ordinarly HTTP proxy requests are delegated directly.
 		Handler: proxy,
+
+		ConnState: front.connState,
+	}
+	if _, err := front.setHosts(hosts); err != nil {
+		return nil, err
 	}
-	g.Go(func() error { return psrv.ServeTLS(bridge, "", "") })
+	expvar.Publish("proxyconn", front.metrics)
 
 	g.Run(func() {
 		<-env.Context().Done()
 		vprintf("stopping proxy bridge")
-		psrv.Shutdown(context.Background())
+		front.psrv.Shutdown(context.Background())
 	})
 
+	dbg.HandleSilent(reloadSlug, reloadRevProxy(front))
+	dbg.HandleSilent(warmSlug, warmRevProxy(proxy))
 	expvar.Publish("revcache", proxy.Metrics())
-	vprintf("enabling reverse proxy for %s", strings.Join(proxy.Targets, ", "))
-	return bridge, nil
+	dbg.Handle("revproxy-entries", "Reverse proxy cache contents (JSON)", revProxyEntries(proxy))
+	vprintf("enabling reverse proxy for %s", strings.Join(hosts, ", "))
+	return front, nil
 }
 
-// initServerCert creates a signed certificate advertising the specified host
-// names, for use in creating a TLS server.
-func initServerCert(env *command.Env, hosts []string) (tls.Certificate, error) {
+// initSigningCert creates a certificate for signing the server certificates
+// of the reverse proxy, and installs it in the system store (or writes it to
+// a file, if --revproxy-no-install-ca is set). Clients must trust the signing
+// certificate to accept the server certificates it issues.
+func initSigningCert(env *command.Env) (tlsutil.Certificate, error) {
 	ca, err := tlsutil.NewSigningCert(24*time.Hour, &x509.Certificate{
 		Subject: pkix.Name{Organization: []string{"Tailscale build automation"}},
 	})
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("generate signing cert: %w", err)
+		return tlsutil.Certificate{}, fmt.Errorf("generate signing cert: %w", err)
 	}
-	if err := installSigningCert(env, ca); err != nil {
+	if serveFlags.NoInstallCA {
+		certFile := revProxyCAPath()
+		if err := atomicfile.WriteData(certFile, ca.CertPEM(), 0644); err != nil {
+			return tlsutil.Certificate{}, fmt.Errorf("write signing cert: %w", err)
+		}
+		log.Printf("Wrote reverse proxy signing cert to %s", certFile)
+	} else if err := installSigningCert(env, ca); err != nil {
 		vprintf("WARNING: %v", err)
 	} else {
 		vprintf("installed signing cert in system store")
@@ -243,7 +568,12 @@ func initServerCert(env *command.Env, hosts []string) (tls.Certificate, error) {
 		// TODO(creachadair): We should probably clean up old expired certs.
 		// This is OK for ephemeral build/CI workers, though.
 	}
+	return ca, nil
+}
 
+// newServerCert creates a certificate signed by ca advertising the specified
+// host names, for use in creating a TLS server.
+func newServerCert(ca tlsutil.Certificate, hosts []string) (tls.Certificate, error) {
 	sc, err := tlsutil.NewServerCert(24*time.Hour, ca, &x509.Certificate{
 		Subject:  pkix.Name{Organization: []string{"Go cache plugin reverse proxy"}},
 		DNSNames: hosts,
@@ -251,15 +581,202 @@ func initServerCert(env *command.Env, hosts []string) (tls.Certificate, error) {
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("generate server cert: %w", err)
 	}
-
 	return sc.TLSCertificate()
 }
 
-// makeHandler returns an HTTP handler that dispatches requests to debug
-// handlers or to the specified proxies, if they are defined.
-func makeHandler(modProxy, revProxy http.Handler) http.HandlerFunc {
-	mux := http.NewServeMux()
-	tsweb.Debugger(mux)
+// revProxyCAPath returns the path where the signing certificate for the
+// reverse proxy is written when --revproxy-no-install-ca is set.
+func revProxyCAPath() string { return filepath.Join(flags.CacheDir, "revproxy-ca.crt") }
+
+// caCertPath is the URL path at which the HTTP server serves the signing
+// certificate for the reverse proxy, when the reverse proxy is enabled.
+const caCertPath = "/_cache/ca.crt"
+
+// serveCACert returns an HTTP handler that serves the certificate of ca in
+// PEM format.
+func serveCACert(ca tlsutil.Certificate) http.HandlerFunc {
+	pem := ca.CertPEM()
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(pem)
+	}
+}
+
+// resetMetrics returns an HTTP handler that resets the metrics of the build
+// cache in response to a POST request. The reset is not atomic with respect to
+// concurrent cache requests; see [gobuild.S3Cache.ResetMetrics].
+func resetMetrics(cache *gobuild.S3Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		cache.ResetMetrics()
+		vprintf("build cache metrics reset")
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+// flushUploads returns an HTTP handler that waits for pending uploads from the
+// build cache to complete in response to a POST request.
+func flushUploads(cache *gobuild.S3Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		start := time.Now()
+		if err := cache.Flush(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		vprintf("build cache flushed (%v elapsed)", time.Since(start))
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+// revProxyEntries returns an HTTP handler that reports the contents of the
+// local reverse proxy cache as a JSON array.
+func revProxyEntries(proxy *revproxy.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		es, err := proxy.Entries(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(es)
+	}
+}
+
+// warmSlug is the debug handler path (under /debug/) at which the HTTP server
+// accepts requests to warm the reverse proxy cache, when the reverse proxy is
+// enabled.
+const warmSlug = "revproxy-warm"
+
+// maxWarmRequest is the largest request body accepted by warmRevProxy.
+const maxWarmRequest = 1 << 20
+
+// warmRevProxy returns an HTTP handler that fetches a list of URLs into the
+// reverse proxy cache in response to a POST request, and reports the results
+// as a JSON array. The request body lists the URLs either as a JSON array of
+// strings, or as text with one URL per line.
+func warmRevProxy(proxy *revproxy.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWarmRequest))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var urls []string
+		if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("[")) {
+			if err := json.Unmarshal(trimmed, &urls); err != nil {
+				http.Error(w, fmt.Sprintf("invalid URL list: %v", err), http.StatusBadRequest)
+				return
+			}
+		} else {
+			for _, line := range strings.Split(string(trimmed), "\n") {
+				if u := strings.TrimSpace(line); u != "" && !strings.HasPrefix(u, "#") {
+					urls = append(urls, u)
+				}
+			}
+		}
+		start := time.Now()
+		res := proxy.Warm(r.Context(), r.Header, urls)
+		vprintf("warmed reverse proxy cache with %d URLs (%v elapsed)", len(urls), time.Since(start))
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(res)
+	}
+}
+
+// modPrefetchSlug is the debug handler path (under /debug/) at which the HTTP
+// server accepts requests to prefetch files into the module cache, when the
+// module proxy is enabled.
+const modPrefetchSlug = "modproxy-prefetch"
+
+// prefetchModProxy returns an HTTP handler that faults in module files from
+// S3 into the local module cache in response to a POST request. The request
+// body is either a go.sum file, a go.mod file, or text listing one cache file
+// name per line.
+func prefetchModProxy(cacher *modproxy.S3Cacher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWarmRequest))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		names, err := modPrefetchNames(data)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid file list: %v", err), http.StatusBadRequest)
+			return
+		}
+		start := time.Now()
+		err = cacher.Prefetch(r.Context(), names)
+		vprintf("prefetched module cache with %d files (%v elapsed, err=%v)", len(names), time.Since(start), err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "OK %d\n", len(names))
+	}
+}
+
+// modPrefetchNames returns the module cache file names requested by data,
+// which is either a go.sum file, a go.mod file, or a list of names one per
+// line. The format is chosen by the first non-blank line.
+func modPrefetchNames(data []byte) ([]string, error) {
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if t := strings.TrimSpace(line); t != "" && !strings.HasPrefix(t, "#") {
+			lines = append(lines, t)
+		}
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	first := strings.Fields(lines[0])
+	switch {
+	case len(first) == 3 && strings.HasPrefix(first[2], "h1:"):
+		return modproxy.SumFileNames(data)
+	case first[0] == "module" || first[0] == "go" || first[0] == "require":
+		return modproxy.ModFileNames(data)
+	}
+	return lines, nil
+}
+
+// buildInfo returns the version information for the running binary, as
+// reported by the "version" subcommand. The result is computed once.
+var buildInfo = sync.OnceValue(command.GetVersionInfo)
+
+// versionInfo is an HTTP handler that reports the version information for the
+// running binary as a JSON object.
+func versionInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(buildInfo())
+}
+
+// makeHandler returns an HTTP handler that dispatches requests to the debug
+// handlers in mux or to the specified proxies, if they are defined.
+func makeHandler(mux *http.ServeMux, modProxy, revProxy http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Host != "" && r.URL.Host == r.Host {
 			// The caller wants us to proxy for them.
@@ -273,11 +790,15 @@ func makeHandler(modProxy, revProxy http.Handler) http.HandlerFunc {
 		}
 
 		path := r.URL.Path
-		if strings.HasPrefix(path, "/debug/") {
+		if strings.HasPrefix(path, "/debug/") || path == caCertPath {
 			mux.ServeHTTP(w, r)
 			return
 		}
-		if modProxy != nil && r.Method == http.MethodGet && strings.HasPrefix(path, "/mod/") {
+		if path == "/version" && r.Method == http.MethodGet {
+			versionInfo(w, r)
+			return
+		}
+		if modProxy != nil && r.Method == http.MethodGet && strings.HasPrefix(path, modProxyPath()+"/") {
 			modProxy.ServeHTTP(w, r)
 			return
 		}
@@ -285,5 +806,44 @@ func makeHandler(modProxy, revProxy http.Handler) http.HandlerFunc {
 	}
 }
 
+// modProxyPath returns the URL path prefix for the module proxy, as set by the
+// --modproxy-path flag, or "/mod" if that flag is not set. The result has a
+// leading slash and no trailing slash, or is empty if the path is "/".
+func modProxyPath() string {
+	if serveFlags.ModPath == "" {
+		return "/mod"
+	}
+	return strings.TrimSuffix(path.Clean("/"+serveFlags.ModPath), "/")
+}
+
+// modCacheDir returns the path of the local module proxy cache, as set by the
+// --module-cache-dir flag, or the "module" subdirectory of --cache-dir if that
+// flag is not set.
+func modCacheDir() string {
+	if serveFlags.ModCacheDir != "" {
+		return serveFlags.ModCacheDir
+	}
+	return filepath.Join(flags.CacheDir, "module")
+}
+
+// revProxyCacheDir returns the path of the local reverse proxy cache, as set
+// by the --revproxy-cache-dir flag, or the "revproxy" subdirectory of
+// --cache-dir if that flag is not set.
+func revProxyCacheDir() string {
+	if serveFlags.RevCacheDir != "" {
+		return serveFlags.RevCacheDir
+	}
+	return filepath.Join(flags.CacheDir, "revproxy")
+}
+
+// dirMode returns the permission mode for local cache directories, as set by
+// the --dir-mode flag, or 0755 if that flag is not set.
+func dirMode() fs.FileMode {
+	if flags.DirMode != 0 {
+		return fs.FileMode(flags.DirMode)
+	}
+	return 0755
+}
+
 // noop is a cleanup function that does nothing, used as a default.
 func noop() {}
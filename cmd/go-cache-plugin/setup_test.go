@@ -0,0 +1,120 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseBucket(t *testing.T) {
+	for _, tc := range []struct {
+		input          string
+		bucket, prefix string
+		ok             bool
+	}{
+		{"my-bucket", "my-bucket", "", true},
+		{"s3://my-bucket", "my-bucket", "", true},
+		{"s3://my-bucket/", "my-bucket", "", true},
+		{"s3://my-bucket/a/b", "my-bucket", "a/b", true},
+		{"s3://my-bucket/a/b/", "my-bucket", "a/b", true},
+
+		{"my-bucket/prefix", "", "", false}, // use a URI for a prefix
+		{"https://my-bucket/a", "", "", false},
+		{"s3:///a/b", "", "", false},
+		{"s3://user@my-bucket/a", "", "", false},
+		{"s3://my-bucket/a?x=1", "", "", false},
+		{"s3://my-bucket/a#frag", "", "", false},
+	} {
+		bucket, prefix, err := parseBucket(tc.input)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("parseBucket(%q): got (%q, %q), want error", tc.input, bucket, prefix)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBucket(%q): unexpected error: %v", tc.input, err)
+		} else if bucket != tc.bucket || prefix != tc.prefix {
+			t.Errorf("parseBucket(%q): got (%q, %q), want (%q, %q)", tc.input, bucket, prefix, tc.bucket, tc.prefix)
+		}
+	}
+}
+
+func TestExpandPrefix(t *testing.T) {
+	t.Setenv("TEST_BRANCH", "main")
+	t.Setenv("TEST_EMPTY", "")
+	t.Setenv("TEST_UNSAFE", "a b")
+	for _, tc := range []struct {
+		input, want string
+		ok          bool
+	}{
+		{"", "", true},
+		{"cache", "cache", true},
+		{"ci/$TEST_BRANCH", "ci/main", true},
+		{"ci/${TEST_BRANCH}/go", "ci/main/go", true},
+		{"/a/b/", "/a/b/", true},
+		{"x$TEST_EMPTY", "x", true},
+		{"$TEST_EMPTY", "", true},
+		{"v1.2_(test)!-*'", "v1.2_(test)!-*'", true},
+
+		{"ci/$TEST_UNDEFINED", "", false},
+		{"ci/$TEST_UNSAFE", "", false},
+
+		// These were accepted verbatim before variables were expanded.
+		{"my cache", "", false},
+		{"a+b", "", false},
+		{"user@host", "", false},
+		{"a//b", "", false},
+		{"a/./b", "", false},
+		{"../b", "", false},
+		{"caché", "", false},
+	} {
+		got, err := expandPrefix(tc.input)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("expandPrefix(%q): got %q, want error", tc.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandPrefix(%q): unexpected error: %v", tc.input, err)
+		} else if got != tc.want {
+			t.Errorf("expandPrefix(%q): got %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestModFetchEnv(t *testing.T) {
+	const base = "GOPROXY=https://proxy.golang.org"
+	for _, tc := range []struct {
+		extra []string
+		want  []string // nil means an error is expected
+	}{
+		{nil, []string{base}},
+		{[]string{"GOFLAGS=-mod=mod"}, []string{base, "GOFLAGS=-mod=mod"}},
+		{[]string{"GOPROXY=https://goproxy.example.com"}, []string{base, "GOPROXY=https://goproxy.example.com"}},
+		{[]string{"GOPROXY=https://a.example.com,https://b.example.com|off"},
+			[]string{base, "GOPROXY=https://a.example.com,https://b.example.com|off"}},
+		{[]string{"GONOPROXY="}, []string{base, "GONOPROXY="}},
+
+		{[]string{"GOPROXY="}, nil},
+		{[]string{"GOPROXY=direct"}, nil},
+		{[]string{"GOPROXY=https://goproxy.example.com,direct"}, nil},
+		{[]string{"GOPROXY=https://goproxy.example.com|direct"}, nil},
+		{[]string{"GONOPROXY=example.com"}, nil},
+		{[]string{"GOPRIVATE=example.com/*"}, nil},
+	} {
+		got, err := modFetchEnv(tc.extra)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("modFetchEnv(%q): got %q, want error", tc.extra, got)
+			}
+		} else if err != nil {
+			t.Errorf("modFetchEnv(%q): unexpected error: %v", tc.extra, err)
+		} else if !slices.Equal(got, tc.want) {
+			t.Errorf("modFetchEnv(%q): got %q, want %q", tc.extra, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// statsdMetrics lists the names of the published metrics maps exported to
+// StatsD. Maps that are not published (for example, because the module proxy
+// is disabled) are skipped.
+var statsdMetrics = []string{"gocache_host", "gocache_server", "modcache", "revcache", "proxyconn"}
+
+// statsdPrefix is prepended to the name of each metric sent to StatsD.
+const statsdPrefix = "gocache"
+
+// maxStatsdPacket is the largest UDP payload the exporter sends. It is chosen
+// to fit in a typical Ethernet MTU without fragmentation.
+const maxStatsdPacket = 1400
+
+// runStatsd sends the current values of the published metrics to the StatsD
+// server at addr every interval, until ctx ends. It sends one final report
+// before returning.
+//
+// Each integer or floating-point metric is sent as a gauge named
+// "gocache.<map>.<key>", with nested maps adding further components. Gauges
+// report the absolute value of each metric, so the collector sees consistent
+// values even if a report is lost or the metrics are reset.
+func runStatsd(ctx context.Context, addr string, interval time.Duration) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		vprintf("statsd: dial %q: %v (metrics not exported)", addr, err)
+		return
+	}
+	defer conn.Close()
+	vprintf("exporting metrics to statsd at %q every %v", addr, interval)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			sendStatsd(conn)
+			return
+		case <-t.C:
+			sendStatsd(conn)
+		}
+	}
+}
+
+// sendStatsd writes one report of the published metrics to conn, in as many
+// packets as needed. Errors are logged and otherwise ignored, since StatsD is
+// best-effort.
+func sendStatsd(conn net.Conn) {
+	statsdReport(statsdMetrics, func(packet []byte) {
+		if _, err := conn.Write(packet); err != nil {
+			vprintf("statsd: write: %v", err)
+		}
+	})
+}
+
+// statsdReport calls send with each packet of a report of the published
+// metrics maps with the given names. Each packet holds as many complete lines
+// as fit in maxStatsdPacket bytes. The packet is reused after send returns.
+func statsdReport(names []string, send func([]byte)) {
+	var buf bytes.Buffer
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		send(buf.Bytes())
+		buf.Reset()
+	}
+	for _, name := range names {
+		if m, ok := expvar.Get(name).(*expvar.Map); ok {
+			statsdLines(statsdPrefix+"."+name, m, func(line string) {
+				if buf.Len()+len(line) > maxStatsdPacket {
+					flush()
+				}
+				buf.WriteString(line)
+			})
+		}
+	}
+	flush()
+}
+
+// statsdLines calls emit with a StatsD gauge line for each numeric metric in
+// m, named with the given prefix. Non-numeric metrics are skipped.
+func statsdLines(prefix string, m *expvar.Map, emit func(string)) {
+	m.Do(func(kv expvar.KeyValue) {
+		name := prefix + "." + statsdName(kv.Key)
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			emit(fmt.Sprintf("%s:%d|g\n", name, v.Value()))
+		case *expvar.Float:
+			emit(fmt.Sprintf("%s:%g|g\n", name, v.Value()))
+		case *expvar.Map:
+			statsdLines(name, v, emit)
+		}
+	})
+}
+
+// statsdName replaces characters in a metric key that have special meaning
+// in the StatsD line protocol.
+func statsdName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, key)
+}
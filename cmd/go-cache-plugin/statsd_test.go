@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStatsdName(t *testing.T) {
+	for _, tc := range []struct {
+		input, want string
+	}{
+		{"", ""},
+		{"get_hit", "get_hit"},
+		{"a.b-c/d", "a.b-c/d"},
+		{"host:port", "host_port"},
+		{"a|b@c", "a_b_c"},
+		{"two words", "two_words"},
+		{"line\nbreak", "line_break"},
+		{"ü:ñ", "ü_ñ"},
+	} {
+		if got := statsdName(tc.input); got != tc.want {
+			t.Errorf("statsdName(%q): got %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestStatsdLines(t *testing.T) {
+	m := new(expvar.Map)
+	m.Add("count", 3)
+	m.AddFloat("ratio", 0.5)
+	m.Set("label", new(expvar.String)) // not numeric, skipped
+	sub := new(expvar.Map)
+	sub.Add("bad key", 7)
+	m.Set("sub", sub)
+
+	var got []string
+	statsdLines("p.m", m, func(line string) { got = append(got, line) })
+	want := []string{
+		"p.m.count:3|g\n",
+		"p.m.ratio:0.5|g\n",
+		"p.m.sub.bad_key:7|g\n",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("statsdLines: got %q, want %q", got, want)
+	}
+}
+
+func TestStatsdReport(t *testing.T) {
+	const numKeys = 200
+	m := expvar.NewMap("statsd_test")
+	var want []string
+	for i := range numKeys {
+		key := fmt.Sprintf("metric_with_a_fairly_long_name_%03d", i)
+		m.Add(key, int64(i))
+		want = append(want, fmt.Sprintf("%s.statsd_test.%s:%d|g", statsdPrefix, key, i))
+	}
+
+	// Unpublished names are skipped.
+	var packets []string
+	statsdReport([]string{"statsd_test", "statsd_nonesuch"}, func(packet []byte) {
+		packets = append(packets, string(packet))
+	})
+	if len(packets) < 2 {
+		t.Fatalf("Got %d packets, want the report split across several", len(packets))
+	}
+
+	// Each packet fits, and holds only complete lines.
+	var got []string
+	for i, p := range packets {
+		if len(p) > maxStatsdPacket {
+			t.Errorf("Packet %d: got %d bytes, want at most %d", i, len(p), maxStatsdPacket)
+		}
+		if !strings.HasSuffix(p, "\n") {
+			t.Errorf("Packet %d: does not end with a complete line: %q", i, p)
+		}
+		got = append(got, strings.Split(strings.TrimSuffix(p, "\n"), "\n")...)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Report lines: got %d, want %d\ngot:  %q\nwant: %q", len(got), len(want), got, want)
+	}
+}
@@ -7,21 +7,34 @@ package gobuild
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
 	"io/fs"
+	"log/slog"
+	"maps"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creachadair/gocache"
 	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/mds/cache"
 	"github.com/creachadair/taskgroup"
 	"github.com/tailscale/go-cache-plugin/lib/s3util"
 )
@@ -41,7 +54,9 @@ import (
 //	[<prefix>/]output/<xx>/<object-id>
 //
 // The object and action IDs are encoded as lower-case hexadecimal strings,
-// with "<xx>" denoting the first two bytes of the ID to partition the space.
+// with "<xx>" denoting a prefix of the ID to partition the space. By default
+// the prefix is the first byte of the ID (two hex digits), giving 256
+// partitions; see PartitionBytes. To use a different layout, see KeyFunc.
 //
 // The contents of each action file have the format:
 //
@@ -49,6 +64,25 @@ import (
 //
 // where the object ID is hex encoded and the timestamp is Unix nanoseconds.
 // The object file contains just the binary data of the object.
+//
+// When RecordAccessTime is true, action files instead have the format:
+//
+//	v2 <output-id> <created> <accessed>
+//
+// where the created timestamp is the time the object was first written, and
+// the accessed timestamp is the last time the action was written or refreshed,
+// both in Unix nanoseconds.
+//
+// When CombinedObjects is true, the action record for a small object embeds
+// the object itself, and no separate object file is written:
+//
+//	v3 <output-id> <created> <accessed> <size>\n<object-data>
+//
+// where the size is the length of the object data in bytes. The cache reads
+// all three formats.
+//
+// When VerifyStrong is true, the S3 user metadata of each object and action
+// record written also include the SHA-256 digest of the object, in hex.
 type S3Cache struct {
 	// Local is the local cache directory where actions and objects are staged.
 	// It must be non-nil. A local stage is required because the Go toolchain
@@ -57,93 +91,887 @@ type S3Cache struct {
 	Local *cachedir.Dir
 
 	// S3Client is the S3 client used to read and write cache entries to the
-	// backing store. It must be non-nil.
+	// backing store. If nil, the cache uses only the local directory, and does
+	// not read from or write to S3.
 	S3Client *s3util.Client
 
+	// Shards, if non-empty, lists additional S3 clients, typically for other
+	// buckets, across which cache entries are spread together with S3Client,
+	// to raise the request rate S3 will sustain. Each action and object is
+	// stored with the client chosen deterministically from its ID, so all
+	// caches using the same S3Client and Shards, in the same order, agree on
+	// where each entry lives. Actions and their objects may be stored in
+	// different shards. KeyPrefix and the key layout apply within each shard.
+	//
+	// Changing the number or order of shards moves most entries to a
+	// different shard, so that they are no longer found. Shards has no
+	// effect if S3Client is nil.
+	Shards []*s3util.Client
+
 	// KeyPrefix, if non-empty, is prepended to each key stored into S3, with an
 	// intervening slash.
 	KeyPrefix string
 
+	// PartitionBytes is the number of leading bytes of each ID used to
+	// partition the keys stored in S3, encoded as two hex digits per byte.
+	// If zero or negative, it uses 1 (256 partitions). Values greater than 4
+	// are treated as 4. It does not affect the layout of the local directory.
+	//
+	// Changing PartitionBytes for an existing bucket and prefix orphans the
+	// entries already stored there, since they will no longer be found under
+	// the new keys. To change it, use a fresh KeyPrefix (or bucket), and all
+	// caches sharing a prefix must use the same setting. Use CheckPartition
+	// to detect a mismatch with the entries already stored.
+	PartitionBytes int
+
+	// KeyFunc, if non-nil, derives the S3 key of each entry in place of the
+	// default layout (see "Remote Cache Layout"). It is called with the kind of
+	// the entry, "action" or "output", and its ID as a lower-case hex string,
+	// and returns the key of the entry within KeyPrefix. This permits
+	// alternative layouts, for example to shard entries differently or to
+	// derive keys from salted IDs. Use [S3Cache.DefaultKey] to obtain the
+	// default key for an entry.
+	//
+	// KeyFunc must be deterministic, and must return distinct keys for
+	// distinct entries. As with PartitionBytes, all caches sharing a bucket
+	// and prefix must use the same key derivation, or they will not find each
+	// other's entries.
+	KeyFunc func(kind, id string) string
+
 	// MinUploadSize, if positive, defines a minimum object size in bytes below
 	// which the cache will not write the object to S3.
 	MinUploadSize int64
 
+	// MaxUploadSize, if positive, defines a maximum object size in bytes above
+	// which the cache will not write the object to S3. Such objects are still
+	// stored in the local directory. This guards against propagating
+	// pathologically large objects to the shared store.
+	MaxUploadSize int64
+
 	// UploadConcurrency, if positive, defines the maximum number of concurrent
 	// tasks for writing cache entries to S3.  If zero or negative, it uses
 	// runtime.NumCPU.
 	UploadConcurrency int
 
+	// UploadRate, if positive, is the maximum average number of background
+	// uploads to S3 started per second. Uploads queued faster than this, as
+	// at the end of a large build, are spread out over time rather than sent
+	// in a burst that S3 may throttle. Each upload still counts against
+	// UploadConcurrency while it waits for its turn, and uploads still waiting
+	// when the server's context ends are not started. Rates below one upload
+	// per hour are treated as one per hour. If zero or negative, uploads start
+	// as soon as a task is available.
+	UploadRate float64
+
+	// UploadTimeout, if positive, bounds the time allowed to write each entry
+	// to S3 in the background, including both the object and its action
+	// record. If zero or negative, the default is 1 minute.
+	//
+	// An object written to S3 in multiple parts (see the MultipartPartSize
+	// field of [s3util.Client]) is allowed UploadTimeout for each part, so
+	// that the bound scales with the size of the object.
+	UploadTimeout time.Duration
+
+	// DirMode, if nonzero, is the permission mode applied to directories
+	// created in the local cache.
+	DirMode fs.FileMode
+
+	// FileMode, if nonzero, is the permission mode applied to action and
+	// object files written to the local cache.
+	//
+	// The local directory creates files and directories with fixed modes, so
+	// when DirMode or FileMode is set, the cache updates the permissions of
+	// the entries it writes before reporting them to the caller.
+	FileMode fs.FileMode
+
+	// MaxLocalObjectBytes, if positive, defines a maximum object size in bytes
+	// above which the cache does not keep a persistent copy of the object in
+	// the local directory. Such objects are written to S3, and their local
+	// copies are removed when the cache is closed. A Get that faults in such
+	// an object from S3 stages it in a temporary file, which is likewise
+	// removed when the cache is closed.
+	//
+	// Because the Go toolchain may read the files reported by the cache at any
+	// point until it exits, local copies cannot safely be removed sooner.
+	MaxLocalObjectBytes int64
+
+	// DropUploaded, if true, causes the cache to remove the local copy of each
+	// object it successfully writes to S3 when the cache is closed, so that
+	// the local directory serves only as a scratch area for the current
+	// session. A later Get for such an object faults it in again from S3.
+	//
+	// As with MaxLocalObjectBytes, local copies are not removed before the
+	// cache is closed, because the Go toolchain may still read them.
+	DropUploaded bool
+
+	// LockFile, if non-empty, is the path of a file used to coordinate with
+	// other processes sharing the local directory, such as several go commands
+	// each running its own copy of the plugin. The cache holds a shared
+	// advisory lock on this file while it is open.
+	//
+	// When the cache is closed, it removes files from the local directory (for
+	// MaxLocalObjectBytes and DropUploaded) and calls Cleanup only if it can
+	// obtain an exclusive lock, meaning that no other process is using the
+	// directory. Otherwise these steps are skipped, and the files are left in
+	// place, since another process may have reported them to its toolchain;
+	// their paths are recorded in a file beside LockFile (with the suffix
+	// ".remove"), and they are removed by the next process to obtain the
+	// exclusive lock. While the cache holds the exclusive lock, other
+	// processes wait for it before using the directory, for up to
+	// lockTimeout.
+	// Temporary files staged outside the local directory are always removed.
+	//
+	// Advisory locks are supported only on Unix systems; elsewhere, LockFile
+	// is ignored.
+	LockFile string
+
+	// Cleanup, if non-nil, is called when the cache is closed, after pending
+	// uploads have completed, to prune the local directory. For example, it
+	// may be the result of [cachedir.Dir.Cleanup]. See also LockFile.
+	Cleanup func(context.Context) error
+
+	// RefreshOnHit, if true, enables refreshing the S3 copies of actions that
+	// are found by Get, so that entries in use are not removed by a bucket
+	// lifecycle rule based on the last-modified time of the objects.
+	//
+	// When an action found by Get was last written more than RefreshInterval
+	// ago, the cache rewrites its action record with the current time and
+	// copies its output object onto itself in the background. Each action is
+	// refreshed at most once per RefreshInterval by a given cache.
+	RefreshOnHit bool
+
+	// RecordAccessTime, if true, causes the cache to write action records in
+	// the v2 format, which records both the creation time of the object and
+	// the last time the action was accessed (see "Remote Cache Layout").
+	// When RefreshOnHit is also true, refreshing an action updates its access
+	// time and preserves its creation time. Otherwise the cache writes action
+	// records in the original format, which has a single timestamp that a
+	// refresh replaces.
+	//
+	// Versions of the cache that do not support the v2 format cannot read
+	// these records, so all caches sharing a bucket and prefix should be
+	// upgraded before enabling this option.
+	RecordAccessTime bool
+
+	// CombinedObjects, if true, causes the cache to store each object no
+	// larger than CombinedMaxObject in S3 together with its action record, in
+	// a single v3 record (see "Remote Cache Layout"), rather than as separate
+	// action and object files. This halves the number of S3 requests needed to
+	// write or fault in a small object, at the cost of storing a separate copy
+	// of an object for each action that produces it.
+	//
+	// Caches read both layouts regardless of this setting, so entries written
+	// before it was enabled remain usable. Versions of the cache that do not
+	// support the v3 format cannot read combined records, however, so all
+	// caches sharing a bucket and prefix should be upgraded before enabling
+	// this option.
+	CombinedObjects bool
+
+	// CombinedMaxObject is the largest object size in bytes stored in combined
+	// form when CombinedObjects is true. If zero or negative, it uses 64 KiB.
+	CombinedMaxObject int64
+
+	// RefreshInterval is the minimum age of an action before it is refreshed
+	// when RefreshOnHit is true. If zero or negative, it uses 24 hours.
+	RefreshInterval time.Duration
+
+	// AuditMode, if true, enables a diagnostic check of consistency between
+	// the local cache and S3. On each local hit, Get also reads the action and
+	// object from S3 in the background, and logs a warning if they differ from
+	// the local copy in output ID or size. The result of Get is not affected.
+	//
+	// This is expensive, since it reads every object found locally from S3,
+	// and is meant only for debugging.
+	AuditMode bool
+
+	// ShadowMode, if true, prevents Put from writing to S3. In place of each
+	// upload, the cache checks in the background whether S3 already has a
+	// matching action record and object, and counts and logs any that are
+	// missing or differ. This allows a new configuration to be validated
+	// against a populated bucket before it is allowed to write. Objects are
+	// still stored in the local cache, and are not removed by DropUploaded.
+	//
+	// ShadowMode affects only Put. To avoid all writes to S3, also leave
+	// RefreshOnHit unset, and do not use DanglingDelete.
+	ShadowMode bool
+
+	// MemoryCacheEntries, if positive, enables an in-memory LRU cache of up to
+	// this many local cache hits, in front of the local directory. An action
+	// found in the memory cache is reported without reading its action record
+	// or checking its object on disk. The object file in the local directory
+	// remains the source of truth, since the Go toolchain reads it by path.
+	MemoryCacheEntries int
+
+	// MemoryCacheBytes bounds the total size in bytes of the entries in the
+	// memory cache. If zero or negative, it uses 4 MiB.
+	MemoryCacheBytes int64
+
+	// MemoryCacheMaxObject is the largest object size in bytes whose action is
+	// eligible for the memory cache. If zero or negative, it uses 64 KiB.
+	MemoryCacheMaxObject int64
+
+	// DanglingActions controls how Get and Prefetch handle an action found in
+	// S3 whose output object is missing, for example because a bucket
+	// lifecycle rule removed the object but not the action. The default,
+	// DanglingError, reports an error. Other errors reading the object are
+	// always reported, regardless of this setting.
+	DanglingActions DanglingActionPolicy
+
+	// Provenance, if non-empty, is attached as S3 user metadata to each object
+	// and action record the cache writes to S3, to identify the source of the
+	// entry for auditing, for example a build ID or host name. S3 transmits
+	// user metadata as "x-amz-meta-<key>" headers, so keys should be valid
+	// header names, and keys and values should be ASCII. The total size of
+	// user metadata for an object is limited to 2KiB.
+	//
+	// An object already present in S3 with matching content is not rewritten,
+	// so it retains the provenance of the cache that first wrote it. When
+	// RefreshOnHit refreshes an action, it keeps the provenance of the
+	// original action record.
+	Provenance map[string]string
+
+	// VerifyStrong, if true, causes the cache to compute a SHA-256 digest of
+	// each object it writes to S3, and to record it in the user metadata of
+	// the object and of its action record, under the key "content-sha256".
+	// When an object is faulted in from S3, its contents are checked against
+	// the digest recorded with its action, and an object that does not match
+	// is logged and reported as a cache miss, so that the toolchain rebuilds
+	// and replaces it.
+	//
+	// An action written without a digest, for example by a cache without
+	// VerifyStrong, is also reported as a miss, since its object cannot be
+	// verified; when the toolchain rebuilds it, the action is rewritten with
+	// a digest.
+	//
+	// This is a defense in depth against a bucket whose contents have been
+	// altered: the etags used for conditional writes are MD5 digests, and
+	// are not relied on for integrity.
+	VerifyStrong bool
+
+	// OnProvenance, if non-nil, is called when Get or Prefetch faults in an
+	// action from S3 whose action record has provenance metadata (see
+	// Provenance), with the action ID and the metadata. S3 reports metadata
+	// keys in lower case. OnProvenance may be called concurrently, so it
+	// should return quickly.
+	OnProvenance func(actionID string, meta map[string]string)
+
+	// OnGet, if non-nil, is called after each Get request is handled, with
+	// the action ID and the disposition of the request. It is called
+	// synchronously, so it should return quickly. For GetMulti, OnGet is
+	// called for each action, and may be called concurrently.
+	OnGet func(actionID string, result GetResult)
+
+	// OnPut, if non-nil, is called once for each Put request, after the
+	// object has been written to S3, or when it is known that it will not be.
+	// The uploaded flag reports whether the entry was written to S3, and err
+	// reports the error, if any, that prevented it. The Body field of obj is
+	// nil. OnPut may be called from a background goroutine, and concurrently
+	// with other hooks, so it should return quickly.
+	OnPut func(obj gocache.Object, uploaded bool, err error)
+
+	// RequestLog, if non-nil, receives a structured record of each Get and Put
+	// request handled by the cache, and of each background upload to S3,
+	// encoded as one line of JSON per request. See [RequestRecord].
+	// Writes to RequestLog are serialized by the cache.
+	RequestLog io.Writer
+
+	// Logger, if non-nil, receives the diagnostic messages of the cache, in
+	// place of the logger attached to the context of each request (see
+	// [gocache.Logf]). In addition, each record described by RequestLog is
+	// written to Logger with its fields as attributes, at level Debug, or at
+	// level Warn if the request failed.
+	Logger *slog.Logger
+
 	// Tracks tasks pushing cache writes to S3.
 	initOnce sync.Once
 	push     *taskgroup.Group
 	start    func(taskgroup.Task)
 
+	// Background tasks that have been started and not yet finished, for Flush.
+	pmu     sync.Mutex
+	pending map[*pendingTask]struct{}
+
+	// Recent local cache hits, if MemoryCacheEntries > 0.
+	mem *cache.Cache[string, memEntry]
+
+	// Paces the start of uploads, if UploadRate > 0.
+	pace *pacer
+
+	// The shared lock on LockFile, if set, and the error acquiring it.
+	lock    *dirLock
+	lockErr error
+
+	// Paths of large objects to be removed when the cache is closed, of
+	// uploaded objects to be removed if DropUploaded is true, and of temporary
+	// files outside the local directory.
+	tmu       sync.Mutex
+	transient []string
+	uploaded  []string
+	temp      []string
+
+	// Serializes writes to RequestLog.
+	lmu sync.Mutex
+
+	// Times at which actions were last refreshed, for RefreshOnHit.
+	// Entries older than the refresh interval are pruned periodically.
+	rmu       sync.Mutex
+	refreshed map[string]time.Time
+	rpruned   time.Time // when refreshed was last pruned
+
 	getLocalHit  expvar.Int // count of Get hits in the local cache
 	getFaultHit  expvar.Int // count of Get hits faulted in from S3
 	getFaultMiss expvar.Int // count of Get faults that were misses
 	putSkipSmall expvar.Int // count of "small" objects not written to S3
+	putSkipLarge expvar.Int // count of "large" objects not written to S3
 	putS3Found   expvar.Int // count of objects not written to S3 because they were already present
 	putS3Action  expvar.Int // count of actions written to S3
 	putS3Object  expvar.Int // count of objects written to S3
 	putS3Error   expvar.Int // count of errors writing to S3
+	getTransient expvar.Int // count of large objects faulted in without a local copy
+	prefetchHit  expvar.Int // count of actions faulted in from S3 by Prefetch
+	putTransient expvar.Int // count of large objects not kept in the local cache
+	refreshHit   expvar.Int // count of actions refreshed in S3 on a hit
+	refreshError expvar.Int // count of errors refreshing actions in S3
+	dropLocal    expvar.Int // count of uploaded objects removed from the local cache
+	auditCheck   expvar.Int // count of local hits compared with S3
+	auditMissing expvar.Int // count of local hits not found in S3
+	auditDiffer  expvar.Int // count of local hits that differ from S3
+	auditError   expvar.Int // count of errors reading S3 for comparison
+	memHit       expvar.Int // count of local hits served from the memory cache
+	memMiss      expvar.Int // count of lookups not found in the memory cache
+	getDangling  expvar.Int // count of actions found in S3 whose objects are missing
+	getCombined  expvar.Int // count of objects faulted in from combined action records
+	putCombined  expvar.Int // count of objects written to S3 in combined action records
+	putPaced     expvar.Int // count of uploads delayed by UploadRate
+	getVerified  expvar.Int // count of objects faulted in that matched their recorded digest
+	getNoDigest  expvar.Int // count of objects faulted in without a recorded digest
+	getBadDigest expvar.Int // count of objects faulted in that did not match their recorded digest
+	shadowCheck  expvar.Int // count of uploads checked against S3 by ShadowMode
+	shadowMiss   expvar.Int // count of ShadowMode checks not found in S3
+	shadowDiffer expvar.Int // count of ShadowMode checks that differ from S3
+	shadowError  expvar.Int // count of errors reading S3 for ShadowMode
+	closeShared  expvar.Int // count of closes that skipped cleanup because the directory was in use
 }
 
 func (s *S3Cache) init() {
 	s.initOnce.Do(func() {
-		s.push, s.start = taskgroup.New(nil).Limit(s.uploadConcurrency())
+		var start func(taskgroup.Task)
+		s.push, start = taskgroup.New(nil).Limit(s.uploadConcurrency())
+		s.start = func(task taskgroup.Task) { start(s.track(task)) }
+		s.mem = s.newMemCache()
+		s.pace = newPacer(s.UploadRate)
+		if s.LockFile != "" {
+			s.lock, s.lockErr = openDirLock(s.LockFile)
+		}
 	})
 }
 
+// GetResult describes the disposition of a Get request.
+type GetResult int
+
+const (
+	GetLocalHit GetResult = iota // the action was found in the local cache
+	GetFaultHit                  // the action was faulted in from S3
+	GetMiss                      // the action was not found
+	GetError                     // an error occurred handling the request
+)
+
+func (r GetResult) String() string {
+	switch r {
+	case GetLocalHit:
+		return "local hit"
+	case GetFaultHit:
+		return "fault hit"
+	case GetMiss:
+		return "miss"
+	case GetError:
+		return "error"
+	default:
+		return fmt.Sprintf("GetResult(%d)", int(r))
+	}
+}
+
+// DanglingActionPolicy describes how the cache handles an action found in S3
+// whose output object is missing. See [S3Cache.DanglingActions].
+type DanglingActionPolicy int
+
+const (
+	DanglingError  DanglingActionPolicy = iota // report an error
+	DanglingMiss                               // report a cache miss
+	DanglingDelete                             // delete the action from S3 and report a cache miss
+)
+
+func (p DanglingActionPolicy) String() string {
+	switch p {
+	case DanglingError:
+		return "error"
+	case DanglingMiss:
+		return "miss"
+	case DanglingDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("DanglingActionPolicy(%d)", int(p))
+	}
+}
+
+// ParseDanglingActionPolicy returns the policy with the specified name, as
+// reported by its String method.
+func ParseDanglingActionPolicy(name string) (DanglingActionPolicy, error) {
+	for _, p := range []DanglingActionPolicy{DanglingError, DanglingMiss, DanglingDelete} {
+		if name == p.String() {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown dangling action policy %q", name)
+}
+
 // Get implements the corresponding callback of the cache protocol.
 func (s *S3Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
 	s.init()
 
-	objID, diskPath, err := s.Local.Get(ctx, actionID)
-	if err == nil && objID != "" && diskPath != "" {
-		s.getLocalHit.Add(1)
-		return objID, diskPath, nil // cache hit, OK
+	start := time.Now()
+	outputID, diskPath, result, err := s.get(ctx, actionID)
+	s.onGet(actionID, result)
+	s.logGet(start, actionID, outputID, diskPath, result, err)
+	return outputID, diskPath, err
+}
+
+func (s *S3Cache) get(ctx context.Context, actionID string) (outputID, diskPath string, _ GetResult, _ error) {
+	if objID, diskPath, ok := s.getLocal(ctx, actionID); ok {
+		return objID, diskPath, GetLocalHit, nil // cache hit, OK
+	}
+	return s.getRemote(ctx, actionID)
+}
+
+// getLocal reports whether actionID is present in the local cache, and if so
+// returns its output ID and the path of its object.
+func (s *S3Cache) getLocal(ctx context.Context, actionID string) (outputID, diskPath string, ok bool) {
+	e, ok := s.memGet(actionID)
+	if !ok {
+		objID, diskPath, err := s.Local.Get(ctx, actionID)
+		if err != nil || objID == "" || diskPath == "" {
+			return "", "", false
+		}
+		e = memEntry{outputID: objID, diskPath: diskPath}
+		if s.RefreshOnHit || s.mem != nil {
+			// The local object preserves the timestamp of its action.
+			if fi, err := os.Stat(diskPath); err == nil {
+				e.size, e.mtime = fi.Size(), fi.ModTime()
+				s.memPut(actionID, e)
+			}
+		}
+	}
+	s.getLocalHit.Add(1)
+	if s.RefreshOnHit && !e.mtime.IsZero() {
+		s.maybeRefresh(actionID, actionRecord{outputID: e.outputID, created: e.mtime, accessed: e.mtime})
+	}
+	if s.AuditMode {
+		s.audit(ctx, actionID, e.outputID, e.diskPath)
+	}
+	return e.outputID, e.diskPath, true
+}
+
+// getRemote faults in actionID and its object from S3, if possible.
+func (s *S3Cache) getRemote(ctx context.Context, actionID string) (outputID, diskPath string, _ GetResult, _ error) {
+	if s.S3Client == nil {
+		return "", "", GetMiss, nil // local only, cache miss
 	}
 
 	// Reaching here, either we got a cache miss or an error reading from local.
 	// Try reading the action from S3.
-	action, err := s.S3Client.GetData(ctx, s.actionKey(actionID))
+	rec, err := s.readAction(ctx, actionID)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			s.getFaultMiss.Add(1)
-			return "", "", nil // cache miss, OK
+			return "", "", GetMiss, nil // cache miss, OK
 		}
-		return "", "", fmt.Errorf("[s3] read action %s: %w", actionID, err)
+		return "", "", GetError, err
 	}
 
 	// We got an action hit remotely, try to update the local copy.
-	outputID, mtime, err := parseAction(action)
+	diskPath, err = s.faultObject(ctx, actionID, rec)
 	if err != nil {
-		return "", "", err
+		if s.isDangling(ctx, actionID, err) {
+			s.getFaultMiss.Add(1)
+			return "", "", GetMiss, nil // dangling action, treated as a miss
+		} else if errors.Is(err, errDigestMismatch) {
+			s.getFaultMiss.Add(1)
+			s.logf(ctx, slog.LevelWarn, "action %s: %v (treated as a miss)", actionID, err)
+			return "", "", GetMiss, nil
+		} else if errors.Is(err, errNoDigest) {
+			s.getFaultMiss.Add(1) // counted in getNoDigest; not logged, as it may be common
+			return "", "", GetMiss, nil
+		}
+		return "", "", GetError, err
+	}
+	s.getFaultHit.Add(1)
+	s.onProvenance(actionID, rec.meta)
+	if s.RefreshOnHit {
+		s.maybeRefresh(actionID, rec)
+	}
+	return rec.outputID, diskPath, GetFaultHit, nil
+}
+
+// Result is the result of a single lookup by GetMulti. For a cache miss, both
+// fields are empty.
+type Result struct {
+	OutputID string // the output ID for the action
+	DiskPath string // the local path of the object
+}
+
+// GetMulti looks up multiple actions in the cache, and returns a slice of
+// results in which each entry corresponds to the action at the same position
+// in actionIDs.
+//
+// GetMulti first checks the local cache for all the actions, and then reads
+// the actions that were not found locally concurrently from S3.  At most
+// UploadConcurrency reads are in flight at once. Actions found in S3 are
+// faulted in to the local cache, as for Get.
+//
+// If any lookups fail, GetMulti reports the first error, and the results for
+// the failed lookups are reported as misses.
+func (s *S3Cache) GetMulti(ctx context.Context, actionIDs []string) ([]Result, error) {
+	s.init()
+
+	out := make([]Result, len(actionIDs))
+	var misses []int
+	for i, id := range actionIDs {
+		lstart := time.Now()
+		if objID, diskPath, ok := s.getLocal(ctx, id); ok {
+			out[i] = Result{OutputID: objID, DiskPath: diskPath}
+			s.onGet(id, GetLocalHit)
+			s.logGet(lstart, id, objID, diskPath, GetLocalHit, nil)
+		} else {
+			misses = append(misses, i)
+		}
+	}
+
+	g, start := taskgroup.New(nil).Limit(s.uploadConcurrency())
+	for _, i := range misses {
+		start(func() error {
+			rstart := time.Now()
+			outputID, diskPath, result, err := s.getRemote(ctx, actionIDs[i])
+			s.onGet(actionIDs[i], result)
+			s.logGet(rstart, actionIDs[i], outputID, diskPath, result, err)
+			if err != nil {
+				return err
+			}
+			out[i] = Result{OutputID: outputID, DiskPath: diskPath}
+			return nil
+		})
+	}
+	return out, g.Wait()
+}
+
+// maybeRefresh starts a background refresh of the S3 copies of actionID and
+// its output, if the action was last accessed (per rec) more than the refresh
+// interval ago and it has not already been refreshed within that interval.
+func (s *S3Cache) maybeRefresh(actionID string, rec actionRecord) {
+	if s.S3Client == nil {
+		return // local only, nothing to refresh
+	}
+	interval := s.refreshInterval()
+	now := time.Now()
+	if now.Sub(rec.accessed) < interval {
+		return // recently written
 	}
 
-	object, err := s.S3Client.GetData(ctx, s.outputKey(outputID))
+	s.rmu.Lock()
+	last, ok := s.refreshed[actionID]
+	if ok && now.Sub(last) < interval {
+		s.rmu.Unlock()
+		return // recently refreshed
+	}
+	if s.refreshed == nil {
+		s.refreshed = make(map[string]time.Time)
+	}
+	if now.Sub(s.rpruned) >= interval {
+		for id, last := range s.refreshed {
+			if now.Sub(last) >= interval {
+				delete(s.refreshed, id)
+			}
+		}
+		s.rpruned = now
+	}
+	s.refreshed[actionID] = now
+	s.rmu.Unlock()
+
+	s.start(func() error {
+		sctx, cancel := context.WithTimeout(context.Background(), s.uploadTimeout())
+		defer cancel()
+
+		// A combined record embeds its object, so rewriting the record
+		// refreshes both. Both keep the provenance of the original record,
+		// rather than that of this cache.
+		if rec.body != nil {
+			rec.accessed = now
+			if err := s.client(actionID).PutMeta(sctx, s.actionKey(actionID),
+				bytes.NewReader(rec.formatCombined()), rec.meta); err != nil {
+				s.refreshError.Add(1)
+				return nil // best-effort
+			}
+			s.refreshHit.Add(1)
+			return nil
+		}
+
+		// For a local hit, we do not have the metadata of the stored entry,
+		// which include its provenance and digest. Read them from the action
+		// record, so that the rewrite preserves them.
+		if rec.meta == nil {
+			meta, err := s.client(actionID).Meta(sctx, s.actionKey(actionID))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				s.refreshError.Add(1)
+				return nil // best-effort
+			}
+			rec.meta = meta
+		}
+
+		// Touch the object before rewriting the action record, so that the
+		// action does not outlive its object.
+		if err := s.client(rec.outputID).TouchMeta(sctx, s.outputKey(rec.outputID), rec.meta); err != nil {
+			if s.CombinedObjects && errors.Is(err, fs.ErrNotExist) {
+				// For a local hit, we do not know whether S3 has a combined
+				// record. If so, there is no object file, but copying the
+				// record onto itself refreshes it in place.
+				if err := s.client(actionID).TouchMeta(sctx, s.actionKey(actionID), rec.meta); err == nil {
+					s.refreshHit.Add(1)
+					return nil
+				}
+			}
+			s.refreshError.Add(1)
+			return nil // don't refresh the action without its object
+		}
+		rec.accessed = now
+		if !s.RecordAccessTime {
+			rec.created = now // the original format has only one timestamp
+		}
+		if err := s.client(actionID).PutMeta(sctx, s.actionKey(actionID),
+			strings.NewReader(rec.format(s.RecordAccessTime)), rec.meta); err != nil {
+			s.refreshError.Add(1)
+			return nil // best-effort
+		}
+		s.refreshHit.Add(1)
+		return nil
+	})
+}
+
+// audit starts a background comparison of the local copy of actionID, whose
+// output is outputID stored at diskPath, with its copy in S3.
+func (s *S3Cache) audit(ctx context.Context, actionID, outputID, diskPath string) {
+	if s.S3Client == nil {
+		return // local only, nothing to compare
+	}
+	s.start(func() error {
+		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.uploadTimeout())
+		defer cancel()
+
+		s.auditCheck.Add(1)
+		fi, err := os.Stat(diskPath)
+		if err != nil {
+			s.auditError.Add(1)
+			return nil // removed after the hit
+		}
+		rec, err := s.readAction(sctx, actionID)
+		if errors.Is(err, fs.ErrNotExist) {
+			s.auditMissing.Add(1)
+			return nil // not (yet) uploaded
+		} else if err != nil {
+			s.auditError.Add(1)
+			s.logf(ctx, slog.LevelWarn, "audit action %s: %v", actionID, err)
+			return nil
+		}
+		if rec.outputID != outputID {
+			s.auditDiffer.Add(1)
+			s.logf(ctx, slog.LevelWarn, "audit action %s: local output %s, S3 output %s", actionID, outputID, rec.outputID)
+			return nil
+		}
+		size := int64(len(rec.body))
+		if rec.body == nil {
+			size, err = s.client(outputID).GetTo(sctx, s.outputKey(outputID), io.Discard, nil)
+		}
+		if err != nil {
+			s.auditError.Add(1)
+			s.logf(ctx, slog.LevelWarn, "audit action %s: [s3] read object %s: %v", actionID, outputID, err)
+			return nil
+		}
+		if size != fi.Size() {
+			s.auditDiffer.Add(1)
+			s.logf(ctx, slog.LevelWarn, "audit action %s: object %s has %d bytes locally, %d bytes in S3",
+				actionID, outputID, fi.Size(), size)
+		}
+		return nil
+	})
+}
+
+// onGet calls the OnGet hook, if it is defined.
+func (s *S3Cache) onGet(actionID string, result GetResult) {
+	if s.OnGet != nil {
+		s.OnGet(actionID, result)
+	}
+}
+
+// readAction reads the action record for actionID from S3. If the action is
+// not found, the error satisfies [fs.ErrNotExist].
+func (s *S3Cache) readAction(ctx context.Context, actionID string) (actionRecord, error) {
+	action, meta, err := s.client(actionID).GetDataMeta(ctx, s.actionKey(actionID))
 	if err != nil {
-		// At this point we know the action exists, so if we can't read the
-		// object report it as an error rather than a cache miss.
-		return "", "", fmt.Errorf("[s3] read object %s: %w", outputID, err)
+		if errors.Is(err, fs.ErrNotExist) {
+			return actionRecord{}, err
+		}
+		return actionRecord{}, fmt.Errorf("[s3] read action %s: %w", actionID, err)
+	}
+	rec, err := parseAction(action)
+	rec.meta = meta
+	return rec, err
+}
+
+// faultObject reads the object for the action record rec from S3 and stores
+// it in the local cache for actionID, returning the local path of the object.
+// If rec is a combined record, its embedded object is used without reading
+// S3 again.
+func (s *S3Cache) faultObject(ctx context.Context, actionID string, rec actionRecord) (string, error) {
+	outputID, mtime := rec.outputID, rec.created
+	if s.VerifyStrong {
+		// Without a digest the object cannot be verified, so do not read it.
+		if _, ok := rec.meta[digestMetaKey]; !ok {
+			s.getNoDigest.Add(1)
+			return "", fmt.Errorf("object %s: %w", outputID, errNoDigest)
+		}
+	}
+	object := rec.body
+	if object != nil {
+		s.getCombined.Add(1)
+	} else {
+		var err error
+		object, err = s.client(outputID).GetData(ctx, s.outputKey(outputID))
+		if err != nil {
+			// At this point we know the action exists, so if we can't read the
+			// object report it as an error rather than a cache miss. The caller
+			// decides whether a missing object is a miss (see DanglingActions).
+			return "", fmt.Errorf("[s3] read object %s: %w", outputID, err)
+		}
+	}
+	if s.VerifyStrong {
+		if err := s.checkDigest(rec, object); err != nil {
+			return "", err
+		}
+	}
+
+	// If the object is too large to keep locally, stage it in a temporary file
+	// that will be cleaned up when the cache is closed.
+	if s.isTransient(int64(len(object))) {
+		diskPath, err := s.writeTransient(object, mtime)
+		if err != nil {
+			return "", err
+		}
+		s.getTransient.Add(1)
+		return diskPath, nil
 	}
-	s.getFaultHit.Add(1)
 
 	// Now we should have the body; poke it into the local cache.  Preserve the
 	// modification timestamp recorded with the original action.
-	diskPath, err = s.Local.Put(ctx, gocache.Object{
+	diskPath, err := s.Local.Put(ctx, gocache.Object{
 		ActionID: actionID,
 		OutputID: outputID,
 		Size:     int64(len(object)),
 		Body:     bytes.NewReader(object),
 		ModTime:  mtime,
 	})
-	return outputID, diskPath, err
+	if err != nil {
+		return "", err
+	}
+	return diskPath, s.setModes(actionID, diskPath)
+}
+
+// isDangling reports whether err, from faulting in the object for actionID,
+// indicates a dangling action that should be treated as a cache miss under
+// the DanglingActions policy. Under DanglingDelete, it also removes the action
+// from S3, so that later lookups do not find it.
+func (s *S3Cache) isDangling(ctx context.Context, actionID string, err error) bool {
+	if !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	s.getDangling.Add(1)
+	switch s.DanglingActions {
+	case DanglingMiss:
+		s.logf(ctx, slog.LevelWarn, "action %s: output object is missing in S3 (treating as a miss)", actionID)
+		return true
+	case DanglingDelete:
+		if derr := s.client(actionID).Delete(ctx, s.actionKey(actionID)); derr != nil {
+			s.logf(ctx, slog.LevelWarn, "action %s: [s3] delete dangling action: %v", actionID, derr)
+		} else {
+			s.logf(ctx, slog.LevelInfo, "action %s: deleted dangling action from S3", actionID)
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// Prefetch faults in the actions with the specified IDs from S3, along with
+// their objects, so that subsequent calls to Get for those actions can be
+// satisfied from the local cache. Actions already present in the local cache,
+// and actions not found in S3, are skipped.
+//
+// The two stages of each read are pipelined: Action records are read
+// concurrently, and the read of each object begins as soon as its action has
+// been read, independent of the other actions. At most UploadConcurrency reads
+// of each kind are in flight at once.
+//
+// Prefetch returns the number of actions faulted in from S3. If any reads
+// fail, it also reports the first error.
+func (s *S3Cache) Prefetch(ctx context.Context, actionIDs []string) (int, error) {
+	s.init()
+	if s.S3Client == nil {
+		return 0, nil // local only, nothing to fetch
+	}
+
+	nt := s.uploadConcurrency()
+	actions, startAction := taskgroup.New(nil).Limit(nt)
+	objects, startObject := taskgroup.New(nil).Limit(nt)
+
+	var nfetched atomic.Int64
+	for _, id := range actionIDs {
+		startAction(func() error {
+			if objID, diskPath, err := s.Local.Get(ctx, id); err == nil && objID != "" && diskPath != "" {
+				return nil // already present locally
+			}
+			rec, err := s.readAction(ctx, id)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // not cached remotely
+			} else if err != nil {
+				return err
+			}
+			startObject(func() error {
+				if _, err := s.faultObject(ctx, id, rec); err != nil {
+					if s.isDangling(ctx, id, err) {
+						return nil // dangling action, treated as a miss
+					}
+					return err
+				}
+				s.prefetchHit.Add(1)
+				s.onProvenance(id, rec.meta)
+				nfetched.Add(1)
+				return nil
+			})
+			return nil
+		})
+	}
+	aerr := actions.Wait()
+	oerr := objects.Wait()
+	return int(nfetched.Load()), cmp.Or(aerr, oerr)
 }
 
 // Put implements the corresponding callback of the cache protocol.
-func (s *S3Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
+func (s *S3Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, oerr error) {
 	s.init()
+	if s.RequestLog != nil || s.Logger != nil {
+		rec := RequestRecord{
+			Time: time.Now(), Op: "put", ActionID: obj.ActionID, OutputID: obj.OutputID,
+			Result: "ok", Bytes: obj.Size,
+		}
+		defer func() { s.logRequest(rec, oerr) }()
+	}
 
 	// Compute an etag so we can do a conditional put on the object data.
 	// We do not rely on it as a secure checksum. The toolchain verifies the
@@ -151,71 +979,538 @@ func (s *S3Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string,
 	etr := s3util.NewETagReader(obj.Body)
 	obj.Body = etr
 
+	// If requested, also compute a digest we can rely on.
+	var digest hash.Hash
+	if s.VerifyStrong {
+		digest = sha256.New()
+		obj.Body = io.TeeReader(obj.Body, digest)
+	}
+
+	s.memRemove(obj.ActionID) // the action may be replaced
 	diskPath, err := s.Local.Put(ctx, obj)
+	if err == nil {
+		err = s.setModes(obj.ActionID, diskPath)
+	}
 	if err != nil {
+		s.onPut(obj, false, err)
 		return "", err // don't bother trying to forward it to the remote
 	}
-	if obj.Size < s.MinUploadSize {
+	if s.isTransient(obj.Size) {
+		s.putTransient.Add(1)
+		s.addTransient(diskPath)
+	}
+	if s.S3Client == nil {
+		s.onPut(obj, false, nil)
+		return diskPath, nil // local only, nothing to upload
+	} else if obj.Size < s.MinUploadSize {
 		s.putSkipSmall.Add(1)
+		s.onPut(obj, false, nil)
 		return diskPath, nil // don't bother uploading this, it's too small
+	} else if s.MaxUploadSize > 0 && obj.Size > s.MaxUploadSize {
+		s.putSkipLarge.Add(1)
+		s.logf(ctx, slog.LevelWarn, "warning: not uploading large object %s (%d bytes > %d)",
+			obj.OutputID, obj.Size, s.MaxUploadSize)
+		s.onPut(obj, false, nil)
+		return diskPath, nil // too large to propagate to the shared store
+	}
+
+	if s.ShadowMode {
+		s.start(func() error {
+			rec := RequestRecord{
+				Time: time.Now(), Op: "shadow", ActionID: obj.ActionID, OutputID: obj.OutputID,
+				Bytes: obj.Size,
+			}
+			var err error
+			rec.Result, err = s.shadow(ctx, obj, diskPath, etr.ETag())
+			s.logRequest(rec, err)
+			s.onPut(obj, false, err)
+			return err
+		})
+		return diskPath, nil
 	}
 
 	// Try to push the record to S3 in the background.
 	s.start(func() error {
-		// Override the context with a separate timeout in case S3 is farkakte.
-		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 1*time.Minute)
-		defer cancel()
-
-		// Stage 1: Maybe write the object. Do this before writing the action
-		// record so we are less likely to get a spurious miss later.
-		mtime, err := s.maybePutObject(sctx, obj.OutputID, diskPath, etr.ETag())
+		delay, err := s.pace.wait(ctx)
+		if delay > 0 {
+			s.putPaced.Add(1)
+		}
+		rec := RequestRecord{
+			Time: time.Now(), Op: "upload", ActionID: obj.ActionID, OutputID: obj.OutputID,
+			Result: "ok", Bytes: obj.Size,
+		}
 		if err != nil {
-			return err
+			// The server is stopping; do not start new uploads.
+			err = fmt.Errorf("upload not started: %w", err)
+		} else {
+			err = s.upload(ctx, obj, diskPath, etr.ETag(), s.uploadMeta(digest))
 		}
-
-		// Stage 2: Write the action record.
-		if err := s.S3Client.Put(ctx, s.actionKey(obj.ActionID),
-			strings.NewReader(fmt.Sprintf("%s %d", obj.OutputID, mtime.UnixNano()))); err != nil {
-			gocache.Logf(ctx, "write action %s: %v", obj.ActionID, err)
-			return err
+		s.logRequest(rec, err)
+		if err == nil && s.DropUploaded && !s.isTransient(obj.Size) {
+			s.addUploaded(diskPath)
 		}
-		s.putS3Action.Add(1)
-		return nil
+		s.onPut(obj, err == nil, err)
+		return err
 	})
 
 	return diskPath, nil
 }
 
+// upload writes the object at diskPath and its action record to S3, with the
+// given user metadata.
+func (s *S3Cache) upload(ctx context.Context, obj gocache.Object, diskPath, etag string, meta map[string]string) error {
+	// Override the context with a separate timeout in case S3 is farkakte.
+	// A large object gets the timeout once per part it is written in.
+	timeout := s.uploadTimeout() * time.Duration(s.client(obj.OutputID).Parts(obj.Size))
+	sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	if s.CombinedObjects && obj.Size <= s.combinedMaxObject() {
+		return s.putCombinedRecord(sctx, obj, diskPath, meta)
+	}
+
+	// Stage 1: Maybe write the object. Do this before writing the action
+	// record so we are less likely to get a spurious miss later.
+	mtime, err := s.maybePutObject(sctx, obj.OutputID, diskPath, etag, meta)
+	if err != nil {
+		return err
+	}
+
+	// Stage 2: Write the action record.
+	rec := actionRecord{outputID: obj.OutputID, created: mtime, accessed: time.Now()}
+	if err := s.client(obj.ActionID).PutMeta(sctx, s.actionKey(obj.ActionID),
+		strings.NewReader(rec.format(s.RecordAccessTime)), meta); err != nil {
+		s.logf(ctx, slog.LevelWarn, "write action %s: %v", obj.ActionID, err)
+		return err
+	}
+	s.putS3Action.Add(1)
+	return nil
+}
+
+// digestMetaKey is the user metadata key under which VerifyStrong records the
+// SHA-256 digest of an object, as lower-case hex.
+const digestMetaKey = "content-sha256"
+
+// errDigestMismatch is reported when an object faulted in from S3 does not
+// match the digest recorded with its action.
+var errDigestMismatch = errors.New("object does not match its recorded digest")
+
+// errNoDigest is reported, when VerifyStrong is set, for an action whose
+// record has no digest of its object.
+var errNoDigest = errors.New("no digest is recorded for the object")
+
+// uploadMeta returns the user metadata to store with an object and its action
+// record. This is Provenance, plus the object digest if digest is non-nil.
+func (s *S3Cache) uploadMeta(digest hash.Hash) map[string]string {
+	if digest == nil {
+		return s.Provenance
+	}
+	meta := maps.Clone(s.Provenance)
+	if meta == nil {
+		meta = make(map[string]string)
+	}
+	meta[digestMetaKey] = hex.EncodeToString(digest.Sum(nil))
+	return meta
+}
+
+// checkDigest reports an error wrapping errDigestMismatch if object does not
+// match the digest recorded in the metadata of its action record rec, or
+// wrapping errNoDigest if rec has no digest.
+func (s *S3Cache) checkDigest(rec actionRecord, object []byte) error {
+	want, ok := rec.meta[digestMetaKey]
+	if !ok {
+		s.getNoDigest.Add(1)
+		return fmt.Errorf("object %s: %w", rec.outputID, errNoDigest)
+	}
+	got := sha256.Sum256(object)
+	if hex.EncodeToString(got[:]) != strings.ToLower(want) {
+		s.getBadDigest.Add(1)
+		return fmt.Errorf("object %s: %w", rec.outputID, errDigestMismatch)
+	}
+	s.getVerified.Add(1)
+	return nil
+}
+
+// shadow compares the object at diskPath and its action record with the
+// copies in S3, in place of writing them, for ShadowMode. It returns "match"
+// if both are present and match, "missing" if either is not found, or
+// "differ" if either has different contents.
+func (s *S3Cache) shadow(ctx context.Context, obj gocache.Object, diskPath, etag string) (string, error) {
+	sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.uploadTimeout())
+	defer cancel()
+
+	s.shadowCheck.Add(1)
+	rec, err := s.readAction(sctx, obj.ActionID)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.shadowMiss.Add(1)
+		s.logf(ctx, slog.LevelInfo, "shadow action %s: not found in S3", obj.ActionID)
+		return "missing", nil
+	} else if err != nil {
+		s.shadowError.Add(1)
+		s.logf(ctx, slog.LevelWarn, "shadow action %s: %v", obj.ActionID, err)
+		return "", err
+	}
+	if rec.outputID != obj.OutputID {
+		s.shadowDiffer.Add(1)
+		s.logf(ctx, slog.LevelWarn, "shadow action %s: local output %s, S3 output %s",
+			obj.ActionID, obj.OutputID, rec.outputID)
+		return "differ", nil
+	}
+	if rec.body != nil {
+		// A combined record holds the object itself.
+		if fmt.Sprintf("%x", md5.Sum(rec.body)) != etag {
+			s.shadowDiffer.Add(1)
+			s.logf(ctx, slog.LevelWarn, "shadow action %s: object %s differs from S3", obj.ActionID, obj.OutputID)
+			return "differ", nil
+		}
+		return "match", nil
+	}
+
+	f, err := os.Open(diskPath)
+	if err != nil {
+		s.shadowError.Add(1)
+		s.logf(ctx, slog.LevelWarn, "[s3] open local object %s: %v", obj.OutputID, err)
+		return "", err
+	}
+	defer f.Close()
+	exists, match, err := s.client(obj.OutputID).Match(sctx, s.outputKey(obj.OutputID), etag, f)
+	if err != nil {
+		s.shadowError.Add(1)
+		s.logf(ctx, slog.LevelWarn, "shadow action %s: [s3] check object %s: %v", obj.ActionID, obj.OutputID, err)
+		return "", err
+	} else if !exists {
+		s.shadowMiss.Add(1)
+		s.logf(ctx, slog.LevelInfo, "shadow action %s: object %s not found in S3", obj.ActionID, obj.OutputID)
+		return "missing", nil
+	} else if !match {
+		s.shadowDiffer.Add(1)
+		s.logf(ctx, slog.LevelWarn, "shadow action %s: object %s differs from S3", obj.ActionID, obj.OutputID)
+		return "differ", nil
+	}
+	return "match", nil
+}
+
+// putCombinedRecord writes the object at diskPath to S3 embedded in a
+// combined action record for obj.
+func (s *S3Cache) putCombinedRecord(ctx context.Context, obj gocache.Object, diskPath string, meta map[string]string) error {
+	data, err := os.ReadFile(diskPath)
+	if err != nil {
+		s.logf(ctx, slog.LevelWarn, "[s3] read local object %s: %v", obj.OutputID, err)
+		return err
+	}
+	fi, err := os.Stat(diskPath)
+	if err != nil {
+		return err
+	}
+	rec := actionRecord{outputID: obj.OutputID, created: fi.ModTime(), accessed: time.Now(), body: data}
+	if err := s.client(obj.ActionID).PutMeta(ctx, s.actionKey(obj.ActionID),
+		bytes.NewReader(rec.formatCombined()), meta); err != nil {
+		s.logf(ctx, slog.LevelWarn, "write action %s: %v", obj.ActionID, err)
+		return err
+	}
+	s.putS3Action.Add(1)
+	s.putCombined.Add(1)
+	return nil
+}
+
+// onProvenance calls the OnProvenance hook, if it is defined and meta is not
+// empty.
+func (s *S3Cache) onProvenance(actionID string, meta map[string]string) {
+	if _, ok := meta[digestMetaKey]; ok {
+		meta = maps.Clone(meta)
+		delete(meta, digestMetaKey) // not provenance
+	}
+	if s.OnProvenance != nil && len(meta) != 0 {
+		s.OnProvenance(actionID, meta)
+	}
+}
+
+// onPut calls the OnPut hook, if it is defined.
+func (s *S3Cache) onPut(obj gocache.Object, uploaded bool, err error) {
+	if s.OnPut != nil {
+		obj.Body = nil
+		s.OnPut(obj, uploaded, err)
+	}
+}
+
+// Flush waits for the background tasks that are pending when it is called,
+// including uploads to S3, to complete. Tasks started after Flush is called
+// are not waited for, so Flush can be used as a barrier while the cache
+// continues to handle requests. If ctx ends before the tasks complete, Flush
+// reports the error from ctx. Otherwise, Flush reports the first error from
+// any of the tasks it waited for, or nil.
+func (s *S3Cache) Flush(ctx context.Context) error {
+	s.pmu.Lock()
+	tasks := make([]*pendingTask, 0, len(s.pending))
+	for t := range s.pending {
+		tasks = append(tasks, t)
+	}
+	s.pmu.Unlock()
+
+	var first error
+	for _, t := range tasks {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.done:
+			if first == nil {
+				first = t.err
+			}
+		}
+	}
+	return first
+}
+
+// A pendingTask records the completion of a background task, for Flush.
+type pendingTask struct {
+	done chan struct{} // closed when the task is complete
+	err  error         // the result of the task, valid after done is closed
+}
+
+// track records task as pending, and returns a task that runs task and then
+// records its completion.
+func (s *S3Cache) track(task taskgroup.Task) taskgroup.Task {
+	t := &pendingTask{done: make(chan struct{})}
+	s.pmu.Lock()
+	if s.pending == nil {
+		s.pending = make(map[*pendingTask]struct{})
+	}
+	s.pending[t] = struct{}{}
+	s.pmu.Unlock()
+
+	return func() error {
+		t.err = task()
+		s.pmu.Lock()
+		delete(s.pending, t)
+		s.pmu.Unlock()
+		close(t.done)
+		return t.err
+	}
+}
+
 // Close implements the corresponding callback of the cache protocol.
 func (s *S3Cache) Close(ctx context.Context) error {
 	if s.push != nil {
-		gocache.Logf(ctx, "waiting for uploads...")
+		s.logf(ctx, slog.LevelInfo, "waiting for uploads...")
 		wstart := time.Now()
 		s.push.Wait()
-		gocache.Logf(ctx, "uploads complete (%v elapsed)", time.Since(wstart).Round(10*time.Microsecond))
+		s.logf(ctx, slog.LevelInfo, "uploads complete (%v elapsed)", time.Since(wstart).Round(10*time.Microsecond))
 	}
-	return nil
+	if s.mem != nil {
+		s.mem.Clear() // local objects may be removed below, or by cleanup
+	}
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+	for _, path := range s.temp {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.logf(ctx, slog.LevelWarn, "remove temporary object: %v (ignored)", err)
+		}
+	}
+	s.temp = nil
+
+	if !s.closeExclusive(ctx) {
+		s.closeShared.Add(1)
+		s.logf(ctx, slog.LevelInfo, "local directory is in use; left %d objects for its last user to remove",
+			len(s.transient)+len(s.uploaded))
+		s.transient, s.uploaded = nil, nil
+		return nil
+	}
+	for _, path := range s.transient {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.logf(ctx, slog.LevelWarn, "remove large object: %v (ignored)", err)
+		}
+	}
+	if len(s.transient) != 0 {
+		s.logf(ctx, slog.LevelInfo, "removed %d large objects", len(s.transient))
+	}
+	s.transient = nil
+
+	var ndrop int64
+	for _, path := range s.uploaded {
+		if err := os.Remove(path); err == nil {
+			ndrop++
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			s.logf(ctx, slog.LevelWarn, "remove uploaded object: %v (ignored)", err)
+		}
+	}
+	if ndrop != 0 {
+		s.dropLocal.Add(ndrop)
+		s.logf(ctx, slog.LevelInfo, "removed %d uploaded objects", ndrop)
+	}
+	s.uploaded = nil
+	s.removePending(ctx)
+
+	var err error
+	if s.Cleanup != nil {
+		err = s.Cleanup(ctx)
+	}
+	return errors.Join(err, s.unlock())
+}
+
+// closeExclusive reports whether s may remove files from the local directory
+// when it is closed, that is, whether LockFile is unset or no other process
+// holds a lock on it. If it returns false, s no longer holds its lock.
+// The caller must hold s.tmu.
+func (s *S3Cache) closeExclusive(ctx context.Context) bool {
+	if s.LockFile == "" {
+		return true
+	} else if s.lock == nil && s.lockErr == nil {
+		// The cache was not used, or was closed already.
+		s.lock, s.lockErr = openDirLock(s.LockFile)
+	}
+	if s.lockErr != nil {
+		s.logf(ctx, slog.LevelWarn, "lock %s: %v", s.LockFile, s.lockErr)
+		return false
+	}
+
+	// Record the objects to remove while s still holds its shared lock, since
+	// a failed attempt to upgrade the lock releases it. If s does obtain the
+	// exclusive lock, it removes them itself.
+	if err := s.recordPending(); err != nil {
+		s.logf(ctx, slog.LevelWarn, "record objects to remove: %v (ignored)", err)
+	}
+	ok := s.lock.tryExclusive()
+	if !ok {
+		s.unlock()
+	}
+	return ok
+}
+
+// pendingPath returns the path of the file listing objects in the local
+// directory that are to be removed by the next process to close the cache
+// with an exclusive lock on LockFile.
+func (s *S3Cache) pendingPath() string { return s.LockFile + ".remove" }
+
+// recordPending appends the paths of the transient and uploaded objects of s
+// to the pending file. The caller must hold s.tmu and a lock on LockFile.
+func (s *S3Cache) recordPending() error {
+	if len(s.transient)+len(s.uploaded) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, path := range slices.Concat(s.transient, s.uploaded) {
+		buf.WriteString(path)
+		buf.WriteByte('\n')
+	}
+	f, err := os.OpenFile(s.pendingPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, werr := f.Write(buf.Bytes())
+	return errors.Join(werr, f.Close())
+}
+
+// removePending removes the objects listed in the pending file, then the
+// file itself. The caller must hold s.tmu and the exclusive lock on LockFile.
+func (s *S3Cache) removePending(ctx context.Context) {
+	if s.LockFile == "" {
+		return
+	}
+	data, err := os.ReadFile(s.pendingPath())
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			s.logf(ctx, slog.LevelWarn, "read objects to remove: %v (ignored)", err)
+		}
+		return
+	}
+	var nrm int
+	for _, path := range strings.Split(string(data), "\n") {
+		if path == "" {
+			continue
+		} else if err := os.Remove(path); err == nil {
+			nrm++
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			s.logf(ctx, slog.LevelWarn, "remove object: %v (ignored)", err)
+		}
+	}
+	if nrm != 0 {
+		s.logf(ctx, slog.LevelInfo, "removed %d objects left by other processes", nrm)
+	}
+	if err := os.Remove(s.pendingPath()); err != nil {
+		s.logf(ctx, slog.LevelWarn, "remove %s: %v (ignored)", s.pendingPath(), err)
+	}
+}
+
+// unlock releases the lock on LockFile, if s holds one.
+// The caller must hold s.tmu.
+func (s *S3Cache) unlock() error {
+	if s.lock == nil {
+		return nil
+	}
+	err := s.lock.Close()
+	s.lock = nil
+	return err
 }
 
 // SetMetrics implements the corresponding server callback.
 func (s *S3Cache) SetMetrics(_ context.Context, m *expvar.Map) {
-	m.Set("get_local_hit", &s.getLocalHit)
-	m.Set("get_fault_hit", &s.getFaultHit)
-	m.Set("get_fault_miss", &s.getFaultMiss)
-	m.Set("put_skip_small", &s.putSkipSmall)
-	m.Set("put_s3_found", &s.putS3Found)
-	m.Set("put_s3_action", &s.putS3Action)
-	m.Set("put_s3_object", &s.putS3Object)
-	m.Set("put_s3_error", &s.putS3Error)
+	for _, c := range s.counters() {
+		m.Set(c.name, c.value)
+	}
+}
+
+// ResetMetrics sets all the metrics counters for s to zero.
+//
+// Each counter is reset atomically, but the counters are not reset together:
+// Updates made concurrently with a reset may be reflected in some counters
+// and not others. For a consistent reading, reset while the cache is idle.
+func (s *S3Cache) ResetMetrics() {
+	for _, c := range s.counters() {
+		c.value.Set(0)
+	}
+}
+
+type counter struct {
+	name  string
+	value *expvar.Int
+}
+
+// counters returns the metrics counters for s, with their exported names.
+func (s *S3Cache) counters() []counter {
+	return []counter{
+		{"get_local_hit", &s.getLocalHit},
+		{"get_fault_hit", &s.getFaultHit},
+		{"get_fault_miss", &s.getFaultMiss},
+		{"put_skip_small", &s.putSkipSmall},
+		{"put_skip_large", &s.putSkipLarge},
+		{"put_s3_found", &s.putS3Found},
+		{"put_s3_action", &s.putS3Action},
+		{"put_s3_object", &s.putS3Object},
+		{"put_s3_error", &s.putS3Error},
+		{"get_transient", &s.getTransient},
+		{"prefetch_hit", &s.prefetchHit},
+		{"put_transient", &s.putTransient},
+		{"refresh_hit", &s.refreshHit},
+		{"refresh_error", &s.refreshError},
+		{"drop_local", &s.dropLocal},
+		{"audit_check", &s.auditCheck},
+		{"audit_missing", &s.auditMissing},
+		{"audit_differ", &s.auditDiffer},
+		{"audit_error", &s.auditError},
+		{"mem_hit", &s.memHit},
+		{"mem_miss", &s.memMiss},
+		{"get_dangling", &s.getDangling},
+		{"get_combined", &s.getCombined},
+		{"put_combined", &s.putCombined},
+		{"put_paced", &s.putPaced},
+		{"get_verified", &s.getVerified},
+		{"get_no_digest", &s.getNoDigest},
+		{"get_bad_digest", &s.getBadDigest},
+		{"shadow_check", &s.shadowCheck},
+		{"shadow_miss", &s.shadowMiss},
+		{"shadow_differ", &s.shadowDiffer},
+		{"shadow_error", &s.shadowError},
+		{"close_shared", &s.closeShared},
+	}
 }
 
 // maybePutObject writes the specified object contents to S3 if there is not
 // already a matching key with the same etag. It returns the modified time of
 // the object file, whether or not it was sent to S3.
-func (s *S3Cache) maybePutObject(ctx context.Context, outputID, diskPath, etag string) (time.Time, error) {
+func (s *S3Cache) maybePutObject(ctx context.Context, outputID, diskPath, etag string, meta map[string]string) (time.Time, error) {
 	f, err := os.Open(diskPath)
 	if err != nil {
-		gocache.Logf(ctx, "[s3] open local object %s: %v", outputID, err)
+		s.logf(ctx, slog.LevelWarn, "[s3] open local object %s: %v", outputID, err)
 		return time.Time{}, err
 	}
 	defer f.Close()
@@ -224,10 +1519,10 @@ func (s *S3Cache) maybePutObject(ctx context.Context, outputID, diskPath, etag s
 		return time.Time{}, err
 	}
 
-	written, err := s.S3Client.PutCond(ctx, s.outputKey(outputID), etag, f)
+	written, err := s.client(outputID).PutCondMeta(ctx, s.outputKey(outputID), etag, f, meta)
 	if err != nil {
 		s.putS3Error.Add(1)
-		gocache.Logf(ctx, "[s3] put object %s: %v", outputID, err)
+		s.logf(ctx, slog.LevelWarn, "[s3] put object %s: %v", outputID, err)
 		return fi.ModTime(), err
 	}
 	if written {
@@ -238,14 +1533,183 @@ func (s *S3Cache) maybePutObject(ctx context.Context, outputID, diskPath, etag s
 	return fi.ModTime(), nil
 }
 
+// client returns the S3 client for the entry with the specified ID, which
+// is S3Client unless Shards is set.
+func (s *S3Cache) client(id string) *s3util.Client {
+	if len(s.Shards) == 0 {
+		return s.S3Client
+	}
+	h := fnv.New32a()
+	io.WriteString(h, id)
+	if i := int(h.Sum32() % uint32(len(s.Shards)+1)); i > 0 {
+		return s.Shards[i-1]
+	}
+	return s.S3Client
+}
+
 // makeKey assembles a complete key from the specified parts, including the key
 // prefix if one is defined.
 func (s *S3Cache) makeKey(parts ...string) string {
 	return path.Join(s.KeyPrefix, path.Join(parts...))
 }
 
-func (s *S3Cache) actionKey(id string) string { return s.makeKey("action", id[:2], id) }
-func (s *S3Cache) outputKey(id string) string { return s.makeKey("output", id[:2], id) }
+func (s *S3Cache) actionKey(id string) string { return s.entryKey("action", id) }
+func (s *S3Cache) outputKey(id string) string { return s.entryKey("output", id) }
+
+// entryKey returns the complete key for the entry of the given kind and ID,
+// using KeyFunc if it is set, or otherwise the default layout.
+func (s *S3Cache) entryKey(kind, id string) string {
+	if s.KeyFunc != nil {
+		return s.makeKey(s.KeyFunc(kind, id))
+	}
+	return s.makeKey(s.DefaultKey(kind, id))
+}
+
+// DefaultKey returns the key within KeyPrefix of the entry of the given kind
+// ("action" or "output") and ID in the default layout, "<kind>/<xx>/<id>",
+// where the partition "<xx>" is determined by PartitionBytes.
+func (s *S3Cache) DefaultKey(kind, id string) string {
+	return path.Join(kind, s.partition(id), id)
+}
+
+// maxPartitionBytes is the largest supported value of PartitionBytes.
+const maxPartitionBytes = 4
+
+// partition returns the prefix of id used to partition its S3 key.
+func (s *S3Cache) partition(id string) string {
+	n := 2 * s.partitionBytes()
+	return id[:min(n, len(id))]
+}
+
+func (s *S3Cache) partitionBytes() int { return min(max(s.PartitionBytes, 1), maxPartitionBytes) }
+
+// CheckPartition reports an error if the action records already stored in S3
+// under KeyPrefix are partitioned by a different number of bytes than
+// PartitionBytes specifies, since the cache would not find those entries. It
+// examines one action key in each bucket, and reports nil if there are none.
+// It does nothing if S3Client is nil or KeyFunc is set.
+func (s *S3Cache) CheckPartition(ctx context.Context) error {
+	if s.S3Client == nil || s.KeyFunc != nil {
+		return nil
+	}
+	want := s.partitionBytes()
+	prefix := s.makeKey("action") + "/"
+	for _, c := range append([]*s3util.Client{s.S3Client}, s.Shards...) {
+		var found string
+		errFound := errors.New("found")
+		err := c.List(ctx, prefix, func(key string) error {
+			found = key
+			return errFound
+		})
+		if err != nil && !errors.Is(err, errFound) {
+			return fmt.Errorf("list %s: %w", prefix, err)
+		} else if found == "" {
+			continue // no entries here yet
+		}
+		part, _, ok := strings.Cut(strings.TrimPrefix(found, prefix), "/")
+		if ok && len(part) != 2*want {
+			return fmt.Errorf("existing key %q is partitioned by %d bytes, but PartitionBytes is %d",
+				found, len(part)/2, want)
+		}
+	}
+	return nil
+}
+
+// isTransient reports whether an object of the given size should not be kept
+// in the local cache.
+func (s *S3Cache) isTransient(size int64) bool {
+	return s.MaxLocalObjectBytes > 0 && size > s.MaxLocalObjectBytes
+}
+
+// addTransient records that path should be removed when the cache is closed.
+func (s *S3Cache) addTransient(path string) {
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+	s.transient = append(s.transient, path)
+}
+
+// addUploaded records that the uploaded object at path should be removed when
+// the cache is closed.
+func (s *S3Cache) addUploaded(path string) {
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+	s.uploaded = append(s.uploaded, path)
+}
+
+// writeTransient writes data to a temporary file that will be removed when
+// the cache is closed, and returns the path of the file.
+func (s *S3Cache) writeTransient(data []byte, mtime time.Time) (string, error) {
+	f, err := os.CreateTemp("", "gobuild-object-*")
+	if err != nil {
+		return "", err
+	}
+	s.tmu.Lock()
+	s.temp = append(s.temp, f.Name())
+	s.tmu.Unlock()
+	_, werr := f.Write(data)
+	cerr := f.Close()
+	if err := errors.Join(werr, cerr); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(f.Name(), cmp.Or(s.FileMode, 0644)); err != nil {
+		return "", err
+	}
+	if !mtime.IsZero() {
+		os.Chtimes(f.Name(), time.Time{}, mtime) // best-effort
+	}
+	return f.Name(), nil
+}
+
+// setModes applies the configured DirMode and FileMode, if any, to the action
+// and object files in the local cache for the specified action, along with
+// their enclosing directories. The object is stored at diskPath.
+func (s *S3Cache) setModes(actionID, diskPath string) error {
+	if s.DirMode == 0 && s.FileMode == 0 {
+		return nil
+	}
+
+	// The local cache stores objects as <root>/output/<xx>/<id>, and actions
+	// as <root>/action/<xx>/<id>.
+	root := filepath.Dir(filepath.Dir(filepath.Dir(diskPath)))
+	actionPath := filepath.Join(root, "action", actionID[:2], actionID)
+	for _, path := range []string{diskPath, actionPath} {
+		if s.FileMode != 0 {
+			if err := os.Chmod(path, s.FileMode); err != nil {
+				return err
+			}
+		}
+		if s.DirMode != 0 {
+			dir := filepath.Dir(path)
+			for _, d := range []string{dir, filepath.Dir(dir)} {
+				if err := os.Chmod(d, s.DirMode); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *S3Cache) refreshInterval() time.Duration {
+	if s.RefreshInterval <= 0 {
+		return 24 * time.Hour
+	}
+	return s.RefreshInterval
+}
+
+func (s *S3Cache) uploadTimeout() time.Duration {
+	if s.UploadTimeout <= 0 {
+		return 1 * time.Minute
+	}
+	return s.UploadTimeout
+}
+
+func (s *S3Cache) combinedMaxObject() int64 {
+	if s.CombinedMaxObject <= 0 {
+		return 64 << 10
+	}
+	return s.CombinedMaxObject
+}
 
 func (s *S3Cache) uploadConcurrency() int {
 	if s.UploadConcurrency <= 0 {
@@ -254,14 +1718,89 @@ func (s *S3Cache) uploadConcurrency() int {
 	return s.UploadConcurrency
 }
 
-func parseAction(data []byte) (outputID string, mtime time.Time, _ error) {
+// actionRecord is the decoded content of an action record.
+type actionRecord struct {
+	outputID string
+	created  time.Time         // when the object was written
+	accessed time.Time         // when the action was last written or refreshed
+	meta     map[string]string // S3 user metadata of the record (not encoded)
+	body     []byte            // the embedded object of a combined record, or nil
+}
+
+// format encodes r as an action record. If v2 is true, it uses the v2 format;
+// otherwise it uses the original format, which records only the created time.
+// See "Remote Cache Layout" in the documentation of [S3Cache].
+func (r actionRecord) format(v2 bool) string {
+	if v2 {
+		return fmt.Sprintf("v2 %s %d %d", r.outputID, r.created.UnixNano(), r.accessed.UnixNano())
+	}
+	return fmt.Sprintf("%s %d", r.outputID, r.created.UnixNano())
+}
+
+// formatCombined encodes r as a combined (v3) action record, embedding r.body.
+// See "Remote Cache Layout" in the documentation of [S3Cache].
+func (r actionRecord) formatCombined() []byte {
+	hdr := fmt.Sprintf("v3 %s %d %d %d\n", r.outputID, r.created.UnixNano(), r.accessed.UnixNano(), len(r.body))
+	return append([]byte(hdr), r.body...)
+}
+
+// parseAction decodes an action record in any format. For a record in the
+// original format, the accessed time is the same as the created time.
+func parseAction(data []byte) (actionRecord, error) {
+	if bytes.HasPrefix(data, []byte("v3 ")) {
+		return parseCombined(data)
+	}
 	fs := strings.Fields(string(data))
-	if len(fs) != 2 {
-		return "", time.Time{}, errors.New("invalid action record")
+	switch {
+	case len(fs) == 2:
+		ts, err := parseTimestamp(fs[1])
+		if err != nil {
+			return actionRecord{}, err
+		}
+		return actionRecord{outputID: fs[0], created: ts, accessed: ts}, nil
+	case len(fs) == 4 && fs[0] == "v2":
+		created, err := parseTimestamp(fs[2])
+		if err != nil {
+			return actionRecord{}, err
+		}
+		accessed, err := parseTimestamp(fs[3])
+		if err != nil {
+			return actionRecord{}, err
+		}
+		return actionRecord{outputID: fs[1], created: created, accessed: accessed}, nil
+	default:
+		return actionRecord{}, errors.New("invalid action record")
+	}
+}
+
+// parseCombined decodes a combined (v3) action record, including its embedded
+// object. The body of the result is non-nil even if the object is empty.
+func parseCombined(data []byte) (actionRecord, error) {
+	hdr, body, ok := bytes.Cut(data, []byte("\n"))
+	fs := strings.Fields(string(hdr))
+	if !ok || len(fs) != 5 {
+		return actionRecord{}, errors.New("invalid action record")
+	}
+	created, err := parseTimestamp(fs[2])
+	if err != nil {
+		return actionRecord{}, err
 	}
-	ts, err := strconv.ParseInt(fs[1], 10, 64)
+	accessed, err := parseTimestamp(fs[3])
+	if err != nil {
+		return actionRecord{}, err
+	}
+	size, err := strconv.Atoi(fs[4])
+	if err != nil || size != len(body) {
+		return actionRecord{}, fmt.Errorf("invalid action record: object has %d bytes, want %s", len(body), fs[4])
+	}
+	return actionRecord{outputID: fs[1], created: created, accessed: accessed, body: body}, nil
+}
+
+// parseTimestamp decodes a timestamp in Unix nanoseconds.
+func parseTimestamp(s string) (time.Time, error) {
+	ts, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
-		return "", time.Time{}, fmt.Errorf("invalid timestamp: %w", err)
+		return time.Time{}, fmt.Errorf("invalid timestamp: %w", err)
 	}
-	return fs[0], time.Unix(ts/1e9, ts%1e9), nil
+	return time.Unix(ts/1e9, ts%1e9), nil
 }
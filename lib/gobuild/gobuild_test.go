@@ -0,0 +1,1889 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/tailscale/go-cache-plugin/lib/s3util"
+)
+
+// fakeS3 is a minimal in-memory implementation of the S3 object API, for use
+// as a backing store in tests. It records the number of requests it receives,
+// and the maximum number of requests in flight at once.
+type fakeS3 struct {
+	delay time.Duration // if positive, delay each request this long
+
+	mu          sync.Mutex
+	data        map[string][]byte
+	meta        map[string]http.Header // x-amz-meta-* headers, by path
+	numRequests int
+	numCopies   int
+	inFlight    int
+	maxInFlight int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.numRequests++
+	f.inFlight++
+	f.maxInFlight = max(f.maxInFlight, f.inFlight)
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.inFlight--
+		f.mu.Unlock()
+	}()
+	time.Sleep(f.delay)
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if r.URL.Query().Get("list-type") == "2" {
+			f.list(w, r)
+			return
+		}
+		data, ok := f.get(r.URL.Path)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		f.mu.Lock()
+		for name, vals := range f.meta[r.URL.Path] {
+			w.Header()[name] = vals
+		}
+		f.mu.Unlock()
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(data)))
+		w.Write(data)
+	case "PUT":
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			data, ok := f.get("/" + strings.TrimPrefix(src, "/"))
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+				return
+			}
+			f.set(r.URL.Path, data)
+			f.setMeta(r.URL.Path, r.Header)
+			f.mu.Lock()
+			f.numCopies++
+			f.mu.Unlock()
+			io.WriteString(w, `<CopyObjectResult></CopyObjectResult>`)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.set(r.URL.Path, data)
+		f.setMeta(r.URL.Path, r.Header)
+	case "DELETE":
+		f.mu.Lock()
+		delete(f.data, r.URL.Path)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+// list serves a single page listing the keys in the bucket of r matching
+// the requested prefix.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	bucket := strings.TrimSuffix(r.URL.Path, "/") + "/"
+	prefix := bucket + r.URL.Query().Get("prefix")
+	f.mu.Lock()
+	var keys []string
+	for path := range f.data {
+		if strings.HasPrefix(path, prefix) {
+			keys = append(keys, strings.TrimPrefix(path, bucket))
+		}
+	}
+	f.mu.Unlock()
+	slices.Sort(keys)
+
+	var buf strings.Builder
+	buf.WriteString("<ListBucketResult>")
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "<Contents><Key>%s</Key></Contents>", key)
+	}
+	buf.WriteString("</ListBucketResult>")
+	io.WriteString(w, buf.String())
+}
+
+func (f *fakeS3) get(path string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.data[path]
+	return data, ok
+}
+
+func (f *fakeS3) set(path string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.data == nil {
+		f.data = make(map[string][]byte)
+	}
+	f.data[path] = data
+}
+
+// setMeta records the user metadata headers of h for path, replacing any
+// previous metadata.
+func (f *fakeS3) setMeta(path string, h http.Header) {
+	meta := make(http.Header)
+	for name, vals := range h {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			meta[name] = vals
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.meta == nil {
+		f.meta = make(map[string]http.Header)
+	}
+	f.meta[path] = meta
+}
+
+// getMeta returns the value of the user metadata key for path.
+func (f *fakeS3) getMeta(path, key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.meta[path].Get("X-Amz-Meta-" + key)
+}
+
+func (f *fakeS3) requests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.numRequests
+}
+
+// newTestCache returns an S3Cache using a temporary local directory, and
+// backed by the given fake S3 service.
+func newTestCache(t *testing.T, f *fakeS3) *S3Cache {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	dir, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("Create local cache: %v", err)
+	}
+	return &S3Cache{
+		Local: dir,
+		S3Client: &s3util.Client{
+			Client: s3.New(s3.Options{
+				BaseEndpoint: aws.String(srv.URL),
+				Region:       "us-east-1",
+				UsePathStyle: true,
+				Credentials:  aws.AnonymousCredentials{},
+			}),
+			Bucket: "test-bucket",
+		},
+	}
+}
+
+func hexID(s string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(s))) }
+
+// addRemote adds an action and its object to the fake S3 store.
+func addRemote(f *fakeS3, actionID, content string) {
+	addRemoteAt(f, actionID, content, time.Now())
+}
+
+// addRemoteAt adds an action and its object to the fake S3 store, with the
+// action timestamp set to mtime.
+func addRemoteAt(f *fakeS3, actionID, content string, mtime time.Time) {
+	outputID := hexID(content)
+	f.set("/test-bucket/action/"+actionID[:2]+"/"+actionID,
+		[]byte(fmt.Sprintf("%s %d", outputID, mtime.UnixNano())))
+	f.set("/test-bucket/output/"+outputID[:2]+"/"+outputID, []byte(content))
+}
+
+func TestPrefetch(t *testing.T) {
+	const numActions = 8
+	f := &fakeS3{delay: 10 * time.Millisecond}
+	c := newTestCache(t, f)
+	c.UploadConcurrency = numActions
+	ctx := context.Background()
+
+	var ids []string
+	for i := range numActions {
+		id := hexID(fmt.Sprintf("action %d", i))
+		addRemote(f, id, fmt.Sprintf("object %d", i))
+		ids = append(ids, id)
+	}
+	ids = append(ids, hexID("missing action"))
+
+	n, err := c.Prefetch(ctx, ids)
+	if err != nil {
+		t.Fatalf("Prefetch: unexpected error: %v", err)
+	} else if n != numActions {
+		t.Errorf("Prefetch: got %d actions, want %d", n, numActions)
+	}
+
+	// Each action present requires two reads, plus one for the missing action.
+	if got, want := f.requests(), 2*numActions+1; got != want {
+		t.Errorf("Got %d S3 requests, want %d", got, want)
+	}
+	if f.maxInFlight < 2 {
+		t.Errorf("Got at most %d requests in flight, want concurrency", f.maxInFlight)
+	}
+	t.Logf("Max requests in flight: %d", f.maxInFlight)
+
+	// After prefetching, all the actions should be served locally.
+	before := f.requests()
+	for i, id := range ids[:numActions] {
+		outputID, diskPath, err := c.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("Get %d: unexpected error: %v", i, err)
+		} else if want := hexID(fmt.Sprintf("object %d", i)); outputID != want || diskPath == "" {
+			t.Errorf("Get %d: got (%q, %q), want (%q, <path>)", i, outputID, diskPath, want)
+		}
+	}
+	if got := f.requests(); got != before {
+		t.Errorf("Get after prefetch made %d S3 requests, want 0", got-before)
+	}
+	if got := c.getLocalHit.Value(); got != numActions {
+		t.Errorf("Got %d local hits, want %d", got, numActions)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var gets []GetResult
+	var puts []bool
+	c.OnGet = func(_ string, r GetResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		gets = append(gets, r)
+	}
+	c.OnPut = func(obj gocache.Object, uploaded bool, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			t.Errorf("OnPut %s: unexpected error: %v", obj.ActionID, err)
+		}
+		puts = append(puts, uploaded)
+	}
+
+	const content = "hello, world"
+	actionID := hexID("hooks action")
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: actionID,
+		OutputID: hexID(content),
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	c.Get(ctx, actionID)
+	c.Get(ctx, hexID("unknown action"))
+	addRemote(f, hexID("remote action"), "remote content")
+	c.Get(ctx, hexID("remote action"))
+
+	if want := []bool{true}; !slices.Equal(puts, want) {
+		t.Errorf("OnPut results: got %v, want %v", puts, want)
+	}
+	if want := []GetResult{GetLocalHit, GetMiss, GetFaultHit}; !slices.Equal(gets, want) {
+		t.Errorf("OnGet results: got %v, want %v", gets, want)
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	f := &fakeS3{delay: 5 * time.Millisecond}
+	c := newTestCache(t, f)
+	c.UploadConcurrency = 4
+	ctx := context.Background()
+
+	// One action stored locally, several remotely, and one missing.
+	const localContent = "local content"
+	localID := hexID("local action")
+	if _, err := c.Local.Put(ctx, gocache.Object{
+		ActionID: localID,
+		OutputID: hexID(localContent),
+		Size:     int64(len(localContent)),
+		Body:     strings.NewReader(localContent),
+	}); err != nil {
+		t.Fatalf("Local put: %v", err)
+	}
+	ids := []string{localID}
+	want := []string{hexID(localContent)}
+	for i := range 4 {
+		id, content := hexID(fmt.Sprintf("remote %d", i)), fmt.Sprintf("remote content %d", i)
+		addRemote(f, id, content)
+		ids = append(ids, id)
+		want = append(want, hexID(content))
+	}
+	ids = append(ids, hexID("missing"))
+	want = append(want, "")
+
+	got, err := c.GetMulti(ctx, ids)
+	if err != nil {
+		t.Fatalf("GetMulti: unexpected error: %v", err)
+	}
+	if len(got) != len(ids) {
+		t.Fatalf("GetMulti: got %d results, want %d", len(got), len(ids))
+	}
+	for i, r := range got {
+		if r.OutputID != want[i] {
+			t.Errorf("Result %d: got output %q, want %q", i, r.OutputID, want[i])
+		}
+		if (r.DiskPath != "") != (want[i] != "") {
+			t.Errorf("Result %d: got path %q, want present=%v", i, r.DiskPath, want[i] != "")
+		}
+	}
+
+	// The local hit should not have touched S3: One read for each remote
+	// action and its object, and one read for the missing action.
+	if got, want := f.requests(), 2*4+1; got != want {
+		t.Errorf("Got %d S3 requests, want %d", got, want)
+	}
+	if got := c.getFaultHit.Value(); got != 4 {
+		t.Errorf("Got %d fault hits, want 4", got)
+	}
+}
+
+func TestRefreshOnHit(t *testing.T) {
+	f := &fakeS3{}
+	c := newTestCache(t, f)
+	c.RefreshOnHit = true
+	c.RefreshInterval = time.Hour
+	ctx := context.Background()
+
+	stale := hexID("stale action")
+	fresh := hexID("fresh action")
+	addRemoteAt(f, stale, "stale object", time.Now().Add(-2*time.Hour))
+	addRemote(f, fresh, "fresh object")
+
+	// Fault in both actions, then hit them again locally.
+	for range 3 {
+		for _, id := range []string{stale, fresh} {
+			if _, diskPath, err := c.Get(ctx, id); err != nil || diskPath == "" {
+				t.Fatalf("Get %s: got (%q, %v), want hit", id[:8], diskPath, err)
+			}
+		}
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+
+	// Only the stale action should have been refreshed, and only once.
+	if got := c.refreshHit.Value(); got != 1 {
+		t.Errorf("Refresh count: got %d, want 1", got)
+	}
+	if f.numCopies != 1 {
+		t.Errorf("Object copies: got %d, want 1", f.numCopies)
+	}
+	data, _ := f.get("/test-bucket/action/" + stale[:2] + "/" + stale)
+	rec, err := parseAction(data)
+	if err != nil {
+		t.Fatalf("Parse refreshed action: %v", err)
+	}
+	if age := time.Since(rec.created); age > time.Minute {
+		t.Errorf("Refreshed action timestamp is %v old, want recent", age)
+	}
+}
+
+func TestRefreshLocalMeta(t *testing.T) {
+	ctx := context.Background()
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	c.VerifyStrong = true
+	c.Provenance = map[string]string{"build-id": "b123"}
+
+	const content = "refreshed content"
+	id, outputID := hexID("refreshed"), hexID(content)
+	diskPath, err := c.Put(ctx, gocache.Object{
+		ActionID: id,
+		OutputID: outputID,
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	})
+	if err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+
+	// Age the local copy, so that a local hit triggers a refresh.
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(diskPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	c2 := newTestCache(t, f)
+	c2.Local = c.Local
+	c2.RefreshOnHit = true
+	c2.RefreshInterval = time.Hour
+	var got GetResult
+	c2.OnGet = func(_ string, r GetResult) { got = r }
+	if _, _, err := c2.Get(ctx, id); err != nil || got != GetLocalHit {
+		t.Fatalf("Get: got (%v, %v), want a local hit", got, err)
+	}
+	if err := c2.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if n := c2.refreshHit.Value(); n != 1 {
+		t.Fatalf("Refresh count: got %d, want 1", n)
+	}
+
+	// The refreshed object and action record keep their metadata.
+	for _, path := range []string{
+		"/test-bucket/action/" + id[:2] + "/" + id,
+		"/test-bucket/output/" + outputID[:2] + "/" + outputID,
+	} {
+		if got := f.getMeta(path, "build-id"); got != "b123" {
+			t.Errorf("Metadata for %s: got build-id %q, want b123", path, got)
+		}
+		if got := f.getMeta(path, digestMetaKey); got != outputID {
+			t.Errorf("Metadata for %s: got digest %q, want %q", path, got, outputID)
+		}
+	}
+}
+
+func TestRefreshPrune(t *testing.T) {
+	f := &fakeS3{}
+	c := newTestCache(t, f)
+	c.RefreshOnHit = true
+	c.RefreshInterval = 50 * time.Millisecond
+	ctx := context.Background()
+	defer c.Close(ctx)
+
+	old := time.Now().Add(-time.Hour)
+	first, second := hexID("first action"), hexID("second action")
+	addRemoteAt(f, first, "first object", old)
+	addRemoteAt(f, second, "second object", old)
+
+	get := func(id string) {
+		t.Helper()
+		if _, diskPath, err := c.Get(ctx, id); err != nil || diskPath == "" {
+			t.Fatalf("Get %s: got (%q, %v), want hit", id[:8], diskPath, err)
+		}
+	}
+	get(first)
+	time.Sleep(2 * c.RefreshInterval)
+	get(second)
+
+	// The record of the first refresh has expired, and is pruned.
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if _, ok := c.refreshed[first]; ok {
+		t.Error("Expired refresh was not pruned")
+	}
+	if _, ok := c.refreshed[second]; !ok {
+		t.Error("Recent refresh is missing")
+	}
+}
+
+func TestRecordAccessTime(t *testing.T) {
+	f := &fakeS3{}
+	c := newTestCache(t, f)
+	c.RefreshOnHit = true
+	c.RefreshInterval = time.Hour
+	c.RecordAccessTime = true
+	ctx := context.Background()
+
+	// An action in the original format is refreshed to the v2 format, keeping
+	// its timestamp as the creation time.
+	created := time.Unix(1700000000, 0)
+	stale := hexID("stale action")
+	addRemoteAt(f, stale, "stale object", created)
+	if _, diskPath, err := c.Get(ctx, stale); err != nil || diskPath == "" {
+		t.Fatalf("Get: got (%q, %v), want hit", diskPath, err)
+	}
+
+	// A newly written action is written in the v2 format.
+	const content = "new object"
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: hexID("new action"),
+		OutputID: hexID(content),
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+
+	for _, id := range []string{stale, hexID("new action")} {
+		data, _ := f.get("/test-bucket/action/" + id[:2] + "/" + id)
+		if !strings.HasPrefix(string(data), "v2 ") {
+			t.Errorf("Action %s: got %q, want v2 format", id[:8], data)
+		}
+		rec, err := parseAction(data)
+		if err != nil {
+			t.Fatalf("Parse action %s: %v", id[:8], err)
+		}
+		if age := time.Since(rec.accessed); age > time.Minute {
+			t.Errorf("Action %s: access time is %v old, want recent", id[:8], age)
+		}
+	}
+	data, _ := f.get("/test-bucket/action/" + stale[:2] + "/" + stale)
+	if rec, _ := parseAction(data); !rec.created.Equal(created) {
+		t.Errorf("Refreshed action: created %v, want %v", rec.created, created)
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	const id = "0123abcd"
+	t1, t2 := time.Unix(100, 5), time.Unix(200, 7)
+	for _, tc := range []struct {
+		input string
+		want  actionRecord
+		ok    bool
+	}{
+		{"0123abcd 100000000005", actionRecord{outputID: id, created: t1, accessed: t1}, true},
+		{"v2 0123abcd 100000000005 200000000007", actionRecord{outputID: id, created: t1, accessed: t2}, true},
+		{"v2 0123abcd 100000000005\n", actionRecord{}, false},
+		{"v3 0123abcd 100000000005 200000000007", actionRecord{}, false},
+		{"0123abcd bogus", actionRecord{}, false},
+		{"", actionRecord{}, false},
+	} {
+		got, err := parseAction([]byte(tc.input))
+		if (err == nil) != tc.ok {
+			t.Errorf("parseAction(%q): got err=%v, want ok=%v", tc.input, err, tc.ok)
+			continue
+		}
+		if got.outputID != tc.want.outputID || !got.created.Equal(tc.want.created) || !got.accessed.Equal(tc.want.accessed) {
+			t.Errorf("parseAction(%q): got %+v, want %+v", tc.input, got, tc.want)
+		}
+		if tc.ok {
+			v2 := strings.HasPrefix(tc.input, "v2 ")
+			if out := got.format(v2); out != tc.input {
+				t.Errorf("format(%v): got %q, want %q", v2, out, tc.input)
+			}
+		}
+	}
+}
+
+func TestParseCombined(t *testing.T) {
+	const id = "0123abcd"
+	t1, t2 := time.Unix(100, 5), time.Unix(200, 7)
+	for _, tc := range []struct {
+		input string
+		body  string
+		ok    bool
+	}{
+		{"v3 0123abcd 100000000005 200000000007 5\nhello", "hello", true},
+		{"v3 0123abcd 100000000005 200000000007 6\nline\n\n", "line\n\n", true},
+		{"v3 0123abcd 100000000005 200000000007 0\n", "", true},
+		{"v3 0123abcd 100000000005 200000000007 4\nhello", "", false}, // size mismatch
+		{"v3 0123abcd 100000000005 200000000007 5", "", false},        // missing body
+		{"v3 0123abcd 100000000005 5\nhello", "", false},              // missing timestamp
+		{"v3 0123abcd 100000000005 200000000007 x\nhello", "", false}, // bad size
+	} {
+		got, err := parseAction([]byte(tc.input))
+		if (err == nil) != tc.ok {
+			t.Errorf("parseAction(%q): got err=%v, want ok=%v", tc.input, err, tc.ok)
+			continue
+		} else if !tc.ok {
+			continue
+		}
+		if got.outputID != id || !got.created.Equal(t1) || !got.accessed.Equal(t2) {
+			t.Errorf("parseAction(%q): got %+v, want output %q at (%v, %v)", tc.input, got, id, t1, t2)
+		}
+		if got.body == nil || string(got.body) != tc.body {
+			t.Errorf("parseAction(%q): got body %q, want %q", tc.input, got.body, tc.body)
+		}
+		if out := string(got.formatCombined()); out != tc.input {
+			t.Errorf("formatCombined: got %q, want %q", out, tc.input)
+		}
+	}
+}
+
+func TestCombinedObjects(t *testing.T) {
+	ctx := context.Background()
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	c.CombinedObjects = true
+	c.CombinedMaxObject = 16
+
+	const small, large = "small content", "large content, too big to combine"
+	put := func(c *S3Cache, id, content string) {
+		t.Helper()
+		if _, err := c.Put(ctx, gocache.Object{
+			ActionID: id,
+			OutputID: hexID(content),
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+		}); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", content, err)
+		}
+	}
+	smallID, largeID := hexID("small"), hexID("large")
+	put(c, smallID, small)
+	put(c, largeID, large)
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if got := c.putCombined.Value(); got != 1 {
+		t.Errorf("Combined puts: got %d, want 1", got)
+	}
+
+	// The small object is embedded in its action record, and has no separate
+	// object file. The large object is stored separately.
+	objectKey := func(content string) string {
+		id := hexID(content)
+		return "/test-bucket/output/" + id[:2] + "/" + id
+	}
+	if data, ok := f.get("/test-bucket/action/" + smallID[:2] + "/" + smallID); !ok {
+		t.Error("Small action record not found")
+	} else if !strings.HasPrefix(string(data), "v3 ") || !strings.HasSuffix(string(data), "\n"+small) {
+		t.Errorf("Small action record: got %q, want combined record", data)
+	}
+	if _, ok := f.get(objectKey(small)); ok {
+		t.Error("Small object was stored separately")
+	}
+	if _, ok := f.get(objectKey(large)); !ok {
+		t.Error("Large object was not stored")
+	}
+
+	// A separate cache faults in both objects, with one read for the
+	// combined record, whether or not it writes combined records itself.
+	c2 := newTestCache(t, f)
+	for _, tc := range []struct {
+		id, want string
+	}{
+		{smallID, small},
+		{largeID, large},
+	} {
+		before := f.requests()
+		_, diskPath, err := c2.Get(ctx, tc.id)
+		if err != nil {
+			t.Fatalf("Get: unexpected error: %v", err)
+		}
+		if data, err := os.ReadFile(diskPath); err != nil || string(data) != tc.want {
+			t.Errorf("Get: got (%q, %v), want %q", data, err, tc.want)
+		}
+		wantReqs := 2
+		if tc.id == smallID {
+			wantReqs = 1
+		}
+		if got := f.requests() - before; got != wantReqs {
+			t.Errorf("Get %q: got %d S3 requests, want %d", tc.want, got, wantReqs)
+		}
+	}
+	if got := c2.getCombined.Value(); got != 1 {
+		t.Errorf("Combined gets: got %d, want 1", got)
+	}
+}
+
+func TestDanglingActions(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		policy     DanglingActionPolicy
+		wantErr    bool
+		wantAction bool // whether the action remains in S3
+	}{
+		{DanglingError, true, true},
+		{DanglingMiss, false, true},
+		{DanglingDelete, false, false},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			f := new(fakeS3)
+			c := newTestCache(t, f)
+			c.DanglingActions = tc.policy
+
+			// An action whose output object has gone missing.
+			id := hexID("dangling")
+			addRemote(f, id, "lost content")
+			outputID := hexID("lost content")
+			f.mu.Lock()
+			delete(f.data, "/test-bucket/output/"+outputID[:2]+"/"+outputID)
+			f.mu.Unlock()
+
+			objID, diskPath, err := c.Get(ctx, id)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("Get: got err=%v, want error %v", err, tc.wantErr)
+			}
+			if objID != "" || diskPath != "" {
+				t.Errorf("Get: got (%q, %q), want a miss", objID, diskPath)
+			}
+			if _, ok := f.get("/test-bucket/action/" + id[:2] + "/" + id); ok != tc.wantAction {
+				t.Errorf("Action present: got %v, want %v", ok, tc.wantAction)
+			}
+			if got := c.getDangling.Value(); got != 1 {
+				t.Errorf("Dangling actions: got %d, want 1", got)
+			}
+
+			n, err := c.Prefetch(ctx, []string{id})
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("Prefetch: got err=%v, want error %v", err, tc.wantErr)
+			}
+			if n != 0 {
+				t.Errorf("Prefetch: got %d, want 0", n)
+			}
+		})
+	}
+}
+
+func TestParseDanglingActionPolicy(t *testing.T) {
+	for _, p := range []DanglingActionPolicy{DanglingError, DanglingMiss, DanglingDelete} {
+		got, err := ParseDanglingActionPolicy(p.String())
+		if err != nil || got != p {
+			t.Errorf("Parse %q: got (%v, %v), want %v", p, got, err, p)
+		}
+	}
+	if got, err := ParseDanglingActionPolicy("bogus"); err == nil {
+		t.Errorf("Parse bogus: got %v, want error", got)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	ctx := context.Background()
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	c.Provenance = map[string]string{"build-id": "b123", "host": "builder-1"}
+
+	const content = "provenance content"
+	id, outputID := hexID("provenance"), hexID(content)
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: id,
+		OutputID: outputID,
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+
+	// The object and its action record carry the provenance metadata.
+	for _, path := range []string{
+		"/test-bucket/action/" + id[:2] + "/" + id,
+		"/test-bucket/output/" + outputID[:2] + "/" + outputID,
+	} {
+		if got := f.getMeta(path, "build-id"); got != "b123" {
+			t.Errorf("Metadata for %s: got build-id %q, want b123", path, got)
+		}
+	}
+
+	// A cache that faults in the action reports its provenance.
+	c2 := newTestCache(t, f)
+	var got map[string]string
+	c2.OnProvenance = func(actionID string, meta map[string]string) {
+		if actionID != id {
+			t.Errorf("OnProvenance: got action %q, want %q", actionID, id)
+		}
+		got = meta
+	}
+	if _, _, err := c2.Get(ctx, id); err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if got["build-id"] != "b123" || got["host"] != "builder-1" {
+		t.Errorf("OnProvenance: got %v, want %v", got, c.Provenance)
+	}
+}
+
+func TestVerifyStrong(t *testing.T) {
+	ctx := context.Background()
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	c.VerifyStrong = true
+	c.Provenance = map[string]string{"host": "builder-1"}
+
+	const content = "verified content"
+	id, outputID := hexID("verified"), hexID(content)
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: id,
+		OutputID: outputID,
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+
+	// The object and its action record carry the digest of the object.
+	objectPath := "/test-bucket/output/" + outputID[:2] + "/" + outputID
+	for _, path := range []string{"/test-bucket/action/" + id[:2] + "/" + id, objectPath} {
+		if got := f.getMeta(path, digestMetaKey); got != outputID {
+			t.Errorf("Metadata for %s: got digest %q, want %q", path, got, outputID)
+		}
+	}
+
+	// Each check uses a new cache, so that the object is faulted in from S3.
+	get := func(id string, want GetResult) *S3Cache {
+		t.Helper()
+		c := newTestCache(t, f)
+		c.VerifyStrong = true
+		var got GetResult
+		c.OnGet = func(_ string, r GetResult) { got = r }
+		c.OnProvenance = func(_ string, meta map[string]string) {
+			if _, ok := meta[digestMetaKey]; ok {
+				t.Errorf("OnProvenance: got %v, want no digest", meta)
+			}
+		}
+		if _, _, err := c.Get(ctx, id); err != nil {
+			t.Fatalf("Get: unexpected error: %v", err)
+		}
+		if got != want {
+			t.Errorf("Get result: got %v, want %v", got, want)
+		}
+		return c
+	}
+	if c := get(id, GetFaultHit); c.getVerified.Value() != 1 {
+		t.Errorf("Verified: got %d, want 1", c.getVerified.Value())
+	}
+
+	// An action written without a digest is reported as a miss, and its
+	// object is not read.
+	addRemote(f, hexID("unverified"), "unverified content")
+	f.mu.Lock()
+	before := f.numRequests
+	f.mu.Unlock()
+	if c := get(hexID("unverified"), GetMiss); c.getNoDigest.Value() != 1 {
+		t.Errorf("No digest: got %d, want 1", c.getNoDigest.Value())
+	}
+	f.mu.Lock()
+	if n := f.numRequests - before; n != 1 {
+		t.Errorf("Requests for an action without a digest: got %d, want 1", n)
+	}
+	f.mu.Unlock()
+
+	// Once the toolchain rebuilds it, the action has a digest.
+	c2 := newTestCache(t, f)
+	c2.VerifyStrong = true
+	if _, err := c2.Put(ctx, gocache.Object{
+		ActionID: hexID("unverified"),
+		OutputID: hexID("unverified content"),
+		Size:     int64(len("unverified content")),
+		Body:     strings.NewReader("unverified content"),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c2.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if c := get(hexID("unverified"), GetFaultHit); c.getVerified.Value() != 1 {
+		t.Errorf("Verified after rebuild: got %d, want 1", c.getVerified.Value())
+	}
+
+	// An object that does not match its digest is reported as a miss.
+	f.set(objectPath, []byte("tampered content"))
+	if c := get(id, GetMiss); c.getBadDigest.Value() != 1 {
+		t.Errorf("Bad digest: got %d, want 1", c.getBadDigest.Value())
+	}
+}
+
+func TestResetMetrics(t *testing.T) {
+	f := &fakeS3{}
+	c := newTestCache(t, f)
+	ctx := context.Background()
+
+	id := hexID("action")
+	addRemote(f, id, "object")
+	for _, want := range []GetResult{GetFaultHit, GetLocalHit} {
+		if _, diskPath, err := c.Get(ctx, id); err != nil || diskPath == "" {
+			t.Fatalf("Get (%v): got (%q, %v), want hit", want, diskPath, err)
+		}
+	}
+	if _, _, err := c.Get(ctx, hexID("missing")); err != nil {
+		t.Fatalf("Get missing: unexpected error: %v", err)
+	}
+
+	m := new(expvar.Map)
+	c.SetMetrics(ctx, m)
+	snapshot := func() map[string]string {
+		out := make(map[string]string)
+		m.Do(func(kv expvar.KeyValue) { out[kv.Key] = kv.Value.String() })
+		return out
+	}
+	if got := snapshot(); got["get_fault_hit"] != "1" || got["get_local_hit"] != "1" || got["get_fault_miss"] != "1" {
+		t.Fatalf("Metrics before reset: got %v", got)
+	}
+
+	c.ResetMetrics()
+	for name, v := range snapshot() {
+		if v != "0" {
+			t.Errorf("Metric %q after reset: got %s, want 0", name, v)
+		}
+	}
+
+	// The exported metrics continue to track the cache after a reset.
+	if _, _, err := c.Get(ctx, id); err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	for name, v := range snapshot() {
+		want := "0"
+		if name == "get_local_hit" {
+			want = "1"
+		}
+		if v != want {
+			t.Errorf("Metric %q: got %s, want %s", name, v, want)
+		}
+	}
+}
+
+func TestUploadTimeout(t *testing.T) {
+	f := &fakeS3{delay: 200 * time.Millisecond}
+	c := newTestCache(t, f)
+	c.UploadTimeout = 50 * time.Millisecond
+
+	var putErr error
+	c.OnPut = func(_ gocache.Object, _ bool, err error) { putErr = err }
+
+	ctx := context.Background()
+	const content = "some object data"
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: hexID("action"),
+		OutputID: hexID(content),
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if !errors.Is(putErr, context.DeadlineExceeded) {
+		t.Errorf("Upload error: got %v, want %v", putErr, context.DeadlineExceeded)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	f := &fakeS3{delay: 50 * time.Millisecond}
+	c := newTestCache(t, f)
+
+	ctx := context.Background()
+	put := func(content string) {
+		t.Helper()
+		if _, err := c.Put(ctx, gocache.Object{
+			ActionID: hexID("action " + content),
+			OutputID: hexID(content),
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+		}); err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+	}
+	hasAction := func(content string) bool {
+		id := hexID("action " + content)
+		_, ok := f.get("/test-bucket/action/" + id[:2] + "/" + id)
+		return ok
+	}
+
+	// A flush that times out reports the error from its context.
+	put("first object")
+	tctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	if err := c.Flush(tctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Flush: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// After a complete flush, the pending uploads have landed.
+	put("second object")
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("Flush: unexpected error: %v", err)
+	}
+	for _, content := range []string{"first object", "second object"} {
+		if !hasAction(content) {
+			t.Errorf("Action for %q not found after Flush", content)
+		}
+	}
+
+	// A flush reports errors from the uploads it waited for.
+	c.UploadTimeout = 10 * time.Millisecond
+	put("third object")
+	if err := c.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Flush: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The cache remains usable after a flush.
+	c.UploadTimeout = 0
+	put("fourth object")
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if !hasAction("fourth object") {
+		t.Error("Action for fourth object not found after Close")
+	}
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	c.MaxUploadSize = 10
+
+	var uploaded []bool
+	c.OnPut = func(_ gocache.Object, ok bool, _ error) { uploaded = append(uploaded, ok) }
+
+	ctx := context.Background()
+	for _, content := range []string{"this object is too large", "small"} {
+		diskPath, err := c.Put(ctx, gocache.Object{
+			ActionID: hexID(content),
+			OutputID: hexID(content),
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+		})
+		if err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+		if _, err := os.Stat(diskPath); err != nil {
+			t.Errorf("Local object: %v", err)
+		}
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+
+	if want := []bool{false, true}; !slices.Equal(uploaded, want) {
+		t.Errorf("Uploaded: got %v, want %v", uploaded, want)
+	}
+	if got := c.putSkipLarge.Value(); got != 1 {
+		t.Errorf("Skipped large objects: got %d, want 1", got)
+	}
+	if _, ok := f.get("/test-bucket/" + c.outputKey(hexID("this object is too large"))); ok {
+		t.Error("Large object was written to S3")
+	}
+}
+
+func TestUploadRate(t *testing.T) {
+	const numObjects = 6
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	c.UploadConcurrency = numObjects
+	c.UploadRate = 50 // an average of 20ms between uploads
+
+	ctx := context.Background()
+	start := time.Now()
+	for i := range numObjects {
+		content := fmt.Sprintf("object %d", i)
+		if _, err := c.Put(ctx, gocache.Object{
+			ActionID: hexID(content),
+			OutputID: hexID(content),
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+		}); err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+
+	// With jitter, each interval is at least half the average.
+	if elapsed, want := time.Since(start), (numObjects-1)*10*time.Millisecond; elapsed < want {
+		t.Errorf("Uploads took %v, want at least %v", elapsed, want)
+	}
+	if got := c.putPaced.Value(); got == 0 {
+		t.Error("Paced uploads: got 0, want some")
+	}
+	if got := c.putS3Action.Value(); got != numObjects {
+		t.Errorf("Uploaded actions: got %d, want %d", got, numObjects)
+	}
+}
+
+func TestPacer(t *testing.T) {
+	for _, tc := range []struct {
+		rate float64
+		want time.Duration
+	}{
+		{1e-300, maxPaceInterval},
+		{1, time.Second},
+		{1e300, 1},
+	} {
+		if got := newPacer(tc.rate).every; got != tc.want {
+			t.Errorf("newPacer(%g): got interval %v, want %v", tc.rate, got, tc.want)
+		}
+	}
+	if p := newPacer(math.NaN()); p != nil {
+		t.Errorf("newPacer(NaN): got %+v, want nil", p)
+	}
+
+	// The first slot is free; the next is at least half an hour away, so a
+	// wait for it ends with its context.
+	p := newPacer(1e-300)
+	if d, err := p.wait(context.Background()); d != 0 || err != nil {
+		t.Fatalf("wait: got (%v, %v), want (0, nil)", d, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestShards(t *testing.T) {
+	const numObjects = 16
+	stores := []*fakeS3{new(fakeS3), new(fakeS3), new(fakeS3)}
+	newCache := func() *S3Cache {
+		c := newTestCache(t, stores[0])
+		for _, f := range stores[1:] {
+			c.Shards = append(c.Shards, newTestCache(t, f).S3Client)
+		}
+		return c
+	}
+	shardOf := func(c *S3Cache, id string) *fakeS3 {
+		for i, sc := range append([]*s3util.Client{c.S3Client}, c.Shards...) {
+			if c.client(id) == sc {
+				return stores[i]
+			}
+		}
+		t.Fatalf("No shard for %s", id)
+		return nil
+	}
+
+	// Write objects through one cache.
+	ctx := context.Background()
+	c := newCache()
+	var ids []string
+	for i := range numObjects {
+		content := fmt.Sprintf("object %d", i)
+		ids = append(ids, hexID(content))
+		if _, err := c.Put(ctx, gocache.Object{
+			ActionID: hexID(content),
+			OutputID: hexID(content + " output"),
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+		}); err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+
+	// Each action is stored only in its own shard, and every shard is used.
+	used := make(map[*fakeS3]bool)
+	for _, id := range ids {
+		want := shardOf(c, id)
+		used[want] = true
+		for _, f := range stores {
+			_, ok := f.get("/test-bucket/" + c.actionKey(id))
+			if ok != (f == want) {
+				t.Errorf("Action %s: present=%v in the wrong shard", id[:8], ok)
+			}
+		}
+	}
+	if len(used) != len(stores) {
+		t.Errorf("Shards used: got %d, want %d", len(used), len(stores))
+	}
+
+	// Another cache with the same shards finds all the entries.
+	c2 := newCache()
+	for _, id := range ids {
+		if _, diskPath, err := c2.Get(ctx, id); err != nil || diskPath == "" {
+			t.Errorf("Get %s: got (%q, %v), want hit", id[:8], diskPath, err)
+		}
+	}
+	if got := c2.getFaultHit.Value(); got != numObjects {
+		t.Errorf("Fault hits: got %d, want %d", got, numObjects)
+	}
+}
+
+func TestPartitionBytes(t *testing.T) {
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	c.PartitionBytes = 2
+
+	ctx := context.Background()
+	const content = "partitioned content"
+	actionID, outputID := hexID("partitioned action"), hexID(content)
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: actionID,
+		OutputID: outputID,
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	for _, key := range []string{
+		"/test-bucket/action/" + actionID[:4] + "/" + actionID,
+		"/test-bucket/output/" + outputID[:4] + "/" + outputID,
+	} {
+		if _, ok := f.get(key); !ok {
+			t.Errorf("Key %q not found in S3", key)
+		}
+	}
+
+	// A cache with the same setting finds the entry, but one using the
+	// default partitioning does not.
+	for _, tc := range []struct {
+		partition int
+		want      GetResult
+	}{
+		{2, GetFaultHit},
+		{0, GetMiss},
+	} {
+		c := newTestCache(t, f)
+		c.PartitionBytes = tc.partition
+		var got GetResult
+		c.OnGet = func(_ string, r GetResult) { got = r }
+		if _, _, err := c.Get(ctx, actionID); err != nil {
+			t.Errorf("Get (partition %d): unexpected error: %v", tc.partition, err)
+		}
+		if got != tc.want {
+			t.Errorf("Get (partition %d): got %v, want %v", tc.partition, got, tc.want)
+		}
+	}
+
+	// A cache configured with a different depth than the existing entries
+	// reports the mismatch, and one with the same depth does not.
+	for _, tc := range []struct {
+		partition int
+		ok        bool
+	}{
+		{2, true},
+		{0, false},
+		{3, false},
+	} {
+		c := newTestCache(t, f)
+		c.PartitionBytes = tc.partition
+		err := c.CheckPartition(ctx)
+		if tc.ok && err != nil {
+			t.Errorf("CheckPartition (partition %d): unexpected error: %v", tc.partition, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("CheckPartition (partition %d): got nil, want error", tc.partition)
+		}
+	}
+
+	// An empty bucket accepts any depth.
+	if err := newTestCache(t, new(fakeS3)).CheckPartition(ctx); err != nil {
+		t.Errorf("CheckPartition (empty): unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		partition int
+		want      string
+	}{
+		{-1, "ab"}, {0, "ab"}, {1, "ab"}, {3, "abcdef"}, {4, "abcdef01"}, {9, "abcdef01"},
+	} {
+		c := &S3Cache{PartitionBytes: tc.partition}
+		if got := c.partition("abcdef0123456789"); got != tc.want {
+			t.Errorf("partition(%d): got %q, want %q", tc.partition, got, tc.want)
+		}
+	}
+}
+
+func TestKeyFunc(t *testing.T) {
+	f := new(fakeS3)
+	saltedKey := func(kind, id string) string {
+		return path.Join("salted", kind, hexID("salt:"+id))
+	}
+	c := newTestCache(t, f)
+	c.KeyFunc = saltedKey
+
+	ctx := context.Background()
+	const content = "salted content"
+	actionID, outputID := hexID("salted action"), hexID(content)
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: actionID,
+		OutputID: outputID,
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	for _, key := range []string{saltedKey("action", actionID), saltedKey("output", outputID)} {
+		if _, ok := f.get("/test-bucket/" + key); !ok {
+			t.Errorf("Key %q not found in S3", key)
+		}
+	}
+
+	// A cache with the same key function finds the entry, but one using the
+	// default layout does not.
+	for _, tc := range []struct {
+		keyFunc func(kind, id string) string
+		want    GetResult
+	}{
+		{saltedKey, GetFaultHit},
+		{nil, GetMiss},
+	} {
+		c := newTestCache(t, f)
+		c.KeyFunc = tc.keyFunc
+		var got GetResult
+		c.OnGet = func(_ string, r GetResult) { got = r }
+		if _, _, err := c.Get(ctx, actionID); err != nil {
+			t.Errorf("Get: unexpected error: %v", err)
+		}
+		if got != tc.want {
+			t.Errorf("Get (custom keys %v): got %v, want %v", tc.keyFunc != nil, got, tc.want)
+		}
+	}
+
+	// The default key honors the prefix and partition settings.
+	d := &S3Cache{KeyPrefix: "pfx", PartitionBytes: 2}
+	if got, want := d.DefaultKey("output", "abcdef01"), "output/abcd/abcdef01"; got != want {
+		t.Errorf("DefaultKey: got %q, want %q", got, want)
+	}
+	if got, want := d.outputKey("abcdef01"), "pfx/output/abcd/abcdef01"; got != want {
+		t.Errorf("outputKey: got %q, want %q", got, want)
+	}
+}
+
+func TestAuditMode(t *testing.T) {
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	c.AuditMode = true
+	c.MinUploadSize = 10
+
+	ctx := context.Background()
+	put := func(actionID, content string) {
+		t.Helper()
+		if _, err := c.Put(ctx, gocache.Object{
+			ActionID: actionID,
+			OutputID: hexID(content),
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+		}); err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+	}
+	put(hexID("same"), "consistent content")
+	put(hexID("differ"), "original content")
+	put(hexID("missing"), "tiny")
+	c.push.Wait()
+
+	// Replace the S3 copy of one action with a different output.
+	addRemote(f, hexID("differ"), "replacement content")
+
+	for _, id := range []string{hexID("same"), hexID("differ"), hexID("missing")} {
+		if _, diskPath, err := c.Get(ctx, id); err != nil || diskPath == "" {
+			t.Errorf("Get: got (%q, %v), want a hit", diskPath, err)
+		}
+	}
+	c.push.Wait()
+
+	for _, tc := range []struct {
+		name string
+		v    *expvar.Int
+		want int64
+	}{
+		{"check", &c.auditCheck, 3},
+		{"missing", &c.auditMissing, 1},
+		{"differ", &c.auditDiffer, 1},
+		{"error", &c.auditError, 0},
+		{"local hit", &c.getLocalHit, 3},
+	} {
+		if got := tc.v.Value(); got != tc.want {
+			t.Errorf("Audit %s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestShadowMode(t *testing.T) {
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	c.ShadowMode = true
+
+	addRemote(f, hexID("same"), "consistent content")
+	addRemote(f, hexID("differ"), "original content")
+	addRemote(f, hexID("object"), "object content")
+	f.set("/test-bucket/output/"+hexID("object content")[:2]+"/"+hexID("object content"), []byte("corrupted"))
+	before := len(f.data)
+
+	ctx := context.Background()
+	put := func(actionID, content string) {
+		t.Helper()
+		if _, err := c.Put(ctx, gocache.Object{
+			ActionID: actionID,
+			OutputID: hexID(content),
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+		}); err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+	}
+	put(hexID("same"), "consistent content")
+	put(hexID("differ"), "replacement content") // different output ID
+	put(hexID("object"), "object content")      // same output ID, different contents
+	put(hexID("missing"), "new content")
+	c.push.Wait()
+
+	// Nothing is written to S3.
+	if got := len(f.data); got != before {
+		t.Errorf("S3 objects: got %d, want %d", got, before)
+	}
+	for _, tc := range []struct {
+		name string
+		v    *expvar.Int
+		want int64
+	}{
+		{"check", &c.shadowCheck, 4},
+		{"missing", &c.shadowMiss, 1},
+		{"differ", &c.shadowDiffer, 2},
+		{"error", &c.shadowError, 0},
+		{"object", &c.putS3Object, 0},
+		{"action", &c.putS3Action, 0},
+	} {
+		if got := tc.v.Value(); got != tc.want {
+			t.Errorf("Shadow %s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	c := newTestCache(t, new(fakeS3))
+	c.S3Client = nil // local only
+	c.MemoryCacheEntries = 2
+	c.MemoryCacheMaxObject = 16
+
+	ctx := context.Background()
+	put := func(actionID, content string) {
+		t.Helper()
+		if _, err := c.Put(ctx, gocache.Object{
+			ActionID: actionID,
+			OutputID: hexID(content),
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+		}); err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+	}
+	get := func(actionID, content string) {
+		t.Helper()
+		outputID, diskPath, err := c.Get(ctx, actionID)
+		if err != nil || outputID != hexID(content) {
+			t.Fatalf("Get: got (%q, %v), want %q", outputID, err, hexID(content))
+		}
+		if data, err := os.ReadFile(diskPath); err != nil || string(data) != content {
+			t.Errorf("Read %q: got (%q, %v), want %q", diskPath, data, err, content)
+		}
+	}
+	check := func(hit, miss int64) {
+		t.Helper()
+		if got := c.memHit.Value(); got != hit {
+			t.Errorf("Memory hits: got %d, want %d", got, hit)
+		}
+		if got := c.memMiss.Value(); got != miss {
+			t.Errorf("Memory misses: got %d, want %d", got, miss)
+		}
+	}
+
+	put(hexID("a"), "small a")
+	put(hexID("b"), "small b")
+	put(hexID("big"), "this object is too large")
+
+	// The first read of each action misses, and later reads of small objects
+	// are served from memory.
+	get(hexID("a"), "small a")
+	get(hexID("b"), "small b")
+	get(hexID("big"), "this object is too large")
+	check(0, 3)
+	get(hexID("a"), "small a")
+	get(hexID("b"), "small b")
+	get(hexID("big"), "this object is too large")
+	check(2, 4)
+
+	// Adding a third small action evicts the least-recently used.
+	put(hexID("c"), "small c")
+	get(hexID("c"), "small c")
+	get(hexID("a"), "small a")
+	check(2, 6)
+
+	// Replacing an action discards its memory entry.
+	put(hexID("a"), "other a")
+	get(hexID("a"), "other a")
+	check(2, 7)
+
+	if got := c.getLocalHit.Value(); got != 9 {
+		t.Errorf("Local hits: got %d, want 9", got)
+	}
+
+	// An entry whose object was removed from disk after it was cached is
+	// discarded, and the lookup falls through to the local directory.
+	_, cPath, err := c.Get(ctx, hexID("c"))
+	if err != nil || cPath == "" {
+		t.Fatalf("Get: got (%q, %v), want a hit", cPath, err)
+	}
+	check(3, 7)
+	if err := os.Remove(cPath); err != nil {
+		t.Fatal(err)
+	}
+	outputID, diskPath, err := c.Get(ctx, hexID("c"))
+	if err != nil || outputID != "" || diskPath != "" {
+		t.Errorf("Get (removed): got (%q, %q, %v), want a miss", outputID, diskPath, err)
+	}
+	check(3, 8)
+	if _, ok := c.mem.Get(hexID("c")); ok {
+		t.Error("Memory entry for removed object was not discarded")
+	}
+}
+
+func TestMaxLocalObjectBytes(t *testing.T) {
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	c.MaxLocalObjectBytes = 10
+
+	ctx := context.Background()
+	put := func(actionID, content string) string {
+		t.Helper()
+		diskPath, err := c.Put(ctx, gocache.Object{
+			ActionID: actionID,
+			OutputID: hexID(content),
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+		})
+		if err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+		return diskPath
+	}
+	bigPath := put(hexID("big"), "this object is too large")
+	smallPath := put(hexID("small"), "tiny")
+
+	// A large object faulted in from S3 is staged outside the local cache.
+	addRemote(f, hexID("remote"), "this remote object is too large")
+	_, remotePath, err := c.Get(ctx, hexID("remote"))
+	if err != nil || remotePath == "" {
+		t.Fatalf("Get: got (%q, %v), want a hit", remotePath, err)
+	}
+	if root := filepath.Dir(filepath.Dir(filepath.Dir(smallPath))); strings.HasPrefix(remotePath, root) {
+		t.Errorf("Get: path %q is in the local cache %q", remotePath, root)
+	}
+	if data, err := os.ReadFile(remotePath); err != nil || string(data) != "this remote object is too large" {
+		t.Errorf("Get: read %q: got (%q, %v)", remotePath, data, err)
+	}
+
+	// All the files remain available until the cache is closed.
+	c.push.Wait()
+	for _, path := range []string{bigPath, smallPath, remotePath} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Before close: %v", err)
+		}
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+
+	// The large objects are removed, but the small one is kept.
+	for _, path := range []string{bigPath, remotePath} {
+		if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Large object %s: got err=%v, want %v", path, err, fs.ErrNotExist)
+		}
+	}
+	if _, err := os.Stat(smallPath); err != nil {
+		t.Errorf("Small object: unexpected error: %v", err)
+	}
+	if got := c.putTransient.Value(); got != 1 {
+		t.Errorf("Put transient: got %d, want 1", got)
+	}
+	if got := c.getTransient.Value(); got != 1 {
+		t.Errorf("Get transient: got %d, want 1", got)
+	}
+
+	// The large object is still available from S3.
+	id := hexID("this object is too large")
+	if _, ok := f.get("/test-bucket/output/" + id[:2] + "/" + id); !ok {
+		t.Error("Large object was not uploaded to S3")
+	}
+}
+
+func TestDropUploaded(t *testing.T) {
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	c.DropUploaded = true
+	c.MinUploadSize = 10
+
+	ctx := context.Background()
+	put := func(actionID, content string) string {
+		t.Helper()
+		diskPath, err := c.Put(ctx, gocache.Object{
+			ActionID: actionID,
+			OutputID: hexID(content),
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+		})
+		if err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+		return diskPath
+	}
+	bigPath := put(hexID("big"), "this object is uploaded")
+	smallPath := put(hexID("small"), "tiny")
+
+	// Local copies remain available until the cache is closed.
+	c.push.Wait()
+	for _, path := range []string{bigPath, smallPath} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Before close: %v", err)
+		}
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+
+	// The uploaded object is removed, but the small one is kept.
+	if _, err := os.Stat(bigPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Uploaded object: got err=%v, want %v", err, fs.ErrNotExist)
+	}
+	if _, err := os.Stat(smallPath); err != nil {
+		t.Errorf("Small object: unexpected error: %v", err)
+	}
+	if got := c.dropLocal.Value(); got != 1 {
+		t.Errorf("Dropped objects: got %d, want 1", got)
+	}
+
+	// The uploaded object is faulted in again on demand.
+	var got GetResult
+	c.OnGet = func(_ string, r GetResult) { got = r }
+	if _, diskPath, err := c.Get(ctx, hexID("big")); err != nil || diskPath == "" {
+		t.Errorf("Get: got (%q, %v), want a hit", diskPath, err)
+	}
+	if got != GetFaultHit {
+		t.Errorf("Get result: got %v, want %v", got, GetFaultHit)
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	var buf bytes.Buffer
+	c.RequestLog = &buf
+	ctx := context.Background()
+
+	const content = "logged content"
+	actionID := hexID("logged action")
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: actionID,
+		OutputID: hexID(content),
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	c.Get(ctx, actionID)
+	c.Get(ctx, hexID("unknown action"))
+	addRemote(f, hexID("remote action"), "remote content")
+	c.Get(ctx, hexID("remote action"))
+
+	type summary struct {
+		Op, Result string
+		Bytes      int64
+	}
+	var got []summary
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec RequestRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("Decode log record: %v", err)
+		}
+		if rec.ActionID == "" || rec.Time.IsZero() || rec.ElapsedMS < 0 {
+			t.Errorf("Invalid log record: %+v", rec)
+		}
+		got = append(got, summary{rec.Op, rec.Result, rec.Bytes})
+	}
+	want := []summary{
+		{"put", "ok", int64(len(content))},
+		{"upload", "ok", int64(len(content))},
+		{"get", "hit", int64(len(content))},
+		{"get", "miss", 0},
+		{"get", "fault", int64(len("remote content"))},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Log records:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	var buf bytes.Buffer
+	c.Logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	ctx := context.Background()
+
+	const content = "logged content"
+	actionID := hexID("logged action")
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: actionID,
+		OutputID: hexID(content),
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	c.Get(ctx, actionID)
+	c.Get(ctx, hexID("unknown action"))
+
+	type summary struct {
+		Level, Op, Result string
+		Bytes             int64
+	}
+	var got []summary
+	var sawClose bool
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec struct {
+			Level     string  `json:"level"`
+			Msg       string  `json:"msg"`
+			Op        string  `json:"op"`
+			ActionID  string  `json:"action"`
+			Result    string  `json:"result"`
+			Bytes     int64   `json:"bytes"`
+			ElapsedMS float64 `json:"elapsed_ms"`
+		}
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("Decode log record: %v", err)
+		}
+		if rec.Op == "" {
+			// A diagnostic message, for example from Close.
+			sawClose = sawClose || strings.Contains(rec.Msg, "uploads complete")
+			continue
+		}
+		if rec.ActionID == "" || rec.ElapsedMS < 0 {
+			t.Errorf("Invalid log record: %+v", rec)
+		}
+		got = append(got, summary{rec.Level, rec.Op, rec.Result, rec.Bytes})
+	}
+	want := []summary{
+		{"DEBUG", "put", "ok", int64(len(content))},
+		{"DEBUG", "upload", "ok", int64(len(content))},
+		{"DEBUG", "get", "hit", int64(len(content))},
+		{"DEBUG", "get", "miss", 0},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Log records:\n got %+v\nwant %+v", got, want)
+	}
+	if !sawClose {
+		t.Error("Logger did not receive diagnostic messages from Close")
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	f := new(fakeS3)
+	c := newTestCache(t, f)
+	c.DirMode = 0700
+	c.FileMode = 0600
+	defer c.Close(context.Background())
+
+	checkMode := func(path string, want fs.FileMode) {
+		t.Helper()
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if got := fi.Mode().Perm(); got != want {
+			t.Errorf("Mode of %s: got %v, want %v", path, got, want)
+		}
+	}
+	checkPaths := func(actionID, diskPath string) {
+		t.Helper()
+		root := filepath.Dir(filepath.Dir(filepath.Dir(diskPath)))
+		actionPath := filepath.Join(root, "action", actionID[:2], actionID)
+		for _, path := range []string{diskPath, actionPath} {
+			checkMode(path, c.FileMode)
+			checkMode(filepath.Dir(path), c.DirMode)
+			checkMode(filepath.Dir(filepath.Dir(path)), c.DirMode)
+		}
+	}
+
+	// Objects written by Put have the configured modes.
+	ctx := context.Background()
+	putID := hexID("put")
+	diskPath, err := c.Put(ctx, gocache.Object{
+		ActionID: putID,
+		OutputID: hexID("put content"),
+		Size:     int64(len("put content")),
+		Body:     strings.NewReader("put content"),
+	})
+	if err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	checkPaths(putID, diskPath)
+
+	// So do objects faulted in from the remote by Get.
+	getID := hexID("get")
+	addRemote(f, getID, "get content")
+	if _, diskPath, err := c.Get(ctx, getID); err != nil || diskPath == "" {
+		t.Fatalf("Get: got (%q, %v), want a hit", diskPath, err)
+	} else {
+		checkPaths(getID, diskPath)
+	}
+}
+
+func TestLocalOnly(t *testing.T) {
+	dir, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("Create local cache: %v", err)
+	}
+	c := &S3Cache{Local: dir} // no S3 client
+	ctx := context.Background()
+
+	// A missing action is a miss, not an error.
+	var got GetResult
+	c.OnGet = func(_ string, r GetResult) { got = r }
+	if outputID, diskPath, err := c.Get(ctx, hexID("missing")); err != nil || diskPath != "" {
+		t.Errorf("Get missing: got (%q, %q, %v), want miss", outputID, diskPath, err)
+	}
+	if got != GetMiss {
+		t.Errorf("Get missing: got result %v, want %v", got, GetMiss)
+	}
+
+	// Objects written by Put are served locally.
+	const content = "local content"
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: hexID("local"),
+		OutputID: hexID(content),
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	outputID, diskPath, err := c.Get(ctx, hexID("local"))
+	if err != nil || outputID != hexID(content) {
+		t.Fatalf("Get: got (%q, %v), want (%q, nil)", outputID, err, hexID(content))
+	}
+	if data, err := os.ReadFile(diskPath); err != nil || string(data) != content {
+		t.Errorf("Get: read %q: got (%q, %v), want %q", diskPath, data, err, content)
+	}
+	if got != GetLocalHit {
+		t.Errorf("Get: got result %v, want %v", got, GetLocalHit)
+	}
+
+	// Prefetch has nothing to do.
+	if n, err := c.Prefetch(ctx, []string{hexID("missing")}); n != 0 || err != nil {
+		t.Errorf("Prefetch: got (%d, %v), want (0, nil)", n, err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !unix
+
+package gobuild
+
+// A dirLock is a placeholder for an advisory lock on a file shared by the
+// processes using a local cache directory. Advisory locks are not supported
+// on this platform, so it does not coordinate with other processes.
+type dirLock struct{}
+
+func openDirLock(path string) (*dirLock, error) { return new(dirLock), nil }
+
+func (*dirLock) tryExclusive() bool { return true }
+
+func (*dirLock) Close() error { return nil }
@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build unix
+
+package gobuild
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creachadair/gocache"
+)
+
+func TestLockFile(t *testing.T) {
+	f := new(fakeS3)
+	c1 := newTestCache(t, f)
+	c2 := newTestCache(t, f)
+	c2.Local = c1.Local // share a local directory
+
+	lockPath := filepath.Join(t.TempDir(), "gobuild.lock")
+	var cleanups []string
+	for i, c := range []*S3Cache{c1, c2} {
+		c.LockFile = lockPath
+		c.DropUploaded = true
+		c.Cleanup = func(context.Context) error {
+			cleanups = append(cleanups, []string{"c1", "c2"}[i])
+			return nil
+		}
+	}
+
+	ctx := context.Background()
+	const content = "this object is uploaded"
+	diskPath, err := c1.Put(ctx, gocache.Object{
+		ActionID: hexID("shared"),
+		OutputID: hexID(content),
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	})
+	if err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+
+	// While c2 is in use, closing c1 does not remove files from the directory.
+	if _, _, err := c2.Get(ctx, hexID("shared")); err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if err := c1.Close(ctx); err != nil {
+		t.Fatalf("Close c1: unexpected error: %v", err)
+	}
+	if _, err := os.Stat(diskPath); err != nil {
+		t.Errorf("After close c1: %v", err)
+	}
+	if got := c1.closeShared.Value(); got != 1 {
+		t.Errorf("Shared closes: got %d, want 1", got)
+	}
+
+	// Once c2 is the only user, closing it does clean up, including the
+	// objects left by c1.
+	if err := c2.Close(ctx); err != nil {
+		t.Fatalf("Close c2: unexpected error: %v", err)
+	}
+	if got := strings.Join(cleanups, ","); got != "c2" {
+		t.Errorf("Cleanups: got %q, want %q", got, "c2")
+	}
+	if _, err := os.Stat(diskPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("After close c2: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if _, err := os.Stat(lockPath + ".remove"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Pending file after close c2: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	defer func(d time.Duration) { lockTimeout = d }(lockTimeout)
+	lockTimeout = 50 * time.Millisecond
+
+	lockPath := filepath.Join(t.TempDir(), "gobuild.lock")
+	l1, err := openDirLock(lockPath)
+	if err != nil {
+		t.Fatalf("Lock: unexpected error: %v", err)
+	}
+	defer l1.Close()
+	if !l1.tryExclusive() {
+		t.Fatal("Exclusive lock failed")
+	}
+
+	// While l1 holds an exclusive lock, another lock gives up.
+	start := time.Now()
+	if l2, err := openDirLock(lockPath); err == nil {
+		l2.Close()
+		t.Error("Lock: got nil error, want timeout")
+	} else if elapsed := time.Since(start); elapsed < lockTimeout {
+		t.Errorf("Lock: gave up after %v, want at least %v", elapsed, lockTimeout)
+	}
+
+	l1.Close()
+	l2, err := openDirLock(lockPath)
+	if err != nil {
+		t.Fatalf("Lock after release: unexpected error: %v", err)
+	}
+	l2.Close()
+}
@@ -0,0 +1,67 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build unix
+
+package gobuild
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockTimeout is how long openDirLock waits for another process to release an
+// exclusive lock, which it holds only while it removes files when it closes.
+// The variable is for testing.
+var lockTimeout = 30 * time.Second
+
+// lockRetryInterval is how often openDirLock retries a lock it cannot get.
+const lockRetryInterval = 20 * time.Millisecond
+
+// A dirLock is an advisory lock on a file shared by the processes using a
+// local cache directory. Each process holds a shared lock while it uses the
+// directory, and removes files from it only while it holds an exclusive lock.
+type dirLock struct {
+	f *os.File
+}
+
+// openDirLock opens the lock file at path, creating it if necessary, and
+// acquires a shared lock on it. While another process holds an exclusive
+// lock, it retries until lockTimeout has elapsed, and then reports an error.
+func openDirLock(path string) (*dirLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB)
+		if err == nil {
+			return &dirLock{f: f}, nil
+		} else if !errors.Is(err, unix.EWOULDBLOCK) && !errors.Is(err, unix.EINTR) {
+			f.Close()
+			return nil, fmt.Errorf("lock: %w", err)
+		} else if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("lock: held by another process for over %v", lockTimeout)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// tryExclusive reports whether l could be converted to an exclusive lock
+// without blocking, that is, whether no other process holds a lock on the
+// file. If not, l no longer holds any lock.
+func (l *dirLock) tryExclusive() bool {
+	return unix.Flock(int(l.f.Fd()), unix.LOCK_EX|unix.LOCK_NB) == nil
+}
+
+// Close releases the lock and closes its file.
+func (l *dirLock) Close() error {
+	uerr := unix.Flock(int(l.f.Fd()), unix.LOCK_UN)
+	return errors.Join(uerr, l.f.Close())
+}
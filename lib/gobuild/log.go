@@ -0,0 +1,123 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/creachadair/gocache"
+)
+
+// A RequestRecord is a structured log record for a request handled by an
+// [S3Cache]. Records are written to the RequestLog of the cache, one JSON
+// object per line.
+type RequestRecord struct {
+	Time      time.Time `json:"time"`             // when the request began
+	Op        string    `json:"op"`               // "get", "put", "upload", or "shadow"
+	ActionID  string    `json:"action"`           // the action ID
+	OutputID  string    `json:"output,omitempty"` // the output ID, if known
+	Result    string    `json:"result"`           // see below
+	Bytes     int64     `json:"bytes"`            // the size of the object, if known
+	ElapsedMS float64   `json:"elapsed_ms"`       // request duration in milliseconds
+	Error     string    `json:"error,omitempty"`  // the error, if the request failed
+
+	// The result of a "get" is one of "hit" (found locally), "fault" (faulted
+	// in from S3), "miss", or "error".
+	//
+	// The result of a "put" is "ok" or "error". A "put" stores the object in
+	// the local cache; if it is to be written to S3, that is reported by a
+	// separate "upload" record when the write completes, whose result is "ok"
+	// or "error". With ShadowMode, the "upload" record is replaced by a
+	// "shadow" record, whose result is "match", "missing", "differ", or
+	// "error".
+}
+
+// logf writes a diagnostic message for the cache at the specified level. If
+// Logger is set, the message is written there; otherwise it is written to the
+// logger attached to ctx (see [gocache.Logf]), regardless of level.
+func (s *S3Cache) logf(ctx context.Context, level slog.Level, msg string, args ...any) {
+	if s.Logger != nil {
+		s.Logger.Log(ctx, level, fmt.Sprintf(msg, args...))
+		return
+	}
+	gocache.Logf(ctx, msg, args...)
+}
+
+// logRequest writes a record for a request to the request log and to Logger,
+// if they are defined. The elapsed time is computed from the start time of rec.
+func (s *S3Cache) logRequest(rec RequestRecord, err error) {
+	if s.RequestLog == nil && s.Logger == nil {
+		return
+	}
+	rec.ElapsedMS = float64(time.Since(rec.Time).Microseconds()) / 1000
+	if err != nil {
+		rec.Result, rec.Error = "error", err.Error()
+	}
+	if s.Logger != nil {
+		s.logAttrs(rec)
+	}
+	if s.RequestLog == nil {
+		return
+	}
+	data, jerr := json.Marshal(rec)
+	if jerr != nil {
+		return // should not be possible
+	}
+	data = append(data, '\n')
+
+	s.lmu.Lock()
+	defer s.lmu.Unlock()
+	s.RequestLog.Write(data)
+}
+
+// logAttrs writes rec to Logger as a structured record. Requests that failed
+// are logged at level Warn, and others at level Debug.
+func (s *S3Cache) logAttrs(rec RequestRecord) {
+	level := slog.LevelDebug
+	attrs := []slog.Attr{
+		slog.String("op", rec.Op),
+		slog.String("action", rec.ActionID),
+		slog.String("result", rec.Result),
+		slog.Int64("bytes", rec.Bytes),
+		slog.Float64("elapsed_ms", rec.ElapsedMS),
+	}
+	if rec.OutputID != "" {
+		attrs = append(attrs, slog.String("output", rec.OutputID))
+	}
+	if rec.Error != "" {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.String("error", rec.Error))
+	}
+	s.Logger.LogAttrs(context.Background(), level, "gocache "+rec.Op, attrs...)
+}
+
+// logGet writes a record for a Get request to the request log and to Logger,
+// if they are defined.
+func (s *S3Cache) logGet(start time.Time, actionID, outputID, diskPath string, result GetResult, err error) {
+	if s.RequestLog == nil && s.Logger == nil {
+		return
+	}
+	rec := RequestRecord{Time: start, Op: "get", ActionID: actionID, OutputID: outputID}
+	switch result {
+	case GetLocalHit:
+		rec.Result = "hit"
+	case GetFaultHit:
+		rec.Result = "fault"
+	case GetMiss:
+		rec.Result = "miss"
+	default:
+		rec.Result = "error"
+	}
+	if diskPath != "" {
+		if fi, err := os.Stat(diskPath); err == nil {
+			rec.Bytes = fi.Size()
+		}
+	}
+	s.logRequest(rec, err)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"os"
+	"time"
+
+	"github.com/creachadair/mds/cache"
+)
+
+// memEntry is the format of entries in the memory cache. Each entry records
+// the result of a local cache hit for an action.
+type memEntry struct {
+	outputID string
+	diskPath string
+	size     int64     // size of the object in bytes
+	mtime    time.Time // modification time of the object
+}
+
+// memEntryOverhead is the approximate size in bytes of a memEntry apart from
+// the contents of its strings.
+const memEntryOverhead = 64
+
+// newMemCache constructs the memory cache for s, or returns nil if the memory
+// cache is not enabled.
+//
+// The cache limits the total size of its entries to memoryCacheBytes. To also
+// limit the number of entries, each entry is charged at least 1/n of the total,
+// where n is MemoryCacheEntries.
+func (s *S3Cache) newMemCache() *cache.Cache[string, memEntry] {
+	if s.MemoryCacheEntries <= 0 {
+		return nil
+	}
+	limit := s.memoryCacheBytes()
+	unit := max(1, limit/int64(s.MemoryCacheEntries))
+	return cache.New(cache.LRU[string, memEntry](limit).WithSize(func(e memEntry) int64 {
+		return max(unit, int64(memEntryOverhead+len(e.outputID)+len(e.diskPath)))
+	}))
+}
+
+// memGet reports whether actionID is present in the memory cache, and if so
+// returns its entry. It reports false if the memory cache is not enabled.
+//
+// Because the object may be removed or replaced by another process sharing
+// the local directory, or by cleanup, memGet checks that the object file
+// still exists with the recorded size. If not, it discards the entry and
+// reports a miss.
+func (s *S3Cache) memGet(actionID string) (memEntry, bool) {
+	if s.mem == nil {
+		return memEntry{}, false
+	}
+	e, ok := s.mem.Get(actionID)
+	if ok {
+		if fi, err := os.Stat(e.diskPath); err != nil || fi.Size() != e.size {
+			s.mem.Remove(actionID)
+			ok = false
+		}
+	}
+	if ok {
+		s.memHit.Add(1)
+	} else {
+		s.memMiss.Add(1)
+	}
+	return e, ok
+}
+
+// memPut adds e to the memory cache for actionID, if the memory cache is
+// enabled and the object is small enough to be eligible.
+func (s *S3Cache) memPut(actionID string, e memEntry) {
+	if s.mem == nil || e.size > s.memoryCacheMaxObject() || s.isTransient(e.size) {
+		return
+	}
+	s.mem.Put(actionID, e)
+}
+
+// memRemove discards the memory cache entry for actionID, if any.
+func (s *S3Cache) memRemove(actionID string) {
+	if s.mem != nil {
+		s.mem.Remove(actionID)
+	}
+}
+
+func (s *S3Cache) memoryCacheBytes() int64 {
+	if s.MemoryCacheBytes <= 0 {
+		return 4 << 20
+	}
+	return s.MemoryCacheBytes
+}
+
+func (s *S3Cache) memoryCacheMaxObject() int64 {
+	if s.MemoryCacheMaxObject <= 0 {
+		return 64 << 10
+	}
+	return s.MemoryCacheMaxObject
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// A pacer spaces out events to a steady average rate. It is a token bucket
+// holding a single token: each call to wait reserves the next free slot, and
+// blocks until that slot arrives. A pacer is safe for concurrent use.
+type pacer struct {
+	every time.Duration // average interval between events
+
+	mu   sync.Mutex
+	next time.Time // earliest time of the next unreserved slot
+}
+
+// maxPaceInterval bounds the average interval of a pacer, so that a tiny rate
+// does not overflow the interval or the time of the next slot.
+const maxPaceInterval = time.Hour
+
+// newPacer returns a pacer for the given rate in events per second, or nil if
+// rate is not positive. The interval between events is clamped to between 1ns
+// and maxPaceInterval.
+func newPacer(rate float64) *pacer {
+	if !(rate > 0) { // also NaN
+		return nil
+	}
+	every := min(float64(time.Second)/rate, float64(maxPaceInterval))
+	return &pacer{every: max(time.Duration(every), 1)}
+}
+
+// wait blocks until the next slot of p is available or ctx ends, and reports
+// how long it waited. If ctx ends first, wait reports the context's error.
+// The intervals between slots vary randomly between half and one and a half
+// times the average, so that uploads started by several processes at once do
+// not stay in lockstep. A nil pacer does not wait.
+func (p *pacer) wait(ctx context.Context) (time.Duration, error) {
+	if p == nil {
+		return 0, nil
+	}
+	now := time.Now()
+	p.mu.Lock()
+	slot := p.next
+	if slot.Before(now) {
+		slot = now
+	}
+	jitter := time.Duration(rand.Int64N(int64(p.every) + 1))
+	p.next = slot.Add(p.every/2 + jitter)
+	p.mu.Unlock()
+
+	delay := slot.Sub(now)
+	if delay <= 0 {
+		return 0, nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return delay, nil
+	case <-ctx.Done():
+		return time.Since(now), ctx.Err()
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -48,24 +49,79 @@ var _ goproxy.Cacher = (*S3Cacher)(nil)
 // the specified key prefix instead:
 //
 //	<key-prefix>/module/16/0db4d719252162c87a9169e26deda33d2340770d0d540fd4c580c55008b2d6
+//
+// # Mutable Files
+//
+// Version lists ("<module>/@v/list") and latest-version queries
+// ("<module>/@latest") change as new versions are published, so unlike other
+// files they are cached only for MutableTTL. Each Put replaces the cached
+// value. Such entries are stored with an expiration time, under a digest that
+// is distinct from that of an entry without one.
 type S3Cacher struct {
 	// Local is the path of a local cache directory where modules are cached.
 	// It must be non-empty.
 	Local string
 
 	// S3Client is the S3 client used to read and write cache entries to the
-	// backing store. It must be non-nil.
+	// backing store. If nil, the cache uses only the local directory, and does
+	// not read from or write to S3.
 	S3Client *s3util.Client
 
 	// KeyPrefix, if non-empty, is prepended to each key stored into S3, with an
 	// intervening slash.
 	KeyPrefix string
 
+	// MirrorDirs, if non-empty, lists read-only directories in the layout of
+	// the module download cache ($GOPATH/pkg/mod/cache/download), which are
+	// checked in order on a local miss before faulting in from S3. Files found
+	// in a mirror are copied into the local cache.
+	//
+	// Only module files (.info, .mod, and .zip) are read from the mirrors,
+	// since version lists and other files may be stale.
+	MirrorDirs []string
+
+	// PrivatePatterns, if non-empty, lists glob patterns of module path
+	// prefixes for private modules, in the same syntax as GOPRIVATE. Files for
+	// matching modules are never stored in or read from the cache: Get reports
+	// them as missing, and Put discards them. Use [S3Cacher.PrivateFilter] to
+	// reject proxy requests for these modules before they reach the upstream
+	// proxy.
+	PrivatePatterns []string
+
+	// MutableTTL, if positive, is the length of time for which version lists
+	// and latest-version queries are cached. If zero or negative, the default
+	// is 5 minutes. Files for specific module versions do not expire.
+	MutableTTL time.Duration
+
 	// MaxTasks, if positive, limits the number of concurrent tasks that may be
 	// interacting with S3. If zero or negative, the default is
 	// [runtime.NumCPU].
 	MaxTasks int
 
+	// S3Timeout, if positive, bounds the time allowed for each individual S3
+	// operation issued by the cache. It applies to reads that fault in entries
+	// on Get, and to the background writes issued by Put. If zero or negative,
+	// Get uses a default of 20 seconds, and Put uses a default of 1 minute.
+	//
+	// When a read times out on Get, the cache reports a miss so that the caller
+	// can fall back to the upstream source.
+	S3Timeout time.Duration
+
+	// FailOpen, if true, causes Get to report a miss ([fs.ErrNotExist]) when
+	// reading from S3 fails with an error other than a timeout, so that the
+	// caller can fall back to the upstream source while S3 is unavailable.
+	// Otherwise, the error is returned to the caller. Either way, the error
+	// is counted in the get_fault_error metric.
+	FailOpen bool
+
+	// DirMode, if nonzero, is the permission mode used when creating
+	// directories in the local cache. If zero, the default is 0755.
+	DirMode fs.FileMode
+
+	// FileMode, if nonzero, is the permission mode used when writing files to
+	// the local cache. If zero, the default is 0644.
+	FileMode fs.FileMode
+
 	// Logf, if non-nil, is used to write log messages. If nil, logs are
 	// discarded.
 	Logf func(string, ...any)
@@ -84,10 +140,19 @@ type S3Cacher struct {
 	//
 	//    F GET "<name>" hit (<digest>)
 	//
+	// When a GET operation is satisfied from a mirror directory, the log is:
+	//
+	//    M GET "<name>" hit (<mirror-dir>)
+	//
 	// When a PUT operation finishes writing a value behind to S3, the log is:
 	//
 	//    W PUT "<name>", err=<error>, <time> elapsed
 	//
+	// When a request for a private module is rejected by PrivateFilter, the
+	// log is:
+	//
+	//    P "<path>" private
+	//
 	LogRequests bool
 
 	// Tracks tasks interacting with S3 in the background.
@@ -103,23 +168,31 @@ type S3Cacher struct {
 	getFaultHit   expvar.Int // get: hit in S3
 	getFaultMiss  expvar.Int // get: miss in S3
 	getLocalError expvar.Int // get: error reading the local directory
+	getMirrorHit  expvar.Int // get: hit in a mirror directory
 	getFaultError expvar.Int // get: error reading from S3
+	getFaultTime  expvar.Int // get: timeout reading from S3 (treated as miss)
 	getLocalBytes expvar.Int // get: total bytes fetched from the local directory
 	getS3Bytes    expvar.Int // get: total bytes fetched from S3
+	getExpired    expvar.Int // get: mutable file found but expired (treated as miss)
 	putRequest    expvar.Int // total number of Put requests
 	putLocalHit   expvar.Int // put: put of object already stored locally
 	putLocalError expvar.Int // put: error writing the local directory
 	putS3Error    expvar.Int // put: error writing to S3
 	putLocalBytes expvar.Int // put: total bytes written to the local directory
 	putS3Bytes    expvar.Int // put: total bytes written to S3
+	getPrivate    expvar.Int // get: request for a private module (treated as miss)
+	putPrivate    expvar.Int // put: request for a private module (discarded)
+	reqPrivate    expvar.Int // proxy requests rejected for private modules
+
+	prefetchRequest expvar.Int // prefetch: total number of files requested
+	prefetchHit     expvar.Int // prefetch: file present in the local directory
+	prefetchMiss    expvar.Int // prefetch: file not found (skipped)
+	prefetchError   expvar.Int // prefetch: error fetching a file
 }
 
 func (c *S3Cacher) init() {
 	c.initOnce.Do(func() {
-		nt := c.MaxTasks
-		if nt <= 0 {
-			nt = runtime.NumCPU()
-		}
+		nt := c.maxTasks()
 		c.tasks, c.start = taskgroup.New(nil).Limit(nt)
 		c.sema = semaphore.NewWeighted(int64(nt))
 	})
@@ -138,6 +211,12 @@ func (c *S3Cacher) Get(ctx context.Context, name string) (_ io.ReadCloser, oerr
 
 	if err != nil {
 		return nil, err
+	} else if c.IsPrivate(name) {
+		c.getPrivate.Add(1)
+		return nil, fs.ErrNotExist
+	}
+	if isMutableFile(name) {
+		return c.getMutable(ctx, name, hash, path)
 	}
 
 	// Check whether the file already exists locally.
@@ -152,38 +231,121 @@ func (c *S3Cacher) Get(ctx context.Context, name string) (_ io.ReadCloser, oerr
 		c.logf("get %q local: %v (treating as miss)", name, err)
 	}
 
+	// Check whether the file is available in a mirror.
+	if rc, ok := c.getMirror(ctx, name, path); ok {
+		return rc, nil
+	}
+
+	if c.S3Client == nil {
+		return nil, fs.ErrNotExist // local only, cache miss
+	}
+
 	// Local cache miss, fault in from S3.
 	if err := c.sema.Acquire(ctx, 1); err != nil {
 		return nil, err
 	}
 	defer c.sema.Release(1)
 
-	obj, err := c.S3Client.Get(ctx, c.makeKey(hash))
+	// Bound the time we are willing to wait for S3, separately from the
+	// deadline (if any) of the caller.
+	sctx, cancel := context.WithTimeout(ctx, c.getTimeout())
+	defer cancel()
+
+	obj, err := c.S3Client.Get(sctx, c.makeKey(hash))
 	if errors.Is(err, fs.ErrNotExist) {
 		c.getFaultMiss.Add(1)
 		return nil, err
+	} else if isTimeout(ctx, err) {
+		c.getFaultTime.Add(1)
+		c.logf("get %q: S3 read timed out (treating as miss)", name)
+		return nil, fs.ErrNotExist
 	} else if err != nil {
-		c.getFaultError.Add(1)
-		return nil, err
+		return nil, c.faultError(ctx, name, err)
 	}
 	defer obj.Close()
 	c.getFaultHit.Add(1)
 	c.vlogf("mc F GET %q hit (%s)", name, hash)
 
-	if _, err := c.putLocal(ctx, name, path, obj); err != nil {
+	if _, err := c.putLocal(sctx, name, path, obj); isTimeout(ctx, err) {
+		c.getFaultTime.Add(1)
+		c.logf("get %q: S3 read timed out (treating as miss)", name)
+		return nil, fs.ErrNotExist
+	} else if err != nil {
 		return nil, err
 	}
 	rc, _, err := openReader(path)
 	return rc, err
 }
 
+// faultError records a failure to read name from S3 with the given error, and
+// returns the error to report from Get. If FailOpen is set, the error is
+// reported as a miss, unless ctx has ended.
+func (c *S3Cacher) faultError(ctx context.Context, name string, err error) error {
+	c.getFaultError.Add(1)
+	if !c.FailOpen || ctx.Err() != nil {
+		return err
+	}
+	c.logf("get %q: S3 read failed: %v (treating as miss)", name, err)
+	return fs.ErrNotExist
+}
+
+// getMirror checks the mirror directories for the specified name, and if it is
+// found copies it into the local cache at path and returns a reader for it.
+// Errors reading the mirrors are logged and treated as misses.
+func (c *S3Cacher) getMirror(ctx context.Context, name, path string) (io.ReadCloser, bool) {
+	if len(c.MirrorDirs) == 0 || !isModuleFile(name) {
+		return nil, false
+	}
+	for _, dir := range c.MirrorDirs {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			c.logf("get %q mirror: %v (treating as miss)", name, err)
+			continue
+		}
+		_, err = c.putLocal(ctx, name, path, f)
+		f.Close()
+		if err != nil {
+			c.logf("get %q mirror: copy to local: %v", name, err)
+			return nil, false
+		}
+		rc, size, err := openReader(path)
+		if err != nil {
+			return nil, false
+		}
+		c.getMirrorHit.Add(1)
+		c.getLocalBytes.Add(size)
+		c.vlogf("mc M GET %q hit (%s)", name, dir)
+		return rc, true
+	}
+	return nil, false
+}
+
+// isModuleFile reports whether name is the cache name of an immutable module
+// file, of the form "<module>/@v/<version>.{info,mod,zip}".
+func isModuleFile(name string) bool {
+	if name != path.Clean(name) || path.IsAbs(name) || strings.HasPrefix(name, "../") {
+		return false // not a clean relative path
+	}
+	dir, file := path.Split(name)
+	if !strings.HasSuffix(dir, "/@v/") {
+		return false
+	}
+	switch path.Ext(file) {
+	case ".info", ".mod", ".zip":
+		return true
+	}
+	return false
+}
+
 // putLocal reports whether the specified path already exists in the local
 // cache, and if not, writes data atomically into the path.
 func (c *S3Cacher) putLocal(ctx context.Context, name, path string, data io.Reader) (bool, error) {
 	if _, err := os.Stat(path); err == nil {
 		return true, nil
 	}
-	nw, err := atomicfile.WriteAll(path, data, 0644)
+	nw, err := atomicfile.WriteAll(path, data, c.fileMode())
 	c.putLocalBytes.Add(nw)
 	if err != nil {
 		c.putLocalError.Add(1)
@@ -204,6 +366,12 @@ func (c *S3Cacher) Put(ctx context.Context, name string, data io.ReadSeeker) (oe
 
 	if err != nil {
 		return err
+	} else if c.IsPrivate(name) {
+		c.putPrivate.Add(1)
+		return nil
+	}
+	if isMutableFile(name) {
+		return c.putMutable(ctx, name, hash, path, data)
 	}
 
 	if ok, err := c.putLocal(ctx, name, path, data); err != nil {
@@ -211,6 +379,8 @@ func (c *S3Cacher) Put(ctx context.Context, name string, data io.ReadSeeker) (oe
 	} else if ok {
 		c.putLocalHit.Add(1)
 		return nil
+	} else if c.S3Client == nil {
+		return nil // local only, nothing to upload
 	}
 
 	// Try to push the object to S3 in the background.
@@ -224,7 +394,7 @@ func (c *S3Cacher) Put(ctx context.Context, name string, data io.ReadSeeker) (oe
 		start := time.Now()
 
 		// Override the context with a separate timeout in case S3 is farkakte.
-		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 1*time.Minute)
+		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.putTimeout())
 		defer cancel()
 
 		if err := c.S3Client.Put(sctx, c.makeKey(hash), f); err != nil {
@@ -256,18 +426,35 @@ func (c *S3Cacher) Metrics() *expvar.Map {
 	m.Set("get_fault_hit", &c.getFaultHit)
 	m.Set("get_fault_miss", &c.getFaultMiss)
 	m.Set("get_local_error", &c.getLocalError)
+	m.Set("get_mirror_hit", &c.getMirrorHit)
+	m.Set("get_fault_error", &c.getFaultError)
+	m.Set("get_fault_timeout", &c.getFaultTime)
 	m.Set("get_local_bytes", &c.getLocalBytes)
 	m.Set("get_s3_bytes", &c.getS3Bytes)
+	m.Set("get_expired", &c.getExpired)
 	m.Set("put_request", &c.putRequest)
 	m.Set("put_local_hit", &c.putLocalHit)
 	m.Set("put_local_error", &c.putLocalError)
 	m.Set("put_s3_error", &c.putS3Error)
 	m.Set("put_local_bytes", &c.putLocalBytes)
 	m.Set("put_s3_bytes", &c.putS3Bytes)
+	m.Set("get_private", &c.getPrivate)
+	m.Set("put_private", &c.putPrivate)
+	m.Set("req_private", &c.reqPrivate)
+	m.Set("prefetch_request", &c.prefetchRequest)
+	m.Set("prefetch_hit", &c.prefetchHit)
+	m.Set("prefetch_miss", &c.prefetchMiss)
+	m.Set("prefetch_error", &c.prefetchError)
 	return m
 }
 
+// hashName returns the storage digest for name. Mutable files are stored in a
+// different format from other files, so their names are marked to keep them
+// distinct from entries stored before expiration was recorded.
 func hashName(name string) string {
+	if isMutableFile(name) {
+		name = "mutable:" + name
+	}
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(name)))
 }
 
@@ -282,13 +469,54 @@ func (c *S3Cacher) makeKey(hash string) string {
 func (c *S3Cacher) makePath(name string) (hash, path string, err error) {
 	hash = hashName(name)
 	path = filepath.Join(c.Local, hash[:2], hash)
-	err = os.MkdirAll(filepath.Dir(path), 0755)
+	err = os.MkdirAll(filepath.Dir(path), c.dirMode())
 	if err != nil {
 		c.pathError.Add(1)
 	}
 	return hash, path, err
 }
 
+func (c *S3Cacher) maxTasks() int {
+	if c.MaxTasks <= 0 {
+		return runtime.NumCPU()
+	}
+	return c.MaxTasks
+}
+
+func (c *S3Cacher) dirMode() fs.FileMode {
+	if c.DirMode != 0 {
+		return c.DirMode
+	}
+	return 0755
+}
+
+func (c *S3Cacher) fileMode() fs.FileMode {
+	if c.FileMode != 0 {
+		return c.FileMode
+	}
+	return 0644
+}
+
+func (c *S3Cacher) getTimeout() time.Duration {
+	if c.S3Timeout > 0 {
+		return c.S3Timeout
+	}
+	return 20 * time.Second
+}
+
+func (c *S3Cacher) putTimeout() time.Duration {
+	if c.S3Timeout > 0 {
+		return c.S3Timeout
+	}
+	return 1 * time.Minute
+}
+
+// isTimeout reports whether err is due to an S3 deadline expiring, rather than
+// cancellation or expiration of the parent context ctx.
+func isTimeout(ctx context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil
+}
+
 func (c *S3Cacher) logf(msg string, args ...any) {
 	if c.Logf != nil {
 		c.Logf(msg, args...)
@@ -0,0 +1,503 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tailscale/go-cache-plugin/lib/s3util"
+)
+
+// fakeS3 is a minimal in-memory implementation of the S3 object API, for use
+// as a backing store in tests.
+type fakeS3 struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case "GET", "HEAD":
+		data, ok := f.data[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Write(data)
+	case "PUT":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if f.data == nil {
+			f.data = make(map[string][]byte)
+		}
+		f.data[r.URL.Path] = data
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+// newTestClient returns an S3 client backed by a new fakeS3 instance.
+func newTestClient(t *testing.T) *s3util.Client {
+	t.Helper()
+	srv := httptest.NewServer(new(fakeS3))
+	t.Cleanup(srv.Close)
+	return &s3util.Client{
+		Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		Bucket: "test-bucket",
+	}
+}
+
+func TestMirrorDirs(t *testing.T) {
+	// Populate two mirrors in module download cache layout.
+	mirror1, mirror2 := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		filepath.Join(mirror1, "example.com/!foo/@v/v1.0.0.mod"): "module example.com/Foo\n",
+		filepath.Join(mirror2, "example.com/!foo/@v/v1.0.0.mod"): "wrong mirror\n",
+		filepath.Join(mirror2, "example.com/!foo/@v/v1.0.0.zip"): "zip data",
+		filepath.Join(mirror2, "example.com/!foo/@v/list"):       "v1.0.0\n",
+	}
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &S3Cacher{
+		Local:      t.TempDir(),
+		MirrorDirs: []string{mirror1, mirror2},
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	get := func(name string) (string, error) {
+		t.Helper()
+		rc, err := c.Get(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		return string(data), err
+	}
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"example.com/!foo/@v/v1.0.0.mod", "module example.com/Foo\n"},
+		{"example.com/!foo/@v/v1.0.0.zip", "zip data"},
+	} {
+		if got, err := get(tc.name); err != nil || got != tc.want {
+			t.Errorf("Get %q: got (%q, %v), want %q", tc.name, got, err, tc.want)
+		}
+	}
+
+	// Version lists and unclean names are not read from mirrors.
+	for _, name := range []string{
+		"example.com/!foo/@v/list",
+		"example.com/!foo/@v/../@v/v1.0.0.zip",
+		"../mirror/@v/v1.0.0.zip",
+	} {
+		if _, err := get(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Get %q: got err=%v, want %v", name, err, fs.ErrNotExist)
+		}
+	}
+	if got := c.getMirrorHit.Value(); got != 2 {
+		t.Errorf("Mirror hits: got %d, want 2", got)
+	}
+
+	// Files copied from a mirror are subsequently served locally.
+	os.RemoveAll(mirror1)
+	os.RemoveAll(mirror2)
+	if got, err := get("example.com/!foo/@v/v1.0.0.zip"); err != nil || got != "zip data" {
+		t.Errorf("Get after mirror removal: got (%q, %v), want zip data", got, err)
+	}
+	if got := c.getLocalHit.Value(); got != 1 {
+		t.Errorf("Local hits: got %d, want 1", got)
+	}
+}
+
+func TestPrivatePatterns(t *testing.T) {
+	c := &S3Cacher{
+		Local:           t.TempDir(),
+		PrivatePatterns: []string{"example.com/private", "*.corp.example.com"},
+	}
+	defer c.Close()
+
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"example.com/private/@v/list", true},
+		{"example.com/private/sub/@v/v1.0.0.zip", true},
+		{"example.com/privateer/@v/list", false},
+		{"git.corp.example.com/foo/@latest", true},
+		{"example.com/!foo/@v/v1.0.0.mod", false},
+		{"sumdb/sum.golang.org/lookup/example.com/private@v1.0.0", true},
+		{"sumdb/sum.golang.org/lookup/example.com/public@v1.0.0", false},
+		{"sumdb/sum.golang.org/latest", false},
+		{"example.com/private", false}, // not a proxy request
+	} {
+		if got := c.IsPrivate(tc.name); got != tc.want {
+			t.Errorf("IsPrivate(%q): got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Private modules are not stored or served by the cache.
+	ctx := context.Background()
+	const name = "example.com/private/@v/v1.0.0.mod"
+	if err := c.Put(ctx, name, strings.NewReader("module example.com/private\n")); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if _, err := c.Get(ctx, name); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get: got err=%v, want %v", err, fs.ErrNotExist)
+	}
+	if got := c.putLocalBytes.Value(); got != 0 {
+		t.Errorf("Put stored %d bytes, want 0", got)
+	}
+
+	// The filter rejects private requests without consulting the proxy.
+	var forwarded []string
+	h := c.PrivateFilter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.URL.Path)
+	}))
+	for _, path := range []string{"/example.com/private/@v/list", "/example.com/public/@v/list"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		want := http.StatusOK
+		if c.IsPrivate(strings.TrimPrefix(path, "/")) {
+			want = http.StatusNotFound
+		}
+		if got := rec.Code; got != want {
+			t.Errorf("GET %s: got status %d, want %d", path, got, want)
+		}
+	}
+	if want := []string{"/example.com/public/@v/list"}; !slices.Equal(forwarded, want) {
+		t.Errorf("Forwarded: got %q, want %q", forwarded, want)
+	}
+}
+
+func TestMutableFiles(t *testing.T) {
+	client := newTestClient(t)
+	c := &S3Cacher{
+		Local:      t.TempDir(),
+		S3Client:   client,
+		MutableTTL: time.Hour,
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	get := func(c *S3Cacher, name string) (string, error) {
+		t.Helper()
+		rc, err := c.Get(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		return string(data), err
+	}
+	put := func(name, data string) {
+		t.Helper()
+		if err := c.Put(ctx, name, strings.NewReader(data)); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", name, err)
+		}
+	}
+
+	// Each put of a mutable file replaces its value, unlike immutable files.
+	const listName, modName = "example.com/foo/@v/list", "example.com/foo/@v/v1.0.0.mod"
+	put(listName, "v1.0.0\n")
+	put(listName, "v1.0.0\nv1.1.0\n")
+	put(modName, "module example.com/foo\n")
+	put(modName, "module example.com/bar\n")
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{listName, "v1.0.0\nv1.1.0\n"},
+		{modName, "module example.com/foo\n"},
+	} {
+		if got, err := get(c, tc.name); err != nil || got != tc.want {
+			t.Errorf("Get %q: got (%q, %v), want %q", tc.name, got, err, tc.want)
+		}
+	}
+
+	// A cacher with an empty local directory faults in the value from S3.
+	c.Close()
+	c2 := &S3Cacher{Local: t.TempDir(), S3Client: client}
+	defer c2.Close()
+	if got, err := get(c2, listName); err != nil || got != "v1.0.0\nv1.1.0\n" {
+		t.Errorf("Get %q from S3: got (%q, %v), want v1.1.0", listName, got, err)
+	}
+
+	// Once expired, a mutable file is reported as missing, locally and in S3.
+	c.MutableTTL = time.Nanosecond
+	const latestName = "example.com/foo/@latest"
+	put(latestName, `{"Version":"v1.1.0"}`)
+	c.Close()
+	for _, tc := range []struct {
+		c    *S3Cacher
+		want int64 // expired entries found
+	}{
+		{c, 2}, // local and S3
+		{&S3Cacher{Local: t.TempDir(), S3Client: client}, 1}, // S3 only
+	} {
+		if _, err := get(tc.c, latestName); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Get %q: got err=%v, want %v", latestName, err, fs.ErrNotExist)
+		}
+		if got := tc.c.getExpired.Value(); got != tc.want {
+			t.Errorf("Expired: got %d, want %d", got, tc.want)
+		}
+	}
+}
+
+func TestIsMutableFile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"example.com/foo/@v/list", true},
+		{"example.com/foo/@latest", true},
+		{"example.com/foo/@v/v1.0.0.info", false},
+		{"example.com/foo/@v/v1.0.0.mod", false},
+		{"example.com/foo/@v/v1.0.0.zip", false},
+		{"example.com/list", false},
+	} {
+		if got := isMutableFile(tc.name); got != tc.want {
+			t.Errorf("isMutableFile(%q): got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	s3c := newTestClient(t)
+	ctx := context.Background()
+
+	// Store some files via one cacher, so they are written through to S3.
+	files := map[string]string{
+		"example.com/!foo/@v/v1.0.0.info": `{"Version":"v1.0.0"}`,
+		"example.com/!foo/@v/v1.0.0.mod":  "module example.com/Foo\n",
+		"example.com/!foo/@v/v1.0.0.zip":  "zip data",
+	}
+	w := &S3Cacher{Local: t.TempDir(), S3Client: s3c}
+	for name, data := range files {
+		if err := w.Put(ctx, name, strings.NewReader(data)); err != nil {
+			t.Fatalf("Put %q: %v", name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Prefetch them into a separate cacher with an empty local directory.
+	c := &S3Cacher{Local: t.TempDir(), S3Client: s3c, MaxTasks: 2}
+	defer c.Close()
+	names := slices.Sorted(maps.Keys(files))
+	names = append(names, "example.com/!foo/@v/v2.0.0.zip") // not cached
+	if err := c.Prefetch(ctx, names); err != nil {
+		t.Fatalf("Prefetch: unexpected error: %v", err)
+	}
+	if got := c.prefetchHit.Value(); got != 3 {
+		t.Errorf("Prefetch hits: got %d, want 3", got)
+	}
+	if got := c.prefetchMiss.Value(); got != 1 {
+		t.Errorf("Prefetch misses: got %d, want 1", got)
+	}
+	if got := c.getFaultHit.Value(); got != 3 {
+		t.Errorf("Fault hits: got %d, want 3", got)
+	}
+
+	// Prefetched files are subsequently served locally.
+	for name, want := range files {
+		rc, err := c.Get(ctx, name)
+		if err != nil {
+			t.Fatalf("Get %q: %v", name, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(data) != want {
+			t.Errorf("Get %q: got (%q, %v), want %q", name, data, err, want)
+		}
+	}
+	if got := c.getLocalHit.Value(); got != 3 {
+		t.Errorf("Local hits: got %d, want 3", got)
+	}
+}
+
+func TestFileNames(t *testing.T) {
+	const goSum = `example.com/Foo v1.0.0 h1:abc=
+example.com/Foo v1.0.0/go.mod h1:def=
+example.com/bar v0.1.0/go.mod h1:ghi=
+`
+	const goMod = `module example.com/main
+
+go 1.23
+
+require (
+	example.com/Foo v1.0.0
+	example.com/bar v0.1.0 // indirect
+	example.com/local v0.0.0
+)
+
+replace example.com/bar => example.com/baz v0.2.0
+
+replace example.com/local => ../local
+`
+	for _, tc := range []struct {
+		label string
+		parse func([]byte) ([]string, error)
+		input string
+		want  []string
+	}{
+		{"go.sum", SumFileNames, goSum, []string{
+			"example.com/!foo/@v/v1.0.0.info",
+			"example.com/!foo/@v/v1.0.0.mod",
+			"example.com/!foo/@v/v1.0.0.zip",
+			"example.com/bar/@v/v0.1.0.mod",
+		}},
+		{"go.mod", ModFileNames, goMod, []string{
+			"example.com/!foo/@v/v1.0.0.info",
+			"example.com/!foo/@v/v1.0.0.mod",
+			"example.com/!foo/@v/v1.0.0.zip",
+			"example.com/baz/@v/v0.2.0.info",
+			"example.com/baz/@v/v0.2.0.mod",
+			"example.com/baz/@v/v0.2.0.zip",
+		}},
+	} {
+		got, err := tc.parse([]byte(tc.input))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.label, err)
+		} else if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.label, got, tc.want)
+		}
+	}
+
+	if _, err := SumFileNames([]byte("example.com/Foo v1.0.0\n")); err == nil {
+		t.Error("SumFileNames: got nil error for malformed input")
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `<Error><Code>AccessDenied</Code></Error>`)
+	}))
+	defer srv.Close()
+	client := &s3util.Client{
+		Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		Bucket: "test-bucket",
+	}
+	ctx := context.Background()
+	names := []string{"example.com/foo/@v/v1.0.0.mod", "example.com/foo/@v/list"}
+
+	// By default, S3 errors are reported to the caller.
+	c := &S3Cacher{Local: t.TempDir(), S3Client: client}
+	defer c.Close()
+	for _, name := range names {
+		if _, err := c.Get(ctx, name); err == nil || errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Get %q: got error %v, want an S3 error", name, err)
+		}
+	}
+
+	// With FailOpen, they are reported as misses.
+	c = &S3Cacher{Local: t.TempDir(), S3Client: client, FailOpen: true}
+	defer c.Close()
+	for _, name := range names {
+		if _, err := c.Get(ctx, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Get %q: got error %v, want %v", name, err, fs.ErrNotExist)
+		}
+	}
+	if got := c.getFaultError.Value(); got != int64(len(names)) {
+		t.Errorf("Fault errors: got %d, want %d", got, len(names))
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	c := &S3Cacher{
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+		DirMode:  0700,
+		FileMode: 0600,
+	}
+	defer c.Close()
+
+	const name = "example.com/foo/@v/v1.0.0.mod"
+	if err := c.Put(context.Background(), name, strings.NewReader("module example.com/foo\n")); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	_, path, err := c.makePath(name)
+	if err != nil {
+		t.Fatalf("makePath: %v", err)
+	}
+	for _, tc := range []struct {
+		path string
+		want fs.FileMode
+	}{
+		{path, c.FileMode},
+		{filepath.Dir(path), c.DirMode},
+	} {
+		fi, err := os.Stat(tc.path)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if got := fi.Mode().Perm(); got != tc.want {
+			t.Errorf("Mode of %s: got %v, want %v", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestLocalOnly(t *testing.T) {
+	c := &S3Cacher{Local: t.TempDir()} // no S3 client
+	defer c.Close()
+	ctx := context.Background()
+
+	const name = "example.com/foo/@v/v1.0.0.mod"
+	if _, err := c.Get(ctx, name); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get missing: got error %v, want %v", err, fs.ErrNotExist)
+	}
+	const content = "module example.com/foo\n"
+	if err := c.Put(ctx, name, strings.NewReader(content)); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	rc, err := c.Get(ctx, name)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(data) != content {
+		t.Errorf("Get: got (%q, %v), want %q", data, err, content)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+)
+
+// isMutableFile reports whether name is the cache name of a module file whose
+// content changes as new versions are published, namely a version list
+// ("<module>/@v/list") or a latest-version query ("<module>/@latest").
+func isMutableFile(name string) bool {
+	return strings.HasSuffix(name, "/@v/list") || strings.HasSuffix(name, "/@latest")
+}
+
+// getMutable reads the mutable file for name from the local cache at path, or
+// faults it in from S3. Entries that have expired are reported as missing.
+func (c *S3Cacher) getMutable(ctx context.Context, name, hash, path string) (io.ReadCloser, error) {
+	now := time.Now()
+	if data, err := os.ReadFile(path); err == nil {
+		if body, ok := parseMutable(data, now); ok {
+			c.getLocalHit.Add(1)
+			c.getLocalBytes.Add(int64(len(body)))
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		c.getExpired.Add(1)
+		c.getLocalMiss.Add(1)
+	} else if errors.Is(err, fs.ErrNotExist) {
+		c.getLocalMiss.Add(1)
+	} else {
+		c.getLocalError.Add(1)
+		c.logf("get %q local: %v (treating as miss)", name, err)
+	}
+	if c.S3Client == nil {
+		return nil, fs.ErrNotExist // local only, cache miss
+	}
+
+	if err := c.sema.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	defer c.sema.Release(1)
+	sctx, cancel := context.WithTimeout(ctx, c.getTimeout())
+	defer cancel()
+
+	data, err := c.S3Client.GetData(sctx, c.makeKey(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		c.getFaultMiss.Add(1)
+		return nil, err
+	} else if isTimeout(ctx, err) {
+		c.getFaultTime.Add(1)
+		c.logf("get %q: S3 read timed out (treating as miss)", name)
+		return nil, fs.ErrNotExist
+	} else if err != nil {
+		return nil, c.faultError(ctx, name, err)
+	}
+	body, ok := parseMutable(data, now)
+	if !ok {
+		c.getExpired.Add(1)
+		c.getFaultMiss.Add(1)
+		return nil, fs.ErrNotExist
+	}
+	c.getFaultHit.Add(1)
+	c.getS3Bytes.Add(int64(len(data)))
+	c.vlogf("mc F GET %q hit (%s)", name, hash)
+
+	// Replace the local copy, which is missing or expired.
+	if err := atomicfile.WriteData(path, data, c.fileMode()); err != nil {
+		c.putLocalError.Add(1)
+		c.logf("get %q: update local: %v", name, err)
+	} else {
+		c.putLocalBytes.Add(int64(len(data)))
+	}
+	return io.NopCloser(bytes.NewReader(body)), nil
+}
+
+// putMutable stores data as the mutable file for name in the local cache at
+// path, replacing any previous value, and writes it to S3 in the background.
+func (c *S3Cacher) putMutable(ctx context.Context, name, hash, path string, data io.Reader) error {
+	body, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	entry := formatMutable(body, time.Now().Add(c.mutableTTL()))
+	if err := atomicfile.WriteData(path, entry, c.fileMode()); err != nil {
+		c.putLocalError.Add(1)
+		return err
+	}
+	c.putLocalBytes.Add(int64(len(entry)))
+	if c.S3Client == nil {
+		return nil // local only, nothing to upload
+	}
+	c.start(func() error {
+		start := time.Now()
+		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.putTimeout())
+		defer cancel()
+
+		err := c.S3Client.Put(sctx, c.makeKey(hash), bytes.NewReader(entry))
+		if err != nil {
+			c.putS3Error.Add(1)
+			c.logf("[s3] put %q failed: %v", name, err)
+		} else {
+			c.putS3Bytes.Add(int64(len(entry)))
+		}
+		c.vlogf("mc W PUT %q, err=%v %v elapsed", name, err, time.Since(start))
+		return err
+	})
+	return nil
+}
+
+// formatMutable encodes body as a mutable cache entry that expires at the
+// specified time. The entry is a line "expires <timestamp>" followed by the
+// contents of body, where the timestamp is in Unix nanoseconds.
+func formatMutable(body []byte, expires time.Time) []byte {
+	return fmt.Appendf(nil, "expires %d\n%s", expires.UnixNano(), body)
+}
+
+// parseMutable decodes a mutable cache entry, and returns its body if it is
+// valid and has not expired as of now.
+func parseMutable(data []byte, now time.Time) ([]byte, bool) {
+	line, body, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return nil, false
+	}
+	ts, ok := strings.CutPrefix(string(line), "expires ")
+	if !ok {
+		return nil, false
+	}
+	nsec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || !now.Before(time.Unix(0, nsec)) {
+		return nil, false
+	}
+	return body, true
+}
+
+func (c *S3Cacher) mutableTTL() time.Duration {
+	if c.MutableTTL > 0 {
+		return c.MutableTTL
+	}
+	return 5 * time.Minute
+}
@@ -0,0 +1,142 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/creachadair/taskgroup"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// Prefetch faults in the specified cache files from S3 (or a mirror) into the
+// local cache directory, so that later requests for them are local hits.
+// Names have the same form as those passed to Get, for example
+// "golang.org/x/mod/@v/v0.21.0.zip". At most MaxTasks files are fetched at
+// once.
+//
+// Files already present locally are left alone, and files not found in the
+// cache are skipped, since the proxy will fetch them from upstream on demand.
+// If any file cannot be fetched for another reason, Prefetch reports the
+// first such error after all the fetches have finished.
+func (c *S3Cacher) Prefetch(ctx context.Context, names []string) error {
+	c.init()
+	g, start := taskgroup.New(nil).Limit(c.maxTasks())
+	for _, name := range names {
+		c.prefetchRequest.Add(1)
+		start(func() error {
+			rc, err := c.Get(ctx, name)
+			if errors.Is(err, fs.ErrNotExist) {
+				c.prefetchMiss.Add(1)
+				return nil
+			} else if err != nil {
+				c.prefetchError.Add(1)
+				return fmt.Errorf("prefetch %q: %w", name, err)
+			}
+			c.prefetchHit.Add(1)
+			return rc.Close()
+		})
+	}
+	return g.Wait()
+}
+
+// SumFileNames returns the names of the cache files for the module versions
+// listed in data, which must be in the format of a go.sum file. Each module
+// version yields its .info, .mod, and .zip files, while a "/go.mod" entry
+// yields only the .mod file. Names are returned in order of first mention,
+// without duplicates.
+func SumFileNames(data []byte) ([]string, error) {
+	var fl fileList
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for ln := 1; sc.Scan(); ln++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: malformed go.sum entry", ln)
+		}
+		mod, vers := fields[0], fields[1]
+		if v, ok := strings.CutSuffix(vers, "/go.mod"); ok {
+			if err := fl.add(mod, v, ".mod"); err != nil {
+				return nil, fmt.Errorf("line %d: %w", ln, err)
+			}
+		} else if err := fl.add(mod, vers, ".info", ".mod", ".zip"); err != nil {
+			return nil, fmt.Errorf("line %d: %w", ln, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return fl.names, nil
+}
+
+// ModFileNames returns the names of the cache files for the module versions
+// required by data, which must be in the format of a go.mod file. Each
+// requirement yields its .info, .mod, and .zip files. Requirements replaced by
+// another module version are mapped to the replacement, and those replaced by
+// a local directory are omitted. Names are returned in order of first mention,
+// without duplicates.
+func ModFileNames(data []byte) ([]string, error) {
+	mf, err := modfile.Parse("go.mod", data, nil)
+	if err != nil {
+		return nil, err
+	}
+	repl := make(map[module.Version]module.Version)
+	for _, r := range mf.Replace {
+		repl[r.Old] = r.New
+	}
+	var fl fileList
+	for _, req := range mf.Require {
+		mv := req.Mod
+		if r, ok := repl[mv]; ok {
+			mv = r
+		} else if r, ok := repl[module.Version{Path: mv.Path}]; ok {
+			mv = r
+		}
+		if mv.Version == "" {
+			continue // replaced by a local directory
+		}
+		if err := fl.add(mv.Path, mv.Version, ".info", ".mod", ".zip"); err != nil {
+			return nil, err
+		}
+	}
+	return fl.names, nil
+}
+
+// fileList accumulates a list of cache file names without duplicates.
+type fileList struct {
+	names []string
+	seen  map[string]bool
+}
+
+// add adds the names of the files for the specified module version with each
+// of the given extensions.
+func (f *fileList) add(mod, vers string, exts ...string) error {
+	emod, err := module.EscapePath(mod)
+	if err != nil {
+		return err
+	}
+	evers, err := module.EscapeVersion(vers)
+	if err != nil {
+		return err
+	}
+	if f.seen == nil {
+		f.seen = make(map[string]bool)
+	}
+	for _, ext := range exts {
+		name := emod + "/@v/" + evers + ext
+		if !f.seen[name] {
+			f.seen[name] = true
+			f.names = append(f.names, name)
+		}
+	}
+	return nil
+}
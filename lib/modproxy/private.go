@@ -0,0 +1,71 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// IsPrivate reports whether name, a file name presented to the cache or the
+// path of a module proxy request without its leading slash, refers to a module
+// matched by c.PrivatePatterns. Checksum database lookups for such modules
+// ("sumdb/<host>/lookup/<module>@<version>") are also considered private.
+func (c *S3Cacher) IsPrivate(name string) bool {
+	if len(c.PrivatePatterns) == 0 {
+		return false
+	}
+	modPath, ok := requestModulePath(name)
+	return ok && module.MatchPrefixPatterns(strings.Join(c.PrivatePatterns, ","), modPath)
+}
+
+// PrivateFilter returns a handler that responds to module proxy requests for
+// private modules (see [S3Cacher.IsPrivate]) with HTTP 404 (Not Found), and
+// forwards all other requests to h. A toolchain configured with a fallback in
+// GOPROXY, such as "https://cache.example.com/mod,direct", then fetches the
+// private modules directly, without involving the cache or upstream proxy.
+//
+// The filter must receive request paths relative to the root of the module
+// proxy, as for h.
+func (c *S3Cacher) PrivateFilter(h http.Handler) http.Handler {
+	if len(c.PrivatePatterns) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.IsPrivate(strings.TrimPrefix(r.URL.Path, "/")) {
+			c.reqPrivate.Add(1)
+			c.vlogf("mc P %q private", r.URL.Path)
+			w.Header().Set("Cache-Control", "no-store")
+			http.Error(w, "not found: private module", http.StatusNotFound)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestModulePath extracts the module path from the name of a module proxy
+// file or checksum database lookup. It reports false if name does not have
+// one of those forms.
+func requestModulePath(name string) (string, bool) {
+	if rest, ok := strings.CutPrefix(name, "sumdb/"); ok {
+		_, lookup, ok := strings.Cut(rest, "/lookup/")
+		if !ok {
+			return "", false
+		}
+		escaped, _, ok := strings.Cut(lookup, "@")
+		if !ok {
+			return "", false
+		}
+		modPath, err := module.UnescapePath(escaped)
+		return modPath, err == nil
+	}
+	escaped, _, ok := strings.Cut(name, "/@")
+	if !ok {
+		return "", false
+	}
+	modPath, err := module.UnescapePath(escaped)
+	return modPath, err == nil
+}
@@ -0,0 +1,88 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker tracks the health of upstream target hosts, to implement a circuit
+// breaker for requests forwarded to targets that are failing.
+type breaker struct {
+	threshold int           // consecutive failures to trip the breaker
+	window    time.Duration // maximum span of failures counted together
+	cooldown  time.Duration // how long the breaker stays open once tripped
+
+	mu    sync.Mutex
+	hosts map[string]*breakerState
+}
+
+// breakerState records the failure history of a single host.
+type breakerState struct {
+	failures  int       // consecutive failures observed
+	firstFail time.Time // when the first of the current failures occurred
+	openUntil time.Time // if non-zero, the breaker is open until this time
+}
+
+// allow reports whether a request to host should be forwarded.  If not, it
+// also reports how long remains until the breaker will admit requests again.
+func (b *breaker) allow(host string, now time.Time) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.hosts[host]
+	if !ok || st.openUntil.IsZero() {
+		return 0, true
+	} else if now.Before(st.openUntil) {
+		return st.openUntil.Sub(now), false
+	}
+
+	// The cooldown has expired. Let requests through, but leave the breaker
+	// "half-open" so that a single additional failure will trip it again.
+	st.openUntil = time.Time{}
+	st.failures = b.threshold - 1
+	st.firstFail = now
+	return 0, true
+}
+
+// record updates the state for host with the result of a forwarded request.
+// It reports whether this result caused the breaker to trip.
+//
+// If the request failed and the target asked to wait for retryAfter before
+// sending more requests, a breaker tripped by this result stays open for at
+// least that long, and a breaker that is already open is extended to that
+// time if it would otherwise close sooner. The retryAfter delay is capped at
+// maxRetryAfter, so that a target cannot hold the breaker open indefinitely.
+func (b *breaker) record(host string, ok bool, retryAfter time.Duration, now time.Time) bool {
+	retryAfter = min(max(retryAfter, 0), maxRetryAfter)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		delete(b.hosts, host)
+		return false
+	}
+	st, found := b.hosts[host]
+	if !found {
+		if b.hosts == nil {
+			b.hosts = make(map[string]*breakerState)
+		}
+		st = new(breakerState)
+		b.hosts[host] = st
+	}
+	if !st.openUntil.IsZero() {
+		if until := now.Add(retryAfter); until.After(st.openUntil) {
+			st.openUntil = until
+		}
+		return false // already tripped
+	}
+	if st.failures == 0 || now.Sub(st.firstFail) > b.window {
+		st.failures, st.firstFail = 0, now
+	}
+	st.failures++
+	if st.failures >= b.threshold {
+		st.openUntil = now.Add(max(b.cooldown, retryAfter))
+		return true
+	}
+	return false
+}
@@ -4,8 +4,11 @@
 package revproxy
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -13,6 +16,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,40 +26,138 @@ import (
 )
 
 // cacheLoadLocal reads cached headers and body from the local cache.
-func (s *Server) cacheLoadLocal(hash string) ([]byte, http.Header, error) {
-	data, err := os.ReadFile(s.makePath(hash))
+// If DisableLocalCache is true, it reports fs.ErrNotExist.
+func (s *Server) cacheLoadLocal(host, hash string) ([]byte, http.Header, error) {
+	if s.DisableLocalCache {
+		return nil, nil, fs.ErrNotExist
+	}
+	path := s.makePath(host, hash)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.index.remove(hash) // removed externally
+	}
 	if err != nil {
 		return nil, nil, err
 	}
-	return parseCacheObject(data)
+	body, hdr, err := parseCacheObject(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.MaxImmutableAge > 0 {
+		stored, ok := storedTime(hdr)
+		if !ok {
+			// Objects written before the storage time was recorded use the
+			// modification time of the file instead.
+			fi, err := os.Stat(path)
+			if err != nil {
+				return nil, nil, err
+			}
+			stored = fi.ModTime()
+		}
+		if s.isTooOld(stored) {
+			s.reqLocalExpired.Add(1)
+			return nil, nil, fs.ErrNotExist
+		}
+	}
+	s.index.touch(hash)
+	return body, hdr, nil
 }
 
 // cacheStoreLocal writes the contents of body to the local cache.
 //
 // The file format is a plain-text section at the top recording a subset of the
 // response headers, followed by "\n\n", followed by the response body.
-func (s *Server) cacheStoreLocal(hash string, hdr http.Header, body []byte) error {
-	path := s.makePath(hash)
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+//
+// The object is staged in a temporary file in the same directory as its
+// final path, not in the system temporary directory, so that the rename that
+// installs it is atomic even if Local is on a separate filesystem.
+//
+// If DisableLocalCache is true, this is a no-op.
+func (s *Server) cacheStoreLocal(host, hash string, hdr http.Header, body []byte) error {
+	if s.DisableLocalCache {
+		return nil
+	}
+	path := s.makePath(host, hash)
+	if err := os.MkdirAll(filepath.Dir(path), s.dirMode()); err != nil {
 		return err
 	}
-	return atomicfile.Tx(s.makePath(hash), 0644, func(f *atomicfile.File) error {
+	if err := atomicfile.Tx(path, s.fileMode(), func(f *atomicfile.File) error {
 		return writeCacheObject(f, hdr, body)
-	})
+	}); err != nil {
+		return err
+	}
+	s.index.add(hash, path)
+	s.maybeEvictLocal()
+	return nil
+}
+
+// maybeEvictLocal removes the least recently used objects from the local
+// cache, if it holds more than MaxDiskEntries objects.
+func (s *Server) maybeEvictLocal() {
+	if s.MaxDiskEntries <= 0 {
+		return
+	}
+	keep := s.MaxDiskEntries - s.MaxDiskEntries/10
+	paths, err := s.index.evict(s.Local, s.MaxDiskEntries, keep)
+	if err != nil {
+		s.logf("evict local cache: %v", err)
+		return
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.logf("evict %q: %v", filepath.Base(path), err)
+			continue
+		}
+		s.rspEvict.Add(1)
+	}
+	if len(paths) != 0 {
+		s.vlogf("rp evicted %d local entries", len(paths))
+	}
 }
 
 // cacheLoadS3 reads cached headers and body from the remote S3 cache.
-func (s *Server) cacheLoadS3(ctx context.Context, hash string) ([]byte, http.Header, error) {
-	data, err := s.S3Client.GetData(ctx, s.makeKey(hash))
+func (s *Server) cacheLoadS3(ctx context.Context, tenant, hash string) ([]byte, http.Header, error) {
+	if s.S3Client == nil {
+		return nil, nil, fs.ErrNotExist
+	}
+	data, err := s.S3Client.GetData(ctx, s.makeKey(tenant, hash))
 	if err != nil {
 		return nil, nil, err
 	}
-	return parseCacheObject(data)
+	body, hdr, err := parseCacheObject(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.MaxImmutableAge > 0 {
+		// Objects without a storage time are treated as too old, since S3
+		// does not preserve the original modification time.
+		if stored, ok := storedTime(hdr); !ok || s.isTooOld(stored) {
+			s.reqFaultExpired.Add(1)
+			return nil, nil, fs.ErrNotExist
+		}
+	}
+	return body, hdr, nil
+}
+
+// storedTime returns the storage time recorded in the header of a cache
+// object, and reports whether it was present and valid.
+func storedTime(hdr http.Header) (time.Time, bool) {
+	t, err := http.ParseTime(hdr.Get("X-Cache-Stored"))
+	return t, err == nil
+}
+
+// isTooOld reports whether a cache object stored at the given time has
+// exceeded MaxImmutableAge, if one is set.
+func (s *Server) isTooOld(stored time.Time) bool {
+	return s.MaxImmutableAge > 0 && time.Since(stored) > s.MaxImmutableAge
 }
 
 // cacheStoreS3 returns a task that writes the contents of body to the remote
-// S3 cache.
-func (s *Server) cacheStoreS3(hash string, hdr http.Header, body []byte) taskgroup.Task {
+// S3 cache. If there is no S3 client, the task does nothing.
+func (s *Server) cacheStoreS3(tenant, hash string, hdr http.Header, body []byte) taskgroup.Task {
+	if s.S3Client == nil {
+		return func() error { return nil }
+	}
 	var buf bytes.Buffer
 	writeCacheObject(&buf, hdr, body)
 	nb := buf.Len()
@@ -63,7 +165,7 @@ func (s *Server) cacheStoreS3(hash string, hdr http.Header, body []byte) taskgro
 		sctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
 		defer cancel()
 
-		if err := s.S3Client.Put(sctx, s.makeKey(hash), &buf); err != nil {
+		if err := s.S3Client.Put(sctx, s.makeKey(tenant, hash), &buf); err != nil {
 			s.logf("[s3] put %q failed: %v", hash, err)
 			s.rspPushError.Add(1)
 		} else {
@@ -76,26 +178,112 @@ func (s *Server) cacheStoreS3(hash string, hdr http.Header, body []byte) taskgro
 
 // cacheLoadMemory reads cached headers and body from the memory cache.
 func (s *Server) cacheLoadMemory(hash string) ([]byte, http.Header, error) {
+	if s.mcache == nil {
+		return nil, nil, fs.ErrNotExist
+	}
 	e, ok := s.mcache.Get(hash)
-	if !ok {
+	if !ok || e.status != 0 || !time.Now().Before(e.expires) {
 		return nil, nil, fs.ErrNotExist
 	}
-	return e.body, e.header, nil
+	return e.body, e.header.Clone(), nil
+}
+
+// cacheLoadStale reads cached headers and body from the memory cache for an
+// entry that has expired, but which may still be served if the target fails.
+func (s *Server) cacheLoadStale(hash string) ([]byte, http.Header, bool) {
+	if s.mcache == nil {
+		return nil, nil, false
+	}
+	e, ok := s.mcache.Get(hash)
+	if !ok || e.status != 0 || !time.Now().Before(e.staleUntil) {
+		return nil, nil, false
+	}
+	return e.body, e.header.Clone(), true
+}
+
+// hasStale reports whether the memory cache has an entry for hash that may be
+// served if the target fails.
+func (s *Server) hasStale(hash string) bool {
+	_, _, ok := s.cacheLoadStale(hash)
+	return ok
+}
+
+// cacheLoadNegative reports whether the memory cache has a negative entry for
+// the specified hash, and if so returns its status code and headers.
+func (s *Server) cacheLoadNegative(hash string) (int, http.Header, bool) {
+	if s.mcache == nil || s.NegativeTTL <= 0 {
+		return 0, nil, false
+	}
+	e, ok := s.mcache.Get(hash)
+	if !ok || e.status == 0 || e.preflight {
+		return 0, nil, false
+	}
+	return e.status, e.header.Clone(), true
 }
 
-// cacheStoreMemory writes the contents of body to the memory cache.
-func (s *Server) cacheStoreMemory(hash string, maxAge time.Duration, hdr http.Header, body []byte) {
+// cacheStoreNegative records a negative entry with the given status code in
+// the memory cache. If the memory cache is disabled, this is a no-op.
+func (s *Server) cacheStoreNegative(hash string, code int, hdr http.Header) {
+	if s.mcache == nil {
+		return
+	}
 	s.mcache.Put(hash, memCacheEntry{
-		header: trimCacheHeader(hdr),
-		body:   body,
+		header: memCacheHeader(hdr, s.NegativeTTL),
+		status: code,
 	})
-	s.expire.After(maxAge, scheddle.Run(func() {
+	s.expire.After(s.NegativeTTL, scheddle.Run(func() {
 		s.mcache.Remove(hash)
 	}))
 }
 
+// cacheStoreMemory writes the contents of body to the memory cache. The entry
+// expires after maxAge, but is retained for a further stale period during
+// which it may be served if the target fails.
+// If the memory cache is disabled, this is a no-op.
+func (s *Server) cacheStoreMemory(hash string, maxAge, stale time.Duration, hdr http.Header, body []byte) {
+	if s.mcache == nil {
+		return
+	}
+	now := time.Now()
+	s.mcache.Put(hash, memCacheEntry{
+		header:     memCacheHeader(hdr, maxAge),
+		body:       body,
+		expires:    now.Add(maxAge),
+		staleUntil: now.Add(maxAge + stale),
+	})
+	s.expire.After(maxAge+stale, scheddle.Run(func() {
+		// The entry may have been replaced by a newer one since this removal
+		// was scheduled, so only remove it if it is no longer usable.
+		if e, ok := s.mcache.Get(hash); ok && e.status == 0 && !time.Now().Before(e.staleUntil) {
+			s.mcache.Remove(hash)
+		}
+	}))
+}
+
+// cacheEvictNegative removes a negative entry for hash from the memory cache,
+// if one is present.
+func (s *Server) cacheEvictNegative(hash string) {
+	if s.mcache == nil {
+		return
+	}
+	if e, ok := s.mcache.Get(hash); ok && e.status != 0 {
+		s.mcache.Remove(hash)
+	}
+}
+
+// memCacheHeader returns a trimmed copy of h for storage in the memory cache,
+// recording the current time as the storage time and the expiration time
+// based on the specified maximum age.
+func memCacheHeader(h http.Header, maxAge time.Duration) http.Header {
+	now := time.Now().UTC()
+	out := trimCacheHeader(h)
+	out.Set("X-Cache-Stored", now.Format(http.TimeFormat))
+	out.Set("X-Cache-Expires", now.Add(maxAge).Format(http.TimeFormat))
+	return out
+}
+
 var keepHeader = []string{
-	"Cache-Control", "Content-Type", "Date", "Etag",
+	"Cache-Control", "Content-Encoding", "Content-Type", "Date", "Etag",
 }
 
 func trimCacheHeader(h http.Header) http.Header {
@@ -125,10 +313,17 @@ func parseCacheObject(data []byte) ([]byte, http.Header, error) {
 }
 
 // writeCacheObject writes the specified response data into a cache object at w.
+//
+// The body is stored as received from the target, so if the response has a
+// Content-Encoding, it is recorded so that the body is served with the same
+// encoding on a cache hit.
 func writeCacheObject(w io.Writer, h http.Header, body []byte) error {
+	hprintf(w, h, "Content-Encoding", "")
 	hprintf(w, h, "Content-Type", "application/octet-stream")
 	hprintf(w, h, "Date", "")
 	hprintf(w, h, "Etag", "")
+	hprintf(w, h, "X-Cache-Stored", time.Now().UTC().Format(http.TimeFormat))
+	hprintf(w, h, "X-Cache-Url", "")
 	fmt.Fprint(w, "\n")
 	_, err := w.Write(body)
 	return err
@@ -143,17 +338,144 @@ func hprintf(w io.Writer, h http.Header, name, fallback string) {
 }
 
 // setXCacheInfo adds cache-specific headers to h.
+//
+// If h records the time its cache object was stored, setXCacheInfo replaces it
+// with an X-Cache-Age header giving the age of the object in seconds.
 func setXCacheInfo(h http.Header, result, hash string) {
 	h.Set("X-Cache", result)
 	if hash != "" {
 		h.Set("X-Cache-Id", hash[:12])
 	}
+	if v := h.Get("X-Cache-Stored"); v != "" {
+		if stored, err := http.ParseTime(v); err == nil {
+			age := max(time.Since(stored), 0)
+			h.Set("X-Cache-Age", strconv.Itoa(int(age.Seconds())))
+		}
+		h.Del("X-Cache-Stored")
+	}
+	h.Del("X-Cache-Url")
 }
 
 // memCacheEntry is the format of entries in the memory cache.
 type memCacheEntry struct {
 	header http.Header
 	body   []byte
+	status int // if nonzero, a negative or preflight entry with this status code
+
+	// If true, a cached response to a CORS preflight request.
+	preflight bool
+
+	// For positive and preflight entries, the time the entry expires, and for
+	// positive entries, the time until which it may be served stale if the
+	// target fails.
+	expires, staleUntil time.Time
+}
+
+// negativeEntrySize is the nominal size charged for a negative cache entry,
+// which has no body, so that the number of such entries is bounded.
+const negativeEntrySize = 512
+
+func entrySize(e memCacheEntry) int64 {
+	if e.preflight {
+		return max(negativeEntrySize, int64(len(e.body)))
+	} else if e.status != 0 {
+		return negativeEntrySize
+	}
+	return int64(len(e.body))
 }
 
-func entrySize(e memCacheEntry) int64 { return int64(len(e.body)) }
+// An Entry describes an object stored in the local cache.
+type Entry struct {
+	Hash        string    `json:"hash"`                  // the storage key
+	URL         string    `json:"url,omitempty"`         // the request URL without its query, if recorded
+	Size        int64     `json:"size"`                  // the size of the response body in bytes
+	ContentType string    `json:"contentType,omitempty"` // the content type of the response
+	Encoding    string    `json:"encoding,omitempty"`    // the content encoding of the body, if any
+	Stored      time.Time `json:"stored"`                // when the object was stored, if recorded
+}
+
+// Entries returns a list of the objects stored in the local cache, in no
+// particular order. Objects stored before the request URL and storage time
+// were recorded in the cache have empty values for those fields.
+//
+// If DisableLocalCache is true, Entries returns no objects.
+func (s *Server) Entries(ctx context.Context) ([]Entry, error) {
+	if s.DisableLocalCache {
+		return nil, nil
+	}
+	paths, err := s.index.list(s.Local)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Entry, 0, len(paths))
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		hash := filepath.Base(path)
+		e, err := readCacheEntry(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			s.index.remove(hash) // removed externally
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("read %s: %w", hash, err)
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// isCacheObjectPath reports whether path has the form of a cache object path,
+// ".../<xx>/<hash>" where <hash> is a hex SHA256 digest beginning with <xx>.
+func isCacheObjectPath(path string) bool {
+	hash := filepath.Base(path)
+	if len(hash) != 2*sha256.Size || filepath.Base(filepath.Dir(path)) != hash[:2] {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// readCacheEntry reads the header of the cache object at path, and returns an
+// Entry describing it. It does not read the body of the object.
+func readCacheEntry(path string) (Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	br := bufio.NewReader(f)
+	var hlen int64
+	e := Entry{Hash: filepath.Base(path)}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return Entry{}, errors.New("invalid cache object: missing header")
+		}
+		hlen += int64(len(line))
+		if line == "\n" {
+			break // end of header
+		}
+		name, value, ok := strings.Cut(strings.TrimSuffix(line, "\n"), ": ")
+		if !ok {
+			continue
+		}
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Type":
+			e.ContentType = value
+		case "Content-Encoding":
+			e.Encoding = value
+		case "X-Cache-Url":
+			e.URL = value
+		case "X-Cache-Stored":
+			e.Stored, _ = http.ParseTime(value)
+		}
+	}
+	e.Size = fi.Size() - hlen
+	return e, nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requestVariant returns the encoding variant of the cache key for r.
+//
+// Requests from clients that accept brotli ("br") are cached separately from
+// other requests, since the target may answer them with a brotli-encoded body
+// that the proxy cannot decode for other clients. For all other requests the
+// variant is empty.
+func requestVariant(r *http.Request) string {
+	if acceptsEncoding(r.Header, "br") {
+		return "br"
+	}
+	return ""
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header in h permits the
+// specified content coding, which must be lower-case. A coding listed with
+// quality 0 is not accepted; a coding that is not listed is accepted only if
+// the header includes a wildcard ("*") with a non-zero quality.
+func acceptsEncoding(h http.Header, coding string) bool {
+	wildcard := false
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, elt := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(elt, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != coding && name != "*" {
+				continue
+			}
+			ok := true
+			for _, p := range strings.Split(params, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+				if strings.EqualFold(k, "q") {
+					q, err := strconv.ParseFloat(v, 64)
+					ok = err == nil && q > 0
+				}
+			}
+			if name == coding {
+				return ok // an explicit listing takes precedence
+			}
+			wildcard = ok
+		}
+	}
+	return wildcard
+}
+
+// maxDecodedBytes is the largest body decodeForClient will decompress, so that
+// a small compressed object cannot expand without bound in memory.
+const maxDecodedBytes = 256 << 20
+
+// decodeForClient returns a version of the cached response with headers hdr
+// and the specified body that is suitable for the client request r.
+//
+// If the body has a gzip Content-Encoding that r does not accept, the result
+// is the decompressed body and true, and hdr is updated to remove the encoding
+// and to weaken its Etag, since the representation differs. If the body cannot
+// be decoded, decodes to more than maxDecodedBytes, or has any other encoding,
+// it is returned unchanged with false. In either case, a response with a
+// Content-Encoding reports that it varies by Accept-Encoding.
+//
+// Brotli ("br") bodies are not decoded: the standard library has no brotli
+// decoder, and the proxy does not take a dependency for one. Instead, requests
+// that accept brotli are cached separately (see requestVariant), so a brotli
+// body is only ever served to a client that asked for it.
+func decodeForClient(r *http.Request, hdr http.Header, body []byte) ([]byte, bool) {
+	ce := strings.ToLower(hdr.Get("Content-Encoding"))
+	if ce == "" || ce == "identity" {
+		return body, false
+	}
+	addVary(hdr, "Accept-Encoding")
+	if ce != "gzip" || acceptsEncoding(r.Header, "gzip") {
+		return body, false
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return body, false
+	}
+	dec, err := io.ReadAll(io.LimitReader(zr, maxDecodedBytes+1))
+	if err != nil || len(dec) > maxDecodedBytes {
+		return body, false
+	}
+	hdr.Del("Content-Encoding")
+	hdr.Del("Content-Length")
+	weakenEtag(hdr)
+	return dec, true
+}
+
+// minStoreCompress is the smallest response body compressed for storage by
+// encodeForStorage. Compressing smaller bodies saves little space.
+const minStoreCompress = 256
+
+// encodeForStorage returns the canonical form of a response body with headers
+// hdr for storage in the cache, when CompressStored is set.
+//
+// The canonical form of a body without a Content-Encoding is gzip-compressed,
+// so that gzip and identity responses for the same request share one stored
+// object, in the smaller form. If the body is compressed, the result is the
+// compressed body and true, and hdr is updated to record the encoding and to
+// weaken its Etag. Bodies that already have an encoding, that are shorter than
+// minStoreCompress, or that do not shrink when compressed, are returned
+// unchanged with false.
+func encodeForStorage(hdr http.Header, body []byte) ([]byte, bool) {
+	ce := strings.ToLower(hdr.Get("Content-Encoding"))
+	if (ce != "" && ce != "identity") || len(body) < minStoreCompress {
+		return body, false
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(body)
+	if err := zw.Close(); err != nil || buf.Len() >= len(body) {
+		return body, false
+	}
+	hdr.Set("Content-Encoding", "gzip")
+	hdr.Del("Content-Length")
+	weakenEtag(hdr)
+	return buf.Bytes(), true
+}
+
+// weakenEtag marks the Etag of h, if any, as a weak validator, since the
+// representation it describes has been re-encoded.
+func weakenEtag(h http.Header) {
+	if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("Etag", "W/"+etag)
+	}
+}
+
+// addVary adds name to the Vary header of h, if it is not already listed.
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, elt := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(elt), name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
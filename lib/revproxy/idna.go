@@ -0,0 +1,124 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// hostToASCII returns the ASCII form of a lower-case domain name, in which
+// each label that contains non-ASCII characters is replaced by "xn--" and its
+// punycode encoding (RFC 3492), as in the IDNA ToASCII operation. Unlike a full
+// IDNA implementation (such as golang.org/x/net/idna), it does not apply
+// Unicode normalization or validate the labels, so names that differ only in
+// their Unicode normal form have different ASCII forms.
+func hostToASCII(name string) string {
+	if isASCII(name) {
+		return name
+	}
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if !isASCII(label) && utf8.ValidString(label) {
+			labels[i] = "xn--" + punycode(label)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Parameters of the punycode encoding (RFC 3492, section 5).
+const (
+	pcBase        = 36
+	pcTMin        = 1
+	pcTMax        = 26
+	pcSkew        = 38
+	pcDamp        = 700
+	pcInitialBias = 72
+	pcInitialN    = 128
+)
+
+// punycode returns the punycode encoding of s, which must be valid UTF-8.
+func punycode(s string) string {
+	var out strings.Builder
+	runes := []rune(s)
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out.WriteRune(r)
+		}
+	}
+	b := out.Len()
+	h := b
+	if b > 0 {
+		out.WriteByte('-')
+	}
+
+	n, delta, bias := rune(pcInitialN), 0, pcInitialBias
+	for h < len(runes) {
+		// Find the smallest code point not yet encoded. Since Unicode code
+		// points are below 0x110000, delta cannot overflow an int.
+		m := rune(utf8.MaxRune + 1)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			} else if r == n {
+				q := delta
+				for k := pcBase; ; k += pcBase {
+					t := min(max(k-bias, pcTMin), pcTMax)
+					if q < t {
+						break
+					}
+					out.WriteByte(punycodeDigit(t + (q-t)%(pcBase-t)))
+					q = (q - t) / (pcBase - t)
+				}
+				out.WriteByte(punycodeDigit(q))
+				bias = punycodeAdapt(delta, h+1, h == b)
+				delta = 0
+				h++
+			}
+		}
+		delta++
+		n++
+	}
+	return out.String()
+}
+
+// punycodeAdapt is the bias adaptation function of RFC 3492, section 6.1.
+func punycodeAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= pcDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((pcBase-pcTMin)*pcTMax)/2 {
+		delta /= pcBase - pcTMin
+		k += pcBase
+	}
+	return k + (pcBase-pcTMin+1)*delta/(delta+pcSkew)
+}
+
+// punycodeDigit returns the lower-case encoding of the digit d < pcBase.
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
@@ -0,0 +1,203 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// An index records the objects present in the local cache directory, with
+// their sizes and modification times, so that operations that need to know
+// what is present do not have to walk the directory.
+//
+// The index is loaded lazily by scanning the directory the first time it is
+// needed, and thereafter updated as objects are stored. Because objects may be
+// removed from the directory by other processes, the index may report objects
+// that no longer exist; callers that discover a missing object should call
+// remove to update the index.
+type index struct {
+	loadMu sync.Mutex // serializes loading the index
+
+	mu       sync.Mutex
+	loaded   bool
+	scanning bool                  // a scan by load is in progress
+	entries  map[string]indexEntry // hash → entry
+	removed  map[string]bool       // hashes removed during the scan
+	size     int64                 // total size of entries in bytes
+}
+
+type indexEntry struct {
+	Path    string    // object file path
+	Size    int64     // object file size in bytes
+	ModTime time.Time // object file modification time
+	Used    time.Time // when the object was last stored or read
+}
+
+// load scans root to populate the index, if it has not already been loaded.
+// Updates to the index are not blocked while the scan is in progress.
+func (ix *index) load(root string) error {
+	ix.loadMu.Lock()
+	defer ix.loadMu.Unlock()
+	ix.mu.Lock()
+	loaded := ix.loaded
+	ix.scanning = !loaded
+	ix.mu.Unlock()
+	if loaded {
+		return nil
+	}
+
+	scanned, err := scanIndex(root)
+
+	// Apply updates recorded while the scan was in progress.
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.scanning = false
+	if err != nil {
+		ix.removed = nil
+		return err
+	}
+	for hash := range ix.removed {
+		delete(scanned, hash)
+	}
+	for hash, e := range ix.entries {
+		scanned[hash] = e
+	}
+	ix.size = 0
+	for _, e := range scanned {
+		ix.size += e.Size
+	}
+	ix.entries, ix.removed, ix.loaded = scanned, nil, true
+	return nil
+}
+
+// scanIndex walks the cache directory at root and returns the cache objects
+// found there.
+func scanIndex(root string) (map[string]indexEntry, error) {
+	entries := make(map[string]indexEntry)
+	err := filepath.WalkDir(root, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if !de.Type().IsRegular() || !isCacheObjectPath(path) {
+			return nil // skip directories, temp files, and other stuff
+		}
+		fi, err := de.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // removed concurrently
+		} else if err != nil {
+			return err
+		}
+		entries[de.Name()] = indexEntry{Path: path, Size: fi.Size(), ModTime: fi.ModTime(), Used: fi.ModTime()}
+		return nil
+	})
+	return entries, err
+}
+
+// add records that the object at path for hash was stored.
+func (ix *index) add(hash, path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		ix.remove(hash)
+		return
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.entries == nil {
+		ix.entries = make(map[string]indexEntry)
+	}
+	if old, ok := ix.entries[hash]; ok {
+		ix.size -= old.Size
+	}
+	ix.entries[hash] = indexEntry{Path: path, Size: fi.Size(), ModTime: fi.ModTime(), Used: time.Now()}
+	ix.size += fi.Size()
+	delete(ix.removed, hash)
+}
+
+// touch records that the object for hash was read, if it is in the index.
+func (ix *index) touch(hash string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if e, ok := ix.entries[hash]; ok {
+		e.Used = time.Now()
+		ix.entries[hash] = e
+	}
+}
+
+// evict checks whether the index holds more than limit objects, loading it
+// from root if necessary. If so, it removes the least recently used objects
+// from the index until keep remain, and returns their paths. The caller is
+// responsible for removing the files.
+func (ix *index) evict(root string, limit, keep int) ([]string, error) {
+	if err := ix.load(root); err != nil {
+		return nil, err
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if len(ix.entries) <= limit {
+		return nil, nil
+	}
+	hashes := make([]string, 0, len(ix.entries))
+	for hash := range ix.entries {
+		hashes = append(hashes, hash)
+	}
+	slices.SortFunc(hashes, func(a, b string) int {
+		return ix.entries[a].Used.Compare(ix.entries[b].Used)
+	})
+	var paths []string
+	for _, hash := range hashes[:len(hashes)-max(keep, 0)] {
+		paths = append(paths, ix.entries[hash].Path)
+		ix.size -= ix.entries[hash].Size
+		delete(ix.entries, hash)
+	}
+	return paths, nil
+}
+
+// remove records that the object for hash is no longer present.
+func (ix *index) remove(hash string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if old, ok := ix.entries[hash]; ok {
+		ix.size -= old.Size
+		delete(ix.entries, hash)
+	}
+	// Only a removal that races with a scan needs to be recorded; a later
+	// scan will not find the file.
+	if ix.scanning {
+		if ix.removed == nil {
+			ix.removed = make(map[string]bool)
+		}
+		ix.removed[hash] = true
+	}
+}
+
+// list returns the paths of the objects in the index, loading it from root
+// if necessary.
+func (ix *index) list(root string) ([]string, error) {
+	if err := ix.load(root); err != nil {
+		return nil, err
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	out := make([]string, 0, len(ix.entries))
+	for _, e := range ix.entries {
+		out = append(out, e.Path)
+	}
+	return out, nil
+}
+
+// stats reports the number and total size of the objects in the index,
+// loading it from root if necessary.
+func (ix *index) stats(root string) (count int, size int64, _ error) {
+	if err := ix.load(root); err != nil {
+		return 0, 0, err
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return len(ix.entries), ix.size, nil
+}
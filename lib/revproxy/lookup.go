@@ -0,0 +1,137 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// CacheInfo describes a cached response, as reported by [Server.Lookup].
+type CacheInfo struct {
+	Hash        string    `json:"hash"`                  // the storage key
+	Size        int64     `json:"size"`                  // the size of the response body in bytes
+	ContentType string    `json:"contentType,omitempty"` // the content type of the response
+	Encoding    string    `json:"encoding,omitempty"`    // the content encoding of the body, if any
+	Stored      time.Time `json:"stored"`                // when the response was stored, if recorded
+	Expires     time.Time `json:"expires"`               // when the entry expires (memory only)
+}
+
+// Lookup reports whether a response for a GET request to the specified URL is
+// held in the cache, and if so returns the tier holding it, "memory", "local",
+// or "remote", along with a description of the cached response. The tiers are
+// checked in that order, as for a request served by the proxy. The S3 cache is
+// checked only if remote is true, since that requires a network request.
+//
+// Lookup does not serve or fault in the response, and does not contact the
+// target. If hdr is non-nil, its Accept-Encoding and TenantHeader values
+// select the encoding variant and tenant to check, as for [Server.Warm]. It
+// reports false if the URL is invalid or names an invalid tenant, or if the
+// response is not cached in any of the tiers checked.
+func (s *Server) Lookup(ctx context.Context, hdr http.Header, rawURL string, remote bool) (tier string, info CacheInfo, ok bool) {
+	s.init()
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", CacheInfo{}, false
+	}
+	req := &http.Request{Method: http.MethodGet, URL: u, Host: u.Host, Header: make(http.Header)}
+	for _, name := range []string{"Accept-Encoding", s.TenantHeader} {
+		if v := hdr.Get(name); name != "" && v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	tenant, ok := s.requestTenant(req)
+	if !ok {
+		return "", CacheInfo{}, false
+	}
+	hash := hashRequestKey(req.Method, s.cacheKeyURL(targetURL(req)), requestVariant(req), tenant)
+
+	if body, hdr, err := s.cacheLoadMemory(hash); err == nil {
+		info := cacheInfo(hash, hdr, int64(len(body)))
+		info.Expires, _ = http.ParseTime(hdr.Get("X-Cache-Expires"))
+		return "memory", info, true
+	}
+	if info, ok := s.lookupLocal(req.Host, hash); ok {
+		return "local", info, true
+	}
+	if remote && s.S3Client != nil {
+		if info, ok := s.lookupS3(ctx, tenant, hash); ok {
+			return "remote", info, true
+		}
+	}
+	return "", CacheInfo{}, false
+}
+
+// lookupLocal reports whether the local cache has an unexpired object for
+// hash, and if so describes it. Only the header of the object is read.
+func (s *Server) lookupLocal(host, hash string) (CacheInfo, bool) {
+	if s.DisableLocalCache {
+		return CacheInfo{}, false
+	}
+	path := s.makePath(host, hash)
+	e, err := readCacheEntry(path)
+	if err != nil {
+		return CacheInfo{}, false
+	}
+	if s.MaxImmutableAge > 0 {
+		stored := e.Stored
+		if stored.IsZero() {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return CacheInfo{}, false
+			}
+			stored = fi.ModTime()
+		}
+		if s.isTooOld(stored) {
+			return CacheInfo{}, false
+		}
+	}
+	return CacheInfo{
+		Hash:        hash,
+		Size:        e.Size,
+		ContentType: e.ContentType,
+		Encoding:    e.Encoding,
+		Stored:      e.Stored,
+	}, true
+}
+
+// lookupS3 reports whether the S3 cache has an unexpired object for hash, and
+// if so describes it. Only a prefix of the object is read from S3, unless its
+// header is unusually long.
+func (s *Server) lookupS3(ctx context.Context, tenant, hash string) (CacheInfo, bool) {
+	head, total, _, err := s.readS3Range(ctx, s.makeKey(tenant, hash), 0, rangeHeadBytes)
+	if err != nil {
+		return CacheInfo{}, false
+	}
+	body, hdr, err := parseCacheObject(head)
+	if err != nil {
+		// The header did not fit in the prefix; read the whole object.
+		if body, hdr, err = s.cacheLoadS3(ctx, tenant, hash); err != nil {
+			return CacheInfo{}, false
+		}
+		return cacheInfo(hash, hdr, int64(len(body))), true
+	}
+	if s.MaxImmutableAge > 0 {
+		if stored, ok := storedTime(hdr); !ok || s.isTooOld(stored) {
+			return CacheInfo{}, false
+		}
+	}
+	return cacheInfo(hash, hdr, total-int64(len(head)-len(body))), true
+}
+
+// cacheInfo returns a description of a cached response with the specified
+// storage key, headers, and body size.
+func cacheInfo(hash string, hdr http.Header, size int64) CacheInfo {
+	stored, _ := storedTime(hdr)
+	return CacheInfo{
+		Hash:        hash,
+		Size:        size,
+		ContentType: hdr.Get("Content-Type"),
+		Encoding:    hdr.Get("Content-Encoding"),
+		Stored:      stored,
+	}
+}
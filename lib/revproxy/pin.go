@@ -0,0 +1,116 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A CertPin is the SHA-256 fingerprint of a DER-encoded X.509 certificate.
+type CertPin [sha256.Size]byte
+
+// ParseCertPin parses a certificate fingerprint given as hex digits, which
+// may be separated by colons as in the output of "openssl x509 -fingerprint".
+func ParseCertPin(s string) (CertPin, error) {
+	var pin CertPin
+	raw, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(s), ":", ""))
+	if err != nil {
+		return pin, fmt.Errorf("invalid certificate fingerprint %q: %w", s, err)
+	} else if len(raw) != len(pin) {
+		return pin, fmt.Errorf("invalid certificate fingerprint %q: got %d bytes, want %d", s, len(raw), len(pin))
+	}
+	copy(pin[:], raw)
+	return pin, nil
+}
+
+// String returns the fingerprint as lower-case hex digits.
+func (p CertPin) String() string { return hex.EncodeToString(p[:]) }
+
+// errCertPin is reported when an upstream presents no pinned certificate.
+var errCertPin = errors.New("upstream certificate does not match any pinned fingerprint")
+
+// upstreamTLSConfig returns a TLS client configuration for upstream requests
+// that verifies targets using roots and pins, or nil if both are empty so
+// that the default configuration applies.
+//
+// If roots is non-nil, it replaces the system certificate pool. If pins is
+// non-empty, a target is accepted only if a certificate it is verified by
+// matches a pin. When roots are given, that is any certificate in a verified
+// chain, so that a pin may name an intermediate or root. When pins are given
+// without roots, the pins take the place of chain verification, so that a
+// target using a self-signed or private CA certificate can be trusted by
+// fingerprint alone; then only the target's own (leaf) certificate is checked,
+// since the other certificates it presents are not verified, and anyone may
+// present a copy of a pinned certificate.
+func upstreamTLSConfig(roots *x509.CertPool, pins []CertPin) *tls.Config {
+	if roots == nil && len(pins) == 0 {
+		return nil
+	}
+	cfg := &tls.Config{RootCAs: roots}
+	if len(pins) == 0 {
+		return cfg
+	}
+
+	// To accept a pinned certificate without a verifiable chain, the built-in
+	// verification must be skipped, and VerifyConnection does the work.
+	// When roots are given, verify the chain (and the host name) here too.
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("upstream presented no certificates")
+		}
+		if roots == nil {
+			return matchPins(cs.PeerCertificates[:1], pins)
+		}
+		chains, err := verifyChain(cs, roots)
+		if err != nil {
+			return err
+		}
+		for _, chain := range chains {
+			if matchPins(chain, pins) == nil {
+				return nil
+			}
+		}
+		return errCertPin
+	}
+	return cfg
+}
+
+// matchPins reports nil if any of certs matches one of pins, or otherwise
+// errCertPin.
+func matchPins(certs []*x509.Certificate, pins []CertPin) error {
+	for _, cert := range certs {
+		fp := CertPin(sha256.Sum256(cert.Raw))
+		for _, pin := range pins {
+			if fp == pin {
+				return nil
+			}
+		}
+	}
+	return errCertPin
+}
+
+// verifyChain verifies the certificates presented in cs for the server name
+// of the connection, using roots as the trusted pool, and returns the
+// verified chains.
+func verifyChain(cs tls.ConnectionState, roots *x509.CertPool) ([][]*x509.Certificate, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return nil, errors.New("upstream presented no certificates")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	return cs.PeerCertificates[0].Verify(opts)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/creachadair/scheddle"
+)
+
+// isPreflight reports whether r is a CORS preflight request, that is, an
+// OPTIONS request with both an Origin and an Access-Control-Request-Method.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// preflightVariant returns the cache key variant for a preflight request r.
+// It includes the request headers that select the CORS policy reported by the
+// target, with the list of requested headers normalized so that requests
+// differing only in its case, order, or spacing share an entry.
+func preflightVariant(r *http.Request) string {
+	var hdrs []string
+	for _, v := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				hdrs = append(hdrs, name)
+			}
+		}
+	}
+	slices.Sort(hdrs)
+	return fmt.Sprintf("preflight %q %q %q",
+		r.Header.Get("Origin"),
+		r.Header.Get("Access-Control-Request-Method"),
+		strings.Join(slices.Compact(hdrs), ","))
+}
+
+// preflightTTL reports whether rsp is a preflight response that can be
+// cached, and if so returns how long the entry should be valid for. This is
+// PreflightTTL, or the Access-Control-Max-Age of the response if shorter.
+func (s *Server) preflightTTL(rsp *http.Response) (time.Duration, bool) {
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return 0, false
+	} else if parseCacheControl(rsp.Header.Get("Cache-Control")).Keys.Has("no-store") {
+		return 0, false
+	} else if !s.canCacheCookies(rsp) {
+		return 0, false
+	}
+	ttl := s.PreflightTTL
+	if v := rsp.Header.Get("Access-Control-Max-Age"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec <= 0 {
+			return 0, false // the target asks that the result not be reused
+		}
+		ttl = min(ttl, time.Duration(sec)*time.Second)
+	}
+	return ttl, true
+}
+
+// cacheLoadPreflight reports whether the memory cache has an unexpired
+// preflight entry for hash, and if so returns its status code, headers, and
+// body.
+func (s *Server) cacheLoadPreflight(hash string) (int, http.Header, []byte, bool) {
+	if s.mcache == nil {
+		return 0, nil, nil, false
+	}
+	e, ok := s.mcache.Get(hash)
+	if !ok || !e.preflight || !time.Now().Before(e.expires) {
+		return 0, nil, nil, false
+	}
+	return e.status, e.header.Clone(), e.body, true
+}
+
+// cacheStorePreflight records a preflight response with the given status,
+// headers, and body in the memory cache for ttl. If the memory cache is
+// disabled, this is a no-op.
+func (s *Server) cacheStorePreflight(hash string, ttl time.Duration, code int, hdr http.Header, body []byte) {
+	if s.mcache == nil {
+		return
+	}
+	out := memCacheHeader(hdr, ttl)
+	for name, vals := range hdr {
+		if strings.HasPrefix(name, "Access-Control-") || name == "Vary" {
+			out[name] = slices.Clone(vals)
+		}
+	}
+	s.mcache.Put(hash, memCacheEntry{
+		header:    out,
+		body:      body,
+		status:    code,
+		preflight: true,
+		expires:   time.Now().Add(ttl),
+	})
+	s.expire.After(ttl, scheddle.Run(func() {
+		if e, ok := s.mcache.Get(hash); ok && e.preflight && !time.Now().Before(e.expires) {
+			s.mcache.Remove(hash)
+		}
+	}))
+}
+
+// writePreflightResponse generates an HTTP response for a cached preflight
+// entry using the provided headers, status code, and body.
+func writePreflightResponse(w http.ResponseWriter, hdr http.Header, code int, body []byte) {
+	wh := w.Header()
+	for name, vals := range hdr {
+		for _, val := range vals {
+			wh.Add(name, val)
+		}
+	}
+	w.WriteHeader(code)
+	w.Write(body)
+}
@@ -0,0 +1,178 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rangeHeadBytes is the length of the prefix of a cache object read from S3
+// to obtain its header when serving a byte range. Cache object headers are
+// much shorter than this, so small ranges near the start of the body are
+// often served from the same read.
+const rangeHeadBytes = 4096
+
+// errNoRange is reported by cacheLoadS3Range when a request cannot be served
+// with a ranged read, and the caller should fault in the whole object.
+var errNoRange = errors.New("range not served from S3")
+
+// canRangeFromS3 reports whether r is a range request that may be served
+// from S3 without faulting in the whole object.
+func (s *Server) canRangeFromS3(r *http.Request) bool {
+	return s.RangeFaultMinSize > 0 && s.S3Client != nil &&
+		r.Method == http.MethodGet &&
+		r.Header.Get("Range") != "" &&
+		r.Header.Get("If-Range") == ""
+}
+
+// rangeResponse is a partial response served from S3.
+type rangeResponse struct {
+	header http.Header
+	body   io.ReadCloser // the n bytes of the range
+	off    int64         // offset of body within the complete response body
+	n      int64         // length of body in bytes
+	size   int64         // size of the complete response body
+}
+
+// writeTo writes a 206 (Partial Content) response for rr to w, streaming the
+// body, and closes the body. It reports an error if the body could not be
+// copied in full; by then the response header has been sent, so the response
+// is truncated.
+func (rr rangeResponse) writeTo(w http.ResponseWriter) error {
+	defer rr.body.Close()
+	wh := w.Header()
+	for name, vals := range rr.header {
+		for _, val := range vals {
+			wh.Add(name, val)
+		}
+	}
+	wh.Set("Accept-Ranges", "bytes")
+	wh.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rr.off, rr.off+rr.n-1, rr.size))
+	wh.Set("Content-Length", strconv.FormatInt(rr.n, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if nw, err := io.Copy(w, rr.body); err != nil {
+		return err
+	} else if nw != rr.n {
+		return fmt.Errorf("short range read: got %d bytes, want %d", nw, rr.n)
+	}
+	return nil
+}
+
+// cacheLoadS3Range reads the byte range requested by r from the body of the
+// cache object for hash in S3, without reading the rest of the object. It
+// reports errNoRange if the range cannot be served this way, for example if
+// the body is smaller than RangeFaultMinSize, or the range is not a single
+// satisfiable byte range.
+//
+// If the range is not contained in the prefix read to obtain the header, the
+// rest of the range is read only if the object has not changed since the
+// prefix was read, and the caller must close the body of the result.
+func (s *Server) cacheLoadS3Range(ctx context.Context, r *http.Request, tenant, hash string) (rangeResponse, error) {
+	key := s.makeKey(tenant, hash)
+	head, total, etag, err := s.readS3Range(ctx, key, 0, rangeHeadBytes)
+	if err != nil {
+		return rangeResponse{}, err
+	}
+	body, hdr, err := parseCacheObject(head)
+	if err != nil {
+		return rangeResponse{}, errNoRange // header too long, or not a cache object
+	}
+	if s.MaxImmutableAge > 0 {
+		if stored, ok := storedTime(hdr); !ok || s.isTooOld(stored) {
+			s.reqFaultExpired.Add(1)
+			return rangeResponse{}, fs.ErrNotExist
+		}
+	}
+	if ce := hdr.Get("Content-Encoding"); ce != "" && !acceptsEncoding(r.Header, ce) {
+		return rangeResponse{}, errNoRange // the client needs the decoded body
+	} else if isNotModified(r, hdr) {
+		return rangeResponse{}, errNoRange
+	}
+
+	hlen := int64(len(head) - len(body))
+	size := total - hlen
+	if size < s.RangeFaultMinSize {
+		return rangeResponse{}, errNoRange
+	}
+	off, n, ok := parseRange(r.Header.Get("Range"), size)
+	if !ok {
+		return rangeResponse{}, errNoRange
+	}
+	rr := rangeResponse{header: hdr, off: off, n: n, size: size}
+	if off+n <= int64(len(body)) {
+		// Already read with the header.
+		rr.body = io.NopCloser(bytes.NewReader(body[off : off+n]))
+		return rr, nil
+	}
+
+	// Match the version read for the header, so that the range is not taken
+	// from an object replaced in the meantime.
+	rc, rsize, _, err := s.S3Client.GetRangeMatch(ctx, key, hlen+off, n, etag)
+	if err != nil {
+		return rangeResponse{}, err
+	} else if rsize != total {
+		rc.Close()
+		return rangeResponse{}, fmt.Errorf("object size changed from %d to %d", total, rsize)
+	}
+	rr.body = rc
+	return rr, nil
+}
+
+// readS3Range reads up to n bytes of the object at key starting from off,
+// and returns them along with the total size and the ETag of the object.
+// Since it reads the bytes into memory, n should be small.
+func (s *Server) readS3Range(ctx context.Context, key string, off, n int64) ([]byte, int64, string, error) {
+	rc, size, etag, err := s.S3Client.GetRangeMatch(ctx, key, off, n, "")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	return data, size, etag, err
+}
+
+// parseRange parses the value of a Range header specifying a single byte
+// range, and returns the offset and length of that range within a body of the
+// given size. It reports false if s does not specify exactly one satisfiable
+// byte range.
+func parseRange(s string, size int64) (off, n int64, ok bool) {
+	spec, ok := strings.CutPrefix(s, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	if first == "" {
+		// A suffix range, "-n", selects the last n bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		n = min(n, size)
+		return size - n, n, true
+	}
+	off, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || off < 0 || off >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < off {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return off, end - off + 1, true
+}
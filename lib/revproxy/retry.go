@@ -0,0 +1,139 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retryTransport is an [http.RoundTripper] that retries idempotent requests
+// that fail with a transport error, a 5xx status, or a 429 (Too Many Requests)
+// status. Only the response to the final attempt is returned to the caller, so
+// the retries are not visible to the response handling of the proxy.
+//
+// If a failed response includes a Retry-After header, the next attempt waits
+// at least as long as it specifies. If that is longer than maxRetryAfter, or
+// would run past the deadline of the request, the response is returned
+// without retrying.
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int           // maximum number of retries after the first attempt
+	backoff time.Duration // delay before the first retry, doubled thereafter
+	retried *expvar.Int   // incremented for each retry
+	limited *expvar.Int   // incremented for each throttled response retried
+	logf    func(string, ...any)
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !canRetryRequest(req) {
+		return t.base.RoundTrip(req)
+	}
+	delay := t.backoff
+	for i := 0; ; i++ {
+		rsp, err := t.base.RoundTrip(req)
+		if i == t.retries || !shouldRetry(req.Context(), rsp, err) {
+			return rsp, err
+		}
+		wait := delay
+		if rsp != nil {
+			if ra, ok := retryAfter(rsp.Header, time.Now()); ok {
+				if ra > maxRetryAfter || !fitsDeadline(req.Context(), ra) {
+					t.logf("not retrying %s %q: status %d, retry after %v", req.Method, req.URL, rsp.StatusCode, ra)
+					return rsp, err
+				}
+				wait = max(wait, ra)
+			}
+			if _, ok := isThrottled(rsp); ok {
+				t.limited.Add(1)
+			}
+
+			// Discard the failed response so its connection can be reused.
+			io.Copy(io.Discard, io.LimitReader(rsp.Body, 64<<10))
+			rsp.Body.Close()
+			t.logf("retry %s %q after status %d (attempt %d)", req.Method, req.URL, rsp.StatusCode, i+1)
+		} else {
+			t.logf("retry %s %q after error: %v (attempt %d)", req.Method, req.URL, err, i+1)
+		}
+		if !sleepContext(req.Context(), wait) {
+			return nil, req.Context().Err()
+		}
+		delay *= 2
+		t.retried.Add(1)
+	}
+}
+
+// canRetryRequest reports whether req is idempotent and can be sent again.
+func canRetryRequest(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		(req.Body == nil || req.Body == http.NoBody)
+}
+
+// shouldRetry reports whether a request that produced rsp and err should be
+// retried. Errors caused by the end of ctx are not retried.
+func shouldRetry(ctx context.Context, rsp *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil
+	}
+	return rsp.StatusCode >= 500 || rsp.StatusCode == http.StatusTooManyRequests
+}
+
+// maxRetryAfter is the longest Retry-After delay that retryTransport will wait
+// for before retrying a request.
+const maxRetryAfter = 30 * time.Second
+
+// retryAfter reports the delay requested by the Retry-After header in h, if
+// it is present and valid. The header may give either a number of seconds or
+// an HTTP date, which is interpreted relative to now. A date in the past is a
+// delay of zero.
+func retryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	} else if sec, err := strconv.Atoi(v); err == nil {
+		if sec < 0 {
+			return 0, false
+		}
+		return time.Duration(sec) * time.Second, true
+	} else if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// isThrottled reports whether rsp is a throttling response from an upstream
+// target, that is, a 429 (Too Many Requests) or 503 (Service Unavailable)
+// status with a Retry-After header. If so, it also reports the delay the
+// target requested.
+func isThrottled(rsp *http.Response) (time.Duration, bool) {
+	if rsp.StatusCode != http.StatusTooManyRequests && rsp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	return retryAfter(rsp.Header, time.Now())
+}
+
+// fitsDeadline reports whether a delay of d would end before the deadline of
+// ctx, if it has one.
+func fitsDeadline(ctx context.Context, d time.Duration) bool {
+	dl, ok := ctx.Deadline()
+	return !ok || time.Until(dl) > d
+}
+
+// sleepContext waits for d to elapse or ctx to end, and reports whether the
+// full duration elapsed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -15,12 +15,21 @@ package revproxy
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"expvar"
 	"fmt"
 	"io"
+	"io/fs"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"path"
 	"path/filepath"
@@ -29,6 +38,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creachadair/mds/cache"
@@ -45,45 +55,421 @@ import (
 // If not, the request is rejected with HTTP 502 (Bad Gateway).  Otherwise, the
 // request is forwarded.  A successful response will be cached if the server's
 // Cache-Control does not include "no-store", and does include "immutable".
+// If CacheableContentTypes is set, the response must also have one of the
+// listed content types. A response that sets a cookie is not cached, unless
+// CacheSetCookie is true.
 //
 // In addition, a successful response that is not immutable and specifies a
-// max-age will be cached temporarily in-memory.
+// max-age will be cached temporarily in-memory, unless DisableMemoryCache is
+// set.
+//
+// Before a response is cached, its body is checked against the length given
+// by its Content-Length header, and against the SHA-256 or SHA-512 digest
+// given by a Digest, Content-Digest, or X-Checksum-Sha256 header, if present.
+// A response whose body does not match is returned to the client, but is not
+// cached.
 //
 // # Cache Format
 //
 // A cached response is a file with a header section and the body, separated by
 // a blank line. Only a subset of response headers are saved.
 //
+// Cached responses are stored under a SHA256 digest of the request method and
+// the complete request URL, including its scheme and host. The host is
+// normalized first (lower case, in ASCII form, without a trailing dot or the
+// default port of the scheme), so that the spellings of one host share their
+// cache entries. If TenantHeader is set, the digest also includes the tenant,
+// if any (see TenantHeader).
+// Earlier versions of this package used a digest of the request URL alone, so
+// objects they stored are not found under the current keys, and are refetched
+// from the target.
+//
+// # Content Encoding
+//
+// A response body is cached as received from the target, along with its
+// Content-Encoding, and is served with the same encoding on a cache hit.
+// Requests from clients that accept brotli ("Accept-Encoding: br") are cached
+// separately from other requests, so that a brotli-encoded response is served
+// only to clients that accept it. When a cached response is gzip-encoded and
+// the client does not accept gzip, the proxy decompresses the body before
+// serving it. Cached responses with a Content-Encoding report that they vary
+// by Accept-Encoding.
+//
+// If CompressStored is set, a cacheable response without a Content-Encoding
+// is gzip-compressed before it is stored on disk and in S3, so that the cache
+// holds a single compressed representation whether the target answered with
+// gzip or identity encoding. Clients that do not accept gzip receive the
+// decompressed body, as above.
+//
 // # Cache Responses
 //
 // For requests handled by the proxy, the response includes an "X-Cache" header
 // indicating how the response was obtained:
 //
+//   - "fixture": The response was served from Fixtures.
 //   - "hit, memory": The response was served out of the memory cache.
+//   - "hit, stale-error": An expired response was served out of the memory
+//     cache because the target failed (see StaleIfError).
+//   - "hit, negative": A "not found" response was served out of the memory
+//     cache (see NegativeTTL).
+//   - "hit, preflight": A response to a CORS preflight request was served
+//     out of the memory cache (see PreflightTTL).
 //   - "hit, local": The response was served out of the local cache.
 //   - "hit, remote": The response was faulted in from S3.
+//   - "not-modified": The request was conditional, and was answered from the
+//     cache with HTTP 304 (Not Modified) because the client already has the
+//     cached response.
 //   - "fetch, cached": The response was forwarded to the target and cached.
+//   - "fetch, cached, preflight": The response to a CORS preflight request was
+//     forwarded to the target and cached in memory.
 //   - "fetch, uncached": The response was forwarded to the target and not cached.
+//   - "miss, circuit open": The request was rejected because the target is
+//     unhealthy (see BreakerThreshold).
+//   - "miss, upstream busy": The request was rejected because too many
+//     requests were already in flight to targets (see MaxUpstreamConcurrency).
 //
 // For results intersecting with the cache, it also reports a X-Cache-Id giving
 // the storage key of the cache object.
+//
+// For responses served from the cache, an X-Cache-Age header reports the age
+// of the cache entry in seconds. Responses served from the memory cache also
+// include an X-Cache-Expires header giving the time when the entry expires.
+// Cache entries stored before the storage time was recorded do not report an
+// age.
 type Server struct {
 	// Targets is the list of hosts for which the proxy should forward requests.
-	// Host names should be fully-qualified ("host.example.com").
+	// Host names should be fully-qualified ("host.example.com"). Request hosts
+	// are matched without regard to case or a default port (80 or 443).
+	//
+	// Targets must not be modified once the server has begun serving. To change
+	// the targets of a running server, use [Server.SetTargets].
 	Targets []string
 
+	// Fixtures, if non-empty, maps complete request URLs (for example,
+	// "https://host.example.com/path?q=1") to fixed responses. A GET or HEAD
+	// request for one of these URLs is answered with the corresponding
+	// response, without contacting the target or consulting the cache. Fixtures
+	// are matched before the request host is checked against Targets.
+	//
+	// Fixtures are useful for hermetic tests, and for pinning or blocking
+	// specific URLs.
+	Fixtures map[string]FixtureResponse
+
+	// Origins, if non-empty, maps target hosts to the network address
+	// ("host" or "host:port") of an origin server from which requests for
+	// that target are fetched. The request forwarded to the origin retains
+	// the original target host in its Host header and, for HTTPS, as the TLS
+	// server name, so that an origin serving multiple sites (such as a CDN)
+	// can route the request. Cache keys are based on the original request URL.
+	//
+	// If an origin address does not include a port, the port of the original
+	// request is used.
+	Origins map[string]string
+
+	// StripQueryParams, if non-empty, lists query parameters that do not
+	// affect the content of responses, and which are removed from the request
+	// URL before computing its cache key. An entry ending in "*" matches all
+	// parameters with the preceding prefix, for example "utm_*".
+	//
+	// Only the cache key is affected; the request forwarded to the target is
+	// not modified.
+	StripQueryParams []string
+
+	// DisableUpstreamHTTP2, if true, restricts requests forwarded to upstream
+	// targets to HTTP/1.1. Otherwise, the proxy negotiates HTTP/2 with targets
+	// that support it over TLS, and multiplexes concurrent requests to each
+	// target over a shared connection. Set this for targets that misbehave
+	// when using HTTP/2.
+	DisableUpstreamHTTP2 bool
+
+	// UpstreamRootCAs, if non-nil, is the pool of CA certificates used to
+	// verify the TLS certificates of upstream targets, in place of the system
+	// certificate pool. Use this to proxy internal targets whose certificates
+	// are issued by a private CA.
+	UpstreamRootCAs *x509.CertPool
+
+	// UpstreamCertPins, if non-empty, lists the SHA-256 fingerprints of
+	// certificates trusted for upstream targets. A TLS connection to a target
+	// is accepted only if a certificate it is verified by matches a pin.
+	//
+	// If UpstreamRootCAs is nil, the pins replace chain verification, so that
+	// a target with a self-signed certificate can be trusted by its
+	// fingerprint; then only the leaf certificate of the target is checked.
+	// Otherwise, the chain must verify, and a pin may match the leaf or any
+	// other certificate in a verified chain.
+	UpstreamCertPins []CertPin
+
+	// SortQueryParams, if true, sorts the query parameters of the request URL
+	// by name before computing its cache key, so that requests differing only
+	// in the order of their parameters share a cache entry. The relative order
+	// of multiple values for the same parameter is preserved.
+	SortQueryParams bool
+
+	// CacheableContentTypes, if non-empty, lists the media types of responses
+	// that are eligible for caching. A response whose Content-Type does not
+	// match any entry is forwarded without being cached, regardless of its
+	// Cache-Control directives. Parameters such as "charset" are ignored when
+	// matching. An entry of the form "type/*" matches all subtypes of type,
+	// for example "image/*".
+	//
+	// If empty, responses are eligible for caching regardless of content type.
+	CacheableContentTypes []string
+
 	// Local is the path of a local cache directory where responses are cached.
-	// It must be non-empty.
+	// It must be non-empty unless DisableLocalCache is true.
 	Local string
 
+	// DisableLocalCache, if true, disables the local disk cache. Cacheable
+	// responses are written only to S3, and a request not answered by the
+	// memory cache is served from S3, without keeping a copy on disk. This
+	// suits hosts with a fast connection to S3 and little local disk.
+	//
+	// If S3Client is also nil, responses eligible for caching on disk are not
+	// cached at all.
+	DisableLocalCache bool
+
+	// LocalPerHost, if true, partitions the local cache directory by target
+	// host, so that responses from each host are stored under a subdirectory
+	// of Local named for the host, "<Local>/<host>/<xx>/<hash>". Host-scoped
+	// maintenance, such as removing or measuring the entries for one host, can
+	// then be done on its directory. The directory is named for the host in
+	// normal form (lower case, without a trailing dot or a default port), and
+	// a port number is separated from the host by "_" rather than ":".
+	// Responses for a host that is not a valid name or address are stored
+	// in the shared layout, "<Local>/<xx>/<hash>".
+	//
+	// The layout of keys in S3 is not affected. Responses stored locally
+	// without this setting are not found with it (and vice versa), but will
+	// be faulted in again from S3 as needed.
+	LocalPerHost bool
+
 	// S3Client is the S3 client used to read and write cache entries to the
-	// backing store. It must be non-nil
+	// backing store. If nil, the proxy uses only the local directory, and does
+	// not read from or write to S3.
 	S3Client *s3util.Client
 
+	// RangeFaultMinSize, if positive, enables serving byte range requests for
+	// large responses directly from S3. When a GET request with a Range header
+	// misses the memory and local caches, and the cached response body in S3
+	// is at least RangeFaultMinSize bytes, the proxy reads only the requested
+	// range from S3 and returns it as a partial (206) response, rather than
+	// faulting in the whole response. The local cache is not updated.
+	//
+	// Only a single byte range is served this way. Requests for multiple
+	// ranges, with an If-Range header, or that require decoding the cached
+	// body, fault in the whole response as usual.
+	RangeFaultMinSize int64
+
 	// KeyPrefix, if non-empty, is prepended to each key stored into S3, with an
 	// intervening slash.
 	KeyPrefix string
 
+	// TenantHeader, if non-empty, is the name of a request header that
+	// identifies the tenant on whose behalf a request is made. Each tenant has
+	// its own cache namespace: its entries have distinct cache keys, and are
+	// stored in S3 under "<KeyPrefix>/tenant/<name>/". Requests without the
+	// header use the default namespace, which is the same as when TenantHeader
+	// is not set. The header is not forwarded to targets.
+	//
+	// A tenant name may contain only letters, digits, "-", "_", and ".".
+	// Requests that name an invalid tenant, or a tenant not listed in Tenants
+	// (if it is set), are rejected with HTTP 403 (Forbidden).
+	TenantHeader string
+
+	// Tenants, if non-empty, lists the tenant names permitted in TenantHeader.
+	// It has no effect if TenantHeader is empty.
+	Tenants []string
+
+	// DisableMemoryCache, if true, disables the in-memory cache for volatile
+	// responses. When set, responses that are not eligible for caching on disk
+	// are not cached at all.
+	DisableMemoryCache bool
+
+	// NegativeTTL, if positive, enables negative caching of "not found"
+	// responses (HTTP 404 and 410) from upstream targets. Such responses are
+	// recorded in the memory cache for up to NegativeTTL, and repeated
+	// requests for the same URL are answered from the cache without contacting
+	// the target. Because a negative entry prevents the proxy from seeing a
+	// later success, NegativeTTL should be kept short.
+	//
+	// Negative caching has no effect if DisableMemoryCache is true.
+	NegativeTTL time.Duration
+
+	// PreflightTTL, if positive, enables caching of responses to CORS
+	// preflight requests, which are OPTIONS requests with Origin and
+	// Access-Control-Request-Method headers. Successful (2xx) responses are
+	// recorded in the memory cache for up to PreflightTTL, or for the
+	// Access-Control-Max-Age of the response if that is shorter, and repeated
+	// preflights are answered from the cache without contacting the target.
+	//
+	// Cached preflights are keyed on the request URL, and on the Origin,
+	// Access-Control-Request-Method, and Access-Control-Request-Headers of the
+	// request. A response with an Access-Control-Max-Age of zero or less, or
+	// a Cache-Control of "no-store", is not cached. Other OPTIONS requests are
+	// always forwarded.
+	//
+	// Preflight caching has no effect if DisableMemoryCache is true.
+	PreflightTTL time.Duration
+
+	// MaxImmutableAge, if positive, is the maximum age of a response cached on
+	// disk or in S3. Cached responses older than this are treated as misses,
+	// so that the proxy fetches and caches a fresh copy from the target, even
+	// if the response was marked immutable. The age of a response is based on
+	// the storage time recorded in the cache object, or for older objects in
+	// the local cache, the modification time of the file.
+	//
+	// This is a safety valve for targets that occasionally republish content
+	// under the same URL. If zero or negative, cached responses do not expire.
+	MaxImmutableAge time.Duration
+
+	// CacheSetCookie, if true, permits caching responses that include a
+	// Set-Cookie header, which are otherwise never cached. Such responses are
+	// usually specific to one client, so this should be enabled only for
+	// targets known to set cookies that do not affect the response body. The
+	// Set-Cookie header itself is never stored in the cache.
+	CacheSetCookie bool
+
+	// TransformResponse, if non-nil, is called with each cacheable response
+	// from an upstream target and its complete body, before the response is
+	// cached or returned to the client. It returns the body to use in place of
+	// data, and reports whether the response should be cached. The body it
+	// returns is what is sent to the client and, if permitted, stored in the
+	// cache; the proxy updates Content-Length to match it.
+	//
+	// The data passed to TransformResponse are as sent by the target, and may
+	// be compressed according to the Content-Encoding of the response. The
+	// function may modify the headers of rsp, for example to remove an ETag
+	// that no longer matches the body, but must not read or close rsp.Body.
+	//
+	// When TransformResponse is set, the body of a cacheable response is read
+	// completely before any of it is sent to the client. Responses that are
+	// not cacheable, negative responses, and preflight responses are passed
+	// through unchanged.
+	TransformResponse func(rsp *http.Response, data []byte) ([]byte, bool)
+
+	// CompressStored, if true, stores cacheable responses that have no
+	// Content-Encoding in gzip-compressed form on disk and in S3, in place of
+	// the body received from the target. Since gzip and identity responses
+	// already share a cache key, this keeps a single compressed object per
+	// request regardless of which encoding the target sent, and clients that
+	// do not accept gzip are served the decompressed body. The Etag of a
+	// compressed response is weakened, since its representation differs.
+	//
+	// Bodies shorter than 256 bytes, or that do not shrink when compressed,
+	// are stored as received. The response to the request that fetched the
+	// object, and responses cached only in memory, are not affected.
+	CompressStored bool
+
+	// DirMode, if nonzero, is the permission mode used when creating
+	// directories in the local cache. If zero, the default is 0755.
+	DirMode fs.FileMode
+
+	// FileMode, if nonzero, is the permission mode used when writing files to
+	// the local cache. If zero, the default is 0644.
+	FileMode fs.FileMode
+
+	// MaxDiskEntries, if positive, limits the number of responses stored in
+	// the local cache directory, to bound its use of inodes. When storing a
+	// response brings the count above MaxDiskEntries, the least recently used
+	// responses are removed until 90% of the limit remain, so that eviction
+	// does not occur on every store. Responses removed from the local cache
+	// remain in S3, and are faulted in again when requested.
+	//
+	// Recency is tracked in memory, so responses already present when the
+	// server starts are ordered by the time they were stored. The first store
+	// after startup scans the local directory to count its contents.
+	MaxDiskEntries int
+
+	// UpstreamTimeout, if positive, bounds the total time allowed for each
+	// request forwarded to an upstream target, including reading the response.
+	// If zero or negative, forwarded requests are bounded only by the context
+	// of the inbound request.
+	UpstreamTimeout time.Duration
+
+	// RequestTimeout, if positive, bounds the total time allowed to handle each
+	// request, including reading from the cache and forwarding the request to
+	// an upstream target. If zero or negative, requests are bounded only by
+	// the context of the inbound request.
+	//
+	// In either case, when the inbound request ends (for example, because the
+	// client disconnected) any request forwarded upstream on its behalf is
+	// canceled, and a partial response is not cached. Writes to S3 that have
+	// already begun are not affected.
+	RequestTimeout time.Duration
+
+	// MaxRequestBodyBytes, if positive, is the largest request body the proxy
+	// will forward to an upstream target. A request that declares a longer
+	// body is rejected with status 413 (Request Entity Too Large) before it
+	// is forwarded. A body of unknown length is forwarded until it exceeds
+	// the limit; the forwarded request is then aborted, and the proxy reports
+	// status 413. If zero or negative, request bodies are not limited.
+	MaxRequestBodyBytes int64
+
+	// UpstreamRetries, if positive, is the maximum number of times a GET or
+	// HEAD request forwarded to an upstream target is retried after it fails
+	// with a transport error, a 5xx status, or a 429 (Too Many Requests)
+	// status. Responses with other statuses, including other 4xx statuses, are
+	// not retried. Only the result of the final attempt is cached or returned
+	// to the client, including any Retry-After header it has.
+	//
+	// When a failed response has a Retry-After header, the next retry waits at
+	// least as long as it specifies. If the requested delay is more than 30
+	// seconds, or would exceed the deadline of the request, the response is
+	// returned without further retries.
+	UpstreamRetries int
+
+	// UpstreamRetryBackoff is the delay before the first retry of a failed
+	// upstream request, which doubles for each subsequent retry. If zero or
+	// negative, the default is 100ms. Retries count against UpstreamTimeout.
+	UpstreamRetryBackoff time.Duration
+
+	// BreakerThreshold, if positive, enables a circuit breaker for each
+	// upstream target. After BreakerThreshold consecutive upstream failures
+	// for a target within BreakerWindow, requests to that target that are not
+	// satisfied by the cache fail immediately with HTTP 503 (Service
+	// Unavailable) until BreakerCooldown has elapsed.
+	//
+	// An upstream failure is a transport error (including a timeout), or a
+	// response with a 5xx or 429 (Too Many Requests) status. If a failed
+	// response has a Retry-After header, a breaker tripped by it stays open at
+	// least as long as the header specifies, up to 30 seconds. Requests served
+	// from the cache are not affected by the state of the breaker.
+	BreakerThreshold int
+
+	// BreakerWindow is the maximum span of time over which consecutive
+	// upstream failures are counted toward BreakerThreshold.
+	// If zero or negative, the default is 1 minute.
+	BreakerWindow time.Duration
+
+	// BreakerCooldown is the length of time the circuit breaker for a target
+	// remains open after it trips. If zero or negative, the default is 30
+	// seconds.
+	BreakerCooldown time.Duration
+
+	// StaleIfError is the default length of time after a volatile response in
+	// the memory cache expires during which it may still be served if a
+	// request to fetch a fresh copy fails, either with a transport error or
+	// with a 5xx status. A "stale-if-error" directive in the Cache-Control
+	// header of the response overrides this default. If zero or negative, and
+	// the response has no such directive, expired responses are not served.
+	StaleIfError time.Duration
+
+	// MaxUpstreamConcurrency, if positive, limits the number of requests that
+	// may be forwarded to upstream targets at once. A request that must be
+	// forwarded when the limit is reached waits for up to MaxUpstreamWait for
+	// another request to finish, and if none does it fails with HTTP 503
+	// (Service Unavailable). Requests served from the cache are not limited.
+	MaxUpstreamConcurrency int
+
+	// MaxUpstreamWait is the maximum time a request waits to be forwarded when
+	// MaxUpstreamConcurrency requests are already in flight. If zero or
+	// negative, such requests fail immediately.
+	MaxUpstreamWait time.Duration
+
+	// WarmConcurrency, if positive, is the maximum number of URLs fetched at
+	// once by Warm. If zero or negative, the default is runtime.NumCPU.
+	WarmConcurrency int
+
 	// Logf, if non-nil, is used to write log messages. If nil, logs are
 	// discarded.
 	Logf func(string, ...any)
@@ -108,14 +494,19 @@ type Server struct {
 	// The dispositions of a request are:
 	//
 	//     hit mem  -- cache hit in memory (volatile)
+	//     hit neg  -- cache hit in memory (negative)
+	//     hit pre  -- cache hit in memory (CORS preflight)
+	//     hit stale -- expired entry in memory served after upstream failure
 	//     hit disk -- cache hit in local disk
 	//     hit S3   -- cache hit in S3 (faulted to disk)
 	//     fetch    -- fetched from the origin server
 	//
 	// On fetches, the "RC" tag indicates whether the response is cacheable,
 	// with "no" meaning it was not cached at all, "mem" meaning it was cached
-	// as a short-lived volatile response in memory, and "yes" meaning it was
-	// cached on disk (and S3).
+	// as a short-lived volatile response in memory, "neg" meaning it was
+	// cached as a negative entry in memory, "pre" meaning it was cached as a
+	// preflight response in memory, and "yes" meaning it was cached on disk
+	// (and S3).
 	LogRequests bool
 
 	initOnce sync.Once
@@ -123,103 +514,307 @@ type Server struct {
 	start    func(taskgroup.Task)
 	mcache   *cache.Cache[string, memCacheEntry] // short-lived mutable objects
 	expire   *scheddle.Queue                     // cache expirations
+	breaker  *breaker                            // upstream circuit breaker (optional)
+	rt       http.RoundTripper                   // upstream transport (nil for default)
+	upstream chan struct{}                       // upstream concurrency limiter (optional)
+	index    index                               // local cache contents
+	targets  atomic.Pointer[[]string]            // targets set by SetTargets
 
-	reqReceived  expvar.Int // total requests received
-	reqMemoryHit expvar.Int // hit in memory cache (volatile)
-	reqLocalHit  expvar.Int // hit in local cache
-	reqLocalMiss expvar.Int // miss in local cache
-	reqFaultHit  expvar.Int // hit in remote (S3) cache
-	reqFaultMiss expvar.Int // miss in remote (S3) cache
-	reqForward   expvar.Int // request forwarded directly to upstream
-	rspSave      expvar.Int // successful response saved in local cache
-	rspSaveMem   expvar.Int // response saved in memory cache
-	rspSaveError expvar.Int // error saving to local cache
-	rspSaveBytes expvar.Int // bytes written to local cache
-	rspPush      expvar.Int // successful response saved in S3
-	rspPushError expvar.Int // error saving to S3
-	rspPushBytes expvar.Int // bytes written to S3
-	rspNotCached expvar.Int // response not cached anywhere
+	reqReceived      expvar.Int // total requests received
+	reqFixture       expvar.Int // request answered by a fixture
+	reqWarm          expvar.Int // request made to warm the cache
+	reqTenantReject  expvar.Int // request rejected for an invalid tenant
+	reqTooLarge      expvar.Int // request rejected for exceeding MaxRequestBodyBytes
+	reqMemoryHit     expvar.Int // hit in memory cache (volatile)
+	reqStaleHit      expvar.Int // hit in memory cache (stale, upstream failed)
+	reqNegativeHit   expvar.Int // hit in memory cache (negative)
+	reqPreflightHit  expvar.Int // hit in memory cache (CORS preflight)
+	reqLocalHit      expvar.Int // hit in local cache
+	reqLocalMiss     expvar.Int // miss in local cache
+	reqLocalExpired  expvar.Int // local cache entry older than MaxImmutableAge
+	reqFaultHit      expvar.Int // hit in remote (S3) cache
+	reqFaultMiss     expvar.Int // miss in remote (S3) cache
+	reqFaultExpired  expvar.Int // remote cache entry older than MaxImmutableAge
+	reqFaultRange    expvar.Int // byte range served from remote (S3) cache
+	reqForward       expvar.Int // request forwarded directly to upstream
+	reqUpstreamError expvar.Int // forwarded request failed upstream
+	reqUpstreamRetry expvar.Int // forwarded request retried after a failure
+	reqThrottled     expvar.Int // forwarded request throttled by upstream (with Retry-After)
+	reqShortCircuit  expvar.Int // request rejected by an open circuit breaker
+	reqUpstreamLimit expvar.Int // request rejected by the upstream concurrency limit
+	upstreamActive   expvar.Int // requests currently in flight to upstream targets
+	breakerTrip      expvar.Int // circuit breaker tripped for a target
+	rspSave          expvar.Int // successful response saved in local cache
+	rspSaveMem       expvar.Int // response saved in memory cache
+	rspSaveError     expvar.Int // error saving to local cache
+	rspSaveBytes     expvar.Int // bytes written to local cache
+	rspCompressed    expvar.Int // response compressed for storage by CompressStored
+	rspEvict         expvar.Int // response removed from local cache by MaxDiskEntries
+	rspPush          expvar.Int // successful response saved in S3
+	rspPushError     expvar.Int // error saving to S3
+	rspPushBytes     expvar.Int // bytes written to S3
+	rspSaveNegative  expvar.Int // "not found" response saved in memory cache
+	rspSavePreflight expvar.Int // preflight response saved in memory cache
+	rspNotCached     expvar.Int // response not cached anywhere
+	rspIncomplete    expvar.Int // response not cached because its body was incomplete
+	rspVerifyFail    expvar.Int // response not cached because its body did not match its length or digest
+	rspTransform     expvar.Int // response body passed to TransformResponse
+	rspNotModified   expvar.Int // conditional request answered "not modified" from cache
+	rspDecoded       expvar.Int // cached response decompressed for the client
+	rspStatus        expvar.Map // count of upstream responses by status code
 }
 
 func (s *Server) init() {
 	s.initOnce.Do(func() {
 		nt := runtime.NumCPU()
 		s.tasks, s.start = taskgroup.New(nil).Limit(nt)
-		s.mcache = cache.New(cache.LRU[string, memCacheEntry](10 << 20).
-			WithSize(entrySize),
-		)
-		s.expire = scheddle.NewQueue(nil)
+		if !s.DisableMemoryCache {
+			s.mcache = cache.New(cache.LRU[string, memCacheEntry](10 << 20).
+				WithSize(entrySize),
+			)
+			s.expire = scheddle.NewQueue(nil)
+		}
+		if tc := upstreamTLSConfig(s.UpstreamRootCAs, s.UpstreamCertPins); tc != nil {
+			t := newUpstreamTransport(s.Origins, !s.DisableUpstreamHTTP2)
+			t.TLSClientConfig = tc
+			s.rt = t
+		} else if len(s.Origins) != 0 || s.DisableUpstreamHTTP2 {
+			s.rt = newUpstreamTransport(s.Origins, !s.DisableUpstreamHTTP2)
+		}
+		if s.UpstreamRetries > 0 {
+			s.rt = &retryTransport{
+				base:    cmp.Or[http.RoundTripper](s.rt, http.DefaultTransport),
+				retries: s.UpstreamRetries,
+				backoff: cmp.Or(max(s.UpstreamRetryBackoff, 0), 100*time.Millisecond),
+				retried: &s.reqUpstreamRetry,
+				limited: &s.reqThrottled,
+				logf:    s.logf,
+			}
+		}
+		if s.BreakerThreshold > 0 {
+			s.breaker = &breaker{
+				threshold: s.BreakerThreshold,
+				window:    cmp.Or(max(s.BreakerWindow, 0), 1*time.Minute),
+				cooldown:  cmp.Or(max(s.BreakerCooldown, 0), 30*time.Second),
+			}
+		}
+		if s.MaxUpstreamConcurrency > 0 {
+			s.upstream = make(chan struct{}, s.MaxUpstreamConcurrency)
+		}
 	})
 }
 
 // Metrics returns a map of cache server metrics for s.  The caller is
 // responsible to publish these metrics as desired.
+//
+// Most metrics are counters. The "rsp_status" metric is itself a map, from
+// the status code of each response received from an upstream target, such as
+// "200" or "403", to the number of such responses.
 func (s *Server) Metrics() *expvar.Map {
 	m := new(expvar.Map)
 	m.Set("req_received", &s.reqReceived)
+	m.Set("req_fixture", &s.reqFixture)
+	m.Set("req_warm", &s.reqWarm)
+	m.Set("req_tenant_reject", &s.reqTenantReject)
+	m.Set("req_too_large", &s.reqTooLarge)
 	m.Set("req_memory_hit", &s.reqMemoryHit)
+	m.Set("req_stale_hit", &s.reqStaleHit)
+	m.Set("req_negative_hit", &s.reqNegativeHit)
+	m.Set("req_preflight_hit", &s.reqPreflightHit)
 	m.Set("req_local_hit", &s.reqLocalHit)
 	m.Set("req_local_miss", &s.reqLocalMiss)
+	m.Set("req_local_expired", &s.reqLocalExpired)
 	m.Set("req_fault_hit", &s.reqFaultHit)
 	m.Set("req_fault_miss", &s.reqFaultMiss)
+	m.Set("req_fault_expired", &s.reqFaultExpired)
+	m.Set("req_fault_range", &s.reqFaultRange)
 	m.Set("req_forward", &s.reqForward)
+	m.Set("req_upstream_error", &s.reqUpstreamError)
+	m.Set("req_upstream_retry", &s.reqUpstreamRetry)
+	m.Set("req_upstream_throttled", &s.reqThrottled)
+	m.Set("req_short_circuit", &s.reqShortCircuit)
+	m.Set("req_upstream_limit", &s.reqUpstreamLimit)
+	m.Set("upstream_active", &s.upstreamActive)
+	m.Set("breaker_trip", &s.breakerTrip)
 	m.Set("rsp_save", &s.rspSave)
 	m.Set("rsp_save_memory", &s.rspSaveMem)
 	m.Set("rsp_save_error", &s.rspSaveError)
 	m.Set("rsp_save_bytes", &s.rspSaveBytes)
+	m.Set("rsp_compressed", &s.rspCompressed)
 	m.Set("rsp_push", &s.rspPush)
 	m.Set("rsp_push_error", &s.rspPushError)
 	m.Set("rsp_push_bytes", &s.rspPushBytes)
+	m.Set("rsp_save_negative", &s.rspSaveNegative)
+	m.Set("rsp_save_preflight", &s.rspSavePreflight)
 	m.Set("rsp_not_cached", &s.rspNotCached)
+	m.Set("rsp_evict", &s.rspEvict)
+	m.Set("rsp_incomplete", &s.rspIncomplete)
+	m.Set("rsp_verify_fail", &s.rspVerifyFail)
+	m.Set("rsp_transform", &s.rspTransform)
+	m.Set("rsp_not_modified", &s.rspNotModified)
+	m.Set("rsp_decoded", &s.rspDecoded)
+	m.Set("rsp_status", &s.rspStatus)
+	m.Set("local_entries", expvar.Func(func() any {
+		if s.DisableLocalCache {
+			return 0
+		}
+		n, _, _ := s.index.stats(s.Local)
+		return n
+	}))
+	m.Set("local_bytes", expvar.Func(func() any {
+		if s.DisableLocalCache {
+			return 0
+		}
+		_, size, _ := s.index.stats(s.Local)
+		return size
+	}))
 	return m
 }
 
+// SetTargets replaces the list of hosts for which s forwards requests, in
+// place of Targets. It is safe to call SetTargets concurrently with requests
+// being served: each request is checked against either the old or the new
+// list in its entirety. Requests already admitted are not affected.
+func (s *Server) SetTargets(targets []string) {
+	t := slices.Clone(targets)
+	s.targets.Store(&t)
+}
+
+// activeTargets returns the current list of target hosts for s.
+func (s *Server) activeTargets() []string {
+	if t := s.targets.Load(); t != nil {
+		return *t
+	}
+	return s.Targets
+}
+
 // ServeHTTP implements the [http.Handler] interface for the proxy.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.init()
 	s.reqReceived.Add(1)
 
+	// Check whether this request is answered by a fixture.
+	if fx, ok := s.fixture(r); ok {
+		s.reqFixture.Add(1)
+		fx.writeTo(w)
+		s.vlogf("rp E U:%q fixture S:%d", r.URL, fx.status())
+		return
+	}
+
 	// Check whether this request is to a target we are permitted to proxy for.
-	if !hostMatchesTarget(r.Host, s.Targets) {
+	if !hostMatchesTarget(r.Host, s.activeTargets()) {
 		s.logf("reject proxy request for non-target %q", r.Host)
 		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
 		return
 	}
 
-	hash := hashRequestURL(r.URL)
+	// Check whether the request body is too large to forward.
+	if s.MaxRequestBodyBytes > 0 {
+		if r.ContentLength > s.MaxRequestBodyBytes {
+			s.reqTooLarge.Add(1)
+			s.logf("reject proxy request for %q: body of %d bytes is too large", r.URL, r.ContentLength)
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.MaxRequestBodyBytes)
+	}
+
+	if s.RequestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.RequestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	tenant, ok := s.requestTenant(r)
+	if !ok {
+		s.reqTenantReject.Add(1)
+		s.logf("reject proxy request for tenant %q", r.Header.Get(s.TenantHeader))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	hash := hashRequestKey(r.Method, s.cacheKeyURL(targetURL(r)), requestVariant(r), tenant)
 	canCache := s.canCacheRequest(r)
+	preflight := canCache && r.Method == http.MethodOptions
+	if preflight {
+		hash = hashRequestKey(r.Method, s.cacheKeyURL(targetURL(r)), preflightVariant(r), tenant)
+	}
 	s.vlogf("rp B U:%q H:%s C:%v", r.URL, hash, canCache)
 	start := time.Now()
-	if canCache {
+	if preflight {
+		// Preflight responses are cached only in memory.
+		if code, hdr, body, ok := s.cacheLoadPreflight(hash); ok {
+			s.reqPreflightHit.Add(1)
+			setXCacheInfo(hdr, "hit, preflight", hash)
+			writePreflightResponse(w, hdr, code, body)
+			s.vlogf("rp E H:%s hit pre S:%d (%v elapsed)", hash, code, time.Since(start))
+			return
+		}
+		s.vlogf("rp - H:%s miss", hash)
+	} else if canCache {
 		// Check for a hit on this object in the memory cache.
 		if data, hdr, err := s.cacheLoadMemory(hash); err == nil {
 			s.reqMemoryHit.Add(1)
 			setXCacheInfo(hdr, "hit, memory", hash)
-			writeCachedResponse(w, hdr, data)
+			s.writeCachedResponse(w, r, hdr, data)
 			s.vlogf("rp E H:%s hit mem B:%d (%v elapsed)", hash, len(data), time.Since(start))
 			return
 		}
 
-		// Check for a hit on this object in the local cache.
-		if data, hdr, err := s.cacheLoadLocal(hash); err == nil {
-			s.reqLocalHit.Add(1)
-			setXCacheInfo(hdr, "hit, local", hash)
-			writeCachedResponse(w, hdr, data)
-			s.vlogf("rp E H:%s hit disk B:%d (%v elapsed)", hash, len(data), time.Since(start))
+		// Check for a negative cache entry for this object.
+		if code, hdr, ok := s.cacheLoadNegative(hash); ok {
+			s.reqNegativeHit.Add(1)
+			setXCacheInfo(hdr, "hit, negative", hash)
+			writeNegativeResponse(w, hdr, code)
+			s.vlogf("rp E H:%s hit neg S:%d (%v elapsed)", hash, code, time.Since(start))
 			return
 		}
-		s.reqLocalMiss.Add(1)
+
+		// Check for a hit on this object in the local cache.
+		if !s.DisableLocalCache {
+			if data, hdr, err := s.cacheLoadLocal(r.Host, hash); err == nil {
+				s.reqLocalHit.Add(1)
+				setXCacheInfo(hdr, "hit, local", hash)
+				s.writeCachedResponse(w, r, hdr, data)
+				s.vlogf("rp E H:%s hit disk B:%d (%v elapsed)", hash, len(data), time.Since(start))
+				return
+			}
+			s.reqLocalMiss.Add(1)
+		}
+
+		// Serve a byte range of a large object directly from S3. If that is
+		// not possible, fall back to faulting in the whole object.
+		missing := false
+		if s.canRangeFromS3(r) {
+			rr, err := s.cacheLoadS3Range(r.Context(), r, tenant, hash)
+			if err == nil {
+				s.reqFaultRange.Add(1)
+				setXCacheInfo(rr.header, "hit, remote, range", hash)
+				if err := rr.writeTo(w); err != nil {
+					s.vlogf("rp E H:%s S3 range O:%d: %v (response truncated)", hash, rr.off, err)
+					return
+				}
+				s.vlogf("rp E H:%s hit S3 range O:%d B:%d (%v elapsed)", hash, rr.off, rr.n, time.Since(start))
+				return
+			}
+			missing = errors.Is(err, fs.ErrNotExist) // no need to look again
+			if !missing && !errors.Is(err, errNoRange) {
+				s.vlogf("rp - H:%s S3 range: %v", hash, err)
+			}
+		}
 
 		// Fault in from S3.
-		if data, hdr, err := s.cacheLoadS3(r.Context(), hash); err == nil {
-			s.reqFaultHit.Add(1)
-			if err := s.cacheStoreLocal(hash, hdr, data); err != nil {
-				s.logf("update %q local: %v", hash, err)
+		if !missing {
+			if data, hdr, err := s.cacheLoadS3(r.Context(), tenant, hash); err == nil {
+				s.reqFaultHit.Add(1)
+				if err := s.cacheStoreLocal(r.Host, hash, hdr, data); err != nil {
+					s.logf("update %q local: %v", hash, err)
+				}
+				setXCacheInfo(hdr, "hit, remote", hash)
+				s.writeCachedResponse(w, r, hdr, data)
+				s.vlogf("rp E H:%s hit S3 B:%d (%v elapsed)", hash, len(data), time.Since(start))
+				return
 			}
-			setXCacheInfo(hdr, "hit, remote", hash)
-			writeCachedResponse(w, hdr, data)
-			s.vlogf("rp E H:%s hit S3 B:%d (%v elapsed)", hash, len(data), time.Since(start))
-			return
 		}
 		s.reqFaultMiss.Add(1)
 		s.vlogf("rp - H:%s miss", hash)
@@ -227,13 +822,99 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Reaching here, the object is not already cached locally so we have to
 	// talk to the backend to get it. We need to do this whether or not it is
-	// cacheable. Note we handle each request with its own proxy instance, so
-	// that we can handle each response in context of this request.
+	// cacheable. If the target is known to be unhealthy, fail fast.
+	if s.breaker != nil {
+		if wait, ok := s.breaker.allow(r.Host, time.Now()); !ok {
+			s.reqShortCircuit.Add(1)
+			setXCacheInfo(w.Header(), "miss, circuit open", "")
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			s.vlogf("rp E H:%s short circuit (%v elapsed)", hash, time.Since(start))
+			return
+		}
+	}
+	release, ok := s.acquireUpstream(r.Context())
+	if !ok {
+		s.reqUpstreamLimit.Add(1)
+		setXCacheInfo(w.Header(), "miss, upstream busy", "")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		s.vlogf("rp E H:%s upstream busy (%v elapsed)", hash, time.Since(start))
+		return
+	}
+	defer release()
+	if s.UpstreamTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.UpstreamTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// Note we handle each request with its own proxy instance, so that we can
+	// handle each response in context of this request.
 	s.reqForward.Add(1)
-	proxy := &httputil.ReverseProxy{Rewrite: s.rewriteRequest}
+	proxy := &httputil.ReverseProxy{
+		Rewrite:      s.rewriteRequest,
+		Transport:    s.rt,
+		ErrorHandler: s.upstreamError,
+	}
 	updateCache := func() {}
 	if canCache {
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			if s.bodyTooLarge(w, r, err) {
+				return
+			}
+
+			// If the target failed and we have a stale copy we're allowed to
+			// use, serve that instead of the error.
+			if !errors.Is(err, errServeStale) && !s.noteUpstreamError(r, err) {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			if data, hdr, ok := s.cacheLoadStale(hash); ok {
+				s.reqStaleHit.Add(1)
+				setXCacheInfo(hdr, "hit, stale-error", hash)
+				s.writeCachedResponse(w, r, hdr, data)
+				s.vlogf("rp E H:%s hit stale B:%d (%v elapsed)", hash, len(data), time.Since(start))
+				return
+			}
+			writeUpstreamError(w, err)
+		}
 		proxy.ModifyResponse = func(rsp *http.Response) error {
+			if preflight {
+				ttl, ok := s.preflightTTL(rsp)
+				if !ok {
+					setXCacheInfo(rsp.Header, "fetch, uncached", "")
+					s.rspNotCached.Add(1)
+					s.vlogf("rp E H:%s fetch RC:no (%v elapsed)", hash, time.Since(start))
+					return nil
+				}
+				body := &captureBody{ReadCloser: rsp.Body}
+				rsp.Body = body
+				setXCacheInfo(rsp.Header, "fetch, cached, preflight", hash)
+				updateCache = func() {
+					if !s.checkComplete(hash, body) {
+						return
+					}
+					data := body.buf.Bytes()
+					s.cacheStorePreflight(hash, ttl, rsp.StatusCode, rsp.Header, data)
+					s.rspSavePreflight.Add(1)
+					s.vlogf("rp E H:%s fetch RC:pre S:%d (%v elapsed)", hash, rsp.StatusCode, time.Since(start))
+				}
+				return nil
+			}
+			if rsp.StatusCode >= 500 && s.hasStale(hash) {
+				return errServeStale // handled by ErrorHandler
+			}
+			if s.canNegativeCache(rsp) {
+				// A "not found" response we can remember briefly.
+				setXCacheInfo(rsp.Header, "fetch, cached, negative", hash)
+				updateCache = func() {
+					s.cacheStoreNegative(hash, rsp.StatusCode, rsp.Header)
+					s.rspSaveNegative.Add(1)
+					s.vlogf("rp E H:%s fetch RC:neg S:%d (%v elapsed)", hash, rsp.StatusCode, time.Since(start))
+				}
+				return nil
+			}
 			maxAge, isVolatile := s.canMemoryCache(rsp)
 			canCacheResponse := s.canCacheResponse(rsp)
 			if !canCacheResponse && !isVolatile {
@@ -243,49 +924,262 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				s.vlogf("rp E H:%s fetch RC:no (%v elapsed)", hash, time.Since(start))
 				return nil
 			}
+			transformed := s.TransformResponse != nil
+			if transformed {
+				if ok, err := s.transformBody(hash, rsp); err != nil {
+					return err
+				} else if !ok {
+					setXCacheInfo(rsp.Header, "fetch, uncached", "")
+					s.rspNotCached.Add(1)
+					s.vlogf("rp E H:%s fetch RC:no transform (%v elapsed)", hash, time.Since(start))
+					return nil
+				}
+			}
 
-			// Read out the whole response body so we can update the cache, and
+			// Capture the whole response body so we can update the cache, and
 			// replace the response reader so we can copy it back to the caller.
-			var buf bytes.Buffer
-			rsp.Body = copyReader{
-				Reader: io.TeeReader(rsp.Body, &buf),
-				Closer: rsp.Body,
-			}
+			body := &captureBody{ReadCloser: rsp.Body}
+			rsp.Body = body
 			if !canCacheResponse && isVolatile {
 				// A volatile response we can cache temporarily.
 				setXCacheInfo(rsp.Header, "fetch, cached, volatile", hash)
 				updateCache = func() {
-					body := buf.Bytes()
-					s.cacheStoreMemory(hash, maxAge, rsp.Header, body)
+					if !s.checkComplete(hash, body) {
+						return
+					}
+					data := body.buf.Bytes()
+					if !transformed && !s.checkVerified(hash, rsp, data) {
+						return
+					}
+					s.cacheStoreMemory(hash, maxAge, s.staleWindow(rsp), rsp.Header, data)
 					s.rspSaveMem.Add(1)
 
 					// N.B. Don't persist on disk or in S3.
-					s.vlogf("rp E H:%s fetch RC:mem B:%d (%v elapsed)", hash, len(body), time.Since(start))
+					s.vlogf("rp E H:%s fetch RC:mem B:%d (%v elapsed)", hash, len(data), time.Since(start))
 				}
 			} else {
 				setXCacheInfo(rsp.Header, "fetch, cached", hash)
 				updateCache = func() {
-					body := buf.Bytes()
-					if err := s.cacheStoreLocal(hash, rsp.Header, body); err != nil {
+					if !s.checkComplete(hash, body) {
+						return
+					}
+					data := body.buf.Bytes()
+					if !transformed && !s.checkVerified(hash, rsp, data) {
+						return
+					}
+					hdr := rsp.Header.Clone()
+					// Record the URL without its query or credentials, which may
+					// contain secrets such as signed tokens.
+					cu := targetURL(r)
+					cu.User, cu.RawQuery, cu.ForceQuery, cu.Fragment = nil, "", false, ""
+					hdr.Set("X-Cache-Url", cu.String())
+					if s.CompressStored {
+						var ok bool
+						if data, ok = encodeForStorage(hdr, data); ok {
+							s.rspCompressed.Add(1)
+						}
+					}
+					if err := s.cacheStoreLocal(r.Host, hash, hdr, data); err != nil {
 						s.rspSaveError.Add(1)
 						s.logf("save %q to cache: %v", hash, err)
 
 						// N.B.: Don't bother trying to forward to S3 in this case.
 					} else {
-						s.rspSave.Add(1)
-						s.rspSaveBytes.Add(int64(len(body)))
-						s.start(s.cacheStoreS3(hash, rsp.Header, body))
+						s.cacheEvictNegative(hash)
+						if !s.DisableLocalCache {
+							s.rspSave.Add(1)
+							s.rspSaveBytes.Add(int64(len(data)))
+						}
+						s.start(s.cacheStoreS3(tenant, hash, hdr, data))
 					}
-					s.vlogf("rp E H:%s fetch RC:yes B:%d (%v elapsed)", hash, len(body), time.Since(start))
+					s.vlogf("rp E H:%s fetch RC:yes B:%d (%v elapsed)", hash, len(data), time.Since(start))
 				}
 			}
 			return nil
 		}
 	}
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(rsp *http.Response) error {
+		for _, name := range internalHeaders {
+			rsp.Header.Del(name) // only we may set these
+		}
+		s.noteUpstreamResponse(r, rsp)
+		if modifyResponse != nil {
+			return modifyResponse(rsp)
+		}
+		return nil
+	}
 	proxy.ServeHTTP(w, r)
+	release()
 	updateCache()
 }
 
+// A FixtureResponse is a fixed response served by a [Server] for a specific
+// request URL. See [Server.Fixtures].
+type FixtureResponse struct {
+	// StatusCode is the HTTP status of the response. If zero, it is 200 (OK).
+	StatusCode int
+
+	// Header, if non-nil, gives headers to include in the response.
+	Header http.Header
+
+	// Body is the body of the response.
+	Body []byte
+}
+
+func (f FixtureResponse) status() int { return cmp.Or(f.StatusCode, http.StatusOK) }
+
+// writeTo writes the fixture response to w.
+func (f FixtureResponse) writeTo(w http.ResponseWriter) {
+	wh := w.Header()
+	for name, vals := range f.Header {
+		for _, val := range vals {
+			wh.Add(name, val)
+		}
+	}
+	wh.Set("X-Cache", "fixture")
+	w.WriteHeader(f.status())
+	w.Write(f.Body)
+}
+
+// fixture reports whether r is answered by a fixture, and if so returns it.
+func (s *Server) fixture(r *http.Request) (FixtureResponse, bool) {
+	if len(s.Fixtures) == 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return FixtureResponse{}, false
+	}
+	fx, ok := s.Fixtures[targetURL(r).String()]
+	return fx, ok
+}
+
+// acquireUpstream obtains a slot to forward a request upstream, if the number
+// of upstream requests is limited. It reports false if no slot was available
+// within MaxUpstreamWait, or before ctx ended. Otherwise, the caller must call
+// the release function when the request is complete; it is safe to call more
+// than once.
+func (s *Server) acquireUpstream(ctx context.Context) (release func(), ok bool) {
+	if s.upstream == nil {
+		return func() {}, true
+	}
+	select {
+	case s.upstream <- struct{}{}:
+	default:
+		if s.MaxUpstreamWait <= 0 {
+			return nil, false
+		}
+		t := time.NewTimer(s.MaxUpstreamWait)
+		defer t.Stop()
+		select {
+		case s.upstream <- struct{}{}:
+		case <-t.C:
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+	s.upstreamActive.Add(1)
+	return sync.OnceFunc(func() {
+		s.upstreamActive.Add(-1)
+		<-s.upstream
+	}), true
+}
+
+// internalHeaders are the headers the proxy uses to record metadata in cached
+// objects. Any values sent by a target are discarded, so that it cannot forge
+// the storage time, expiration, or URL of the objects cached from it.
+var internalHeaders = []string{"X-Cache-Stored", "X-Cache-Expires", "X-Cache-Url"}
+
+// errServeStale is reported by ModifyResponse to the ErrorHandler of a
+// [httputil.ReverseProxy] when a failed response should be replaced with a
+// stale copy from the cache.
+var errServeStale = errors.New("upstream failed, serve stale")
+
+// upstreamError is an error handler for a [httputil.ReverseProxy] that
+// records a failed request to an upstream target.
+func (s *Server) upstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	if s.bodyTooLarge(w, r, err) {
+		return
+	} else if !s.noteUpstreamError(r, err) {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	writeUpstreamError(w, err)
+}
+
+// bodyTooLarge reports whether err, from forwarding r upstream, is because
+// the request body exceeded MaxRequestBodyBytes, and if so writes an error
+// response to w. Such a failure does not reflect on the target.
+func (s *Server) bodyTooLarge(w http.ResponseWriter, r *http.Request, err error) bool {
+	var mbe *http.MaxBytesError
+	if !errors.As(err, &mbe) {
+		return false
+	}
+	s.reqTooLarge.Add(1)
+	s.logf("upstream request for %q aborted: body exceeds %d bytes", r.URL, mbe.Limit)
+	http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+	return true
+}
+
+// noteUpstreamError records a failed request to an upstream target. It
+// reports false if the failure was because the client canceled the request,
+// which does not reflect on the target.
+func (s *Server) noteUpstreamError(r *http.Request, err error) bool {
+	if errors.Is(err, context.Canceled) {
+		s.vlogf("rp upstream request for %q canceled", r.URL)
+		return false
+	}
+	s.reqUpstreamError.Add(1)
+	s.logf("upstream request for %q failed: %v", r.URL, err)
+	s.recordUpstream(r.Host, false, 0)
+	return true
+}
+
+// noteUpstreamResponse records the response to a request forwarded to an
+// upstream target, including its status code and whether the target is
+// throttling requests.
+func (s *Server) noteUpstreamResponse(r *http.Request, rsp *http.Response) {
+	s.rspStatus.Add(statusKey(rsp.StatusCode), 1)
+	if rsp.StatusCode >= 400 {
+		s.vlogf("upstream request for %q: status %d", r.URL, rsp.StatusCode)
+	}
+	wait, throttled := isThrottled(rsp)
+	if throttled {
+		s.reqThrottled.Add(1)
+		s.logf("upstream request for %q throttled: status %d, retry after %v", r.URL, rsp.StatusCode, wait)
+	}
+	ok := rsp.StatusCode < 500 && rsp.StatusCode != http.StatusTooManyRequests
+	s.recordUpstream(r.Host, ok, wait)
+}
+
+// statusKey returns the key under which responses with the given status code
+// are counted in the rsp_status metric. Codes outside the range defined by
+// HTTP are counted together as "other", so the metric stays bounded.
+func statusKey(code int) string {
+	if code < 100 || code > 599 {
+		return "other"
+	}
+	return strconv.Itoa(code)
+}
+
+// writeUpstreamError writes an error response to w for a failed request to an
+// upstream target.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+	} else {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	}
+}
+
+// recordUpstream records the result of a request forwarded to host, if the
+// circuit breaker is enabled. For a failure, retryAfter is the delay the
+// target requested before further requests, or zero.
+func (s *Server) recordUpstream(host string, ok bool, retryAfter time.Duration) {
+	if s.breaker != nil && s.breaker.record(host, ok, retryAfter, time.Now()) {
+		s.breakerTrip.Add(1)
+		s.logf("circuit breaker tripped for %q", host)
+	}
+}
+
 // rewriteRequest rewrites the inbound request for routing to a target.
 func (s *Server) rewriteRequest(pr *httputil.ProxyRequest) {
 	u, _ := url.ParseRequestURI(pr.In.RequestURI)
@@ -295,18 +1189,224 @@ func (s *Server) rewriteRequest(pr *httputil.ProxyRequest) {
 	}
 	pr.Out.URL = u
 	pr.Out.Host = u.Host
+	if s.TenantHeader != "" {
+		pr.Out.Header.Del(s.TenantHeader)
+	}
+}
+
+// newUpstreamTransport returns an HTTP transport for upstream requests, based
+// on the default transport. The transport dials the origin address for each
+// host mapped in origins, and dials other hosts directly. If useHTTP2 is
+// false, the transport uses only HTTP/1.1.
+func newUpstreamTransport(origins map[string]string, useHTTP2 bool) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if len(origins) != 0 {
+		var d net.Dialer
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, network, originAddr(origins, addr))
+		}
+	}
+	if !useHTTP2 {
+		// A non-nil empty map disables the transport's built-in HTTP/2 support.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t
+}
+
+// originAddr returns the origin address mapped for addr in origins, or addr
+// itself if there is no mapping. The address may be mapped either by its
+// complete "host:port" or by its host alone.
+func originAddr(origins map[string]string, addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	origin, ok := origins[addr]
+	if !ok {
+		origin, ok = origins[host]
+	}
+	if !ok {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(origin); err != nil {
+		return net.JoinHostPort(origin, port) // no port specified
+	}
+	return origin
+}
+
+// targetURL returns the complete URL of the target requested by r.
+func targetURL(r *http.Request) *url.URL {
+	u := *r.URL
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "https"
+	}
+	return &u
+}
+
+// captureBody is an [io.ReadCloser] that copies the data read from the wrapped
+// reader into a buffer, and records whether the reader was read to the end.
+type captureBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	complete bool
+}
+
+func (c *captureBody) Read(data []byte) (int, error) {
+	nr, err := c.ReadCloser.Read(data)
+	c.buf.Write(data[:nr])
+	if err == io.EOF {
+		c.complete = true
+	}
+	return nr, err
+}
+
+// checkComplete reports whether the response body captured in body was read
+// completely, so that it may be cached. A body is incomplete if the client
+// went away or the request deadline expired while it was being copied.
+func (s *Server) checkComplete(hash string, body *captureBody) bool {
+	if !body.complete {
+		s.rspIncomplete.Add(1)
+		s.logf("not caching %q: response body incomplete (%d bytes read)", hash, body.buf.Len())
+	}
+	return body.complete
 }
 
-type copyReader struct {
-	io.Reader
-	io.Closer
+// transformBody reads the complete body of rsp and replaces it with the
+// result of calling TransformResponse, updating the content length to match.
+// It reports whether the transformed response may be cached. The body read
+// from the target is verified (see checkVerified) before it is transformed,
+// and a response that fails verification is not cached.
+func (s *Server) transformBody(hash string, rsp *http.Response) (bool, error) {
+	data, err := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		return false, fmt.Errorf("read response body: %w", err)
+	}
+	verified := s.checkVerified(hash, rsp, data)
+	s.rspTransform.Add(1)
+	data, ok := s.TransformResponse(rsp, data)
+	rsp.Body = io.NopCloser(bytes.NewReader(data))
+	rsp.ContentLength = int64(len(data))
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return ok && verified, nil
 }
 
-// makePath returns the local cache path for the specified request hash.
-func (s *Server) makePath(hash string) string { return filepath.Join(s.Local, hash[:2], hash) }
+// makePath returns the local cache path for the specified target host and
+// request hash. If LocalPerHost is true, the host is normalized (see
+// normalizeHost), so that all the spellings of a host share one directory.
+// If LocalPerHost is false, or host is empty or not a valid host name or
+// address, the path does not depend on the host.
+func (s *Server) makePath(host, hash string) string {
+	if s.LocalPerHost && host != "" {
+		if h := normalizeHost(host); isValidHost(h) {
+			return filepath.Join(s.Local, hostDir(h), hash[:2], hash)
+		}
+	}
+	return filepath.Join(s.Local, hash[:2], hash)
+}
+
+// isValidHost reports whether host, in normal form, is a DNS name or an IP
+// address, with an optional port.
+func isValidHost(host string) bool {
+	name := host
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		if n, err := strconv.ParseUint(p, 10, 16); err != nil || n == 0 {
+			return false
+		}
+		name = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		name = host[1 : len(host)-1]
+	}
+	if _, err := netip.ParseAddr(name); err == nil {
+		return true
+	} else if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
 
-// makeKey returns the S3 object key for the specified request hash.
-func (s *Server) makeKey(hash string) string { return path.Join(s.KeyPrefix, hash[:2], hash) }
+// hostDir returns the name of the local cache subdirectory for the specified
+// target host. The host is lower-cased, and characters other than letters,
+// digits, dots, and hyphens (such as the colon before a port number) are
+// replaced by underscores.
+func hostDir(host string) string {
+	if host == "." || host == ".." {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		}
+		return '_'
+	}, host)
+}
+
+// makeKey returns the S3 object key for the specified tenant and request hash.
+func (s *Server) makeKey(tenant, hash string) string {
+	if tenant != "" {
+		return path.Join(s.KeyPrefix, "tenant", tenant, hash[:2], hash)
+	}
+	return path.Join(s.KeyPrefix, hash[:2], hash)
+}
+
+// requestTenant returns the tenant named by r, or "" for the default
+// namespace, and reports whether the tenant is valid and permitted.
+func (s *Server) requestTenant(r *http.Request) (string, bool) {
+	if s.TenantHeader == "" {
+		return "", true
+	}
+	tenant := r.Header.Get(s.TenantHeader)
+	if tenant == "" {
+		return "", true
+	} else if !isValidTenant(tenant) {
+		return "", false
+	}
+	return tenant, len(s.Tenants) == 0 || slices.Contains(s.Tenants, tenant)
+}
+
+// isValidTenant reports whether name is a valid tenant name.
+func isValidTenant(name string) bool {
+	if name == "." || name == ".." {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) dirMode() fs.FileMode {
+	if s.DirMode != 0 {
+		return s.DirMode
+	}
+	return 0755
+}
+
+func (s *Server) fileMode() fs.FileMode {
+	if s.FileMode != 0 {
+		return s.FileMode
+	}
+	return 0644
+}
 
 func (s *Server) logf(msg string, args ...any) {
 	if s.Logf != nil {
@@ -320,18 +1420,64 @@ func (s *Server) vlogf(msg string, args ...any) {
 	}
 }
 
+// hostMatchesTarget reports whether host, the host of a request, names one of
+// the targets. Hosts are compared in normal form (see normalizeHost), so that
+// differences of case or a default port do not prevent a match.
 func hostMatchesTarget(host string, targets []string) bool {
-	return slices.Contains(targets, host)
+	h := normalizeHost(host)
+	return slices.ContainsFunc(targets, func(t string) bool {
+		return normalizeHost(t) == h
+	})
+}
+
+// normalizeHost returns host in a normal form for comparison. The name is
+// converted to lower case, including any non-ASCII letters of an international
+// domain name, and then to its ASCII (punycode) form (see hostToASCII), so
+// that the Unicode and ASCII forms of a name match. A trailing dot and a
+// default port (80 or 443) are removed. Other ports are kept.
+func normalizeHost(host string) string {
+	return normalizeHostPort(host, "80", "443")
+}
+
+// normalizeHostPort is as normalizeHost, but removes only the specified
+// default ports.
+func normalizeHostPort(host string, defaultPorts ...string) string {
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		name, port = h, p
+	}
+	if slices.Contains(defaultPorts, port) {
+		port = ""
+	}
+	name = strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, "["), "]"), ".")
+	name = hostToASCII(strings.ToLower(name))
+	if port != "" {
+		return net.JoinHostPort(name, port)
+	} else if strings.Contains(name, ":") {
+		return "[" + name + "]" // IPv6 address
+	}
+	return name
 }
 
 // canCacheRequest reports whether r is a request whose response can be cached.
+// Besides GET requests, this includes CORS preflight requests when preflight
+// caching is enabled (see PreflightTTL).
 func (s *Server) canCacheRequest(r *http.Request) bool {
-	return r.Method == "GET" && !parseCacheControl(r.Header.Get("Cache-Control")).Keys.Has("no-store")
+	if parseCacheControl(r.Header.Get("Cache-Control")).Keys.Has("no-store") {
+		return false
+	}
+	return r.Method == "GET" || (s.canCachePreflight() && isPreflight(r))
+}
+
+// canCachePreflight reports whether caching of CORS preflight responses is
+// enabled.
+func (s *Server) canCachePreflight() bool {
+	return s.PreflightTTL > 0 && !s.DisableMemoryCache
 }
 
 // canCacheResponse reports whether r is a response whose body can be cached.
 func (s *Server) canCacheResponse(rsp *http.Response) bool {
-	if rsp.StatusCode != http.StatusOK {
+	if rsp.StatusCode != http.StatusOK || !s.canCacheContentType(rsp) || !s.canCacheCookies(rsp) {
 		return false
 	}
 	cc := parseCacheControl(rsp.Header.Get("Cache-Control"))
@@ -347,9 +1493,41 @@ func (s *Server) canCacheResponse(rsp *http.Response) bool {
 	return cc.Keys.Has("must-revalidate") && cc.MaxAge > goodLongTime
 }
 
+// canCacheContentType reports whether the content type of rsp is eligible for
+// caching under the CacheableContentTypes setting.
+func (s *Server) canCacheContentType(rsp *http.Response) bool {
+	if len(s.CacheableContentTypes) == 0 {
+		return true
+	}
+	return matchContentType(rsp.Header.Get("Content-Type"), s.CacheableContentTypes)
+}
+
+// matchContentType reports whether the media type of the Content-Type value ct
+// matches any of the patterns. A pattern ending in "/*" matches any media type
+// with the preceding type; otherwise the pattern must match the media type
+// exactly. Comparisons are not case-sensitive.
+func matchContentType(ct string, patterns []string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if pfx, ok := strings.CutSuffix(p, "*"); ok && strings.HasSuffix(pfx, "/") {
+			if strings.HasPrefix(mt, pfx) {
+				return true
+			}
+		} else if mt == p {
+			return true
+		}
+	}
+	return false
+}
+
 type cacheControl struct {
-	Keys   mapset.Set[string]
-	MaxAge time.Duration
+	Keys         mapset.Set[string]
+	MaxAge       time.Duration
+	StaleIfError time.Duration // meaningful only if Keys has "stale-if-error"
 }
 
 func parseCacheControl(s string) (out cacheControl) {
@@ -360,17 +1538,32 @@ func parseCacheControl(s string) (out cacheControl) {
 			if err == nil {
 				out.MaxAge = time.Duration(sec) * time.Second
 			}
+		} else if ok && key == "stale-if-error" {
+			sec, err := strconv.Atoi(val)
+			if err == nil {
+				out.StaleIfError = time.Duration(sec) * time.Second
+			}
 		}
 		out.Keys.Add(key)
 	}
 	return
 }
 
+// staleWindow returns the length of time after rsp expires during which it
+// may be served if fetching a fresh copy fails.
+func (s *Server) staleWindow(rsp *http.Response) time.Duration {
+	cc := parseCacheControl(rsp.Header.Get("Cache-Control"))
+	if cc.Keys.Has("stale-if-error") {
+		return cc.StaleIfError
+	}
+	return max(s.StaleIfError, 0)
+}
+
 // canMemoryCache reports whether r is a volatile response whose body can be
 // cached temporarily, and if so returns the maxmimum length of time the cache
 // entry should be valid for.
 func (s *Server) canMemoryCache(rsp *http.Response) (time.Duration, bool) {
-	if rsp.StatusCode != http.StatusOK {
+	if s.DisableMemoryCache || rsp.StatusCode != http.StatusOK || !s.canCacheContentType(rsp) || !s.canCacheCookies(rsp) {
 		return 0, false
 	}
 	cc := parseCacheControl(rsp.Header.Get("Cache-Control"))
@@ -388,19 +1581,190 @@ func (s *Server) canMemoryCache(rsp *http.Response) (time.Duration, bool) {
 	return 0, false
 }
 
-// hashRequest generates the storage digest for the specified request URL.
-func hashRequestURL(u *url.URL) string {
-	return fmt.Sprintf("%x", sha256.Sum256([]byte(u.String())))
+// canCacheCookies reports whether rsp may be cached with respect to cookies,
+// meaning it has no Set-Cookie header, or CacheSetCookie is true.
+func (s *Server) canCacheCookies(rsp *http.Response) bool {
+	return s.CacheSetCookie || len(rsp.Header.Values("Set-Cookie")) == 0
 }
 
-// writeCachedResponse generates an HTTP response for a cached result using the
-// provided headers and body from the cache object.
-func writeCachedResponse(w http.ResponseWriter, hdr http.Header, body []byte) {
+// canNegativeCache reports whether rsp is a "not found" response that can be
+// recorded in the negative cache.
+func (s *Server) canNegativeCache(rsp *http.Response) bool {
+	if s.NegativeTTL <= 0 || s.DisableMemoryCache {
+		return false
+	} else if rsp.StatusCode != http.StatusNotFound && rsp.StatusCode != http.StatusGone {
+		return false
+	} else if !s.canCacheCookies(rsp) {
+		return false
+	}
+	return !parseCacheControl(rsp.Header.Get("Cache-Control")).Keys.Has("no-store")
+}
+
+// cacheKeyURL returns the URL to use for computing the cache key of a request
+// for u. The host is normalized (see normalizeHost), removing only the default
+// port of the scheme, and the query normalization rules configured for s are
+// applied.
+func (s *Server) cacheKeyURL(u *url.URL) *url.URL {
+	out := *u
+	out.Host = normalizeHostPort(u.Host, schemePort(u.Scheme))
+	if u.RawQuery != "" && (len(s.StripQueryParams) != 0 || s.SortQueryParams) {
+		out.RawQuery = normalizeQuery(u.RawQuery, s.StripQueryParams, s.SortQueryParams)
+	}
+	return &out
+}
+
+// schemePort returns the default port for the URL scheme, or "" if it has none.
+func schemePort(scheme string) string {
+	switch scheme {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
+
+// normalizeQuery returns a normalized version of the raw query string q, with
+// the parameters matching strip removed, and the remaining parameters sorted
+// by name if sortParams is true.  Otherwise, the order and encoding of the
+// remaining parameters are preserved.
+func normalizeQuery(q string, strip []string, sortParams bool) string {
+	type param struct{ name, raw string }
+	var keep []param
+	for _, raw := range strings.Split(q, "&") {
+		if raw == "" {
+			continue
+		}
+		key, _, _ := strings.Cut(raw, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if !matchParam(name, strip) {
+			keep = append(keep, param{name, raw})
+		}
+	}
+	if sortParams {
+		slices.SortStableFunc(keep, func(a, b param) int { return strings.Compare(a.name, b.name) })
+	}
+	parts := make([]string, len(keep))
+	for i, p := range keep {
+		parts[i] = p.raw
+	}
+	return strings.Join(parts, "&")
+}
+
+// matchParam reports whether name matches any of the patterns. A pattern
+// ending in "*" matches any name having the preceding prefix; otherwise the
+// pattern must match the name exactly.
+func matchParam(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if pfx, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, pfx) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// hashRequest generates the storage digest for a request with the specified
+// method and URL. The URL should be complete, including its scheme and host,
+// so that requests that differ in method, scheme, or host have distinct keys.
+func hashRequest(method string, u *url.URL) string {
+	// The method cannot contain a space, so the input is unambiguous.
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(method+" "+u.String())))
+}
+
+// hashRequestKey generates the storage digest for a request with the specified
+// method and URL, encoding variant (see requestVariant), and tenant. If variant
+// and tenant are both empty, the result is the same as hashRequest.
+func hashRequestKey(method string, u *url.URL, variant, tenant string) string {
+	if variant == "" && tenant == "" {
+		return hashRequest(method, u)
+	}
+	// The URL cannot contain a space, and the tenant is labeled, so the input
+	// is unambiguous.
+	key := method + " " + u.String()
+	if variant != "" {
+		key += " " + variant
+	}
+	if tenant != "" {
+		key += " tenant=" + tenant
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+// writeCachedResponse generates an HTTP response to r for a cached result using
+// the provided headers and body from the cache object.
+//
+// If the cached body is gzip-encoded and r does not accept gzip, the body is
+// decompressed before it is sent (see decodeForClient).
+//
+// If r is a conditional request satisfied by the cached headers, the response
+// is HTTP 304 (Not Modified) without a body, and its X-Cache header is
+// replaced with "not-modified".
+func (s *Server) writeCachedResponse(w http.ResponseWriter, r *http.Request, hdr http.Header, body []byte) {
+	body, decoded := decodeForClient(r, hdr, body)
+	if decoded {
+		s.rspDecoded.Add(1)
+	}
 	wh := w.Header()
 	for name, vals := range hdr {
 		for _, val := range vals {
 			wh.Add(name, val)
 		}
 	}
+	if isNotModified(r, hdr) {
+		s.rspNotModified.Add(1)
+		wh.Set("X-Cache", "not-modified")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	w.Write(body)
 }
+
+// isNotModified reports whether the conditional headers of r indicate that
+// the client already has the cached response described by hdr.
+//
+// An If-None-Match header is compared with the Etag of the response, using the
+// weak comparison. If r has no If-None-Match header, an If-Modified-Since
+// header is compared with the Date of the response.
+func isNotModified(r *http.Request, hdr http.Header) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := hdr.Get("Etag")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	date, err := http.ParseTime(hdr.Get("Date"))
+	return err == nil && !date.After(ims)
+}
+
+// writeNegativeResponse generates an HTTP response for a negative cache entry
+// using the provided headers and status code.
+func writeNegativeResponse(w http.ResponseWriter, hdr http.Header, code int) {
+	wh := w.Header()
+	for name, vals := range hdr {
+		for _, val := range vals {
+			wh.Add(name, val)
+		}
+	}
+	http.Error(w, http.StatusText(code), code)
+}
@@ -0,0 +1,2912 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tailscale/go-cache-plugin/lib/s3util"
+)
+
+// fakeS3 is a minimal in-memory implementation of the S3 object API, for use
+// as a backing store in tests.
+type fakeS3 struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case "GET", "HEAD":
+		data, ok := f.data[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data)) // handles Range
+	case "PUT":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if f.data == nil {
+			f.data = make(map[string][]byte)
+		}
+		f.data[r.URL.Path] = data
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+// newTestClient returns an S3 client backed by a new fakeS3 instance.
+func newTestClient(t *testing.T) *s3util.Client {
+	t.Helper()
+	srv := httptest.NewServer(new(fakeS3))
+	t.Cleanup(srv.Close)
+	return &s3util.Client{
+		Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		Bucket: "test-bucket",
+	}
+}
+
+func TestDisableMemoryCache(t *testing.T) {
+	var numFetch int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numFetch++
+		w.Header().Set("Cache-Control", "max-age=300")
+		io.WriteString(w, "volatile content")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:            []string{u.Host},
+		Local:              t.TempDir(),
+		S3Client:           newTestClient(t),
+		DisableMemoryCache: true,
+	}
+
+	for i := range 3 {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+"/volatile", nil))
+		rsp := rec.Result()
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("Request %d: got status %d, want %d", i+1, rsp.StatusCode, http.StatusOK)
+		}
+		if got, want := rsp.Header.Get("X-Cache"), "fetch, uncached"; got != want {
+			t.Errorf("Request %d: got X-Cache %q, want %q", i+1, got, want)
+		}
+	}
+	if numFetch != 3 {
+		t.Errorf("Got %d upstream fetches, want 3", numFetch)
+	}
+
+	if s.mcache != nil {
+		t.Error("Memory cache was allocated, but should be disabled")
+	}
+	s.cacheStoreMemory("abcdef0123456789", time.Minute, 0, http.Header{}, []byte("data"))
+	if _, _, err := s.cacheLoadMemory("abcdef0123456789"); err == nil {
+		t.Error("Memory cache load succeeded, but should miss")
+	}
+	if got := s.rspSaveMem.Value(); got != 0 {
+		t.Errorf("Got %d memory saves, want 0", got)
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	s := &Server{
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+		DirMode:  0700,
+		FileMode: 0600,
+	}
+	const hash = "abcdef0123456789"
+	if err := s.cacheStoreLocal("", hash, http.Header{}, []byte("data")); err != nil {
+		t.Fatalf("Store: unexpected error: %v", err)
+	}
+	path := s.makePath("", hash)
+	for _, tc := range []struct {
+		path string
+		want fs.FileMode
+	}{
+		{path, s.FileMode},
+		{filepath.Dir(path), s.DirMode},
+	} {
+		fi, err := os.Stat(tc.path)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if got := fi.Mode().Perm(); got != tc.want {
+			t.Errorf("Mode of %s: got %v, want %v", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestDisableLocalCache(t *testing.T) {
+	var numFetch int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numFetch++
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		io.WriteString(w, "immutable content")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	local := t.TempDir()
+	s := &Server{
+		Targets:           []string{u.Host},
+		Local:             local,
+		S3Client:          newTestClient(t),
+		DisableLocalCache: true,
+	}
+
+	for i, want := range []string{"fetch, cached", "hit, remote", "hit, remote"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+"/object", nil))
+		s.tasks.Wait() // wait for the write to S3
+		rsp := rec.Result()
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("Request %d: got status %d, want %d", i+1, rsp.StatusCode, http.StatusOK)
+		}
+		if got := rsp.Header.Get("X-Cache"); got != want {
+			t.Errorf("Request %d: got X-Cache %q, want %q", i+1, got, want)
+		}
+	}
+	if numFetch != 1 {
+		t.Errorf("Got %d upstream fetches, want 1", numFetch)
+	}
+
+	// Nothing was written to the local directory.
+	if des, err := os.ReadDir(local); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	} else if len(des) != 0 {
+		t.Errorf("Local directory has %d entries, want 0", len(des))
+	}
+	if got := s.reqLocalMiss.Value(); got != 0 {
+		t.Errorf("Got %d local misses, want 0", got)
+	}
+	if got := s.rspPush.Value(); got != 1 {
+		t.Errorf("Got %d S3 writes, want 1", got)
+	}
+	if entries, err := s.Entries(context.Background()); err != nil || len(entries) != 0 {
+		t.Errorf("Entries: got (%v, %v), want no entries", entries, err)
+	}
+}
+
+func TestLocalOnly(t *testing.T) {
+	var numFetch int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numFetch++
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		io.WriteString(w, "stable content")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets: []string{u.Host},
+		Local:   t.TempDir(),
+
+		// With no S3 client and no memory cache, hits must come from disk.
+		DisableMemoryCache: true,
+	}
+	for i, want := range []string{"fetch, cached", "hit, local"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+"/stable", nil))
+		rsp := rec.Result()
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("Request %d: got status %d, want %d", i+1, rsp.StatusCode, http.StatusOK)
+		}
+		if got := rsp.Header.Get("X-Cache"); got != want {
+			t.Errorf("Request %d: got X-Cache %q, want %q", i+1, got, want)
+		}
+		s.tasks.Wait()
+	}
+	if numFetch != 1 {
+		t.Errorf("Got %d upstream fetches, want 1", numFetch)
+	}
+}
+
+func TestFixtures(t *testing.T) {
+	var numFetch int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numFetch++
+		io.WriteString(w, "upstream content")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:  []string{u.Host},
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+		Fixtures: map[string]FixtureResponse{
+			upstream.URL + "/pinned": {
+				Header: http.Header{"Content-Type": {"text/plain"}},
+				Body:   []byte("pinned content"),
+			},
+			upstream.URL + "/blocked":           {StatusCode: http.StatusForbidden},
+			"https://other.example.com/fixture": {Body: []byte("not a target")},
+		},
+	}
+	for _, tc := range []struct {
+		method, url  string
+		code         int
+		xcache, body string
+	}{
+		{"GET", upstream.URL + "/pinned", http.StatusOK, "fixture", "pinned content"},
+		{"GET", upstream.URL + "/blocked", http.StatusForbidden, "fixture", ""},
+		{"GET", "https://other.example.com/fixture", http.StatusOK, "fixture", "not a target"},
+		{"POST", upstream.URL + "/pinned", http.StatusOK, "", "upstream content"},
+		{"GET", upstream.URL + "/other", http.StatusOK, "fetch, uncached", "upstream content"},
+	} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.url, nil))
+		rsp := rec.Result()
+		if rsp.StatusCode != tc.code {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.url, rsp.StatusCode, tc.code)
+		}
+		if got := rsp.Header.Get("X-Cache"); got != tc.xcache {
+			t.Errorf("%s %s: got X-Cache %q, want %q", tc.method, tc.url, got, tc.xcache)
+		}
+		if got := rec.Body.String(); got != tc.body {
+			t.Errorf("%s %s: got body %q, want %q", tc.method, tc.url, got, tc.body)
+		}
+	}
+	if numFetch != 2 {
+		t.Errorf("Got %d upstream fetches, want 2", numFetch)
+	}
+	if got := s.reqFixture.Value(); got != 3 {
+		t.Errorf("Got %d fixture responses, want 3", got)
+	}
+}
+
+func TestIncompleteResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Header().Set("Content-Length", "1000")
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // never finish the body
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:  []string{u.Host},
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+	}
+
+	// Cancel the inbound request while the body is being copied, as if the
+	// client had disconnected.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, "GET", upstream.URL+"/object", nil))
+
+	if got := s.rspIncomplete.Value(); got != 1 {
+		t.Errorf("Got %d incomplete responses, want 1", got)
+	}
+	if got := s.rspSave.Value(); got != 0 {
+		t.Errorf("Got %d saved responses, want 0", got)
+	}
+	if _, _, err := s.cacheLoadLocal("", hashRequest("GET", mustParse(t, upstream.URL+"/object"))); err == nil {
+		t.Error("Incomplete response was cached locally")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	var numFetch int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numFetch++
+		if v := r.Header.Get("X-Cache-Tenant"); v != "" {
+			t.Errorf("Upstream got tenant header %q", v)
+		}
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		io.WriteString(w, "some content")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	client := newTestClient(t)
+	newServer := func() *Server {
+		return &Server{
+			Targets:      []string{u.Host},
+			Local:        t.TempDir(),
+			S3Client:     client,
+			TenantHeader: "X-Cache-Tenant",
+			Tenants:      []string{"alpha", "bravo"},
+		}
+	}
+	check := func(s *Server, tenant string, code int, xcache string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", upstream.URL+"/object", nil)
+		if tenant != "" {
+			req.Header.Set("X-Cache-Tenant", tenant)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("Get %q: got status %d, want %d", tenant, rec.Code, code)
+		}
+		if got := rec.Result().Header.Get("X-Cache"); got != xcache {
+			t.Errorf("Get %q: got X-Cache %q, want %q", tenant, got, xcache)
+		}
+	}
+
+	// Each tenant, and the default namespace, has its own cache entries.
+	s := newServer()
+	check(s, "alpha", http.StatusOK, "fetch, cached")
+	check(s, "alpha", http.StatusOK, "hit, local")
+	check(s, "bravo", http.StatusOK, "fetch, cached")
+	check(s, "", http.StatusOK, "fetch, cached")
+	check(s, "bravo", http.StatusOK, "hit, local")
+	check(s, "", http.StatusOK, "hit, local")
+	if numFetch != 3 {
+		t.Errorf("Upstream fetches: got %d, want 3", numFetch)
+	}
+
+	// Unknown and invalid tenants are rejected.
+	check(s, "charlie", http.StatusForbidden, "")
+	check(s, "../alpha", http.StatusForbidden, "")
+	if got := s.reqTenantReject.Value(); got != 2 {
+		t.Errorf("Tenant rejects: got %d, want 2", got)
+	}
+
+	// Tenant entries are stored in S3 under a separate prefix, and fault in
+	// for the same tenant.
+	s.tasks.Wait()
+	hash := hashRequestKey("GET", mustParse(t, upstream.URL+"/object"), "", "alpha")
+	if key, want := s.makeKey("alpha", hash), "tenant/alpha/"+hash[:2]+"/"+hash; key != want {
+		t.Errorf("S3 key: got %q, want %q", key, want)
+	}
+	check(newServer(), "alpha", http.StatusOK, "hit, remote")
+}
+
+func TestWarm(t *testing.T) {
+	var mu sync.Mutex
+	var numFetch int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		numFetch++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/volatile":
+			w.Header().Set("Cache-Control", "no-store")
+			io.WriteString(w, "volatile content")
+		default:
+			w.Header().Set("Cache-Control", "max-age=3600, immutable")
+			io.WriteString(w, "content of "+r.URL.Path)
+		}
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:         []string{u.Host},
+		Local:           t.TempDir(),
+		WarmConcurrency: 2,
+	}
+	res := s.Warm(context.Background(), nil, []string{
+		upstream.URL + "/a",
+		upstream.URL + "/b",
+		upstream.URL + "/missing",
+		upstream.URL + "/volatile",
+		"https://other.example.com/c",
+		"not a URL",
+	})
+	type result struct {
+		Status int
+		Cache  string
+		Cached bool
+	}
+	want := []result{
+		{http.StatusOK, "fetch, cached", true},
+		{http.StatusOK, "fetch, cached", true},
+		{http.StatusNotFound, "fetch, uncached", false},
+		{http.StatusOK, "fetch, uncached", false},
+		{http.StatusBadGateway, "", false},
+		{0, "", false},
+	}
+	for i, r := range res {
+		if got := (result{r.Status, r.Cache, r.Cached}); got != want[i] {
+			t.Errorf("Warm %q: got %+v, want %+v", r.URL, got, want[i])
+		}
+		if ok := r.Error == ""; ok != (r.Status == http.StatusOK) {
+			t.Errorf("Warm %q: status %d with error %q", r.URL, r.Status, r.Error)
+		}
+	}
+	if got := s.reqWarm.Value(); got != 5 {
+		t.Errorf("Warm requests: got %d, want 5", got)
+	}
+
+	// Warmed entries are served from the cache.
+	req := httptest.NewRequest("GET", upstream.URL+"/a", nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if got := rec.Result().Header.Get("X-Cache"); got != "hit, local" {
+		t.Errorf("Get after warm: got X-Cache %q, want hit, local", got)
+	}
+	if got := rec.Body.String(); got != "content of /a" {
+		t.Errorf("Get after warm: got body %q, want %q", got, "content of /a")
+	}
+	if numFetch != 4 {
+		t.Errorf("Upstream fetches: got %d, want 4", numFetch)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		io.WriteString(w, "too late")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:        []string{u.Host},
+		Local:          t.TempDir(),
+		RequestTimeout: 50 * time.Millisecond,
+	}
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+"/slow", nil))
+	if got, want := rec.Result().StatusCode, http.StatusGatewayTimeout; got != want {
+		t.Errorf("Got status %d, want %d", got, want)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Request took %v, want it bounded by the timeout", elapsed)
+	}
+}
+
+func TestMaxRequestBody(t *testing.T) {
+	var mu sync.Mutex
+	var fetches int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return // the proxy aborted the request
+		}
+		fmt.Fprintf(w, "got %d bytes", len(data))
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:             []string{u.Host},
+		Local:               t.TempDir(),
+		S3Client:            newTestClient(t),
+		MaxRequestBodyBytes: 16,
+	}
+	tests := []struct {
+		name string
+		body io.Reader
+		want int // HTTP status
+	}{
+		{"small", strings.NewReader("short body"), http.StatusOK},
+		{"declared", strings.NewReader(strings.Repeat("x", 100)), http.StatusRequestEntityTooLarge},
+		{"streamed", io.MultiReader(strings.NewReader(strings.Repeat("x", 100))), http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("POST", upstream.URL+"/upload", tc.body)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if got := rec.Code; got != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	// The request with a declared length is rejected without forwarding.
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches > 2 {
+		t.Errorf("Got %d upstream fetches, want at most 2", fetches)
+	}
+	if got := s.reqTooLarge.Value(); got != 2 {
+		t.Errorf("Got %d oversized requests, want 2", got)
+	}
+	if got := s.reqUpstreamError.Value(); got != 0 {
+		t.Errorf("Got %d upstream errors, want 0", got)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var numFetch int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numFetch++
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:          []string{u.Host},
+		Local:            t.TempDir(),
+		S3Client:         newTestClient(t),
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Hour,
+	}
+	for i, want := range []int{500, 500, 503, 503} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+"/broken", nil))
+		if got := rec.Result().StatusCode; got != want {
+			t.Errorf("Request %d: got status %d, want %d", i+1, got, want)
+		}
+	}
+	if numFetch != 2 {
+		t.Errorf("Got %d upstream fetches, want 2", numFetch)
+	}
+	if got := s.breakerTrip.Value(); got != 1 {
+		t.Errorf("Got %d breaker trips, want 1", got)
+	}
+	if got := s.reqShortCircuit.Value(); got != 2 {
+		t.Errorf("Got %d short-circuited requests, want 2", got)
+	}
+}
+
+func TestBreakerRetryAfter(t *testing.T) {
+	now := time.Date(2024, 11, 1, 12, 0, 0, 0, time.UTC)
+	b := &breaker{threshold: 1, window: time.Minute, cooldown: time.Second}
+
+	// A huge Retry-After trips the breaker for no longer than maxRetryAfter.
+	if !b.record("a", false, 1000*time.Hour, now) {
+		t.Fatal("Record: breaker did not trip")
+	}
+	if wait, ok := b.allow("a", now); ok || wait != maxRetryAfter {
+		t.Errorf("Allow: got (%v, %v), want (%v, false)", wait, ok, maxRetryAfter)
+	}
+
+	// Nor does it extend a breaker that is already open beyond that.
+	b.record("a", false, time.Duration(math.MaxInt64), now.Add(time.Second))
+	if wait, ok := b.allow("a", now.Add(time.Second)); ok || wait != maxRetryAfter {
+		t.Errorf("Allow (extended): got (%v, %v), want (%v, false)", wait, ok, maxRetryAfter)
+	}
+	if _, ok := b.allow("a", now.Add(time.Second+maxRetryAfter)); !ok {
+		t.Error("Allow after the cap: breaker is still open")
+	}
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	var mu sync.Mutex
+	fetches := make(map[string]int)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches[r.URL.Path]++
+		n := fetches[r.URL.Path]
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/flaky":
+			if n <= 2 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=3600, immutable")
+			io.WriteString(w, "ok")
+		case "/drop":
+			// Close the connection without a response.
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Hijack: %v", err)
+				return
+			}
+			conn.Close()
+		case "/broken":
+			http.Error(w, "broken", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:              []string{u.Host},
+		Local:                t.TempDir(),
+		S3Client:             newTestClient(t),
+		UpstreamRetries:      2,
+		UpstreamRetryBackoff: time.Millisecond,
+	}
+	tests := []struct {
+		method, path string
+		want         int // HTTP status
+		wantFetches  int // if zero, do not check
+	}{
+		{"GET", "/flaky", 200, 3},
+		{"GET", "/drop", 502, 0}, // the transport may also retry
+
+		{"GET", "/broken", 500, 3},
+		{"GET", "/missing", 404, 1},
+		{"POST", "/post-broken", 404, 1},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(tc.method, upstream.URL+tc.path, nil))
+		if got := rec.Result().StatusCode; got != tc.want {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.path, got, tc.want)
+		}
+		mu.Lock()
+		got := fetches[tc.path]
+		mu.Unlock()
+		if tc.wantFetches != 0 && got != tc.wantFetches {
+			t.Errorf("%s %s: got %d fetches, want %d", tc.method, tc.path, got, tc.wantFetches)
+		}
+	}
+	if got := s.reqUpstreamRetry.Value(); got != 6 {
+		t.Errorf("Got %d retries, want 6", got)
+	}
+	if got := s.reqForward.Value(); got != int64(len(tests)) {
+		t.Errorf("Got %d forwarded requests, want %d", got, len(tests))
+	}
+	if got := s.rspSave.Value(); got != 1 {
+		t.Errorf("Got %d responses saved, want 1", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 11, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		input string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"120", 2 * time.Minute, true},
+		{"-5", 0, false},
+		{"soon", 0, false},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0, true},
+	} {
+		h := make(http.Header)
+		if tc.input != "" {
+			h.Set("Retry-After", tc.input)
+		}
+		got, ok := retryAfter(h, now)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("retryAfter(%q): got (%v, %v), want (%v, %v)", tc.input, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestThrottling(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	retryAfter := "1"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		if len(times) == 1 || r.URL.Path == "/always" {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:              []string{u.Host},
+		Local:                t.TempDir(),
+		UpstreamRetries:      2,
+		UpstreamRetryBackoff: time.Millisecond,
+		BreakerThreshold:     1,
+		BreakerCooldown:      time.Millisecond,
+	}
+	// Check the body, and for fetched responses, the updated length.
+	get := func(path string) *http.Response {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+path, nil))
+		return rec.Result()
+	}
+
+	// A throttled request is retried after the delay the target requested.
+	if rsp := get("/object"); rsp.StatusCode != http.StatusOK {
+		t.Errorf("Get: got status %d, want 200", rsp.StatusCode)
+	}
+	if len(times) != 2 {
+		t.Fatalf("Got %d fetches, want 2", len(times))
+	} else if d := times[1].Sub(times[0]); d < time.Second {
+		t.Errorf("Retry after %v, want at least 1s", d)
+	}
+	if got := s.reqThrottled.Value(); got != 1 {
+		t.Errorf("Throttled requests: got %d, want 1", got)
+	}
+
+	// A delay that is too long is not retried, and the response including its
+	// Retry-After header is passed to the client. The breaker stays open for
+	// the requested delay, capped at maxRetryAfter, not its own shorter
+	// cooldown.
+	retryAfter = "3600"
+	rsp := get("/always")
+	if rsp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Get: got status %d, want 429", rsp.StatusCode)
+	}
+	if got := rsp.Header.Get("Retry-After"); got != "3600" {
+		t.Errorf("Get: got Retry-After %q, want 3600", got)
+	}
+	if len(times) != 3 {
+		t.Errorf("Got %d fetches, want 3", len(times))
+	}
+	time.Sleep(5 * time.Millisecond) // longer than BreakerCooldown
+	rsp = get("/always")
+	if rsp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Get: got status %d, want 503", rsp.StatusCode)
+	}
+	if got := rsp.Header.Get("X-Cache"); got != "miss, circuit open" {
+		t.Errorf("Get: got X-Cache %q, want circuit open", got)
+	}
+	if ra, _ := strconv.Atoi(rsp.Header.Get("Retry-After")); ra < 25 || ra > int(maxRetryAfter.Seconds()) {
+		t.Errorf("Get: got Retry-After %d, want about %d", ra, int(maxRetryAfter.Seconds()))
+	}
+}
+
+func TestUpstreamLimit(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-unblock
+		}
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:                []string{u.Host},
+		Local:                  t.TempDir(),
+		S3Client:               newTestClient(t),
+		MaxUpstreamConcurrency: 1,
+	}
+	// Check the body, and for fetched responses, the updated length.
+	get := func(path string) *http.Response {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+path, nil))
+		return rec.Result()
+	}
+
+	// Populate the cache so we can check that hits are not limited.
+	if rsp := get("/cached"); rsp.StatusCode != http.StatusOK {
+		t.Fatalf("Get /cached: got status %d, want 200", rsp.StatusCode)
+	}
+
+	// Occupy the only upstream slot.
+	done := make(chan *http.Response)
+	go func() { done <- get("/slow") }()
+	<-started
+	if got := s.upstreamActive.Value(); got != 1 {
+		t.Errorf("Active upstream requests: got %d, want 1", got)
+	}
+
+	if rsp := get("/other"); rsp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Get /other: got status %d, want 503", rsp.StatusCode)
+	} else if got := rsp.Header.Get("X-Cache"); got != "miss, upstream busy" {
+		t.Errorf("Get /other: got X-Cache %q, want miss, upstream busy", got)
+	}
+	if rsp := get("/cached"); rsp.StatusCode != http.StatusOK {
+		t.Errorf("Get /cached: got status %d, want 200", rsp.StatusCode)
+	}
+
+	close(unblock)
+	if rsp := <-done; rsp.StatusCode != http.StatusOK {
+		t.Errorf("Get /slow: got status %d, want 200", rsp.StatusCode)
+	}
+	if rsp := get("/other"); rsp.StatusCode != http.StatusOK {
+		t.Errorf("Get /other: got status %d, want 200", rsp.StatusCode)
+	}
+	if got := s.reqUpstreamLimit.Value(); got != 1 {
+		t.Errorf("Limited requests: got %d, want 1", got)
+	}
+	if got := s.upstreamActive.Value(); got != 0 {
+		t.Errorf("Active upstream requests: got %d, want 0", got)
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:  []string{u.Host},
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+	}
+	s.init()
+
+	// Store an already-expired entry that may still be served stale.
+	hash := hashRequest("GET", mustParse(t, upstream.URL+"/stale"))
+	s.cacheStoreMemory(hash, time.Nanosecond, time.Hour, http.Header{
+		"Content-Type": {"text/plain"},
+	}, []byte("stale content"))
+	time.Sleep(time.Millisecond)
+
+	// Check the body, and for fetched responses, the updated length.
+	get := func(path string) *http.Response {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+path, nil))
+		return rec.Result()
+	}
+	check := func(path string, wantCode int, wantXCache, wantBody string) {
+		t.Helper()
+		rsp := get(path)
+		body, _ := io.ReadAll(rsp.Body)
+		if rsp.StatusCode != wantCode {
+			t.Errorf("Get %s: got status %d, want %d", path, rsp.StatusCode, wantCode)
+		}
+		if got := rsp.Header.Get("X-Cache"); wantXCache != "" && got != wantXCache {
+			t.Errorf("Get %s: got X-Cache %q, want %q", path, got, wantXCache)
+		}
+		if wantBody != "" && string(body) != wantBody {
+			t.Errorf("Get %s: got body %q, want %q", path, body, wantBody)
+		}
+	}
+
+	// An upstream 5xx is replaced by the stale copy, if there is one.
+	check("/stale", http.StatusOK, "hit, stale-error", "stale content")
+	check("/other", http.StatusInternalServerError, "", "")
+
+	// A transport error is also replaced by the stale copy.
+	upstream.Close()
+	check("/stale", http.StatusOK, "hit, stale-error", "stale content")
+	check("/other", http.StatusBadGateway, "", "")
+
+	if got := s.reqStaleHit.Value(); got != 2 {
+		t.Errorf("Stale hits: got %d, want 2", got)
+	}
+}
+
+func TestStaleWindow(t *testing.T) {
+	s := &Server{StaleIfError: time.Minute}
+	for _, tc := range []struct {
+		cc   string
+		want time.Duration
+	}{
+		{"max-age=60", time.Minute},
+		{"max-age=60, stale-if-error=300", 5 * time.Minute},
+		{"max-age=60, stale-if-error=0", 0},
+	} {
+		rsp := &http.Response{Header: http.Header{"Cache-Control": {tc.cc}}}
+		if got := s.staleWindow(rsp); got != tc.want {
+			t.Errorf("staleWindow(%q): got %v, want %v", tc.cc, got, tc.want)
+		}
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	var numFetch int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numFetch++
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:     []string{u.Host},
+		Local:       t.TempDir(),
+		S3Client:    newTestClient(t),
+		NegativeTTL: time.Minute,
+	}
+	for i, want := range []string{"fetch, cached, negative", "hit, negative", "hit, negative"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+"/missing", nil))
+		rsp := rec.Result()
+		if rsp.StatusCode != http.StatusNotFound {
+			t.Errorf("Request %d: got status %d, want %d", i+1, rsp.StatusCode, http.StatusNotFound)
+		}
+		if got := rsp.Header.Get("X-Cache"); got != want {
+			t.Errorf("Request %d: got X-Cache %q, want %q", i+1, got, want)
+		}
+	}
+	if numFetch != 1 {
+		t.Errorf("Got %d upstream fetches, want 1", numFetch)
+	}
+	if got := s.reqNegativeHit.Value(); got != 2 {
+		t.Errorf("Got %d negative hits, want 2", got)
+	}
+}
+
+func TestSetCookie(t *testing.T) {
+	var numFetch int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numFetch++
+		if r.URL.Path == "/volatile" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		}
+		w.Header().Set("Set-Cookie", "session=secret")
+		io.WriteString(w, "personal content")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	newServer := func(allow bool) *Server {
+		return &Server{
+			Targets:        []string{u.Host},
+			Local:          t.TempDir(),
+			S3Client:       newTestClient(t),
+			CacheSetCookie: allow,
+		}
+	}
+	get := func(s *Server, path, want string) *http.Response {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+path, nil))
+		rsp := rec.Result()
+		if got := rsp.Header.Get("X-Cache"); got != want {
+			t.Errorf("Get %s: got X-Cache %q, want %q", path, got, want)
+		}
+		return rsp
+	}
+
+	// By default, responses that set cookies are never cached.
+	s := newServer(false)
+	for _, path := range []string{"/immutable", "/volatile"} {
+		get(s, path, "fetch, uncached")
+		get(s, path, "fetch, uncached")
+	}
+	if numFetch != 4 {
+		t.Errorf("Got %d upstream fetches, want 4", numFetch)
+	}
+	s.tasks.Wait()
+	if es, err := s.Entries(context.Background()); err != nil || len(es) != 0 {
+		t.Errorf("Entries: got (%v, %v), want none", es, err)
+	}
+
+	// With CacheSetCookie, they are cached, but the cookie is not replayed.
+	s = newServer(true)
+	get(s, "/immutable", "fetch, cached")
+	if got := get(s, "/immutable", "hit, local").Header.Get("Set-Cookie"); got != "" {
+		t.Errorf("Cached response has Set-Cookie %q", got)
+	}
+}
+
+func TestSetTargets(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:  []string{"other.example.com"},
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+	}
+	get := func(want int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+"/x", nil))
+		if got := rec.Code; got != want {
+			t.Errorf("Get: got status %d, want %d", got, want)
+		}
+	}
+
+	// The upstream is not a target, so its requests are rejected.
+	get(http.StatusBadGateway)
+
+	// After it is added, requests are forwarded.
+	s.SetTargets([]string{"other.example.com", u.Host})
+	get(http.StatusOK)
+
+	// After it is removed again, requests are rejected.
+	s.SetTargets([]string{"other.example.com"})
+	get(http.StatusBadGateway)
+
+	// Changing targets concurrently with requests is safe.
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				s.SetTargets([]string{u.Host})
+				return
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+"/x", nil))
+		}()
+	}
+	wg.Wait()
+	s.tasks.Wait()
+}
+
+func TestTransformResponse(t *testing.T) {
+	var numFetch int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numFetch++
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<a href="https://upstream.example/next">next</a>`)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	const want = `<a href="https://proxy.example/next">next</a>`
+	s := &Server{
+		Targets:  []string{u.Host},
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+		TransformResponse: func(rsp *http.Response, data []byte) ([]byte, bool) {
+			out := bytes.ReplaceAll(data, []byte("upstream.example"), []byte("proxy.example"))
+			return out, !strings.HasSuffix(rsp.Request.URL.Path, "/nocache")
+		},
+	}
+	// Check the body, and for fetched responses, the updated length.
+	get := func(path string) *http.Response {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+path, nil))
+		rsp := rec.Result()
+		body, _ := io.ReadAll(rsp.Body)
+		if got := string(body); got != want {
+			t.Errorf("Get %s: got body %q, want %q", path, got, want)
+		}
+		if !strings.HasPrefix(rsp.Header.Get("X-Cache"), "fetch") {
+			return rsp
+		}
+		if got, wantLen := rsp.Header.Get("Content-Length"), strconv.Itoa(len(want)); got != wantLen {
+			t.Errorf("Get %s: got Content-Length %q, want %q", path, got, wantLen)
+		}
+		return rsp
+	}
+
+	// The transformed body is served and cached.
+	get("/page")
+	get("/page")
+	if numFetch != 1 {
+		t.Errorf("Got %d upstream fetches, want 1", numFetch)
+	}
+
+	// A response the transform declines to cache is served but not stored.
+	numFetch = 0
+	if got := get("/nocache").Header.Get("X-Cache"); got != "fetch, uncached" {
+		t.Errorf("Get: got X-Cache %q, want %q", got, "fetch, uncached")
+	}
+	get("/nocache")
+	if numFetch != 2 {
+		t.Errorf("Got %d upstream fetches, want 2", numFetch)
+	}
+	if got := s.rspTransform.Value(); got != 3 {
+		t.Errorf("Got %d transforms, want 3", got)
+	}
+}
+
+func TestPreflightCache(t *testing.T) {
+	var numFetch int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numFetch++
+		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT")
+		w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+		w.Header().Set("Vary", "Origin")
+		if r.URL.Path == "/nocache" {
+			w.Header().Set("Access-Control-Max-Age", "0")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+	u := mustParse(t, upstream.URL)
+
+	s := &Server{
+		Targets:      []string{u.Host},
+		Local:        t.TempDir(),
+		PreflightTTL: time.Minute,
+	}
+	preflight := func(path, origin, method, headers string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest("OPTIONS", upstream.URL+path, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	for i, tc := range []struct {
+		path, origin, method, headers string
+		xcache                        string
+		fetches                       int
+	}{
+		{"/a", "https://one.example", "PUT", "X-Foo, X-Bar", "fetch, cached, preflight", 1},
+		{"/a", "https://one.example", "PUT", "x-bar,x-foo", "hit, preflight", 1},
+		{"/a", "https://two.example", "PUT", "X-Foo, X-Bar", "fetch, cached, preflight", 2},
+		{"/a", "https://one.example", "GET", "X-Foo, X-Bar", "fetch, cached, preflight", 3},
+		{"/a", "https://two.example", "PUT", "X-Bar, X-Foo", "hit, preflight", 3},
+		{"/nocache", "https://one.example", "PUT", "", "fetch, uncached", 4},
+		{"/nocache", "https://one.example", "PUT", "", "fetch, uncached", 5},
+	} {
+		rsp := preflight(tc.path, tc.origin, tc.method, tc.headers)
+		if rsp.StatusCode != http.StatusNoContent {
+			t.Errorf("Request %d: got status %d, want %d", i+1, rsp.StatusCode, http.StatusNoContent)
+		}
+		if got := rsp.Header.Get("X-Cache"); got != tc.xcache {
+			t.Errorf("Request %d: got X-Cache %q, want %q", i+1, got, tc.xcache)
+		}
+		if got := rsp.Header.Get("Access-Control-Allow-Origin"); got != tc.origin {
+			t.Errorf("Request %d: got Allow-Origin %q, want %q", i+1, got, tc.origin)
+		}
+		if numFetch != tc.fetches {
+			t.Errorf("Request %d: got %d upstream fetches, want %d", i+1, numFetch, tc.fetches)
+		}
+	}
+	if got := s.reqPreflightHit.Value(); got != 2 {
+		t.Errorf("Got %d preflight hits, want 2", got)
+	}
+
+	// Without PreflightTTL, preflights are always forwarded.
+	s = &Server{Targets: []string{u.Host}, Local: t.TempDir()}
+	for range 2 {
+		if got := preflight("/a", "https://one.example", "PUT", "").Header.Get("X-Cache"); got != "" {
+			t.Errorf("Preflight without TTL: got X-Cache %q, want none", got)
+		}
+	}
+}
+
+func TestRangeFromS3(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, content)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	client := newTestClient(t)
+	newServer := func() *Server {
+		return &Server{
+			Targets:           []string{u.Host},
+			Local:             t.TempDir(),
+			S3Client:          client,
+			RangeFaultMinSize: 1024,
+		}
+	}
+
+	// Populate S3 with the object.
+	s := newServer()
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", upstream.URL+"/big", nil))
+	s.tasks.Wait()
+
+	// Range requests that miss locally are served from S3 without a fault-in.
+	s = newServer()
+	for _, tc := range []struct {
+		rng        string
+		first, end int
+	}{
+		{"bytes=5000-5099", 5000, 5100},
+		{"bytes=10-19", 10, 20}, // within the header read
+		{"bytes=-10", len(content) - 10, len(content)},
+		{"bytes=9995-", len(content) - 5, len(content)},
+		{"bytes=9990-20000", len(content) - 10, len(content)},
+	} {
+		req := httptest.NewRequest("GET", upstream.URL+"/big", nil)
+		req.Header.Set("Range", tc.rng)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		rsp := rec.Result()
+		if rsp.StatusCode != http.StatusPartialContent {
+			t.Errorf("Range %q: got status %d, want %d", tc.rng, rsp.StatusCode, http.StatusPartialContent)
+		}
+		if got := rsp.Header.Get("X-Cache"); got != "hit, remote, range" {
+			t.Errorf("Range %q: got X-Cache %q, want %q", tc.rng, got, "hit, remote, range")
+		}
+		wantCR := fmt.Sprintf("bytes %d-%d/%d", tc.first, tc.end-1, len(content))
+		if got := rsp.Header.Get("Content-Range"); got != wantCR {
+			t.Errorf("Range %q: got Content-Range %q, want %q", tc.rng, got, wantCR)
+		}
+		if got, want := rec.Body.String(), content[tc.first:tc.end]; got != want {
+			t.Errorf("Range %q: got body %q, want %q", tc.rng, got, want)
+		}
+	}
+	if n, _, err := s.index.stats(s.Local); err != nil || n != 0 {
+		t.Errorf("Local entries: got (%d, %v), want 0", n, err)
+	}
+
+	// A multi-range request faults in the whole object.
+	req := httptest.NewRequest("GET", upstream.URL+"/big", nil)
+	req.Header.Set("Range", "bytes=0-9,20-29")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if got := rec.Result().Header.Get("X-Cache"); got != "hit, remote" {
+		t.Errorf("Multi-range: got X-Cache %q, want %q", got, "hit, remote")
+	}
+	if got := rec.Body.String(); got != content {
+		t.Errorf("Multi-range: got %d bytes, want the whole body (%d bytes)", len(got), len(content))
+	}
+	if got := s.reqFaultRange.Value(); got != 5 {
+		t.Errorf("Range faults: got %d, want 5", got)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for _, tc := range []struct {
+		input  string
+		size   int64
+		off, n int64
+		wantOK bool
+	}{
+		{"bytes=0-9", 100, 0, 10, true},
+		{"bytes=90-", 100, 90, 10, true},
+		{"bytes=90-200", 100, 90, 10, true},
+		{"bytes=-5", 100, 95, 5, true},
+		{"bytes=-500", 100, 0, 100, true},
+		{"bytes=100-", 100, 0, 0, false},
+		{"bytes=10-5", 100, 0, 0, false},
+		{"bytes=-0", 100, 0, 0, false},
+		{"bytes=0-1,3-4", 100, 0, 0, false},
+		{"items=0-9", 100, 0, 0, false},
+		{"bytes=x-9", 100, 0, 0, false},
+		{"bytes=5", 100, 0, 0, false},
+	} {
+		off, n, ok := parseRange(tc.input, tc.size)
+		if ok != tc.wantOK || off != tc.off || n != tc.n {
+			t.Errorf("parseRange(%q, %d): got (%d, %d, %v), want (%d, %d, %v)",
+				tc.input, tc.size, off, n, ok, tc.off, tc.n, tc.wantOK)
+		}
+	}
+}
+
+func TestCacheAge(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/immutable" {
+			w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=300")
+		}
+		io.WriteString(w, "some content")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:  []string{u.Host},
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+	}
+	get := func(path string) http.Header {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+path, nil))
+		return rec.Result().Header
+	}
+
+	for _, tc := range []struct {
+		path, xcache string
+		expires      bool
+	}{
+		{"/immutable", "hit, local", false},
+		{"/volatile", "hit, memory", true},
+	} {
+		if h := get(tc.path); h.Get("X-Cache-Age") != "" {
+			t.Errorf("Fetch %s: unexpected X-Cache-Age %q", tc.path, h.Get("X-Cache-Age"))
+		}
+		h := get(tc.path)
+		if got := h.Get("X-Cache"); got != tc.xcache {
+			t.Errorf("Get %s: got X-Cache %q, want %q", tc.path, got, tc.xcache)
+		}
+		if got := h.Get("X-Cache-Age"); got != "0" {
+			t.Errorf("Get %s: got X-Cache-Age %q, want 0", tc.path, got)
+		}
+		if got := h.Get("X-Cache-Expires"); (got != "") != tc.expires {
+			t.Errorf("Get %s: got X-Cache-Expires %q, want present=%v", tc.path, got, tc.expires)
+		}
+		if got := h.Get("X-Cache-Stored"); got != "" {
+			t.Errorf("Get %s: unexpected X-Cache-Stored %q", tc.path, got)
+		}
+	}
+}
+
+func TestForgedCacheHeaders(t *testing.T) {
+	var numFetch int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numFetch++
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Header().Set("X-Cache-Stored", time.Now().Add(-48*time.Hour).UTC().Format(http.TimeFormat))
+		w.Header().Set("X-Cache-Expires", time.Now().Add(48*time.Hour).UTC().Format(http.TimeFormat))
+		w.Header().Set("X-Cache-Url", "https://forged.example.com/")
+		io.WriteString(w, "some content")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:         []string{u.Host},
+		Local:           t.TempDir(),
+		S3Client:        newTestClient(t),
+		MaxImmutableAge: 24 * time.Hour,
+	}
+	for i, tc := range []struct {
+		xcache, age string
+	}{
+		{"fetch, cached", ""},
+		{"hit, local", "0"}, // not the forged age
+	} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+"/forged", nil))
+		s.tasks.Wait()
+		h := rec.Result().Header
+		if got := h.Get("X-Cache"); got != tc.xcache {
+			t.Errorf("Request %d: got X-Cache %q, want %q", i+1, got, tc.xcache)
+		}
+		if got := h.Get("X-Cache-Age"); got != tc.age {
+			t.Errorf("Request %d: got X-Cache-Age %q, want %q", i+1, got, tc.age)
+		}
+		for _, name := range internalHeaders {
+			if got := h.Get(name); got != "" {
+				t.Errorf("Request %d: unexpected %s %q", i+1, name, got)
+			}
+		}
+	}
+	if numFetch != 1 {
+		t.Errorf("Got %d upstream fetches, want 1", numFetch)
+	}
+	es, err := s.Entries(context.Background())
+	if err != nil || len(es) != 1 {
+		t.Fatalf("Entries: got (%v, %v), want 1 entry", es, err)
+	}
+	if got, want := es[0].URL, upstream.URL+"/forged"; got != want {
+		t.Errorf("Entry URL: got %q, want %q", got, want)
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	const content = "some compressible content, some compressible content"
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	io.WriteString(zw, content)
+	zw.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/immutable" {
+			w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=300")
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(zbuf.Bytes())
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	client := newTestClient(t)
+	newServer := func() *Server {
+		return &Server{
+			Targets:  []string{u.Host},
+			Local:    t.TempDir(),
+			S3Client: client,
+		}
+	}
+	check := func(s *Server, path, xcache string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", upstream.URL+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		rsp := rec.Result()
+		if got := rsp.Header.Get("X-Cache"); got != xcache {
+			t.Errorf("Get %s: got X-Cache %q, want %q", path, got, xcache)
+		}
+		if got := rsp.Header.Get("Content-Encoding"); got != "gzip" {
+			t.Fatalf("Get %s (%s): got Content-Encoding %q, want gzip", path, xcache, got)
+		}
+		zr, err := gzip.NewReader(rsp.Body)
+		if err != nil {
+			t.Fatalf("Get %s (%s): invalid gzip body: %v", path, xcache, err)
+		}
+		body, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("Get %s (%s): read body: %v", path, xcache, err)
+		}
+		if got := string(body); got != content {
+			t.Errorf("Get %s (%s): got body %q, want %q", path, xcache, got, content)
+		}
+	}
+
+	s := newServer()
+	check(s, "/immutable", "fetch, cached")
+	check(s, "/immutable", "hit, local")
+	check(s, "/volatile", "fetch, cached, volatile")
+	check(s, "/volatile", "hit, memory")
+
+	// Wait for the S3 write to land, then check that a server with an empty
+	// local cache faults in the object with its encoding intact.
+	s.tasks.Wait()
+	check(newServer(), "/immutable", "hit, remote")
+}
+
+func TestDecodeLimit(t *testing.T) {
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	if _, err := io.CopyN(zw, zeroReader{}, maxDecodedBytes+1); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+
+	// A body that decodes to more than the limit is returned unchanged.
+	req := httptest.NewRequest("GET", "http://example.com/big", nil)
+	hdr := http.Header{"Content-Encoding": {"gzip"}}
+	body, ok := decodeForClient(req, hdr, zbuf.Bytes())
+	if ok || !bytes.Equal(body, zbuf.Bytes()) {
+		t.Errorf("Decode: got %d bytes, %v; want the %d encoded bytes, false", len(body), ok, zbuf.Len())
+	}
+	if got := hdr.Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Content-Encoding: got %q, want gzip", got)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(buf []byte) (int, error) { clear(buf); return len(buf), nil }
+
+func TestEncodingNegotiation(t *testing.T) {
+	const content = "some compressible content, some compressible content"
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	io.WriteString(zw, content)
+	zw.Close()
+
+	// The upstream prefers brotli if the client accepts it, and otherwise
+	// serves gzip regardless of whether the client accepts it. The brotli
+	// "encoding" here is a placeholder, since the proxy does not decode it.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Header().Set("Etag", `"v1"`)
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "br") {
+			w.Header().Set("Content-Encoding", "br")
+			io.WriteString(w, "brotli:"+content)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(zbuf.Bytes())
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:  []string{u.Host},
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+	}
+	check := func(accept, xcache, encoding, etag, body string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", upstream.URL+"/object", nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		rsp := rec.Result()
+		if got := rsp.Header.Get("X-Cache"); got != xcache {
+			t.Errorf("Get %q: got X-Cache %q, want %q", accept, got, xcache)
+		}
+		if got := rsp.Header.Get("Content-Encoding"); got != encoding {
+			t.Errorf("Get %q: got Content-Encoding %q, want %q", accept, got, encoding)
+		}
+		if got := rsp.Header.Get("Etag"); got != etag {
+			t.Errorf("Get %q: got Etag %q, want %q", accept, got, etag)
+		}
+		if got := rsp.Header.Get("Vary"); strings.HasPrefix(xcache, "hit") && got != "Accept-Encoding" {
+			t.Errorf("Get %q: got Vary %q, want Accept-Encoding", accept, got)
+		}
+		got, _ := io.ReadAll(rsp.Body)
+		if encoding == "gzip" {
+			zr, err := gzip.NewReader(bytes.NewReader(got))
+			if err != nil {
+				t.Fatalf("Get %q: invalid gzip body: %v", accept, err)
+			}
+			got, _ = io.ReadAll(zr)
+		}
+		if string(got) != body {
+			t.Errorf("Get %q: got body %q, want %q", accept, got, body)
+		}
+	}
+
+	// Clients that accept brotli get their own cache entry.
+	check("gzip, br", "fetch, cached", "br", `"v1"`, "brotli:"+content)
+	check("br;q=0.5, gzip", "hit, local", "br", `"v1"`, "brotli:"+content)
+
+	// Other clients share a cache entry, which is decompressed for clients
+	// that do not accept gzip.
+	check("gzip", "fetch, cached", "gzip", `"v1"`, content)
+	check("gzip, br;q=0", "hit, local", "gzip", `"v1"`, content)
+	check("", "hit, local", "", `W/"v1"`, content)
+	check("identity", "hit, local", "", `W/"v1"`, content)
+
+	if got := s.rspDecoded.Value(); got != 2 {
+		t.Errorf("Decoded responses: got %d, want 2", got)
+	}
+}
+
+func TestCompressStored(t *testing.T) {
+	content := strings.Repeat("some compressible content, ", 64)
+	const small = "short"
+
+	// The upstream serves identity-encoded bodies regardless of whether the
+	// client accepts gzip.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Header().Set("Etag", `"v1"`)
+		if r.URL.Path == "/small" {
+			io.WriteString(w, small)
+		} else {
+			io.WriteString(w, content)
+		}
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	client := newTestClient(t)
+	newServer := func() *Server {
+		return &Server{
+			Targets:        []string{u.Host},
+			Local:          t.TempDir(),
+			S3Client:       client,
+			CompressStored: true,
+		}
+	}
+	get := func(s *Server, path, accept, xcache, encoding, want string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", upstream.URL+path, nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		rsp := rec.Result()
+		if got := rsp.Header.Get("X-Cache"); got != xcache {
+			t.Errorf("Get %s %q: got X-Cache %q, want %q", path, accept, got, xcache)
+		}
+		if got := rsp.Header.Get("Content-Encoding"); got != encoding {
+			t.Fatalf("Get %s %q: got Content-Encoding %q, want %q", path, accept, got, encoding)
+		}
+		var body io.Reader = rsp.Body
+		if encoding == "gzip" {
+			zr, err := gzip.NewReader(rsp.Body)
+			if err != nil {
+				t.Fatalf("Get %s %q: invalid gzip body: %v", path, accept, err)
+			}
+			body = zr
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("Get %s %q: read body: %v", path, accept, err)
+		}
+		if got := string(data); got != want {
+			t.Errorf("Get %s %q: got body %q, want %q", path, accept, got, want)
+		}
+	}
+
+	// The fetching client gets the body as sent, but a single compressed
+	// object is stored, and served to clients with or without gzip.
+	s := newServer()
+	get(s, "/big", "", "fetch, cached", "", content)
+	get(s, "/big", "gzip", "hit, local", "gzip", content)
+	get(s, "/big", "", "hit, local", "", content)
+	get(s, "/big", "identity", "hit, local", "", content)
+
+	hash := hashRequest("GET", mustParse(t, upstream.URL+"/big"))
+	data, hdr, err := s.cacheLoadLocal("", hash)
+	if err != nil {
+		t.Fatalf("Load local: %v", err)
+	}
+	if got := hdr.Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Stored Content-Encoding: got %q, want gzip", got)
+	}
+	if len(data) >= len(content) {
+		t.Errorf("Stored body: got %d bytes, want fewer than %d", len(data), len(content))
+	}
+	if got := hdr.Get("Etag"); got != `W/"v1"` {
+		t.Errorf("Stored Etag: got %q, want weak", got)
+	}
+
+	// Small bodies are stored as received.
+	get(s, "/small", "", "fetch, cached", "", small)
+	get(s, "/small", "gzip", "hit, local", "", small)
+	if got := s.rspCompressed.Value(); got != 1 {
+		t.Errorf("Compressed responses: got %d, want 1", got)
+	}
+
+	// The compressed object is also what is stored in S3.
+	s.tasks.Wait()
+	s2 := newServer()
+	get(s2, "/big", "", "hit, remote", "", content)
+	get(s2, "/big", "gzip", "hit, local", "gzip", content)
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		header, coding string
+		want           bool
+	}{
+		{"", "gzip", false},
+		{"gzip", "gzip", true},
+		{"GZIP", "gzip", true},
+		{"deflate, gzip;q=1.0", "gzip", true},
+		{"gzip;q=0", "gzip", false},
+		{"gzip; q=0.000", "gzip", false},
+		{"br;q=0.1", "br", true},
+		{"*", "br", true},
+		{"*;q=0", "br", false},
+		{"br;q=0, *", "br", false},
+		{"*;q=0, br", "br", true},
+		{"gzip, deflate", "br", false},
+	} {
+		h := make(http.Header)
+		if tc.header != "" {
+			h.Set("Accept-Encoding", tc.header)
+		}
+		if got := acceptsEncoding(h, tc.coding); got != tc.want {
+			t.Errorf("acceptsEncoding(%q, %q): got %v, want %v", tc.header, tc.coding, got, tc.want)
+		}
+	}
+}
+
+func TestConditionalRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Header().Set("Etag", `"v1"`)
+		io.WriteString(w, "some content")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:  []string{u.Host},
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+	}
+	get := func(name, value string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest("GET", upstream.URL+"/object", nil)
+		if name != "" {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	get("", "") // populate the cache
+
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	for _, tc := range []struct {
+		name, value string
+		code        int
+		xcache      string
+	}{
+		{"", "", http.StatusOK, "hit, local"},
+		{"If-None-Match", `"v1"`, http.StatusNotModified, "not-modified"},
+		{"If-None-Match", `W/"v1"`, http.StatusNotModified, "not-modified"},
+		{"If-None-Match", `"v0", "v1"`, http.StatusNotModified, "not-modified"},
+		{"If-None-Match", "*", http.StatusNotModified, "not-modified"},
+		{"If-None-Match", `"v2"`, http.StatusOK, "hit, local"},
+		{"If-Modified-Since", future, http.StatusNotModified, "not-modified"},
+		{"If-Modified-Since", past, http.StatusOK, "hit, local"},
+		{"If-Modified-Since", "bogus", http.StatusOK, "hit, local"},
+	} {
+		rsp := get(tc.name, tc.value)
+		if rsp.StatusCode != tc.code {
+			t.Errorf("Get %s=%s: got status %d, want %d", tc.name, tc.value, rsp.StatusCode, tc.code)
+		}
+		if got := rsp.Header.Get("X-Cache"); got != tc.xcache {
+			t.Errorf("Get %s=%s: got X-Cache %q, want %q", tc.name, tc.value, got, tc.xcache)
+		}
+		body, _ := io.ReadAll(rsp.Body)
+		if want := tc.code == http.StatusOK; (len(body) != 0) != want {
+			t.Errorf("Get %s=%s: got body %q, want present=%v", tc.name, tc.value, body, want)
+		}
+	}
+	if got := s.rspNotModified.Value(); got != 5 {
+		t.Errorf("Got %d not-modified responses, want 5", got)
+	}
+}
+
+func TestCacheableContentTypes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/volatile.bin" {
+			w.Header().Set("Cache-Control", "max-age=300")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		}
+		if path.Ext(r.URL.Path) == ".html" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		io.WriteString(w, "some content")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:               []string{u.Host},
+		Local:                 t.TempDir(),
+		S3Client:              newTestClient(t),
+		CacheableContentTypes: []string{"application/octet-stream"},
+	}
+	for _, tc := range []struct {
+		path, xcache string
+	}{
+		{"/error.html", "fetch, uncached"},
+		{"/error.html", "fetch, uncached"},
+		{"/volatile.bin", "fetch, cached, volatile"},
+		{"/volatile.bin", "hit, memory"},
+		{"/object.bin", "fetch, cached"},
+		{"/object.bin", "hit, local"},
+	} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+tc.path, nil))
+		if got := rec.Result().Header.Get("X-Cache"); got != tc.xcache {
+			t.Errorf("Get %s: got X-Cache %q, want %q", tc.path, got, tc.xcache)
+		}
+	}
+}
+
+func TestMatchContentType(t *testing.T) {
+	patterns := []string{"application/octet-stream", "image/*", "Text/Plain"}
+	for _, tc := range []struct {
+		ct   string
+		want bool
+	}{
+		{"", false},
+		{"application/octet-stream", true},
+		{"Application/Octet-Stream", true},
+		{"application/json", false},
+		{"image/png", true},
+		{"image/svg+xml; charset=utf-8", true},
+		{"imagex/png", false},
+		{"text/plain; charset=utf-8", true},
+		{"text/html", false},
+		{"invalid;;", false},
+	} {
+		if got := matchContentType(tc.ct, patterns); got != tc.want {
+			t.Errorf("matchContentType(%q): got %v, want %v", tc.ct, got, tc.want)
+		}
+	}
+}
+
+func TestMaxImmutableAge(t *testing.T) {
+	var numFetch int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numFetch++
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		io.WriteString(w, "fresh content")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:         []string{u.Host},
+		Local:           t.TempDir(),
+		S3Client:        newTestClient(t),
+		MaxImmutableAge: 24 * time.Hour,
+	}
+	get := func(path string) (string, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+path, nil))
+		return rec.Result().Header.Get("X-Cache"), rec.Body.String()
+	}
+	old := http.Header{
+		"Content-Type":   {"text/plain"},
+		"X-Cache-Stored": {time.Now().Add(-48 * time.Hour).UTC().Format(http.TimeFormat)},
+	}
+	hashOf := func(path string) string {
+		return hashRequest("GET", s.cacheKeyURL(mustParse(t, upstream.URL+path)))
+	}
+
+	// An old entry in the local cache is refetched, and then served.
+	if err := s.cacheStoreLocal("", hashOf("/local"), old, []byte("stale content")); err != nil {
+		t.Fatalf("Store local: %v", err)
+	}
+	for _, want := range []string{"fetch, cached", "hit, local"} {
+		if xc, body := get("/local"); xc != want || body != "fresh content" {
+			t.Errorf("Get /local: got (%q, %q), want (%q, fresh content)", xc, body, want)
+		}
+	}
+
+	// An old entry in S3 is likewise refetched.
+	if err := s.cacheStoreS3("", hashOf("/remote"), old, []byte("stale content"))(); err != nil {
+		t.Fatalf("Store S3: %v", err)
+	}
+	if xc, body := get("/remote"); xc != "fetch, cached" || body != "fresh content" {
+		t.Errorf("Get /remote: got (%q, %q), want fetch", xc, body)
+	}
+
+	// A recent entry is served without a fetch.
+	recent := http.Header{"Content-Type": {"text/plain"}}
+	if err := s.cacheStoreLocal("", hashOf("/recent"), recent, []byte("recent content")); err != nil {
+		t.Fatalf("Store local: %v", err)
+	}
+	if xc, body := get("/recent"); xc != "hit, local" || body != "recent content" {
+		t.Errorf("Get /recent: got (%q, %q), want local hit", xc, body)
+	}
+
+	if numFetch != 2 {
+		t.Errorf("Got %d upstream fetches, want 2", numFetch)
+	}
+	if got := s.reqLocalExpired.Value(); got != 1 {
+		t.Errorf("Got %d expired local entries, want 1", got)
+	}
+	if got := s.reqFaultExpired.Value(); got != 1 {
+		t.Errorf("Got %d expired remote entries, want 1", got)
+	}
+}
+
+func TestEntries(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "content of "+r.URL.Path)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:  []string{u.Host},
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+	}
+	want := map[string]string{
+		upstream.URL + "/a": "content of /a",
+		upstream.URL + "/b": "content of /b",
+	}
+	for target := range want {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if got := rec.Result().Header.Get("X-Cache-Url"); got != "" {
+			t.Errorf("Get %s: unexpected X-Cache-Url %q", target, got)
+		}
+	}
+
+	// A stray temp file should not be reported.
+	if err := os.WriteFile(filepath.Join(s.Local, "junk-1234.aftmp"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	es, err := s.Entries(context.Background())
+	if err != nil {
+		t.Fatalf("Entries: unexpected error: %v", err)
+	}
+	if len(es) != len(want) {
+		t.Fatalf("Entries: got %d entries, want %d", len(es), len(want))
+	}
+	for _, e := range es {
+		body, ok := want[e.URL]
+		if !ok {
+			t.Errorf("Entries: unexpected URL %q", e.URL)
+			continue
+		}
+		if e.Size != int64(len(body)) {
+			t.Errorf("Entry %s: got size %d, want %d", e.URL, e.Size, len(body))
+		}
+		if e.ContentType != "text/plain" {
+			t.Errorf("Entry %s: got content type %q, want text/plain", e.URL, e.ContentType)
+		}
+		if e.Stored.IsZero() {
+			t.Errorf("Entry %s: missing storage time", e.URL)
+		}
+		if e.Hash != hashRequest("GET", s.cacheKeyURL(mustParse(t, e.URL))) {
+			t.Errorf("Entry %s: hash %q does not match URL", e.URL, e.Hash)
+		}
+	}
+}
+
+func mustParse(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("Parse %q: %v", s, err)
+	}
+	return u
+}
+
+func TestEntriesOmitQuery(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "content of "+r.URL.Path)
+	}))
+	defer upstream.Close()
+	u := mustParse(t, upstream.URL)
+
+	s := &Server{
+		Targets:  []string{u.Host},
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+	}
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", upstream.URL+"/a?token=secret", nil))
+	s.tasks.Wait()
+
+	es, err := s.Entries(context.Background())
+	if err != nil {
+		t.Fatalf("Entries: unexpected error: %v", err)
+	}
+	if len(es) != 1 {
+		t.Fatalf("Entries: got %d entries, want 1", len(es))
+	}
+	if got, want := es[0].URL, upstream.URL+"/a"; got != want {
+		t.Errorf("Entry URL: got %q, want %q", got, want)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	dir := t.TempDir()
+	hdr := http.Header{"Content-Type": {"text/plain"}}
+
+	// Populate the cache directory before the server exists.
+	s1 := &Server{Local: dir}
+	h1 := hashRequest("GET", mustParse(t, "https://example.com/a"))
+	if err := s1.cacheStoreLocal("", h1, hdr, []byte("apple")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	// A new server loads the existing contents and records later stores.
+	s := &Server{Local: dir}
+	h2 := hashRequest("GET", mustParse(t, "https://example.com/b"))
+	if err := s.cacheStoreLocal("", h2, hdr, []byte("banana")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	checkStats := func(wantN int, wantSize int64) {
+		t.Helper()
+		n, size, err := s.index.stats(s.Local)
+		if err != nil {
+			t.Fatalf("Stats: unexpected error: %v", err)
+		}
+		if n != wantN || size != wantSize {
+			t.Errorf("Stats: got (%d, %d), want (%d, %d)", n, size, wantN, wantSize)
+		}
+	}
+	fileSize := func(hash string) int64 {
+		t.Helper()
+		fi, err := os.Stat(s.makePath("", hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	size1, size2 := fileSize(h1), fileSize(h2)
+	checkStats(2, size1+size2)
+
+	// Rewriting an object replaces its entry.
+	if err := s.cacheStoreLocal("", h2, hdr, []byte("blueberry")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	size2 = fileSize(h2)
+	checkStats(2, size1+size2)
+
+	// Objects removed externally are dropped when they are discovered missing.
+	if err := os.Remove(s.makePath("", h1)); err != nil {
+		t.Fatal(err)
+	}
+	es, err := s.Entries(context.Background())
+	if err != nil {
+		t.Fatalf("Entries: unexpected error: %v", err)
+	}
+	if len(es) != 1 || es[0].Hash != h2 {
+		t.Errorf("Entries: got %+v, want only %s", es, h2)
+	}
+	checkStats(1, size2)
+
+	if err := os.Remove(s.makePath("", h2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.cacheLoadLocal("", h2); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load: got err=%v, want %v", err, fs.ErrNotExist)
+	}
+	checkStats(0, 0)
+}
+
+func TestIndexRemoved(t *testing.T) {
+	dir := t.TempDir()
+	s := &Server{Local: dir}
+
+	// Removals before the index is loaded are not retained, since a later
+	// scan will not find the files anyway.
+	for i := range 100 {
+		s.index.remove(hashRequest("GET", mustParse(t, fmt.Sprintf("https://example.com/%d", i))))
+	}
+	if n := len(s.index.removed); n != 0 {
+		t.Errorf("Removed before load: got %d entries, want 0", n)
+	}
+
+	hdr := http.Header{"Content-Type": {"text/plain"}}
+	h := hashRequest("GET", mustParse(t, "https://example.com/a"))
+	if err := s.cacheStoreLocal("", h, hdr, []byte("apple")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if n, _, err := s.index.stats(dir); err != nil || n != 1 {
+		t.Errorf("Stats: got (%d, %v), want (1, nil)", n, err)
+	}
+	s.index.remove(h)
+	if n := len(s.index.removed); n != 0 {
+		t.Errorf("Removed after load: got %d entries, want 0", n)
+	}
+}
+
+func TestLocalPerHost(t *testing.T) {
+	var hosts []string
+	for range 2 {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=3600, immutable")
+			io.WriteString(w, "content of "+r.Host)
+		}))
+		defer upstream.Close()
+		hosts = append(hosts, strings.TrimPrefix(upstream.URL, "http://"))
+	}
+
+	s := &Server{
+		Targets:      hosts,
+		Local:        t.TempDir(),
+		LocalPerHost: true,
+	}
+	get := func(host, want string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", "http://"+host+"/object", nil))
+		if got := rec.Result().Header.Get("X-Cache"); got != want {
+			t.Errorf("Get %s: got X-Cache %q, want %q", host, got, want)
+		}
+	}
+	for _, host := range hosts {
+		get(host, "fetch, cached")
+	}
+
+	// Each host has its own subdirectory.
+	for _, host := range hosts {
+		hash := hashRequest("GET", mustParse(t, "http://"+host+"/object"))
+		path := filepath.Join(s.Local, hostDir(host), hash[:2], hash)
+		if got := s.makePath(host, hash); got != path {
+			t.Errorf("Path for %s: got %q, want %q", host, got, path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Object for %s: %v", host, err)
+		}
+	}
+	es, err := s.Entries(context.Background())
+	if err != nil {
+		t.Fatalf("Entries: unexpected error: %v", err)
+	} else if len(es) != len(hosts) {
+		t.Errorf("Entries: got %d, want %d", len(es), len(hosts))
+	}
+
+	// Removing the directory for one host leaves the other intact.
+	if err := os.RemoveAll(filepath.Join(s.Local, hostDir(hosts[0]))); err != nil {
+		t.Fatal(err)
+	}
+	get(hosts[0], "fetch, cached")
+	get(hosts[1], "hit, local")
+}
+
+func TestHostDir(t *testing.T) {
+	for _, tc := range []struct {
+		input, want string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM:8080", "example.com_8080"},
+		{"[::1]:443", "___1__443"},
+		{"..", "_"},
+	} {
+		if got := hostDir(tc.input); got != tc.want {
+			t.Errorf("hostDir(%q): got %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestMakePathHost(t *testing.T) {
+	const hash = "0123456789abcdef"
+	s := &Server{Local: "/cache", LocalPerHost: true}
+	shared := filepath.Join("/cache", hash[:2], hash)
+	for _, tc := range []struct {
+		host, want string
+	}{
+		{"example.com", filepath.Join("/cache", "example.com", hash[:2], hash)},
+		{"Example.COM.:443", filepath.Join("/cache", "example.com", hash[:2], hash)},
+		{"example.com:8080", filepath.Join("/cache", "example.com_8080", hash[:2], hash)},
+		{"München.example", filepath.Join("/cache", "xn--mnchen-3ya.example", hash[:2], hash)},
+		{"[::1]:80", filepath.Join("/cache", "___1_", hash[:2], hash)},
+		{"", shared},
+		{"..", shared},
+		{"a/../../b", shared},
+		{"bad_host:99999", shared},
+		{"-example.com", shared},
+	} {
+		if got := s.makePath(tc.host, hash); got != tc.want {
+			t.Errorf("makePath(%q): got %q, want %q", tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestHostMatchesTarget(t *testing.T) {
+	targets := []string{"host.example.com", "münchen.example", "xn--mnchen-3ya.example", "alt.example.com:8443", "[::1]"}
+	for _, tc := range []struct {
+		host string
+		want bool
+	}{
+		{"host.example.com", true},
+		{"HOST.EXAMPLE.COM", true},
+		{"host.example.com:443", true},
+		{"host.example.com:80", true},
+		{"Host.Example.Com.:443", true},
+		{"host.example.com:8080", false},
+		{"other.example.com", false},
+		{"MÜNCHEN.example", true},
+		{"XN--MNCHEN-3YA.EXAMPLE:443", true},
+		{"alt.example.com:8443", true},
+		{"alt.example.com", false},
+		{"[::1]:443", true},
+		{"[::1]:8080", false},
+		{"", false},
+	} {
+		if got := hostMatchesTarget(tc.host, targets); got != tc.want {
+			t.Errorf("hostMatchesTarget(%q): got %v, want %v", tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	for _, tc := range []struct {
+		input, want string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM.:443", "example.com"},
+		{"example.com:8080", "example.com:8080"},
+		{"[::1]:80", "[::1]"},
+		{"::1", "[::1]"},
+		{"München.example", "xn--mnchen-3ya.example"},
+		{"bücher.example:8443", "xn--bcher-kva.example:8443"},
+		{"xn--mnchen-3ya.example", "xn--mnchen-3ya.example"},
+
+		// Samples from RFC 3492, section 7.1.
+		{"他们为什么不说中文", "xn--ihqwcrb4cv8a8dqg056pqjye"},
+		{"3年b組金八先生", "xn--3b-ww4c5e180e575a65lsy2b"},
+		{"ليهمابتكلموشعربي؟", "xn--egbpdaj6bu4bxfgehfvwxn"},
+	} {
+		if got := normalizeHost(tc.input); got != tc.want {
+			t.Errorf("normalizeHost(%q): got %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestStoreLocalTempDir(t *testing.T) {
+	// Make the system temporary directory unusable, so that staging an object
+	// there (and renaming it across filesystems) would fail.
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "nonexistent"))
+
+	s := &Server{Local: t.TempDir()}
+	hash := hashRequest("GET", mustParse(t, "https://example.com/a"))
+	hdr := http.Header{"Content-Type": {"text/plain"}}
+	if err := s.cacheStoreLocal("", hash, hdr, []byte("apple")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	body, _, err := s.cacheLoadLocal("", hash)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	} else if got := string(body); got != "apple" {
+		t.Errorf("Load: got %q, want %q", got, "apple")
+	}
+
+	// No temporary files should be left beside the object.
+	des, err := os.ReadDir(filepath.Dir(s.makePath("", hash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(des) != 1 || des[0].Name() != hash {
+		var names []string
+		for _, de := range des {
+			names = append(names, de.Name())
+		}
+		t.Errorf("Directory contents: got %q, want [%q]", names, hash)
+	}
+}
+
+func TestMaxDiskEntries(t *testing.T) {
+	hdr := http.Header{"Content-Type": {"text/plain"}}
+	s := &Server{Local: t.TempDir(), MaxDiskEntries: 10}
+
+	var hashes []string
+	store := func(i int) {
+		t.Helper()
+		h := hashRequest("GET", mustParse(t, fmt.Sprintf("https://example.com/%d", i)))
+		if err := s.cacheStoreLocal("", h, hdr, []byte("content")); err != nil {
+			t.Fatalf("Store %d: %v", i, err)
+		}
+		hashes = append(hashes, h)
+	}
+	for i := range 10 {
+		store(i)
+	}
+	if n := s.rspEvict.Value(); n != 0 {
+		t.Errorf("Evicted %d entries at the limit, want 0", n)
+	}
+
+	// Reading the oldest entry makes it the most recently used.
+	if _, _, err := s.cacheLoadLocal("", hashes[0]); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	// Exceeding the limit evicts the least recently used entries down to 90%.
+	store(10)
+	if n, _, err := s.index.stats(s.Local); err != nil {
+		t.Fatalf("Stats: unexpected error: %v", err)
+	} else if n != 9 {
+		t.Errorf("Stats: got %d entries, want 9", n)
+	}
+	if n := s.rspEvict.Value(); n != 2 {
+		t.Errorf("Evicted %d entries, want 2", n)
+	}
+	for i, h := range hashes {
+		_, err := os.Stat(s.makePath("", h))
+		if evicted := i == 1 || i == 2; evicted != errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Entry %d: got err=%v, evicted=%v", i, err, evicted)
+		}
+	}
+}
+
+func TestOrigins(t *testing.T) {
+	const target = "artifacts.example.com"
+	var gotHost string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+		io.WriteString(w, "origin content")
+	}))
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatalf("Parse origin URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:  []string{target},
+		Origins:  map[string]string{target: u.Host},
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "http://"+target+"/file", nil))
+	rsp := rec.Result()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("Got status %d, want %d", rsp.StatusCode, http.StatusOK)
+	}
+	if body, _ := io.ReadAll(rsp.Body); string(body) != "origin content" {
+		t.Errorf("Got body %q, want %q", body, "origin content")
+	}
+	if gotHost != target {
+		t.Errorf("Origin got Host %q, want %q", gotHost, target)
+	}
+}
+
+func TestUpstreamHTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	for _, tc := range []struct {
+		useHTTP2 bool
+		want     int
+	}{
+		{true, 2},
+		{false, 1},
+	} {
+		rt := newUpstreamTransport(nil, tc.useHTTP2)
+		rt.TLSClientConfig = &tls.Config{RootCAs: roots}
+		rsp, err := (&http.Client{Transport: rt}).Get(srv.URL)
+		if err != nil {
+			t.Fatalf("Get (HTTP/2 %v): %v", tc.useHTTP2, err)
+		}
+		rsp.Body.Close()
+		rt.CloseIdleConnections()
+		if rsp.ProtoMajor != tc.want {
+			t.Errorf("Get (HTTP/2 %v): got %s, want HTTP/%d", tc.useHTTP2, rsp.Proto, tc.want)
+		}
+	}
+}
+
+func TestUpstreamTrust(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	goodPin := CertPin(sha256.Sum256(srv.Certificate().Raw))
+	badPin := CertPin(sha256.Sum256([]byte("nonesuch")))
+
+	for _, tc := range []struct {
+		label string
+		roots *x509.CertPool
+		pins  []CertPin
+		ok    bool
+	}{
+		{"system roots", nil, nil, false},
+		{"custom roots", roots, nil, true},
+		{"pin only", nil, []CertPin{badPin, goodPin}, true},
+		{"wrong pin", nil, []CertPin{badPin}, false},
+		{"roots and pin", roots, []CertPin{goodPin}, true},
+		{"roots and wrong pin", roots, []CertPin{badPin}, false},
+		{"wrong roots and pin", x509.NewCertPool(), []CertPin{goodPin}, false},
+	} {
+		rt := newUpstreamTransport(nil, true)
+		rt.TLSClientConfig = upstreamTLSConfig(tc.roots, tc.pins)
+		rsp, err := (&http.Client{Transport: rt}).Get(srv.URL)
+		if err == nil {
+			rsp.Body.Close()
+		}
+		rt.CloseIdleConnections()
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("Get (%s): got err=%v, want success=%v", tc.label, err, tc.ok)
+		}
+	}
+}
+
+func TestUpstreamForgedChain(t *testing.T) {
+	// The pinned certificate belongs to a genuine server, but is public.
+	genuine := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer genuine.Close()
+	pin := CertPin(sha256.Sum256(genuine.Certificate().Raw))
+
+	// An impostor presents its own leaf, followed by a copy of the pinned
+	// certificate, for which it does not hold the key.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	forged, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "forged")
+	}))
+	impostor.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{forged, genuine.Certificate().Raw},
+		PrivateKey:  key,
+	}}}
+	impostor.StartTLS()
+	defer impostor.Close()
+
+	roots := genuine.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	for _, tc := range []struct {
+		label string
+		roots *x509.CertPool
+	}{
+		{"pin only", nil},
+		{"roots and pin", roots},
+	} {
+		rt := newUpstreamTransport(nil, true)
+		rt.TLSClientConfig = upstreamTLSConfig(tc.roots, []CertPin{pin})
+		rsp, err := (&http.Client{Transport: rt}).Get(impostor.URL)
+		if err == nil {
+			rsp.Body.Close()
+			t.Errorf("Get (%s): forged chain was accepted", tc.label)
+		}
+		rt.CloseIdleConnections()
+	}
+}
+
+func TestParseCertPin(t *testing.T) {
+	const want = "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	for _, s := range []string{
+		want,
+		strings.ToUpper(want),
+		"00:11:22:33:44:55:66:77:88:99:AA:BB:CC:DD:EE:FF:00:11:22:33:44:55:66:77:88:99:AA:BB:CC:DD:EE:FF",
+	} {
+		pin, err := ParseCertPin(s)
+		if err != nil {
+			t.Errorf("ParseCertPin(%q): unexpected error: %v", s, err)
+		} else if got := pin.String(); got != want {
+			t.Errorf("ParseCertPin(%q): got %q, want %q", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "0011", "xyz", want + "00"} {
+		if pin, err := ParseCertPin(s); err == nil {
+			t.Errorf("ParseCertPin(%q): got %v, want error", s, pin)
+		}
+	}
+}
+
+func TestOriginAddr(t *testing.T) {
+	origins := map[string]string{
+		"a.example.com":      "cdn.example.net",
+		"b.example.com":      "cdn.example.net:8443",
+		"c.example.com:8080": "other.example.net:9090",
+	}
+	for _, tc := range []struct {
+		addr, want string
+	}{
+		{"a.example.com:443", "cdn.example.net:443"},
+		{"a.example.com:80", "cdn.example.net:80"},
+		{"b.example.com:443", "cdn.example.net:8443"},
+		{"c.example.com:8080", "other.example.net:9090"},
+		{"c.example.com:443", "c.example.com:443"},
+		{"d.example.com:443", "d.example.com:443"},
+	} {
+		if got := originAddr(origins, tc.addr); got != tc.want {
+			t.Errorf("originAddr(%q): got %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	strip := []string{"utm_*", "token", "a b"}
+	for _, tc := range []struct {
+		query string
+		sort  bool
+		want  string
+	}{
+		{"", false, ""},
+		{"", true, ""},
+		{"x=1&y=2", false, "x=1&y=2"},
+		{"y=2&x=1", false, "y=2&x=1"},
+		{"y=2&x=1", true, "x=1&y=2"},
+
+		// Stripping removes only matching parameters.
+		{"x=1&token=abc&y=2", false, "x=1&y=2"},
+		{"token=abc", false, ""},
+		{"utm_source=foo&v=1&utm_medium=bar", false, "v=1"},
+		{"utm=foo&v=1", false, "utm=foo&v=1"},
+		{"tokens=1&xtoken=2", false, "tokens=1&xtoken=2"},
+		{"a+b=1&ab=2", false, "ab=2"},
+		{"a%20b=1&ab=2", false, "ab=2"},
+
+		// Sorting preserves the order of repeated values.
+		{"z=3&x=2&z=1&x=1", true, "x=2&x=1&z=3&z=1"},
+		{"b&a=&c=1", true, "a=&b&c=1"},
+
+		// The encoding of parameters is preserved.
+		{"q=a%2Fb&p=x+y", true, "p=x+y&q=a%2Fb"},
+
+		// Empty segments are dropped.
+		{"x=1&&y=2&", false, "x=1&y=2"},
+	} {
+		if got := normalizeQuery(tc.query, strip, tc.sort); got != tc.want {
+			t.Errorf("normalizeQuery(%q, sort=%v): got %q, want %q", tc.query, tc.sort, got, tc.want)
+		}
+	}
+}
+
+func TestCacheKeyURL(t *testing.T) {
+	mustParse := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatalf("Parse %q: %v", s, err)
+		}
+		return u
+	}
+	hash := func(s *Server, raw string) string { return hashRequest("GET", s.cacheKeyURL(mustParse(raw))) }
+
+	// By default, no normalization is done.
+	var plain Server
+	if hash(&plain, "http://x.com/a?p=1&q=2") == hash(&plain, "http://x.com/a?q=2&p=1") {
+		t.Error("Reordered queries have the same key without normalization")
+	}
+
+	s := &Server{StripQueryParams: []string{"utm_*"}, SortQueryParams: true}
+	same := [][2]string{
+		{"http://x.com/a?p=1&q=2", "http://x.com/a?q=2&p=1"},
+		{"http://x.com/a?p=1", "http://x.com/a?utm_source=z&p=1"},
+		{"http://x.com/a", "http://x.com/a?utm_source=z"},
+		{"https://X.COM.:443/a?p=1", "https://x.com/a?p=1"},
+		{"http://x.com:80/a", "http://x.com/a"},
+		{"http://MÜNCHEN.example/a", "http://xn--mnchen-3ya.example/a"},
+	}
+	for _, tc := range same {
+		if hash(s, tc[0]) != hash(s, tc[1]) {
+			t.Errorf("Keys differ for %q and %q", tc[0], tc[1])
+		}
+	}
+	diff := [][2]string{
+		{"http://x.com/a?p=1", "http://x.com/a?p=2"},
+		{"http://x.com/a?p=1&p=2", "http://x.com/a?p=2&p=1"},
+		{"http://x.com/a?p=1", "http://x.com/b?p=1"},
+		{"http://x.com:443/a", "http://x.com/a"},
+		{"https://x.com:8443/a", "https://x.com/a"},
+	}
+	for _, tc := range diff {
+		if hash(s, tc[0]) == hash(s, tc[1]) {
+			t.Errorf("Keys match for %q and %q", tc[0], tc[1])
+		}
+	}
+
+	// The original URL is not modified.
+	u := mustParse("http://x.com/a?utm_source=z&q=1")
+	s.cacheKeyURL(u)
+	if got, want := u.RawQuery, "utm_source=z&q=1"; got != want {
+		t.Errorf("Original query modified: got %q, want %q", got, want)
+	}
+}
+
+func TestHashRequest(t *testing.T) {
+	req := func(method, target, host string) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		r.Host = host
+		return r
+	}
+	var s Server
+	keys := make(map[string]string)
+	for _, r := range []*http.Request{
+		req("GET", "https://x.com/a", "x.com"),
+		req("HEAD", "https://x.com/a", "x.com"),
+		req("GET", "http://x.com/a", "x.com"),
+		req("GET", "https://y.com/a", "y.com"),
+
+		// A request forwarded from the TLS bridge has only a path.
+		req("GET", "/a", "z.com"),
+	} {
+		u := targetURL(r)
+		key := hashRequest(r.Method, s.cacheKeyURL(u))
+		tag := r.Method + " " + u.String()
+		if old, ok := keys[key]; ok {
+			t.Errorf("Key collision for %q and %q", old, tag)
+		}
+		keys[key] = tag
+	}
+
+	// A path-only request has the same key as the equivalent complete URL.
+	r1 := req("GET", "/a", "x.com")
+	r2 := req("GET", "https://x.com/a", "x.com")
+	if k1, k2 := hashRequest("GET", targetURL(r1)), hashRequest("GET", targetURL(r2)); k1 != k2 {
+		t.Errorf("Keys differ for path-only and complete URL: %s, %s", k1, k2)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	const content = "some cached content"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/volatile" {
+			w.Header().Set("Cache-Control", "max-age=300")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, content)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	client := newTestClient(t)
+	newServer := func() *Server {
+		return &Server{
+			Targets:  []string{u.Host},
+			Local:    t.TempDir(),
+			S3Client: client,
+		}
+	}
+	ctx := context.Background()
+	check := func(s *Server, path string, remote bool, want string) {
+		t.Helper()
+		tier, info, ok := s.Lookup(ctx, nil, upstream.URL+path, remote)
+		if want == "" {
+			if ok {
+				t.Errorf("Lookup %s: got (%q, %+v), want not found", path, tier, info)
+			}
+			return
+		}
+		if !ok || tier != want {
+			t.Fatalf("Lookup %s: got (%q, %v), want (%q, true)", path, tier, ok, want)
+		}
+		if info.Size != int64(len(content)) || info.ContentType != "text/plain" || info.Stored.IsZero() {
+			t.Errorf("Lookup %s: got info %+v", path, info)
+		}
+		if want == "memory" && info.Expires.IsZero() {
+			t.Errorf("Lookup %s: memory entry has no expiration", path)
+		}
+	}
+
+	s := newServer()
+	check(s, "/immutable", true, "")
+	check(s, "/volatile", true, "")
+	for _, path := range []string{"/immutable", "/volatile"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+path, nil))
+	}
+	s.tasks.Wait()
+	check(s, "/immutable", false, "local")
+	check(s, "/volatile", false, "memory")
+
+	// A server with an empty local cache finds the object in S3, but only if
+	// asked to check there, and does not fault it in.
+	s2 := newServer()
+	check(s2, "/immutable", false, "")
+	check(s2, "/immutable", true, "remote")
+	check(s2, "/immutable", false, "")
+	if got := s2.reqFaultHit.Value(); got != 0 {
+		t.Errorf("Fault hits: got %d, want 0", got)
+	}
+
+	if _, _, ok := s.Lookup(ctx, nil, "not a URL", true); ok {
+		t.Error("Lookup of an invalid URL succeeded")
+	}
+}
+
+func TestVerifyResponse(t *testing.T) {
+	const content = "an immutable artifact"
+	sum := sha256.Sum256([]byte(content))
+	b64 := base64.StdEncoding.EncodeToString(sum[:])
+	bad := sha256.Sum256([]byte("something else"))
+	badB64 := base64.StdEncoding.EncodeToString(bad[:])
+
+	headers := map[string][2]string{
+		"/plain":               {"", ""},
+		"/good-digest":         {"Digest", "md5=ignored, sha-256=" + b64},
+		"/good-content-digest": {"Content-Digest", "sha-256=:" + b64 + ":"},
+		"/good-checksum":       {"X-Checksum-Sha256", fmt.Sprintf("%x", sum)},
+		"/bad-digest":          {"Digest", "sha-256=" + badB64},
+		"/bad-content-digest":  {"Content-Digest", "sha-256=:" + badB64 + ":"},
+		"/bad-checksum":        {"X-Checksum-Sha256", fmt.Sprintf("%x", bad)},
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, immutable")
+		if h := headers[r.URL.Path]; h[0] != "" {
+			w.Header().Set(h[0], h[1])
+		}
+		io.WriteString(w, content)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:  []string{u.Host},
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+	}
+	get := func(path string) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+path, nil))
+		if got := rec.Body.String(); got != content {
+			t.Errorf("Get %s: got body %q, want %q", path, got, content)
+		}
+		return rec.Result().Header.Get("X-Cache")
+	}
+	for path := range headers {
+		get(path)
+		want := "hit, local"
+		if strings.HasPrefix(path, "/bad") {
+			want = "fetch, cached" // not actually cached, so fetched again
+		}
+		if got := get(path); got != want {
+			t.Errorf("Get %s again: got X-Cache %q, want %q", path, got, want)
+		}
+	}
+	if got := s.rspVerifyFail.Value(); got != 6 {
+		t.Errorf("Verify failures: got %d, want 6", got)
+	}
+}
+
+func TestVerifyBody(t *testing.T) {
+	const content = "some content"
+	tests := []struct {
+		name   string
+		length int64
+		hdr    http.Header
+		uncomp bool
+		ok     bool
+	}{
+		{"no headers", -1, nil, false, true},
+		{"length ok", int64(len(content)), nil, false, true},
+		{"short body", int64(len(content)) + 1, nil, false, false},
+		{"long body", int64(len(content)) - 1, nil, false, false},
+		{"decompressed", 1, http.Header{"Digest": {"sha-256=AAAA"}}, true, true},
+		{"unknown algorithm", -1, http.Header{"Digest": {"sha=AAAA"}}, false, true},
+		{"invalid digest", -1, http.Header{"Digest": {"sha-256=!!!"}}, false, false},
+		{"encoded checksum", -1, http.Header{
+			"X-Checksum-Sha256": {"00"},
+			"Content-Encoding":  {"gzip"},
+		}, false, true},
+	}
+	for _, tc := range tests {
+		rsp := &http.Response{ContentLength: tc.length, Header: tc.hdr, Uncompressed: tc.uncomp}
+		if rsp.Header == nil {
+			rsp.Header = make(http.Header)
+		}
+		err := verifyBody(rsp, []byte(content))
+		if got := err == nil; got != tc.ok {
+			t.Errorf("%s: got error %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestStatusMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			io.WriteString(w, "ok")
+		case "/forbidden":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		default:
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Parse upstream URL: %v", err)
+	}
+
+	s := &Server{
+		Targets:  []string{u.Host},
+		Local:    t.TempDir(),
+		S3Client: newTestClient(t),
+	}
+	for _, path := range []string{"/ok", "/forbidden", "/forbidden", "/broken"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", upstream.URL+path, nil))
+	}
+
+	m, ok := s.Metrics().Get("rsp_status").(*expvar.Map)
+	if !ok {
+		t.Fatal("Metrics: missing rsp_status map")
+	}
+	for code, want := range map[string]int64{"200": 1, "403": 2, "500": 1} {
+		v, ok := m.Get(code).(*expvar.Int)
+		if !ok {
+			t.Errorf("Status %s: not recorded", code)
+		} else if got := v.Value(); got != want {
+			t.Errorf("Status %s: got %d, want %d", code, got, want)
+		}
+	}
+}
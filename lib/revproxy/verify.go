@@ -0,0 +1,91 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// checkVerified reports whether the complete response body data matches the
+// length and digests advertised by the headers of rsp (see verifyBody), so
+// that it may be cached. If not, the failure is logged and counted.
+func (s *Server) checkVerified(hash string, rsp *http.Response, data []byte) bool {
+	if err := verifyBody(rsp, data); err != nil {
+		s.rspVerifyFail.Add(1)
+		s.logf("not caching %q: %v", hash, err)
+		return false
+	}
+	return true
+}
+
+// verifyBody checks the complete body data of rsp against the length and
+// digests advertised by the headers of rsp, and reports an error if they do
+// not match. Headers that are absent are not checked. It checks:
+//
+//   - The Content-Length of the response.
+//   - A "sha-256" or "sha-512" value of a Digest (RFC 3230) or Content-Digest
+//     (RFC 9530) header. Other algorithms are ignored.
+//   - An X-Checksum-Sha256 header, as sent by some artifact repositories,
+//     giving the hex SHA-256 digest of the body. This is checked only if the
+//     response has no Content-Encoding.
+//
+// If the transport decompressed the body (rsp.Uncompressed), the headers
+// describe the compressed body, and none are checked.
+func verifyBody(rsp *http.Response, data []byte) error {
+	if rsp.Uncompressed {
+		return nil
+	}
+	if rsp.ContentLength >= 0 && int64(len(data)) != rsp.ContentLength {
+		return fmt.Errorf("body has %d bytes, Content-Length is %d", len(data), rsp.ContentLength)
+	}
+	for _, name := range []string{"Digest", "Content-Digest"} {
+		for _, v := range rsp.Header.Values(name) {
+			for _, elt := range strings.Split(v, ",") {
+				alg, val, ok := strings.Cut(strings.TrimSpace(elt), "=")
+				if !ok {
+					continue
+				}
+				var h hash.Hash
+				switch strings.ToLower(alg) {
+				case "sha-256":
+					h = sha256.New()
+				case "sha-512":
+					h = sha512.New()
+				default:
+					continue // unsupported algorithm
+				}
+				// Content-Digest values are structured-field byte sequences,
+				// which are wrapped in colons.
+				want, err := base64.StdEncoding.DecodeString(strings.Trim(val, ":"))
+				if err != nil {
+					return fmt.Errorf("invalid %s header: %w", name, err)
+				}
+				h.Write(data)
+				if subtle.ConstantTimeCompare(h.Sum(nil), want) != 1 {
+					return fmt.Errorf("body does not match %s %s", name, alg)
+				}
+			}
+		}
+	}
+	if v := rsp.Header.Get("X-Checksum-Sha256"); v != "" && rsp.Header.Get("Content-Encoding") == "" {
+		want, err := hex.DecodeString(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("invalid X-Checksum-Sha256 header: %w", err)
+		}
+		got := sha256.Sum256(data)
+		if subtle.ConstantTimeCompare(got[:], want) != 1 {
+			return errors.New("body does not match X-Checksum-Sha256")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+
+	"github.com/creachadair/taskgroup"
+)
+
+// A WarmResult reports the outcome of warming the cache for one URL.
+type WarmResult struct {
+	URL    string `json:"url"`              // the requested URL
+	Status int    `json:"status,omitempty"` // the HTTP status of the response
+	Cache  string `json:"cache,omitempty"`  // the X-Cache disposition of the response
+	Cached bool   `json:"cached"`           // whether the response is in the cache
+	Bytes  int64  `json:"bytes,omitempty"`  // the size of the response body in bytes
+	Error  string `json:"error,omitempty"`  // the reason for failure, if any
+}
+
+// Warm fetches each of the specified URLs through the proxy, so that the
+// responses are cached as if a client had requested them, and returns the
+// results in the same order as urls. At most WarmConcurrency URLs are fetched
+// at once.
+//
+// Each URL is requested with a GET through the same path as a proxied
+// request, and so is subject to the same rules: URLs for hosts not listed in
+// Targets fail, and responses not eligible for caching are fetched but not
+// stored. If hdr is non-nil, its Accept-Encoding and TenantHeader values are
+// copied to each request, to select the encoding variant and tenant to warm.
+func (s *Server) Warm(ctx context.Context, hdr http.Header, urls []string) []WarmResult {
+	s.init()
+	out := make([]WarmResult, len(urls))
+	g, start := taskgroup.New(nil).Limit(s.warmConcurrency())
+	for i, u := range urls {
+		start(func() error {
+			out[i] = s.warmOne(ctx, hdr, u)
+			return nil
+		})
+	}
+	g.Wait()
+	return out
+}
+
+// warmOne fetches the URL u through the proxy, and reports the result.
+func (s *Server) warmOne(ctx context.Context, hdr http.Header, u string) WarmResult {
+	res := WarmResult{URL: u}
+	pu, err := url.Parse(u)
+	if err != nil || pu.Host == "" || (pu.Scheme != "http" && pu.Scheme != "https") {
+		res.Error = "invalid URL"
+		return res
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pu.String(), nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	req.RequestURI = pu.String() // as for a proxy request
+	for _, name := range []string{"Accept-Encoding", s.TenantHeader} {
+		if v := hdr.Get(name); name != "" && v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+
+	rec := &warmRecorder{hdr: make(http.Header)}
+	s.ServeHTTP(rec, req)
+	s.reqWarm.Add(1)
+
+	res.Status = rec.status()
+	res.Cache = rec.hdr.Get("X-Cache")
+	res.Bytes = rec.nw
+	res.Cached = res.Status == http.StatusOK &&
+		(strings.HasPrefix(res.Cache, "hit") || strings.HasPrefix(res.Cache, "fetch, cached"))
+	if res.Status != http.StatusOK {
+		res.Error = http.StatusText(res.Status)
+	}
+	return res
+}
+
+func (s *Server) warmConcurrency() int {
+	if s.WarmConcurrency <= 0 {
+		return runtime.NumCPU()
+	}
+	return s.WarmConcurrency
+}
+
+// warmRecorder is an [http.ResponseWriter] that records the status and
+// headers of a response, and discards its body.
+type warmRecorder struct {
+	hdr  http.Header
+	code int
+	nw   int64
+}
+
+func (w *warmRecorder) Header() http.Header { return w.hdr }
+
+func (w *warmRecorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *warmRecorder) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.nw += int64(len(data))
+	return len(data), nil
+}
+
+func (w *warmRecorder) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
@@ -5,6 +5,7 @@
 package s3util
 
 import (
+	"bytes"
 	"cmp"
 	"context"
 	"crypto/md5"
@@ -13,12 +14,21 @@ import (
 	"hash"
 	"io"
 	"io/fs"
+	"net/http"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/creachadair/mds/value"
+	"github.com/creachadair/taskgroup"
 )
 
 // IsNotExist reports whether err is an error indicating the requested resource
@@ -29,22 +39,39 @@ func IsNotExist(err error) bool {
 	if errors.As(err, &e1) || errors.As(err, &e2) {
 		return true
 	}
+
+	// Some operations, such as CopyObject, do not model a missing key as a
+	// distinct type, but report it with the generic API error code.
+	var ae interface{ ErrorCode() string }
+	if errors.As(err, &ae) && ae.ErrorCode() == "NoSuchKey" {
+		return true
+	}
 	return errors.Is(err, os.ErrNotExist)
 }
 
+// defaultRegion is the default AWS region, which we use for resolving bucket
+// locations and also serves as the fallback if the API reports an empty
+// region name. The API returns "" for buckets in this region for historical
+// reasons.
+const defaultRegion = "us-east-1"
+
 // BucketRegion reports the specified region for the given bucket using the
-// GetBucketLocation API.
-func BucketRegion(ctx context.Context, bucket string) (string, error) {
-	// The default AWS region, which we use for resolving the bucket location
-	// and also serves as the fallback if the API reports an empty region name.
-	// The API returns "" for buckets in this region for historical reasons.
-	const defaultRegion = "us-east-1"
-
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(defaultRegion))
+// GetBucketLocation API. Any optFns are applied to the options of the S3
+// client used for the query, as for [s3.NewFromConfig].
+func BucketRegion(ctx context.Context, bucket string, optFns ...func(*s3.Options)) (string, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
 		return "", err
 	}
-	cli := s3.NewFromConfig(cfg)
+	return BucketRegionConfig(ctx, cfg, bucket, optFns...)
+}
+
+// BucketRegionConfig is as [BucketRegion], but uses the given AWS config for
+// the query in place of the default config, for example to supply specific
+// credentials. The region of cfg is ignored.
+func BucketRegionConfig(ctx context.Context, cfg aws.Config, bucket string, optFns ...func(*s3.Options)) (string, error) {
+	cfg.Region = defaultRegion
+	cli := s3.NewFromConfig(cfg, optFns...)
 	loc, err := cli.GetBucketLocation(ctx, &s3.GetBucketLocationInput{Bucket: &bucket})
 	if err != nil {
 		return "", err
@@ -80,10 +107,69 @@ func (e ETagReader) ETag() string { return fmt.Sprintf("%x", e.hash.Sum(nil)) }
 type Client struct {
 	Client *s3.Client
 	Bucket string
+
+	// RequestPayer, if true, indicates that the requester agrees to pay for
+	// requests to the bucket. This is required to access a bucket that has
+	// requester-pays enabled, and has no effect otherwise.
+	RequestPayer bool
+
+	// MaxBufferBytes, if positive, is the largest body that Put will buffer in
+	// memory when it is given a reader that cannot seek. Larger bodies are
+	// spooled to a temporary file. If zero or negative, the default is 16MiB.
+	// See [SeekableBody].
+	MaxBufferBytes int64
+
+	// StorageClass, if non-empty, is the S3 storage class for objects written
+	// by Put, PutCond, and Touch, for example "INTELLIGENT_TIERING". If empty,
+	// objects use the default storage class of the bucket.
+	StorageClass types.StorageClass
+
+	// ACL, if non-empty, is the canned ACL applied to objects written by Put,
+	// PutCond, Copy, and Touch, for example "bucket-owner-full-control". This
+	// lets the owner of a bucket read objects written to it by another
+	// account. If empty, no ACL is requested, and the bucket default applies.
+	ACL types.ObjectCannedACL
+
+	// MultipartPartSize, if positive, is the size in bytes of each part when
+	// Put uploads a large object in multiple parts. Objects no larger than
+	// this are written with a single request. If zero or negative, the default
+	// is 16MiB. Values below the S3 minimum part size (5MiB) are raised to it.
+	MultipartPartSize int64
+
+	// MultipartConcurrency, if positive, is the maximum number of parts of a
+	// single object that Put uploads concurrently. If zero or negative, the
+	// default is runtime.NumCPU.
+	MultipartConcurrency int
+}
+
+// requestPayer returns the request payer setting to use for requests to c.
+func (c *Client) requestPayer() types.RequestPayer {
+	if c.RequestPayer {
+		return types.RequestPayerRequester
+	}
+	return ""
 }
 
 // Put writes the specified data to S3 under the given key.
+//
+// If data does not implement [io.Seeker], Put copies it into a seekable
+// buffer before sending, so that the request can be safely retried.
 func (c *Client) Put(ctx context.Context, key string, data io.Reader) error {
+	return c.PutMeta(ctx, key, data, nil)
+}
+
+// PutMeta is as [Client.Put], but also stores meta as the user metadata of
+// the object. S3 reports user metadata keys in lower case.
+func (c *Client) PutMeta(ctx context.Context, key string, data io.Reader, meta map[string]string) error {
+	if _, ok := data.(io.Seeker); !ok {
+		body, closeBody, err := SeekableBody(data, c.maxBufferBytes())
+		if err != nil {
+			return fmt.Errorf("buffer body: %w", err)
+		}
+		defer closeBody()
+		data = body
+	}
+
 	// Attempt to find the size of the input to send as a content length.
 	// If we can't do this, let the SDK figure it out.
 	var sizePtr *int64
@@ -108,15 +194,114 @@ func (c *Client) Put(ctx context.Context, key string, data io.Reader) error {
 			}
 		}
 	}
+	if sizePtr != nil && *sizePtr > c.multipartPartSize() {
+		return c.putMultipart(ctx, key, data, *sizePtr, meta)
+	}
 	_, err := c.Client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:        &c.Bucket,
 		Key:           &key,
 		Body:          data,
 		ContentLength: sizePtr,
+		Metadata:      meta,
+		RequestPayer:  c.requestPayer(),
+		StorageClass:  c.StorageClass,
+		ACL:           c.ACL,
 	})
 	return err
 }
 
+// putMultipart writes size bytes of data to S3 under the given key, as a
+// multipart upload. If the upload fails, it is aborted so that the parts
+// already written do not linger in the bucket.
+func (c *Client) putMultipart(ctx context.Context, key string, data io.Reader, size int64, meta map[string]string) error {
+	cu, err := c.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		Metadata:     meta,
+		RequestPayer: c.requestPayer(),
+		StorageClass: c.StorageClass,
+		ACL:          c.ACL,
+	})
+	if err != nil {
+		return fmt.Errorf("create multipart upload: %w", err)
+	}
+	uploadID := cu.UploadId
+
+	partSize := c.multipartPartSize()
+	nparts := int((size + partSize - 1) / partSize)
+	parts := make([]types.CompletedPart, nparts)
+	g, start := taskgroup.New(nil).Limit(c.multipartConcurrency())
+
+	// If data supports random access, each part reads its own section.
+	// Otherwise, read the parts in order and buffer each one for its request.
+	// Start blocks while the concurrency limit is reached, which bounds the
+	// number of buffered parts.
+	ra, _ := data.(io.ReaderAt)
+	var readErr error
+	for i := range nparts {
+		off := int64(i) * partSize
+		n := min(partSize, size-off)
+		var body io.ReadSeeker
+		if ra != nil {
+			body = io.NewSectionReader(ra, off, n)
+		} else {
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(data, buf); err != nil {
+				readErr = fmt.Errorf("read part %d: %w", i+1, err)
+				break
+			}
+			body = bytes.NewReader(buf)
+		}
+		start(func() error {
+			pn := value.Ptr(int32(i + 1))
+			rsp, err := c.Client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:        &c.Bucket,
+				Key:           &key,
+				UploadId:      uploadID,
+				PartNumber:    pn,
+				Body:          body,
+				ContentLength: &n,
+				RequestPayer:  c.requestPayer(),
+			})
+			if err != nil {
+				return fmt.Errorf("upload part %d: %w", i+1, err)
+			}
+			parts[i] = types.CompletedPart{ETag: rsp.ETag, PartNumber: pn}
+			return nil
+		})
+	}
+	if err := cmp.Or(g.Wait(), readErr); err != nil {
+		c.abortMultipart(key, uploadID)
+		return err
+	}
+
+	if _, err := c.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &c.Bucket,
+		Key:             &key,
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		RequestPayer:    c.requestPayer(),
+	}); err != nil {
+		c.abortMultipart(key, uploadID)
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+// abortMultipart makes a best-effort attempt to abort the specified multipart
+// upload. It does not use the caller's context, since the caller's context may
+// have ended, which is one of the reasons the upload is being abandoned.
+func (c *Client) abortMultipart(key string, uploadID *string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c.Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		UploadId:     uploadID,
+		RequestPayer: c.requestPayer(),
+	})
+}
+
 // Get returns the contents of the specified key from S3. On success, the
 // returned reader contains the contents of the object, and the caller must
 // close the reader when finished.
@@ -124,8 +309,9 @@ func (c *Client) Put(ctx context.Context, key string, data io.Reader) error {
 // If the key is not found, the resulting error satisfies [fs.ErrNotExist].
 func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, error) {
 	rsp, err := c.Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &c.Bucket,
-		Key:    &key,
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		RequestPayer: c.requestPayer(),
 	})
 	if err != nil {
 		if IsNotExist(err) {
@@ -136,6 +322,68 @@ func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, error) {
 	return rsp.Body, nil
 }
 
+// GetRange returns a reader for up to n bytes of the specified key starting at
+// offset off, along with the total size of the object in bytes. If the object
+// ends before off+n, the reader returns only the bytes available. The caller
+// must close the reader when it is no longer needed.
+//
+// If the key is not found, the resulting error satisfies [fs.ErrNotExist].
+func (c *Client) GetRange(ctx context.Context, key string, off, n int64) (io.ReadCloser, int64, error) {
+	rc, size, _, err := c.GetRangeMatch(ctx, key, off, n, "")
+	return rc, size, err
+}
+
+// GetRangeMatch is as [Client.GetRange], but also returns the ETag of the
+// object read. If etag is non-empty, the read succeeds only if the object
+// still has that ETag, so that several ranges read from the same key are
+// known to come from the same version of the object. Otherwise, it reports
+// an error.
+func (c *Client) GetRangeMatch(ctx context.Context, key string, off, n int64, etag string) (io.ReadCloser, int64, string, error) {
+	if off < 0 || n <= 0 {
+		return nil, 0, "", fmt.Errorf("invalid range offset %d length %d", off, n)
+	}
+	var ifMatch *string
+	if etag != "" {
+		ifMatch = &etag
+	}
+	rsp, err := c.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		Range:        aws.String(fmt.Sprintf("bytes=%d-%d", off, off+n-1)),
+		IfMatch:      ifMatch,
+		RequestPayer: c.requestPayer(),
+	})
+	if err != nil {
+		if IsNotExist(err) {
+			return nil, 0, "", fmt.Errorf("key %q: %w", key, fs.ErrNotExist)
+		}
+		return nil, 0, "", err
+	}
+	tag := value.At(rsp.ETag)
+	cr := value.At(rsp.ContentRange)
+	if cr == "" {
+		// The server ignored the range and sent the whole object, so skip to
+		// the start of the range and stop at its end.
+		if _, err := io.CopyN(io.Discard, rsp.Body, off); err != nil && err != io.EOF {
+			rsp.Body.Close()
+			return nil, 0, "", err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(rsp.Body, n), rsp.Body}, value.At(rsp.ContentLength), tag, nil
+	}
+
+	// A Content-Range has the form "bytes <first>-<last>/<size>".
+	_, ssize, _ := strings.Cut(cr, "/")
+	size, err := strconv.ParseInt(ssize, 10, 64)
+	if err != nil {
+		rsp.Body.Close()
+		return nil, 0, "", fmt.Errorf("invalid content range %q", cr)
+	}
+	return rsp.Body, size, tag, nil
+}
+
 // GetData returns the contents of the specified key from S3. It is a shorthand
 // for calling Get followed by io.ReadAll on the result.
 func (c *Client) GetData(ctx context.Context, key string) ([]byte, error) {
@@ -147,19 +395,439 @@ func (c *Client) GetData(ctx context.Context, key string) ([]byte, error) {
 	return io.ReadAll(rc)
 }
 
+// GetTo copies the contents of the specified key from S3 to w, without
+// buffering the whole object in memory, and returns the number of bytes
+// copied. If progress != nil, it is called after each write to w with the
+// total number of bytes copied so far.
+//
+// If the key is not found, the resulting error satisfies [fs.ErrNotExist].
+// If an error occurs after copying has begun, w may have received part of the
+// object.
+func (c *Client) GetTo(ctx context.Context, key string, w io.Writer, progress func(n int64)) (int64, error) {
+	rc, err := c.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	if progress != nil {
+		w = &progressWriter{w: w, progress: progress}
+	}
+	return io.Copy(w, rc)
+}
+
+// progressWriter is an [io.Writer] that reports the cumulative number of bytes
+// written to a progress function.
+type progressWriter struct {
+	w        io.Writer
+	nw       int64
+	progress func(int64)
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	nw, err := p.w.Write(data)
+	if nw > 0 {
+		p.nw += int64(nw)
+		p.progress(p.nw)
+	}
+	return nw, err
+}
+
+// GetDataMulti returns the contents of the specified keys from S3, fetching
+// up to concurrency keys at once. If concurrency is zero or negative, the
+// default is runtime.NumCPU.
+//
+// The result maps each key that was found to its contents. Keys that are not
+// found are omitted from the result, and are not errors. If any key cannot be
+// read for another reason, GetDataMulti returns the contents of the keys that
+// were read, along with an error that combines the errors for each of the
+// keys that failed.
+func (c *Client) GetDataMulti(ctx context.Context, keys []string, concurrency int) (map[string][]byte, error) {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	var mu sync.Mutex
+	out := make(map[string][]byte)
+	var errs []error
+	g, start := taskgroup.New(nil).Limit(concurrency)
+	for _, key := range keys {
+		start(func() error {
+			data, err := c.GetData(ctx, key)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				out[key] = data
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, fmt.Errorf("get %q: %w", key, err))
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	return out, errors.Join(errs...)
+}
+
+// GetDataMeta is as [Client.GetData], but also returns the user metadata of
+// the object, if any.
+func (c *Client) GetDataMeta(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	rsp, err := c.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		RequestPayer: c.requestPayer(),
+	})
+	if err != nil {
+		if IsNotExist(err) {
+			return nil, nil, fmt.Errorf("key %q: %w", key, fs.ErrNotExist)
+		}
+		return nil, nil, err
+	}
+	defer rsp.Body.Close()
+	data, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, rsp.Metadata, nil
+}
+
+// Delete removes the specified key from S3. Deleting a key that does not
+// exist is not an error.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		RequestPayer: c.requestPayer(),
+	})
+	return err
+}
+
+// List calls f with the key of each object in the bucket whose key begins
+// with prefix, in lexicographic order. If f reports an error, List stops and
+// returns that error.
+func (c *Client) List(ctx context.Context, prefix string, f func(key string) error) error {
+	pages := s3.NewListObjectsV2Paginator(c.Client, &s3.ListObjectsV2Input{
+		Bucket:       &c.Bucket,
+		Prefix:       &prefix,
+		RequestPayer: c.requestPayer(),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			if err := f(*obj.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Copy copies the object stored under src to dst within the bucket, using a
+// server-side copy. The user metadata of the object are preserved. If src is
+// not found, the resulting error satisfies [fs.ErrNotExist].
+//
+// S3 limits a single copy to objects of at most 5GiB.
+func (c *Client) Copy(ctx context.Context, src, dst string) error {
+	_, err := c.Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &dst,
+		CopySource:   value.Ptr(c.Bucket + "/" + src),
+		RequestPayer: c.requestPayer(),
+		StorageClass: c.StorageClass,
+		ACL:          c.ACL,
+	})
+	if err != nil && IsNotExist(err) {
+		return fmt.Errorf("key %q: %w", src, fs.ErrNotExist)
+	}
+	return err
+}
+
+// CheckAccess reports whether the bucket for c exists and is accessible with
+// the credentials of the client, using the HeadBucket API. It is meant as a
+// cheap preflight check, so that misconfiguration can be reported clearly
+// before the client is used.
+//
+// If the bucket does not exist, the error satisfies [fs.ErrNotExist]. If
+// access to the bucket is denied, the error satisfies [fs.ErrPermission].
+// Other errors, such as network failures, are reported as-is.
+func (c *Client) CheckAccess(ctx context.Context) error {
+	_, err := c.Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &c.Bucket})
+	if err == nil {
+		return nil
+	}
+	var rerr *awshttp.ResponseError
+	if errors.As(err, &rerr) {
+		switch rerr.HTTPStatusCode() {
+		case http.StatusNotFound:
+			return fmt.Errorf("bucket %q does not exist: %w", c.Bucket, fs.ErrNotExist)
+		case http.StatusForbidden, http.StatusUnauthorized:
+			return fmt.Errorf("access denied to bucket %q: %w", c.Bucket, fs.ErrPermission)
+		}
+	} else if IsNotExist(err) {
+		return fmt.Errorf("bucket %q does not exist: %w", c.Bucket, fs.ErrNotExist)
+	}
+	return fmt.Errorf("check bucket %q: %w", c.Bucket, err)
+}
+
+// Touch updates the last-modified time of the specified key in S3 without
+// changing its contents, by copying the object onto itself. This is useful to
+// keep an object alive under a bucket lifecycle rule based on its age.
+//
+// If the key is not found, the resulting error satisfies [fs.ErrNotExist].
+//
+// Touch does not preserve the user metadata of the object; to keep it, use
+// [Client.TouchMeta] with the metadata reported by [Client.Meta].
+func (c *Client) Touch(ctx context.Context, key string) error {
+	return c.TouchMeta(ctx, key, nil)
+}
+
+// Meta returns the user metadata of the object stored under key, without
+// reading its contents. If the key is not found, the resulting error
+// satisfies [fs.ErrNotExist].
+func (c *Client) Meta(ctx context.Context, key string) (map[string]string, error) {
+	rsp, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		RequestPayer: c.requestPayer(),
+	})
+	if err != nil {
+		if IsNotExist(err) {
+			return nil, fmt.Errorf("key %q: %w", key, fs.ErrNotExist)
+		}
+		return nil, err
+	}
+	return rsp.Metadata, nil
+}
+
+// TouchMeta is as [Client.Touch], but replaces the user metadata of the
+// object with meta.
+func (c *Client) TouchMeta(ctx context.Context, key string, meta map[string]string) error {
+	// S3 does not permit copying an object onto itself unless something about
+	// it changes, so ask it to replace the (unchanged) metadata. A copy that
+	// does not specify a storage class reverts to the default, so preserve it.
+	_, err := c.Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            &c.Bucket,
+		Key:               &key,
+		CopySource:        value.Ptr(c.Bucket + "/" + key),
+		MetadataDirective: types.MetadataDirectiveReplace,
+		Metadata:          meta,
+		RequestPayer:      c.requestPayer(),
+		StorageClass:      c.StorageClass,
+		ACL:               c.ACL,
+	})
+	if err != nil && IsNotExist(err) {
+		return fmt.Errorf("key %q: %w", key, fs.ErrNotExist)
+	}
+	return err
+}
+
 // PutCond writes the specified data to S3 under the given key if the key does
 // not already exist, or if its content differs from the given etag.
 // The etag is an MD5 of the expected contents, encoded as lowercase hex digits.
 // On success, written reports whether the object was written.
+//
+// If the existing object was uploaded in multiple parts, S3 reports a
+// composite etag that cannot be compared directly to etag. In that case, if
+// data implements [io.Seeker], PutCond computes the corresponding composite
+// etag of data to compare with the existing object. Otherwise, the object is
+// written unconditionally.
 func (c *Client) PutCond(ctx context.Context, key, etag string, data io.Reader) (written bool, _ error) {
-	if _, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket:  &c.Bucket,
-		Key:     &key,
-		IfMatch: &etag,
-	}); err == nil {
-		return false, nil
-	}
-	return true, c.Put(ctx, key, data)
+	return c.PutCondMeta(ctx, key, etag, data, nil)
+}
+
+// PutCondMeta is as [Client.PutCond], but if the object is written, it also
+// stores meta as the user metadata of the object. The metadata of an existing
+// object with matching content are not changed.
+func (c *Client) PutCondMeta(ctx context.Context, key, etag string, data io.Reader, meta map[string]string) (written bool, _ error) {
+	rsp, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		RequestPayer: c.requestPayer(),
+	})
+	if err == nil && rsp.ETag != nil {
+		have := strings.Trim(*rsp.ETag, `"`)
+		if have == etag {
+			return false, nil // already present and matching
+		}
+		if rs, ok := data.(io.ReadSeeker); ok && IsCompositeETag(have) {
+			if ok, err := c.matchComposite(ctx, key, have, rs); err != nil {
+				return false, err
+			} else if ok {
+				return false, nil
+			}
+		}
+	}
+	return true, c.PutMeta(ctx, key, data, meta)
+}
+
+// Match reports whether an object is stored under key, and if so, whether its
+// contents match etag, in the same way as [Client.PutCond], but without
+// writing anything. If the existing object has a composite etag, data is used
+// to compute the corresponding composite etag, and on return it is positioned
+// at its beginning. If data is nil, a composite etag does not match.
+func (c *Client) Match(ctx context.Context, key, etag string, data io.ReadSeeker) (exists, match bool, _ error) {
+	rsp, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		RequestPayer: c.requestPayer(),
+	})
+	if IsNotExist(err) {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, err
+	} else if rsp.ETag == nil {
+		return true, false, nil
+	}
+	have := strings.Trim(*rsp.ETag, `"`)
+	if have == etag {
+		return true, true, nil
+	} else if data != nil && IsCompositeETag(have) {
+		ok, err := c.matchComposite(ctx, key, have, data)
+		return true, ok, err
+	}
+	return true, false, nil
+}
+
+// matchComposite reports whether the contents of data match the composite
+// etag of the existing object at key. On return, data is positioned at its
+// beginning.
+func (c *Client) matchComposite(ctx context.Context, key, etag string, data io.ReadSeeker) (bool, error) {
+	// The parts of a multipart upload other than the last all have the same
+	// size, which we can recover from the size of the first part.
+	rsp, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		PartNumber:   value.Ptr[int32](1),
+		RequestPayer: c.requestPayer(),
+	})
+	if err != nil || rsp.ContentLength == nil || *rsp.ContentLength <= 0 {
+		return false, nil // we can't tell, so assume no match
+	}
+	want, err := MultipartETag(data, *rsp.ContentLength)
+	if _, serr := data.Seek(0, io.SeekStart); serr != nil {
+		return false, fmt.Errorf("[unexpected] seek failed: %w", serr)
+	} else if err != nil {
+		return false, err
+	}
+	return want == etag, nil
+}
+
+// IsCompositeETag reports whether etag is a composite etag, as reported by S3
+// for objects uploaded in multiple parts. A composite etag has the form
+// "<hex-digest>-<part-count>".
+func IsCompositeETag(etag string) bool {
+	_, n, ok := strings.Cut(strings.Trim(etag, `"`), "-")
+	if !ok {
+		return false
+	}
+	_, err := strconv.Atoi(n)
+	return err == nil
+}
+
+// MultipartETag computes the composite S3 etag for the contents of r, as if
+// it were uploaded in parts of partSize bytes. The result is the MD5 of the
+// concatenated MD5 digests of the parts, encoded as lowercase hex digits,
+// followed by "-" and the number of parts.
+func MultipartETag(r io.Reader, partSize int64) (string, error) {
+	if partSize <= 0 {
+		return "", errors.New("part size must be positive")
+	}
+	sum := md5.New()
+	part := md5.New()
+	var nparts int
+	for {
+		part.Reset()
+		nr, err := io.CopyN(part, r, partSize)
+		if nr > 0 || nparts == 0 {
+			sum.Write(part.Sum(nil))
+			nparts++
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x-%d", sum.Sum(nil), nparts), nil
+}
+
+func (c *Client) maxBufferBytes() int64 {
+	if c.MaxBufferBytes > 0 {
+		return c.MaxBufferBytes
+	}
+	return 16 << 20
+}
+
+// Parts reports the number of requests Put uses to write an object of the
+// given size: 1 if the object is written with a single request, otherwise the
+// number of parts in its multipart upload.
+func (c *Client) Parts(size int64) int {
+	partSize := c.multipartPartSize()
+	if size <= partSize {
+		return 1
+	}
+	return int((size + partSize - 1) / partSize)
+}
+
+// minPartSize is the smallest part size permitted by S3 for the parts of a
+// multipart upload other than the last.
+const minPartSize = 5 << 20
+
+func (c *Client) multipartPartSize() int64 {
+	if c.MultipartPartSize <= 0 {
+		return 16 << 20
+	}
+	return max(c.MultipartPartSize, minPartSize)
+}
+
+func (c *Client) multipartConcurrency() int {
+	if c.MultipartConcurrency <= 0 {
+		return runtime.NumCPU()
+	}
+	return c.MultipartConcurrency
+}
+
+// SeekableBody returns a seekable reader with the contents of r, so that a
+// request using it as a body can be rewound and retried. The caller must call
+// the returned close function when the reader is no longer needed.
+//
+// If r already implements [io.ReadSeeker], it is returned unchanged. If r is
+// a [*bytes.Buffer], its unread contents are used without copying. Otherwise,
+// if r has at most maxMemory bytes, it is buffered in memory. Larger inputs
+// are spooled to a temporary file, which is removed by the close function.
+func SeekableBody(r io.Reader, maxMemory int64) (io.ReadSeeker, func() error, error) {
+	noop := func() error { return nil }
+	switch t := r.(type) {
+	case io.ReadSeeker:
+		return t, noop, nil
+	case *bytes.Buffer:
+		return bytes.NewReader(t.Bytes()), noop, nil
+	}
+
+	// Read up to one byte more than the limit, to tell whether r fits.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, maxMemory+1); err == io.EOF {
+		return bytes.NewReader(buf.Bytes()), noop, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.CreateTemp("", "s3util-body-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	closeFile := func() error {
+		f.Close()
+		return os.Remove(f.Name())
+	}
+	if _, err := io.Copy(f, io.MultiReader(&buf, r)); err != nil {
+		closeFile()
+		return nil, nil, err
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		closeFile()
+		return nil, nil, err
+	}
+	return f, closeFile, nil
 }
 
 // A sizer exports a Size method, e.g., [bytes.Reader] and similar.
@@ -5,12 +5,26 @@ package s3util_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/tailscale/go-cache-plugin/lib/s3util"
 )
 
@@ -40,3 +54,735 @@ func TestETagReader(t *testing.T) {
 		t.Errorf("Wrong result: got %x, want %x", got, want)
 	}
 }
+
+func TestMultipartETag(t *testing.T) {
+	const testInput = "abcdefghij"
+	md5hex := func(s string) []byte { h := md5.Sum([]byte(s)); return h[:] }
+
+	for _, tc := range []struct {
+		partSize int64
+		parts    []string
+	}{
+		{4, []string{"abcd", "efgh", "ij"}},
+		{5, []string{"abcde", "fghij"}},
+		{10, []string{"abcdefghij"}},
+		{100, []string{"abcdefghij"}},
+	} {
+		var cat []byte
+		for _, p := range tc.parts {
+			cat = append(cat, md5hex(p)...)
+		}
+		want := fmt.Sprintf("%x-%d", md5.Sum(cat), len(tc.parts))
+
+		got, err := s3util.MultipartETag(strings.NewReader(testInput), tc.partSize)
+		if err != nil {
+			t.Fatalf("MultipartETag(%d): unexpected error: %v", tc.partSize, err)
+		} else if got != want {
+			t.Errorf("MultipartETag(%d): got %q, want %q", tc.partSize, got, want)
+		}
+		if !s3util.IsCompositeETag(got) {
+			t.Errorf("IsCompositeETag(%q): got false, want true", got)
+		}
+	}
+
+	for _, etag := range []string{"", "d41d8cd98f00b204e9800998ecf8427e", `"d41d8cd98f00b204e9800998ecf8427e"`, "abc-def"} {
+		if s3util.IsCompositeETag(etag) {
+			t.Errorf("IsCompositeETag(%q): got true, want false", etag)
+		}
+	}
+}
+
+// oneShot is a reader that does not support seeking.
+type oneShot struct{ io.Reader }
+
+func TestSeekableBody(t *testing.T) {
+	const maxMemory = 16
+	for _, tc := range []struct {
+		name  string
+		input io.Reader
+		want  string
+	}{
+		{"Seeker", strings.NewReader("already seekable"), "already seekable"},
+		{"Buffer", bytes.NewBufferString("a byte buffer"), "a byte buffer"},
+		{"Small", oneShot{strings.NewReader("small data")}, "small data"},
+		{"Exact", oneShot{strings.NewReader("0123456789abcdef")}, "0123456789abcdef"},
+		{"Large", oneShot{strings.NewReader(strings.Repeat("large data ", 100))}, strings.Repeat("large data ", 100)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body, closeBody, err := s3util.SeekableBody(tc.input, maxMemory)
+			if err != nil {
+				t.Fatalf("SeekableBody: unexpected error: %v", err)
+			}
+			defer closeBody()
+
+			// Read the contents twice, rewinding in between.
+			for i := range 2 {
+				got, err := io.ReadAll(body)
+				if err != nil {
+					t.Fatalf("Read %d: unexpected error: %v", i+1, err)
+				} else if string(got) != tc.want {
+					t.Errorf("Read %d: got %q, want %q", i+1, got, tc.want)
+				}
+				if _, err := body.Seek(0, io.SeekStart); err != nil {
+					t.Fatalf("Seek: unexpected error: %v", err)
+				}
+			}
+
+			// A large one-shot body is spooled to a file, which is removed on close.
+			f, isFile := body.(*os.File)
+			if wantFile := tc.name == "Large"; isFile != wantFile {
+				t.Errorf("Spooled to file: got %v, want %v", isFile, wantFile)
+			}
+			if err := closeBody(); err != nil {
+				t.Errorf("Close: unexpected error: %v", err)
+			}
+			if isFile {
+				if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+					t.Errorf("Temp file %q was not removed: %v", f.Name(), err)
+				}
+			}
+		})
+	}
+}
+
+func TestPutRetry(t *testing.T) {
+	const content = "the contents of a one-shot reader"
+	var attempts int
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `<Error><Code>SlowDown</Code></Error>`)
+			return
+		}
+		got = string(data)
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+			Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+				o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) {
+					return time.Millisecond, nil
+				})
+			}),
+		}),
+		Bucket: "test-bucket",
+	}
+	if err := c.Put(context.Background(), "key", oneShot{strings.NewReader(content)}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("Got %d attempts, want 2", attempts)
+	}
+	if got != content {
+		t.Errorf("Retried body: got %q, want %q", got, content)
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Method+" "+r.Header.Get("X-Amz-Storage-Class"))
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			io.WriteString(w, `<CopyObjectResult></CopyObjectResult>`)
+		}
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		Bucket:       "test-bucket",
+		StorageClass: types.StorageClassOnezoneIa,
+	}
+	ctx := context.Background()
+	if err := c.Put(ctx, "key", strings.NewReader("data")); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Touch(ctx, "key"); err != nil {
+		t.Fatalf("Touch: unexpected error: %v", err)
+	}
+	want := []string{"PUT ONEZONE_IA", "PUT ONEZONE_IA"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Storage classes: got %q, want %q", got, want)
+	}
+}
+
+func TestACL(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Method+" "+r.Header.Get("X-Amz-Acl"))
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			io.WriteString(w, `<CopyObjectResult></CopyObjectResult>`)
+		}
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		Bucket: "test-bucket",
+		ACL:    types.ObjectCannedACLBucketOwnerFullControl,
+	}
+	ctx := context.Background()
+	if err := c.Put(ctx, "key", strings.NewReader("data")); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Copy(ctx, "key", "other"); err != nil {
+		t.Fatalf("Copy: unexpected error: %v", err)
+	}
+	if err := c.Touch(ctx, "key"); err != nil {
+		t.Fatalf("Touch: unexpected error: %v", err)
+	}
+	const acl = "bucket-owner-full-control"
+	want := []string{"PUT " + acl, "PUT " + acl, "PUT " + acl}
+	if !slices.Equal(got, want) {
+		t.Errorf("ACLs: got %q, want %q", got, want)
+	}
+}
+
+func TestRequestPayer(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Method+" "+r.Header.Get("X-Amz-Request-Payer"))
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			io.WriteString(w, `<CopyObjectResult></CopyObjectResult>`)
+		}
+	}))
+	defer srv.Close()
+
+	for _, payer := range []bool{false, true} {
+		got = nil
+		c := &s3util.Client{
+			Client: s3.New(s3.Options{
+				BaseEndpoint: aws.String(srv.URL),
+				Region:       "us-east-1",
+				UsePathStyle: true,
+				Credentials:  aws.AnonymousCredentials{},
+			}),
+			Bucket:       "test-bucket",
+			RequestPayer: payer,
+		}
+		ctx := context.Background()
+		if err := c.Put(ctx, "key", strings.NewReader("data")); err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+		if _, err := c.GetData(ctx, "key"); err != nil {
+			t.Fatalf("GetData: unexpected error: %v", err)
+		}
+		if err := c.Touch(ctx, "key"); err != nil {
+			t.Fatalf("Touch: unexpected error: %v", err)
+		}
+		if err := c.Delete(ctx, "key"); err != nil {
+			t.Fatalf("Delete: unexpected error: %v", err)
+		}
+		want := []string{"PUT ", "GET ", "PUT ", "DELETE "}
+		if payer {
+			want = []string{"PUT requester", "GET requester", "PUT requester", "DELETE requester"}
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("RequestPayer=%v: got %q, want %q", payer, got, want)
+		}
+	}
+}
+
+func TestListCopy(t *testing.T) {
+	var mu sync.Mutex
+	objs := map[string]string{
+		"a/1": "one", "a/2": "two", "a/3": "three", "b/1": "other",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/test-bucket/")
+		switch {
+		case r.Method == "GET" && r.URL.Query().Get("list-type") == "2":
+			// Serve the matching keys in pages of two, to exercise pagination.
+			var keys []string
+			for k := range objs {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) && k > r.URL.Query().Get("continuation-token") {
+					keys = append(keys, k)
+				}
+			}
+			slices.Sort(keys)
+			var buf strings.Builder
+			buf.WriteString("<ListBucketResult>")
+			if len(keys) > 2 {
+				keys = keys[:2]
+				fmt.Fprintf(&buf, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", keys[1])
+			}
+			for _, k := range keys {
+				fmt.Fprintf(&buf, "<Contents><Key>%s</Key></Contents>", k)
+			}
+			buf.WriteString("</ListBucketResult>")
+			io.WriteString(w, buf.String())
+		case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+			src := strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "test-bucket/")
+			data, ok := objs[src]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+				return
+			}
+			objs[key] = data
+			io.WriteString(w, `<CopyObjectResult></CopyObjectResult>`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+			Retryer:      aws.NopRetryer{},
+		}),
+		Bucket: "test-bucket",
+	}
+	ctx := context.Background()
+
+	var keys []string
+	if err := c.List(ctx, "a/", func(key string) error {
+		keys = append(keys, key)
+		return c.Copy(ctx, key, "c/"+strings.TrimPrefix(key, "a/"))
+	}); err != nil {
+		t.Fatalf("List: unexpected error: %v", err)
+	}
+	if want := []string{"a/1", "a/2", "a/3"}; !slices.Equal(keys, want) {
+		t.Errorf("List: got %q, want %q", keys, want)
+	}
+	for _, k := range []string{"1", "2", "3"} {
+		if got, want := objs["c/"+k], objs["a/"+k]; got != want {
+			t.Errorf("Copy %s: got %q, want %q", k, got, want)
+		}
+	}
+
+	// An error from the callback stops the listing.
+	errStop := errors.New("stop")
+	var n int
+	if err := c.List(ctx, "", func(string) error { n++; return errStop }); !errors.Is(err, errStop) {
+		t.Errorf("List: got err=%v, want %v", err, errStop)
+	} else if n != 1 {
+		t.Errorf("List: callback ran %d times, want 1", n)
+	}
+
+	if err := c.Copy(ctx, "nonesuch", "d/1"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Copy: got err=%v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	const content = "0123456789abcdefghij"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/norange") {
+			io.WriteString(w, content) // ignore the range
+		} else {
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+		}
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		Bucket: "test-bucket",
+	}
+	ctx := context.Background()
+	for _, key := range []string{"range", "norange"} {
+		for _, tc := range []struct {
+			off, n int64
+			want   string
+		}{
+			{0, 5, "01234"},
+			{10, 4, "abcd"},
+			{15, 100, "fghij"},
+		} {
+			rc, size, err := c.GetRange(ctx, key, tc.off, tc.n)
+			if err != nil {
+				t.Fatalf("GetRange %s(%d, %d): unexpected error: %v", key, tc.off, tc.n, err)
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("GetRange %s(%d, %d): read: %v", key, tc.off, tc.n, err)
+			}
+			if got := string(data); got != tc.want || size != int64(len(content)) {
+				t.Errorf("GetRange %s(%d, %d): got (%q, %d), want (%q, %d)",
+					key, tc.off, tc.n, got, size, tc.want, len(content))
+			}
+		}
+	}
+}
+
+func TestGetRangeMatch(t *testing.T) {
+	const content = "0123456789abcdefghij"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		Bucket: "test-bucket",
+	}
+	ctx := context.Background()
+
+	rc, _, etag, err := c.GetRangeMatch(ctx, "key", 0, 5, "")
+	if err != nil {
+		t.Fatalf("GetRangeMatch: unexpected error: %v", err)
+	}
+	rc.Close()
+	if etag != `"v1"` {
+		t.Errorf("GetRangeMatch: got ETag %q, want %q", etag, `"v1"`)
+	}
+
+	rc, _, _, err = c.GetRangeMatch(ctx, "key", 10, 4, etag)
+	if err != nil {
+		t.Fatalf("GetRangeMatch %s: unexpected error: %v", etag, err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if got := string(data); got != "abcd" {
+		t.Errorf("GetRangeMatch %s: got %q, want %q", etag, got, "abcd")
+	}
+
+	// A read that does not match the current version fails.
+	if rc, _, _, err := c.GetRangeMatch(ctx, "key", 10, 4, `"v0"`); err == nil {
+		rc.Close()
+		t.Error("GetRangeMatch with a stale ETag: got nil error, want error")
+	}
+}
+
+func TestGetDataMulti(t *testing.T) {
+	const concurrency = 3
+	var mu sync.Mutex
+	var active, maxActive int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		maxActive = max(maxActive, active)
+		mu.Unlock()
+		defer func() { mu.Lock(); active--; mu.Unlock() }()
+		time.Sleep(5 * time.Millisecond)
+
+		key := strings.TrimPrefix(r.URL.Path, "/test-bucket/")
+		switch {
+		case strings.HasPrefix(key, "missing"):
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+		case strings.HasPrefix(key, "bad"):
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `<Error><Code>AccessDenied</Code></Error>`)
+		default:
+			io.WriteString(w, "data for "+key)
+		}
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+			Retryer:      aws.NopRetryer{},
+		}),
+		Bucket: "test-bucket",
+	}
+	keys := []string{"a", "b", "missing1", "c", "bad1", "d", "missing2", "e"}
+	got, err := c.GetDataMulti(context.Background(), keys, concurrency)
+	if err == nil || !strings.Contains(err.Error(), `"bad1"`) {
+		t.Errorf("GetDataMulti: got err=%v, want an error for bad1", err)
+	} else if errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("GetDataMulti: error %v should not report missing keys", err)
+	}
+	if len(got) != 5 {
+		t.Errorf("GetDataMulti: got %d results, want 5", len(got))
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if want := "data for " + key; string(got[key]) != want {
+			t.Errorf("Key %q: got %q, want %q", key, got[key], want)
+		}
+	}
+	if maxActive > concurrency {
+		t.Errorf("Max concurrent requests: got %d, want at most %d", maxActive, concurrency)
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.Trim(r.URL.Path, "/") {
+		case "ok-bucket":
+		case "missing-bucket":
+			w.WriteHeader(http.StatusNotFound)
+		case "private-bucket":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	newClient := func(bucket, endpoint string) *s3util.Client {
+		return &s3util.Client{
+			Client: s3.New(s3.Options{
+				BaseEndpoint: aws.String(endpoint),
+				Region:       "us-east-1",
+				UsePathStyle: true,
+				Credentials:  aws.AnonymousCredentials{},
+				Retryer:      aws.NopRetryer{},
+			}),
+			Bucket: bucket,
+		}
+	}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		bucket   string
+		want     error
+		wantFail bool
+	}{
+		{"ok-bucket", nil, false},
+		{"missing-bucket", fs.ErrNotExist, true},
+		{"private-bucket", fs.ErrPermission, true},
+		{"bad-bucket", nil, true},
+	} {
+		err := newClient(tc.bucket, srv.URL).CheckAccess(ctx)
+		if (err != nil) != tc.wantFail {
+			t.Errorf("CheckAccess(%q): got %v, want failure=%v", tc.bucket, err, tc.wantFail)
+		} else if tc.want != nil && !errors.Is(err, tc.want) {
+			t.Errorf("CheckAccess(%q): got %v, want %v", tc.bucket, err, tc.want)
+		}
+	}
+
+	// A network failure is reported, but is neither of the specific cases.
+	srv.Close()
+	err := newClient("ok-bucket", srv.URL).CheckAccess(ctx)
+	if err == nil || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		t.Errorf("CheckAccess (unreachable): got %v, want a network error", err)
+	}
+}
+
+func TestPutMultipart(t *testing.T) {
+	const partSize = 5 << 20 // the S3 minimum
+	input := make([]byte, 2*partSize+12345)
+	for i := range input {
+		input[i] = byte(i % 251)
+	}
+
+	var mu sync.Mutex
+	var parts map[string][]byte
+	var got []byte
+	var aborted, failPart bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		q := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && q.Has("uploads"):
+			parts = make(map[string][]byte)
+			io.WriteString(w, `<InitiateMultipartUploadResult><UploadId>u1</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodPut && q.Get("uploadId") == "u1":
+			if failPart && q.Get("partNumber") == "2" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			data, _ := io.ReadAll(r.Body)
+			parts[q.Get("partNumber")] = data
+			w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(data)))
+		case r.Method == http.MethodPost && q.Get("uploadId") == "u1":
+			got = nil
+			for i := 1; i <= len(parts); i++ {
+				got = append(got, parts[fmt.Sprint(i)]...)
+			}
+			io.WriteString(w, `<CompleteMultipartUploadResult></CompleteMultipartUploadResult>`)
+		case r.Method == http.MethodDelete && q.Get("uploadId") == "u1":
+			aborted = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+			Retryer:      aws.NopRetryer{},
+		}),
+		Bucket:               "test-bucket",
+		MultipartPartSize:    1, // raised to the minimum
+		MultipartConcurrency: 2,
+	}
+	ctx := context.Background()
+
+	t.Run("ReaderAt", func(t *testing.T) {
+		got = nil
+		if err := c.Put(ctx, "key", bytes.NewReader(input)); err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+		if len(parts) != 3 {
+			t.Errorf("Got %d parts, want 3", len(parts))
+		}
+		if !bytes.Equal(got, input) {
+			t.Errorf("Put: got %d bytes, want %d matching input", len(got), len(input))
+		}
+	})
+	t.Run("Sequential", func(t *testing.T) {
+		got = nil
+		if err := c.Put(ctx, "key", struct{ io.ReadSeeker }{bytes.NewReader(input)}); err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+		if !bytes.Equal(got, input) {
+			t.Errorf("Put: got %d bytes, want %d matching input", len(got), len(input))
+		}
+	})
+	t.Run("Abort", func(t *testing.T) {
+		got, failPart = nil, true
+		if err := c.Put(ctx, "key", bytes.NewReader(input)); err == nil {
+			t.Error("Put: got nil error, want failure")
+		}
+		if !aborted {
+			t.Error("Put: failed upload was not aborted")
+		}
+		if got != nil {
+			t.Errorf("Put: failed upload was completed (%d bytes)", len(got))
+		}
+	})
+}
+
+func TestGetTo(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 10000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/test-bucket/key" {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		io.WriteString(w, content)
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+			Retryer:      aws.NopRetryer{},
+		}),
+		Bucket: "test-bucket",
+	}
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	var calls int
+	var last int64
+	n, err := c.GetTo(ctx, "key", &buf, func(n int64) {
+		if n <= last {
+			t.Errorf("Progress: got %d after %d, want increasing", n, last)
+		}
+		calls++
+		last = n
+	})
+	if err != nil {
+		t.Fatalf("GetTo: unexpected error: %v", err)
+	}
+	if n != int64(len(content)) || buf.String() != content {
+		t.Errorf("GetTo: got %d bytes, want %d matching content", n, len(content))
+	}
+	if calls == 0 || last != n {
+		t.Errorf("Progress: got %d calls ending at %d, want final %d", calls, last, n)
+	}
+
+	if _, err := c.GetTo(ctx, "missing", io.Discard, nil); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("GetTo(missing): got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestParts(t *testing.T) {
+	const mb = 1 << 20
+	for _, tc := range []struct {
+		partSize int64
+		size     int64
+		want     int
+	}{
+		{0, 0, 1},
+		{0, 16 * mb, 1},
+		{0, 16*mb + 1, 2},
+		{0, 100 * mb, 7},
+		{1, 5 * mb, 1}, // raised to the S3 minimum
+		{1, 11 * mb, 3},
+		{8 * mb, 64 * mb, 8},
+	} {
+		c := &s3util.Client{MultipartPartSize: tc.partSize}
+		if got := c.Parts(tc.size); got != tc.want {
+			t.Errorf("Parts(%d) [part size %d]: got %d, want %d", tc.size, tc.partSize, got, tc.want)
+		}
+	}
+}
+
+func TestMeta(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("Request: got method %q, want HEAD", r.Method)
+		}
+		if r.URL.Path != "/test-bucket/key" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Amz-Meta-Build-Id", "b123")
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		Bucket: "test-bucket",
+	}
+	ctx := context.Background()
+	meta, err := c.Meta(ctx, "key")
+	if err != nil {
+		t.Fatalf("Meta: unexpected error: %v", err)
+	} else if got := meta["build-id"]; got != "b123" {
+		t.Errorf("Meta: got %v, want build-id b123", meta)
+	}
+	if _, err := c.Meta(ctx, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Meta (missing): got %v, want %v", err, fs.ErrNotExist)
+	}
+}